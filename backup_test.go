@@ -0,0 +1,109 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TestSnapshotRestore backs up a stopped vault, refuses to restore the
+// snapshot under another master key or once tampered with, and restores it
+func TestSnapshotRestore(t *testing.T) {
+	dir := t.TempDir()
+	v := startVault(t, dir, "vault")
+	token := v.token(t)
+	kept := storeKeys(t, v, token, 1)
+	v.stop()
+
+	snapshot := filepath.Join(dir, "snapshot.tar")
+	if out, err := runCommand(t, dir, "vault", nil, "backup", "-out", snapshot); err != nil {
+		t.Fatalf("backup: %v\n%s", err, out)
+	}
+
+	v = startVault(t, dir, "vault")
+	lost := storeKeys(t, v, token, 1)
+	v.stop()
+
+	// 1. A snapshot taken under another master key
+	otherKey := "PRIVATE_KEY_AES=" + hex.EncodeToString(bytes.Repeat([]byte{8}, 32))
+	out, err := runCommand(t, dir, "vault", []string{otherKey}, "restore", "-in", snapshot)
+	if err == nil || !strings.Contains(out, "different master key") {
+		t.Fatalf("restore under another master key: %v\n%s", err, out)
+	}
+
+	// 2. A snapshot whose database was altered
+	tampered := filepath.Join(dir, "tampered.tar")
+	tamperSnapshot(t, snapshot, tampered)
+	out, err = runCommand(t, dir, "vault", nil, "restore", "-in", tampered)
+	if err == nil || !strings.Contains(out, "checksum mismatch") {
+		t.Fatalf("restore of a tampered snapshot: %v\n%s", err, out)
+	}
+
+	// Neither attempt touched the live database
+	v = startVault(t, dir, "vault")
+	if status := v.call(t, "GET", "/vault/retrive/"+lost[0], token, nil, nil); status != http.StatusOK {
+		t.Fatalf("entry written after the backup: status %d after refused restores", status)
+	}
+	v.stop()
+
+	// 3. The snapshot itself
+	if out, err := runCommand(t, dir, "vault", nil, "restore", "-in", snapshot); err != nil {
+		t.Fatalf("restore: %v\n%s", err, out)
+	}
+	v = startVault(t, dir, "vault")
+	if status := v.call(t, "GET", "/vault/retrive/"+kept[0], token, nil, nil); status != http.StatusOK {
+		t.Fatalf("entry in the snapshot: status %d after restore", status)
+	}
+	if status := v.call(t, "GET", "/vault/retrive/"+lost[0], token, nil, nil); status != http.StatusNotFound {
+		t.Fatalf("entry written after the backup: status %d after restore, want 404", status)
+	}
+}
+
+// tamperSnapshot copies the snapshot archive at path to out, flipping a byte
+// of the database in the middle
+func tamperSnapshot(t *testing.T, path, out string) {
+	t.Helper()
+	in, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer in.Close()
+	f, err := os.Create(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	tr, tw := tar.NewReader(in), tar.NewWriter(f)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := io.ReadAll(tr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if hdr.Name == "vault.db" {
+			data[len(data)/2] ^= 0xff
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write(data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,93 @@
+package cli
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"io"
+	"os"
+	"strings"
+
+	"secure-vault/storage"
+)
+
+func backup(args []string) error {
+	fs := flag.NewFlagSet("backup", flag.ContinueOnError)
+	out := fs.String("out", "-", "snapshot archive to write ('-' for stdout)")
+	recipient := fs.String("recipient", "", "hex secp256k1 public key to encrypt the snapshot to")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	var recipientPub []byte
+	if *recipient != "" {
+		var err error
+		if recipientPub, err = hex.DecodeString(*recipient); err != nil {
+			return errors.New("invalid -recipient: " + err.Error())
+		}
+	}
+
+	if err := storage.InitReadOnly(); err != nil {
+		return err
+	}
+	defer storage.Close()
+
+	var w io.Writer = os.Stdout
+	if *out != "-" {
+		f, err := os.OpenFile(*out, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+
+	manifest, err := storage.WriteSnapshot(w, recipientPub)
+	if err != nil {
+		return err
+	}
+	return printJSON(os.Stderr, manifest)
+}
+
+func restore(args []string) error {
+	fs := flag.NewFlagSet("restore", flag.ContinueOnError)
+	in := fs.String("in", "", "snapshot archive to restore")
+	keyFile := fs.String("key", "", "file holding the operator's hex secp256k1 private key (encrypted snapshots)")
+	force := fs.Bool("force", false, "restore even if some entries fail to decrypt")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *in == "" {
+		return errors.New("-in is required")
+	}
+
+	var recipientPriv []byte
+	if *keyFile != "" {
+		data, err := os.ReadFile(*keyFile)
+		if err != nil {
+			return err
+		}
+		if recipientPriv, err = hex.DecodeString(strings.TrimSpace(string(data))); err != nil {
+			return errors.New("invalid private key in " + *keyFile)
+		}
+	}
+
+	f, err := os.Open(*in)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	report, err := storage.RestoreSnapshot(f, recipientPriv, *force)
+	if perr := printJSON(os.Stderr, report); perr != nil && err == nil {
+		err = perr
+	}
+	return err
+}
+
+func printJSON(w io.Writer, v interface{}) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
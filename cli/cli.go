@@ -0,0 +1,33 @@
+package cli
+
+import (
+	"errors"
+	"fmt"
+)
+
+const usage = `usage: secure-vault [command] [flags]
+
+Without a command the HTTP server is started. Commands (run with the server stopped):
+  backup    write a snapshot archive of the database
+  restore   verify a snapshot archive and replace the database with it
+  fsck      check that every entry still decodes and decrypts, and write a JSON report
+  compact   copy live data into a fresh database file and wipe the old one`
+
+// Run dispatches an offline subcommand, e.g. `secure-vault backup -out vault.tar`
+func Run(args []string) error {
+	switch args[0] {
+	case "backup":
+		return backup(args[1:])
+	case "restore":
+		return restore(args[1:])
+	case "fsck":
+		return fsck(args[1:])
+	case "compact":
+		return compact(args[1:])
+	case "help", "-h", "--help":
+		fmt.Println(usage)
+		return nil
+	default:
+		return errors.New("unknown command " + args[0] + "\n" + usage)
+	}
+}
@@ -0,0 +1,21 @@
+package cli
+
+import (
+	"flag"
+	"os"
+
+	"secure-vault/storage"
+)
+
+func compact(args []string) error {
+	fs := flag.NewFlagSet("compact", flag.ContinueOnError)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	report, err := storage.CompactOffline()
+	if err != nil {
+		return err
+	}
+	return printJSON(os.Stderr, report)
+}
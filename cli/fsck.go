@@ -0,0 +1,47 @@
+package cli
+
+import (
+	"errors"
+	"flag"
+	"io"
+	"os"
+	"strconv"
+
+	"secure-vault/storage"
+)
+
+func fsck(args []string) error {
+	fs := flag.NewFlagSet("fsck", flag.ContinueOnError)
+	out := fs.String("out", "-", "JSON report to write ('-' for stdout)")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if err := storage.InitReadOnly(); err != nil {
+		return err
+	}
+	defer storage.Close()
+
+	report, err := storage.Fsck()
+	if err != nil {
+		return err
+	}
+
+	var w io.Writer = os.Stdout
+	if *out != "-" {
+		f, err := os.OpenFile(*out, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+	if err := printJSON(w, report); err != nil {
+		return err
+	}
+
+	if report.Failed > 0 {
+		return errors.New(strconv.Itoa(report.Failed) + " of " + strconv.Itoa(report.Checked) + " entries failed the integrity scan")
+	}
+	return nil
+}
@@ -6,13 +6,13 @@ import (
 	"crypto/rand"
 	"crypto/sha256"
 
-	"secure-vault/utils"
-
 	"github.com/decred/dcrd/dcrec/secp256k1/v4"
 )
 
-// EncryptWithEphemeralECC performs ECC-based envelope encryption
-func EncryptWithEphemeralECC(plainKey []byte) (
+// EncryptWithEphemeralECC performs ECC-based envelope encryption. aad is
+// authenticated but not encrypted; the same bytes must be given to decrypt.
+// The ephemeral private key is sealed with wrap.
+func EncryptWithEphemeralECC(plainKey []byte, aad []byte, wrap KeyWrapper) (
 	ciphertext []byte,
 	nonce []byte,
 	encPrivKey []byte,
@@ -42,10 +42,10 @@ func EncryptWithEphemeralECC(plainKey []byte) (
 	if _, err = rand.Read(nonce); err != nil {
 		return
 	}
-	ciphertext = aesgcm.Seal(nil, nonce, plainKey, nil)
+	ciphertext = aesgcm.Seal(nil, nonce, plainKey, aad)
 
-	// 3. Encrypt the ephemeral private key with server master AES key
-	encPrivKey, encPrivNonce, err = utils.EncryptWithMasterKey(ephPriv.Serialize())
+	// 3. Encrypt the ephemeral private key with the key-encryption key
+	encPrivKey, encPrivNonce, err = wrap.Wrap(ephPriv.Serialize())
 	if err != nil {
 		return
 	}
@@ -62,9 +62,11 @@ func DecryptWithEphemeralECC(
 	nonce []byte,
 	encPrivKey []byte,
 	encPrivNonce []byte,
+	aad []byte,
+	wrap KeyWrapper,
 ) ([]byte, error) {
 	// 1. Decrypt the ephemeral private key
-	privBytes, err := utils.DecryptWithMasterKey(encPrivKey, encPrivNonce)
+	privBytes, err := wrap.Unwrap(encPrivKey, encPrivNonce)
 	if err != nil {
 		return nil, err
 	}
@@ -83,5 +85,5 @@ func DecryptWithEphemeralECC(
 	}
 
 	// 3. Decrypt the submitted key
-	return aesgcm.Open(nil, nonce, ciphertext, nil)
+	return aesgcm.Open(nil, nonce, ciphertext, aad)
 }
@@ -6,13 +6,16 @@ import (
 	"crypto/rand"
 	"crypto/sha256"
 
-	"secure-vault/utils"
-
 	"github.com/open-quantum-safe/liboqs-go/oqs"
 )
 
-// EncryptWithEphemeralKyber encrypts the submitted key using Kyber and AES-GCM.
-func EncryptWithEphemeralKyber(plainKey []byte) (
+// DefaultKyberAlg is used when no parameter set is given (and for entries stored before parameter sets existed)
+const DefaultKyberAlg = "Kyber512"
+
+// EncryptWithEphemeralKyber encrypts the submitted key using Kyber (alg: Kyber512/768/1024) and AES-GCM.
+// aad is authenticated but not encrypted; the same bytes must be given to decrypt.
+// The ephemeral private key is sealed with wrap.
+func EncryptWithEphemeralKyber(plainKey []byte, alg string, aad []byte, wrap KeyWrapper) (
 	ciphertext []byte,
 	nonce []byte,
 	kemCiphertext []byte,
@@ -24,7 +27,10 @@ func EncryptWithEphemeralKyber(plainKey []byte) (
 	var kem oqs.KeyEncapsulation
 
 	// 1. Init Kyber
-	if err = kem.Init("Kyber512", nil); err != nil {
+	if alg == "" {
+		alg = DefaultKyberAlg
+	}
+	if err = kem.Init(alg, nil); err != nil {
 		return
 	}
 	defer kem.Clean()
@@ -59,10 +65,10 @@ func EncryptWithEphemeralKyber(plainKey []byte) (
 	if _, err = rand.Read(nonce); err != nil {
 		return
 	}
-	ciphertext = aesgcm.Seal(nil, nonce, plainKey, nil)
+	ciphertext = aesgcm.Seal(nil, nonce, plainKey, aad)
 
-	// 6. Encrypt ephemeral private key using server AES key
-	encPrivKey, encPrivNonce, err = utils.EncryptWithMasterKey(privKey)
+	// 6. Encrypt ephemeral private key with the key-encryption key
+	encPrivKey, encPrivNonce, err = wrap.Wrap(privKey)
 	return
 }
 
@@ -73,16 +79,22 @@ func DecryptWithEphemeralKyber(
 	kemCiphertext []byte,
 	encPrivKey []byte,
 	encPrivNonce []byte,
+	alg string,
+	aad []byte,
+	wrap KeyWrapper,
 ) ([]byte, error) {
 	// 1. Decrypt ephemeral private key
-	privKey, err := utils.DecryptWithMasterKey(encPrivKey, encPrivNonce)
+	privKey, err := wrap.Unwrap(encPrivKey, encPrivNonce)
 	if err != nil {
 		return nil, err
 	}
 
 	var kem oqs.KeyEncapsulation
 	// 2. Re-init Kyber with privKey
-	if err := kem.Init("Kyber512", privKey); err != nil {
+	if alg == "" {
+		alg = DefaultKyberAlg
+	}
+	if err := kem.Init(alg, privKey); err != nil {
 		return nil, err
 	}
 	defer kem.Clean()
@@ -104,5 +116,5 @@ func DecryptWithEphemeralKyber(
 		return nil, err
 	}
 
-	return aesgcm.Open(nil, nonce, ciphertext, nil)
+	return aesgcm.Open(nil, nonce, ciphertext, aad)
 }
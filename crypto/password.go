@@ -0,0 +1,73 @@
+package crypto
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"secure-vault/utils"
+
+	"golang.org/x/crypto/argon2"
+)
+
+// Argon2id cost for new password hashes. Hashes with other parameters still
+// verify, and are reported for rehashing.
+var (
+	argon2Memory  = uint32(utils.EnvInt("ARGON2_MEMORY_KIB", 64*1024))
+	argon2Time    = uint32(utils.EnvInt("ARGON2_ITERATIONS", 3))
+	argon2Threads = uint8(utils.EnvInt("ARGON2_THREADS", 2))
+)
+
+const (
+	argon2SaltLen = 16
+	argon2KeyLen  = 32
+)
+
+var ErrInvalidPasswordHash = errors.New("invalid password hash")
+
+// HashPassword derives an Argon2id hash in the PHC string format,
+// $argon2id$v=19$m=<KiB>,t=<iterations>,p=<threads>$<salt>$<hash>
+func HashPassword(password string) (string, error) {
+	salt := make([]byte, argon2SaltLen)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	key := argon2.IDKey([]byte(password), salt, argon2Time, argon2Memory, argon2Threads, argon2KeyLen)
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s", argon2.Version, argon2Memory, argon2Time, argon2Threads,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+// VerifyPassword checks password against a hash from HashPassword in constant
+// time. rehash is set when the hash was made with other parameters than the
+// current ones.
+func VerifyPassword(hash, password string) (ok, rehash bool, err error) {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 || parts[1] != "argon2id" {
+		return false, false, ErrInvalidPasswordHash
+	}
+	var version int
+	var memory, iterations uint32
+	var threads uint8
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return false, false, ErrInvalidPasswordHash
+	}
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &memory, &iterations, &threads); err != nil {
+		return false, false, ErrInvalidPasswordHash
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return false, false, ErrInvalidPasswordHash
+	}
+	want, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil || len(want) == 0 {
+		return false, false, ErrInvalidPasswordHash
+	}
+
+	got := argon2.IDKey([]byte(password), salt, iterations, memory, threads, uint32(len(want)))
+	ok = subtle.ConstantTimeCompare(got, want) == 1
+	rehash = memory != argon2Memory || iterations != argon2Time || threads != argon2Threads || len(want) != argon2KeyLen
+	return ok, rehash, nil
+}
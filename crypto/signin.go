@@ -0,0 +1,87 @@
+package crypto
+
+import (
+	"crypto/ed25519"
+	"encoding/hex"
+	"errors"
+	"strconv"
+	"strings"
+
+	"github.com/decred/dcrd/dcrec/secp256k1/v4"
+	"github.com/decred/dcrd/dcrec/secp256k1/v4/ecdsa"
+	"golang.org/x/crypto/sha3"
+)
+
+func keccak256(data ...[]byte) []byte {
+	h := sha3.NewLegacyKeccak256()
+	for _, d := range data {
+		h.Write(d)
+	}
+	return h.Sum(nil)
+}
+
+// EthereumAddress returns the EIP-55 checksummed address of a secp256k1 public key
+func EthereumAddress(pubKey []byte) (string, error) {
+	pub, err := secp256k1.ParsePubKey(pubKey)
+	if err != nil {
+		return "", errors.New("invalid secp256k1 public key")
+	}
+	return checksumAddress(hex.EncodeToString(keccak256(pub.SerializeUncompressed()[1:])[12:])), nil
+}
+
+// ChecksumAddress returns the EIP-55 form of a hex Ethereum address given in
+// any case, with or without 0x
+func ChecksumAddress(address string) (string, error) {
+	addr := strings.ToLower(strings.TrimPrefix(strings.TrimPrefix(address, "0x"), "0X"))
+	if _, err := hex.DecodeString(addr); err != nil || len(addr) != 40 {
+		return "", errors.New("invalid Ethereum address")
+	}
+	return checksumAddress(addr), nil
+}
+
+// checksumAddress upper-cases the letters of a lower-case hex address where
+// the hash of the address has a high nibble
+func checksumAddress(addr string) string {
+	sum := hex.EncodeToString(keccak256([]byte(addr)))
+	var b strings.Builder
+	b.WriteString("0x")
+	for i, c := range addr {
+		if c >= 'a' && sum[i] >= '8' {
+			c -= 'a' - 'A'
+		}
+		b.WriteRune(c)
+	}
+	return b.String()
+}
+
+// VerifyEthereumSignature checks an EIP-191 personal_sign signature of message:
+// 65 bytes r || s || v, v being 0, 1, 27 or 28. The signer is recovered from
+// the signature and must be pubKey.
+func VerifyEthereumSignature(pubKey []byte, message string, sig []byte) bool {
+	pub, err := secp256k1.ParsePubKey(pubKey)
+	if err != nil || len(sig) != 65 {
+		return false
+	}
+	v := sig[64]
+	if v >= 27 {
+		v -= 27
+	}
+	if v > 1 {
+		return false
+	}
+
+	hash := keccak256([]byte("\x19Ethereum Signed Message:\n"+strconv.Itoa(len(message))), []byte(message))
+	compact := make([]byte, 65)
+	compact[0] = 27 + v
+	copy(compact[1:], sig[:64])
+	signer, _, err := ecdsa.RecoverCompact(compact, hash)
+	return err == nil && signer.IsEqual(pub)
+}
+
+// VerifyEd25519Signature checks a raw Ed25519 signature of message
+func VerifyEd25519Signature(pubKey []byte, message string, sig []byte) bool {
+	if len(pubKey) != ed25519.PublicKeySize || len(sig) != ed25519.SignatureSize {
+		return false
+	}
+	return ed25519.Verify(pubKey, []byte(message), sig)
+}
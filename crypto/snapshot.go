@@ -0,0 +1,159 @@
+package crypto
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"io"
+
+	"github.com/decred/dcrd/dcrec/secp256k1/v4"
+)
+
+// Snapshots are encrypted to an operator's secp256k1 public key (ECIES): an
+// ephemeral keypair is generated, ECDH with the recipient gives the AES-256-GCM
+// key, and the stream is sealed in fixed-size chunks. Each chunk's nonce carries
+// its index and a final-chunk flag so chunks cannot be reordered or truncated.
+const (
+	SnapshotCipher    = "secp256k1-ecies-aes256gcm-chunked"
+	snapshotChunkSize = 64 * 1024
+	snapshotTagSize   = 16
+)
+
+// SealedSnapshotSize returns the encrypted size of an n-byte snapshot
+func SealedSnapshotSize(n int64) int64 {
+	chunks := (n + snapshotChunkSize - 1) / snapshotChunkSize
+	if chunks == 0 {
+		chunks = 1
+	}
+	return n + chunks*snapshotTagSize
+}
+
+// NewSnapshotEncrypter returns a writer that encrypts everything written to it for
+// recipientPub (compressed or uncompressed secp256k1). Close must be called to
+// flush the final chunk. ephPub has to be stored alongside the ciphertext.
+func NewSnapshotEncrypter(w io.Writer, recipientPub []byte) (wc io.WriteCloser, ephPub []byte, err error) {
+	pub, err := secp256k1.ParsePubKey(recipientPub)
+	if err != nil {
+		return nil, nil, errors.New("invalid recipient public key")
+	}
+	ephPriv, err := secp256k1.GeneratePrivateKey()
+	if err != nil {
+		return nil, nil, err
+	}
+	aead, err := snapshotAEAD(secp256k1.GenerateSharedSecret(ephPriv, pub))
+	if err != nil {
+		return nil, nil, err
+	}
+	ephPub = ephPriv.PubKey().SerializeCompressed()
+	return &snapshotWriter{w: w, aead: aead, buf: make([]byte, 0, snapshotChunkSize)}, ephPub, nil
+}
+
+// NewSnapshotDecrypter returns a reader over the plaintext of an encrypted snapshot
+// of sealedSize bytes, using the operator's private key and the stored ephPub.
+func NewSnapshotDecrypter(r io.Reader, sealedSize int64, recipientPriv, ephPub []byte) (io.Reader, error) {
+	pub, err := secp256k1.ParsePubKey(ephPub)
+	if err != nil {
+		return nil, errors.New("invalid ephemeral public key")
+	}
+	aead, err := snapshotAEAD(secp256k1.GenerateSharedSecret(secp256k1.PrivKeyFromBytes(recipientPriv), pub))
+	if err != nil {
+		return nil, err
+	}
+	return &snapshotReader{r: r, aead: aead, remaining: sealedSize}, nil
+}
+
+func snapshotAEAD(shared []byte) (cipher.AEAD, error) {
+	key := sha256.Sum256(append([]byte("secure-vault snapshot"), shared...))
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func snapshotNonce(index uint64, final bool) []byte {
+	nonce := make([]byte, 12)
+	binary.BigEndian.PutUint64(nonce[3:11], index)
+	if final {
+		nonce[11] = 1
+	}
+	return nonce
+}
+
+type snapshotWriter struct {
+	w     io.Writer
+	aead  cipher.AEAD
+	buf   []byte
+	index uint64
+}
+
+func (s *snapshotWriter) Write(p []byte) (int, error) {
+	n := 0
+	for len(p) > 0 {
+		// Only flush a full chunk once more data arrives, so the last one can be flagged final
+		if len(s.buf) == snapshotChunkSize {
+			if err := s.flush(false); err != nil {
+				return n, err
+			}
+		}
+		c := copy(s.buf[len(s.buf):snapshotChunkSize], p)
+		s.buf = s.buf[:len(s.buf)+c]
+		p = p[c:]
+		n += c
+	}
+	return n, nil
+}
+
+func (s *snapshotWriter) Close() error {
+	return s.flush(true)
+}
+
+func (s *snapshotWriter) flush(final bool) error {
+	sealed := s.aead.Seal(nil, snapshotNonce(s.index, final), s.buf, nil)
+	s.index++
+	s.buf = s.buf[:0]
+	_, err := s.w.Write(sealed)
+	return err
+}
+
+type snapshotReader struct {
+	r         io.Reader
+	aead      cipher.AEAD
+	remaining int64
+	index     uint64
+	plain     []byte
+	done      bool
+}
+
+func (s *snapshotReader) Read(p []byte) (int, error) {
+	for len(s.plain) == 0 {
+		if s.done {
+			return 0, io.EOF
+		}
+		size := int64(snapshotChunkSize + snapshotTagSize)
+		final := s.remaining <= size
+		if final {
+			size = s.remaining
+		}
+		if size < snapshotTagSize {
+			return 0, errors.New("truncated snapshot")
+		}
+		sealed := make([]byte, size)
+		if _, err := io.ReadFull(s.r, sealed); err != nil {
+			return 0, err
+		}
+		plain, err := s.aead.Open(nil, snapshotNonce(s.index, final), sealed, nil)
+		if err != nil {
+			return 0, errors.New("snapshot decryption failed")
+		}
+		s.index++
+		s.remaining -= size
+		s.plain = plain
+		s.done = final
+	}
+	n := copy(p, s.plain)
+	s.plain = s.plain[n:]
+	return n, nil
+}
@@ -0,0 +1,8 @@
+package crypto
+
+// KeyWrapper seals the ephemeral private key of an envelope. The master key,
+// tenant KEKs and user KEKs all implement it.
+type KeyWrapper interface {
+	Wrap(plaintext []byte) (ciphertext, nonce []byte, err error)
+	Unwrap(ciphertext, nonce []byte) ([]byte, error)
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestEntryExpiry checks that an entry past its deadline answers 410, and that
+// the reaper announces it before and after to the expiry webhook
+func TestEntryExpiry(t *testing.T) {
+	var mu sync.Mutex
+	events := map[string][]string{} // entry ID -> event types
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var ev struct {
+			Type    string `json:"type"`
+			EntryID string `json:"entry_id"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&ev); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		mu.Lock()
+		events[ev.EntryID] = append(events[ev.EntryID], ev.Type)
+		mu.Unlock()
+	}))
+	defer hook.Close()
+	received := func(id string) []string {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]string(nil), events[id]...)
+	}
+
+	v := startVault(t, t.TempDir(), "vault",
+		"EXPIRY_REAPER_INTERVAL=200ms",
+		"EXPIRY_NOTIFY_LEAD=1h",
+		"EXPIRY_WEBHOOK_URL="+hook.URL,
+	)
+	token := v.token(t)
+	key := map[string]string{"key": testKey, "key_type": "secp256k1", "key_encoding": "hex", "ttl": "2s"}
+	var stored struct {
+		ID string `json:"id"`
+	}
+	if status := v.call(t, "POST", "/vault/store", token, key, &stored); status != http.StatusCreated {
+		t.Fatalf("store: status %d", status)
+	}
+	lasting := storeKeys(t, v, token, 1)[0]
+	if status := v.call(t, "GET", "/vault/retrive/"+stored.ID, token, nil, nil); status != http.StatusOK {
+		t.Fatalf("retrieve before the deadline: status %d", status)
+	}
+
+	// 1. Announced ahead, as the deadline is within EXPIRY_NOTIFY_LEAD
+	eventually(t, 5*time.Second, "the expiring event", func() bool {
+		got := received(stored.ID)
+		return len(got) > 0 && got[0] == "entry.expiring"
+	})
+
+	// 2. Gone once past the deadline, then reaped
+	eventually(t, 5*time.Second, "the entry to expire", func() bool {
+		return v.call(t, "GET", "/vault/retrive/"+stored.ID, token, nil, nil) == http.StatusGone
+	})
+	delete(key, "ttl")
+	if status := v.call(t, "POST", "/vault/rotate/"+stored.ID, token, key, nil); status != http.StatusGone {
+		t.Fatalf("rotate after the deadline: status %d, want 410", status)
+	}
+	eventually(t, 5*time.Second, "the expired event", func() bool {
+		got := received(stored.ID)
+		return len(got) == 2 && got[1] == "entry.expired"
+	})
+	if status := v.call(t, "GET", "/vault/retrive/"+stored.ID, token, nil, nil); status != http.StatusGone {
+		t.Fatalf("retrieve after reaping: status %d, want 410", status)
+	}
+
+	// Entries without a deadline are left alone
+	if status := v.call(t, "GET", "/vault/retrive/"+lasting, token, nil, nil); status != http.StatusOK {
+		t.Fatalf("entry without a deadline: status %d", status)
+	}
+	if got := received(lasting); len(got) != 0 {
+		t.Fatalf("events for an entry without a deadline: %v", got)
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+// TestOwnershipGrants checks that an entry is hidden from everyone but its
+// owner until shared, and that grants give exactly their rights
+func TestOwnershipGrants(t *testing.T) {
+	v := startVault(t, t.TempDir(), "vault")
+	admin := v.token(t)
+	alice := v.user(t, admin, "alice", "")
+	bob := v.user(t, admin, "bob", "")
+	carol := v.user(t, admin, "carol", "")
+	if status := v.call(t, "PUT", "/admin/users/carol/groups", admin, map[string][]string{"groups": {"ops"}}, nil); status != http.StatusOK {
+		t.Fatalf("set carol's groups: status %d", status)
+	}
+	id := storeKeys(t, v, alice, 1)[0]
+	key := map[string]string{"key": testKey, "key_type": "secp256k1", "key_encoding": "hex"}
+
+	// 1. Not shared: as if it did not exist
+	if status := v.call(t, "GET", "/vault/retrive/"+id, bob, nil, nil); status != http.StatusNotFound {
+		t.Fatalf("read by another user: status %d, want 404", status)
+	}
+	if status := v.call(t, "POST", "/vault/rotate/"+id, bob, key, nil); status != http.StatusNotFound {
+		t.Fatalf("rotate by another user: status %d, want 404", status)
+	}
+
+	// 2. A read grant to bob, a rotate grant to the ops group
+	var readGrant struct {
+		ID string `json:"id"`
+	}
+	grant := map[string]interface{}{"user_id": "bob", "rights": []string{"read"}}
+	if status := v.call(t, "POST", "/vault/entries/"+id+"/grants", alice, grant, &readGrant); status != http.StatusCreated {
+		t.Fatalf("grant to bob: status %d", status)
+	}
+	grant = map[string]interface{}{"group": "ops", "rights": []string{"rotate"}}
+	if status := v.call(t, "POST", "/vault/entries/"+id+"/grants", alice, grant, nil); status != http.StatusCreated {
+		t.Fatalf("grant to ops: status %d", status)
+	}
+	if status := v.call(t, "GET", "/vault/retrive/"+id, bob, nil, nil); status != http.StatusOK {
+		t.Fatalf("read by bob with a read grant: status %d", status)
+	}
+	if status := v.call(t, "POST", "/vault/rotate/"+id, bob, key, nil); status != http.StatusNotFound {
+		t.Fatalf("rotate by bob with a read grant: status %d, want 404", status)
+	}
+	if status := v.call(t, "POST", "/vault/rotate/"+id, carol, key, nil); status != http.StatusOK {
+		t.Fatalf("rotate by carol through ops: status %d", status)
+	}
+	if status := v.call(t, "GET", "/vault/retrive/"+id, carol, nil, nil); status != http.StatusNotFound {
+		t.Fatalf("read by carol with a rotate grant: status %d, want 404", status)
+	}
+
+	// 3. Only the owner manages grants
+	if status := v.call(t, "GET", "/vault/entries/"+id+"/grants", bob, nil, nil); status != http.StatusNotFound {
+		t.Fatalf("grants listed by bob: status %d, want 404", status)
+	}
+	grant = map[string]interface{}{"user_id": "carol", "rights": []string{"read"}}
+	if status := v.call(t, "POST", "/vault/entries/"+id+"/grants", bob, grant, nil); status != http.StatusNotFound {
+		t.Fatalf("grant by bob: status %d, want 404", status)
+	}
+	if status := v.call(t, "DELETE", "/vault/entries/"+id+"/grants/"+readGrant.ID, alice, nil, nil); status != http.StatusNoContent {
+		t.Fatalf("withdraw bob's grant: status %d", status)
+	}
+	if status := v.call(t, "GET", "/vault/retrive/"+id, bob, nil, nil); status != http.StatusNotFound {
+		t.Fatalf("read by bob after the grant was withdrawn: status %d, want 404", status)
+	}
+}
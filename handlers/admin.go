@@ -0,0 +1,141 @@
+package handlers
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"secure-vault/crypto"
+	"secure-vault/middleware"
+	"secure-vault/models"
+	"secure-vault/storage"
+	"secure-vault/utils"
+
+	"github.com/gorilla/mux"
+)
+
+type reEncryptRequest struct {
+	models.ReEncryptFilter
+	Mode   string `json:"mode"`   // target mode
+	Params string `json:"params"` // target parameter set, e.g. "Kyber768"; defaults per mode
+	Pin    bool   `json:"pin"`    // keep the entries in this mode across later global migrations
+	DryRun bool   `json:"dry_run"`
+}
+
+// ReEncryptHandler re-encrypts a single entry or a filtered subset to a target mode
+func ReEncryptHandler(w http.ResponseWriter, r *http.Request) {
+	var req reEncryptRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON body", http.StatusBadRequest)
+		return
+	}
+
+	if req.ReEncryptFilter.IsEmpty() {
+		http.Error(w, "At least one of id, user_id, key_type, label, tags, created_after or created_before is required", http.StatusBadRequest)
+		return
+	}
+
+	mode, err := models.ToCryptoMode(req.Mode)
+	if err != nil {
+		http.Error(w, "Invalid mode: must be 'classical' or 'quantum-safe'", http.StatusBadRequest)
+		return
+	}
+	if req.Params != "" && !models.IsValidCryptoParams(mode, req.Params) {
+		http.Error(w, "Invalid params for mode "+req.Mode, http.StatusBadRequest)
+		return
+	}
+
+	report, err := storage.ReEncryptEntries(middleware.GetTenantFromContext(r), req.ReEncryptFilter, mode, req.Params, req.Pin, req.DryRun)
+	if errors.Is(err, storage.ErrNoMatch) {
+		http.Error(w, "No vault entry matches", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Re-encryption failed: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	utils.Info("admin", "re-encrypt to %s by user=%s: matched=%d dry_run=%t",
+		req.Mode, middleware.GetUserIDFromContext(r), report.Matched, report.DryRun)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
+
+// BackupHandler streams a consistent snapshot of the vault as a tar archive.
+// With ?recipient=<hex secp256k1 public key> the database is encrypted to that key.
+func BackupHandler(w http.ResponseWriter, r *http.Request) {
+	var recipient []byte
+	if hexKey := r.URL.Query().Get("recipient"); hexKey != "" {
+		var err error
+		recipient, err = hex.DecodeString(hexKey)
+		if err != nil || crypto.ValidatePublicKey(recipient, "secp256k1") != nil {
+			http.Error(w, "Invalid recipient: must be a hex secp256k1 public key", http.StatusBadRequest)
+			return
+		}
+	}
+
+	filename := "vault-" + utils.Now().Format("20060102T150405") + ".tar"
+	w.Header().Set("Content-Type", "application/x-tar")
+	w.Header().Set("Content-Disposition", `attachment; filename="`+filename+`"`)
+
+	// Headers are already sent once streaming starts, so later errors can only be logged
+	manifest, err := storage.WriteSnapshot(w, recipient)
+	if err != nil {
+		utils.Error("backup", "Snapshot failed: %v", err)
+		return
+	}
+
+	utils.Info("backup", "Snapshot streamed by user=%s: entries=%d size=%d encrypted=%t sha256=%s",
+		middleware.GetUserIDFromContext(r), manifest.Entries, manifest.DBSize, manifest.Encrypted, manifest.DBSHA256)
+}
+
+// FsckHandler runs a read-only integrity scan of every entry and returns the report.
+// Responds 200 when every entry passed and 409 when some failed; no key material is included.
+func FsckHandler(w http.ResponseWriter, r *http.Request) {
+	report, err := storage.Fsck()
+	if err != nil {
+		http.Error(w, "Integrity scan failed: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	utils.Info("admin", "fsck by user=%s: checked=%d failed=%d", middleware.GetUserIDFromContext(r), report.Checked, report.Failed)
+
+	w.Header().Set("Content-Type", "application/json")
+	if report.Failed > 0 {
+		w.WriteHeader(http.StatusConflict)
+	}
+	json.NewEncoder(w).Encode(report)
+}
+
+// CompactHandler rewrites the database into a fresh file and swaps it in.
+// Writes are held while live data is copied.
+func CompactHandler(w http.ResponseWriter, r *http.Request) {
+	report, err := storage.Compact()
+	if err != nil {
+		http.Error(w, "Compaction failed: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	utils.Info("admin", "compaction by user=%s: reclaimed=%d bytes", middleware.GetUserIDFromContext(r), report.Reclaimed)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
+
+// ShredUserHandler destroys a user's KEK in the caller's tenant and tombstones their
+// entries. Their keys, retained versions and copies in backups become unrecoverable.
+func ShredUserHandler(w http.ResponseWriter, r *http.Request) {
+	user := mux.Vars(r)["user"]
+	report, err := storage.ShredUser(middleware.GetTenantFromContext(r), user)
+	if err != nil {
+		http.Error(w, "Shred failed: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	utils.Info("admin", "user %s shredded by user=%s: entries=%d", user, middleware.GetUserIDFromContext(r), report.Entries)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
@@ -0,0 +1,122 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"secure-vault/middleware"
+	"secure-vault/models"
+	"secure-vault/storage"
+	"secure-vault/utils"
+
+	"github.com/gorilla/mux"
+)
+
+type createServiceAccountRequest struct {
+	UserID string `json:"user_id"`
+	Role   string `json:"role"` // optional, AUTH_DEFAULT_ROLE when empty
+}
+
+type createAPIKeyRequest struct {
+	Name      string     `json:"name"`
+	Scopes    []string   `json:"scopes"`
+	ExpiresAt *time.Time `json:"expires_at"` // optional deadline (RFC 3339)
+	TTL       string     `json:"ttl"`        // optional lifetime instead of expires_at, e.g. "2160h"
+}
+
+// CreateServiceAccountHandler adds an account without a password to the caller's tenant
+func CreateServiceAccountHandler(w http.ResponseWriter, r *http.Request) {
+	var req createServiceAccountRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON body", http.StatusBadRequest)
+		return
+	}
+	if err := models.ValidateUserID(req.UserID); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.Role != "" {
+		if err := models.ValidateRole(req.Role); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	by := middleware.GetUserIDFromContext(r)
+	user, err := storage.CreateServiceAccount(middleware.GetTenantFromContext(r), req.UserID, req.Role, by)
+	if err != nil {
+		writeUserError(w, err)
+		return
+	}
+
+	utils.Info("admin", "service account %s created by user=%s", user.UserID, by)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(user)
+}
+
+// CreateAPIKeyHandler issues an API key for a service account. The key is
+// returned once and cannot be retrieved later.
+func CreateAPIKeyHandler(w http.ResponseWriter, r *http.Request) {
+	var req createAPIKeyRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON body", http.StatusBadRequest)
+		return
+	}
+	if err := models.ValidateScopes(req.Scopes); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	expiresAt, err := resolveExpiry(req.ExpiresAt, req.TTL)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	by := middleware.GetUserIDFromContext(r)
+	raw, key, err := storage.CreateAPIKey(middleware.GetTenantFromContext(r), mux.Vars(r)["user"], req.Name, req.Scopes, expiresAt, by)
+	if errors.Is(err, storage.ErrNotService) {
+		http.Error(w, "API keys can only be issued to service accounts", http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		writeUserError(w, err)
+		return
+	}
+
+	utils.Info("admin", "API key %s for service account %s issued by user=%s", key.ID, key.ServiceAccount, by)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]interface{}{"key": raw, "api_key": key})
+}
+
+// ListAPIKeysHandler lists the keys of a service account, without their secrets
+func ListAPIKeysHandler(w http.ResponseWriter, r *http.Request) {
+	keys, err := storage.ListAPIKeys(middleware.GetTenantFromContext(r), mux.Vars(r)["user"])
+	if err != nil {
+		writeUserError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"api_keys": keys})
+}
+
+// RevokeAPIKeyHandler deletes an API key; it stops working immediately, while
+// tokens already traded for it run out within API_KEY_TOKEN_TTL
+func RevokeAPIKeyHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	err := storage.RevokeAPIKey(middleware.GetTenantFromContext(r), vars["user"], vars["id"])
+	if errors.Is(err, storage.ErrNotFound) {
+		http.Error(w, "API key not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Cannot revoke API key: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	utils.Info("admin", "API key %s of %s revoked by user=%s", vars["id"], vars["user"], middleware.GetUserIDFromContext(r))
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -2,17 +2,27 @@ package handlers
 
 import (
 	"encoding/json"
+	"errors"
 	"net/http"
-	"os"
+	"strings"
 	"time"
 
+	"secure-vault/middleware"
+	"secure-vault/models"
+	"secure-vault/storage"
 	"secure-vault/utils"
 
 	"github.com/golang-jwt/jwt/v5"
 )
 
 type AuthRequest struct {
-	UserID string `json:"user_id"`
+	UserID   string `json:"user_id"`
+	Password string `json:"password"`
+	Tenant   string `json:"tenant"` // optional, the default tenant when empty
+
+	// Instead of a password: the nonce of a challenge and its message's signature, in hex
+	Nonce     string `json:"nonce"`
+	Signature string `json:"signature"`
 }
 
 func GetToken(w http.ResponseWriter, r *http.Request) {
@@ -22,32 +32,177 @@ func GetToken(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// // Fake auth check (in production use real user DB)
-	// if req.Secret != "password" {
-	// 	utils.Warn("auth", "Invalid credentials for user: %s", req.UserID)
-	// 	http.Error(w, "unauthorized", http.StatusUnauthorized)
-	// 	return
-	// }
+	tenant := req.Tenant
+	if tenant == "" {
+		tenant = models.DefaultTenant
+	}
+	if err := models.ValidateTenantName(tenant); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Check the credentials; callers learn no more than that they were refused
+	var err error
+	if req.Signature != "" {
+		err = verifyChallenge(tenant, &req)
+	} else {
+		_, err = storage.Authenticate(tenant, req.UserID, req.Password)
+	}
+	if err != nil {
+		utils.Warn("auth", "Login refused: tenant=%s user=%s reason=%v", tenant, req.UserID, err)
+		http.Error(w, "invalid credentials", http.StatusUnauthorized)
+		return
+	}
+
+	// A follower cannot store refresh tokens; its logins get an access token only
+	session, err := storage.StartSession(tenant, req.UserID)
+	if errors.Is(err, storage.ErrReadOnlyReplica) {
+		session = storage.Session{Tenant: tenant, UserID: req.UserID}
+	} else if err != nil {
+		utils.Error("auth", "Failed to start session: %v", err)
+		http.Error(w, "token error", http.StatusInternalServerError)
+		return
+	}
+
+	utils.Info("auth", "Issued token for user: %s", req.UserID)
+	writeTokens(w, r, session)
+}
+
+type refreshRequest struct {
+	RefreshToken string `json:"refresh_token"`
+}
 
-	secret := os.Getenv("JWT_SECRET")
-	if secret == "" {
-		http.Error(w, "JWT_SECRET not set", http.StatusInternalServerError)
+// RefreshToken trades a refresh token for a new access token and the next
+// refresh token. Each refresh token works once.
+func RefreshToken(w http.ResponseWriter, r *http.Request) {
+	var req refreshRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid JSON", http.StatusBadRequest)
 		return
 	}
 
-	// Create the token
+	session, err := storage.RefreshSession(req.RefreshToken)
+	switch {
+	case errors.Is(err, storage.ErrReadOnlyReplica):
+		http.Error(w, "Refresh on the leader", http.StatusServiceUnavailable)
+		return
+	case errors.Is(err, storage.ErrInvalidRefreshToken), errors.Is(err, storage.ErrRefreshTokenReused), errors.Is(err, storage.ErrUserDisabled):
+		utils.Warn("auth", "Refresh refused: %v", err)
+		http.Error(w, "invalid or expired refresh token", http.StatusUnauthorized)
+		return
+	case err != nil:
+		utils.Error("auth", "Failed to refresh session: %v", err)
+		http.Error(w, "token error", http.StatusInternalServerError)
+		return
+	}
+
+	writeTokens(w, r, session)
+}
+
+// Logout revokes the caller's access token and ends its session, so the
+// session's refresh token stops working too
+func Logout(w http.ResponseWriter, r *http.Request) {
+	claims := middleware.GetClaimsFromContext(r)
+	if claims == nil {
+		http.Error(w, "API keys have no session; revoke the key instead", http.StatusBadRequest)
+		return
+	}
+
+	if jti, _ := claims["jti"].(string); jti != "" {
+		expires := time.Now().Add(storage.AccessTokenTTL)
+		if exp, err := claims.GetExpirationTime(); err == nil && exp != nil {
+			expires = exp.Time
+		}
+		if err := storage.RevokeToken(jti, expires); err != nil {
+			http.Error(w, "Cannot revoke token: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	if sid, _ := claims["sid"].(string); sid != "" {
+		if err := storage.EndSession(middleware.GetTenantFromContext(r), sid); err != nil {
+			http.Error(w, "Cannot end session: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	utils.Info("auth", "Logged out user: %s", middleware.GetUserIDFromContext(r))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// writeTokens answers with a short-lived access token of session, and its
+// refresh token when it has one. The access token is bound to the caller's
+// client certificate when MTLS_BIND_TOKENS is on.
+func writeTokens(w http.ResponseWriter, r *http.Request, session storage.Session) {
+	expires := time.Now().Add(storage.AccessTokenTTL)
 	claims := jwt.MapClaims{
-		"sub": req.UserID,
-		"exp": time.Now().Add(24 * time.Hour).Unix(),
+		"sub": session.UserID,
+		"exp": expires.Unix(),
+	}
+	if session.Tenant != models.DefaultTenant {
+		claims[middleware.TenantClaim] = session.Tenant
+	}
+	if session.ID != "" {
+		claims["sid"] = session.ID
 	}
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	signed, err := token.SignedString([]byte(secret))
+	middleware.BindToken(r, claims)
+	signed, err := middleware.SignToken(claims)
 	if err != nil {
 		utils.Error("auth", "Failed to sign token: %v", err)
 		http.Error(w, "token error", http.StatusInternalServerError)
 		return
 	}
 
-	utils.Info("auth", "Issued token for user: %s", req.UserID)
-	json.NewEncoder(w).Encode(map[string]string{"token": signed})
+	resp := map[string]interface{}{"token": signed, "expires_at": expires.UTC()}
+	if session.RefreshToken != "" {
+		resp["refresh_token"] = session.RefreshToken
+		resp["refresh_expires_at"] = session.ExpiresAt.UTC()
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// apiKeyTokenTTL bounds the lifetime of tokens traded for an API key
+var apiKeyTokenTTL = utils.EnvDuration("API_KEY_TOKEN_TTL", 15*time.Minute)
+
+// ExchangeAPIKey trades an API key, sent as "Authorization: ApiKey <key>", for
+// a short-lived token carrying the key's scopes
+func ExchangeAPIKey(w http.ResponseWriter, r *http.Request) {
+	// 1. Check the key and its service account
+	raw, ok := strings.CutPrefix(r.Header.Get("Authorization"), "ApiKey ")
+	if !ok {
+		http.Error(w, "Missing ApiKey Authorization header", http.StatusUnauthorized)
+		return
+	}
+	key, err := storage.AuthenticateAPIKey(raw)
+	if err == nil {
+		_, err = storage.CheckUser(key.Tenant, key.ServiceAccount)
+	}
+	if err != nil {
+		utils.Warn("auth", "API key exchange refused: %v", err)
+		http.Error(w, "Invalid or expired API key", http.StatusUnauthorized)
+		return
+	}
+
+	// 2. Never outlive the key
+	expires := time.Now().Add(apiKeyTokenTTL)
+	if key.ExpiresAt != nil && key.ExpiresAt.Before(expires) {
+		expires = *key.ExpiresAt
+	}
+	claims := jwt.MapClaims{
+		"sub":                  key.ServiceAccount,
+		"exp":                  expires.Unix(),
+		middleware.ScopeClaim:  strings.Join(key.Scopes, " "),
+		middleware.TenantClaim: key.Tenant,
+	}
+	middleware.BindToken(r, claims)
+	signed, err := middleware.SignToken(claims)
+	if err != nil {
+		utils.Error("auth", "Failed to sign token: %v", err)
+		http.Error(w, "token error", http.StatusInternalServerError)
+		return
+	}
+
+	utils.Info("auth", "Issued token for service account: %s (key %s)", key.ServiceAccount, key.ID)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"token": signed, "expires_at": expires.UTC()})
 }
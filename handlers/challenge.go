@@ -0,0 +1,161 @@
+package handlers
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+
+	"secure-vault/crypto"
+	"secure-vault/models"
+	"secure-vault/storage"
+	"secure-vault/utils"
+)
+
+var (
+	// challengeDomain names the vault in sign-in messages; the request's host when unset
+	challengeDomain = utils.EnvString("AUTH_CHALLENGE_DOMAIN", "")
+	siweChainID     = utils.EnvInt("SIWE_CHAIN_ID", 1)
+)
+
+type challengeRequest struct {
+	UserID  string `json:"user_id"`
+	Tenant  string `json:"tenant"`  // optional, the default tenant when empty
+	KeyID   string `json:"key_id"`  // a sign-in entry of the user
+	Address string `json:"address"` // the key's Ethereum address, or the hex Ed25519 key
+}
+
+var (
+	errBadSignature = errors.New("signature does not match the key")
+	errBadChallenge = errors.New("unknown or expired challenge")
+)
+
+// signInAddress reads the address of a challenge request: 0x and 40 hex
+// digits for secp256k1 keys, 64 hex digits for Ed25519 keys
+func signInAddress(address string) (keyType, normalized string, err error) {
+	if strings.HasPrefix(address, "0x") || strings.HasPrefix(address, "0X") {
+		normalized, err = crypto.ChecksumAddress(address)
+		return models.SignInSecp256k1, normalized, err
+	}
+	if key, err := hex.DecodeString(address); err != nil || len(key) != 32 {
+		return "", "", errors.New("address must be an Ethereum address or a hex Ed25519 key")
+	}
+	return models.SignInEd25519, strings.ToLower(address), nil
+}
+
+// GetChallenge issues a nonce for signing in with one of the user's sign-in
+// keys, and the message to sign: EIP-4361 text, signed with personal_sign for
+// secp256k1 keys and as raw bytes for Ed25519 keys. Nothing is looked up: every
+// well-formed request gets a challenge, and the key is checked with the signature.
+func GetChallenge(w http.ResponseWriter, r *http.Request) {
+	var req challengeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid JSON", http.StatusBadRequest)
+		return
+	}
+	if req.Tenant == "" {
+		req.Tenant = models.DefaultTenant
+	}
+	if err := models.ValidateTenantName(req.Tenant); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := models.ValidateUserID(req.UserID); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.KeyID == "" || len(req.KeyID) > 64 {
+		http.Error(w, "key_id is required", http.StatusBadRequest)
+		return
+	}
+
+	// 1. The key type follows from the address the client claims
+	keyType, address, err := signInAddress(req.Address)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// 2. Issue the nonce with the text to sign
+	domain := challengeDomain
+	if domain == "" {
+		domain = r.Host
+	}
+	uri := "http://" + domain
+	if r.TLS != nil {
+		uri = "https://" + domain
+	}
+	challenge := models.Challenge{Tenant: req.Tenant, UserID: req.UserID, KeyID: req.KeyID, KeyType: keyType, Address: address}
+	err = storage.IssueChallenge(&challenge, func(c *models.Challenge) string {
+		return c.SignInMessage(domain, uri, siweChainID)
+	})
+	if errors.Is(err, storage.ErrTooManyChallenges) {
+		http.Error(w, "Too many pending challenges, try again later", http.StatusTooManyRequests)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Cannot issue challenge: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"nonce":      challenge.Nonce,
+		"message":    challenge.Message,
+		"key_type":   challenge.KeyType,
+		"expires_at": challenge.ExpiresAt,
+	})
+}
+
+// verifyChallenge checks a signed challenge of a token request, using up its
+// nonce, and records the login
+func verifyChallenge(tenant string, req *AuthRequest) error {
+	c, ok := storage.TakeChallenge(req.Nonce)
+	if !ok || c.Tenant != tenant || c.UserID != req.UserID {
+		return errBadChallenge
+	}
+	sig, err := hex.DecodeString(strings.TrimPrefix(req.Signature, "0x"))
+	if err != nil {
+		return errBadSignature
+	}
+
+	// 1. Only accounts that sign in themselves; service accounts use their API keys
+	user, err := storage.CheckUser(c.Tenant, c.UserID)
+	if err != nil {
+		return err
+	}
+	if user.ServiceAccount {
+		return storage.ErrServiceAccount
+	}
+
+	// 2. The key must be a sign-in key of the user, at the address it was challenged for
+	keyType, pubKey, err := storage.SignInKey(c.Tenant, c.UserID, c.KeyID)
+	if err != nil {
+		return err
+	}
+	address := hex.EncodeToString(pubKey)
+	if keyType == models.SignInSecp256k1 {
+		if address, err = crypto.EthereumAddress(pubKey); err != nil {
+			return err
+		}
+	}
+	if keyType != c.KeyType || address != c.Address {
+		return storage.ErrNoSignInKey
+	}
+
+	// 3. The signature
+	var valid bool
+	switch keyType {
+	case models.SignInSecp256k1:
+		valid = crypto.VerifyEthereumSignature(pubKey, c.Message, sig)
+	case models.SignInEd25519:
+		valid = crypto.VerifyEd25519Signature(pubKey, c.Message, sig)
+	}
+	if !valid {
+		return errBadSignature
+	}
+
+	_, err = storage.RecordSignIn(c.Tenant, c.UserID)
+	return err
+}
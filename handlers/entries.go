@@ -0,0 +1,168 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+
+	"secure-vault/middleware"
+	"secure-vault/models"
+	"secure-vault/storage"
+	"secure-vault/utils"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	defaultListLimit = 100
+	maxListLimit     = 1000
+)
+
+// ListEntriesHandler lists the caller's entries without key material. Filters:
+// tag=key:value (repeatable, all must match), label, key_type; paging with
+// limit and after=<id of the last entry seen>.
+func ListEntriesHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+
+	// 1. Build the filter; callers only ever see their own entries
+	tags, err := models.ParseTagFilter(q["tag"])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	filter := models.ReEncryptFilter{
+		UserID:  middleware.GetUserIDFromContext(r),
+		Label:   q.Get("label"),
+		KeyType: q.Get("key_type"),
+		Tags:    tags,
+	}
+
+	limit := defaultListLimit
+	if v := q.Get("limit"); v != "" {
+		if limit, err = strconv.Atoi(v); err != nil || limit < 1 || limit > maxListLimit {
+			http.Error(w, "limit must be between 1 and 1000", http.StatusBadRequest)
+			return
+		}
+	}
+
+	// 2. Query
+	entries, next, err := storage.ListEntries(middleware.GetTenantFromContext(r), filter, q.Get("after"), limit)
+	if err != nil {
+		http.Error(w, "Cannot list entries: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if entries == nil {
+		entries = []models.EntryInfo{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"entries": entries,
+		"next":    next,
+	})
+}
+
+var errNotOwner = errors.New("not the owner")
+
+type updateMetadataRequest struct {
+	Label *string            `json:"label"`
+	Tags  map[string]*string `json:"tags"` // merged into the existing tags; null removes a tag
+
+	SignIn *bool `json:"sign_in"` // owner only
+}
+
+// UpdateMetadataHandler edits an entry's label and tags without rotating its key
+func UpdateMetadataHandler(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+
+	// 1. Parse If-Match and decode body
+	ifMatch, err := parseIfMatch(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var req updateMetadataRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON body", http.StatusBadRequest)
+		return
+	}
+	for k, v := range req.Tags {
+		if v == nil {
+			continue
+		}
+		if err := models.ValidateTag(k, *v); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	// 2. Apply the change; the envelopes are re-sealed in the same transaction
+	var invalid error
+	caller := middleware.GetCallerFromContext(r)
+	entry, err := storage.UpdateMetadata(middleware.GetTenantFromContext(r), id, caller, models.OpUpdate, ifMatch, func(entry *models.VaultEntry) error {
+		if entry.IsExpired(utils.Now()) {
+			return storage.ErrExpired
+		}
+		if req.SignIn != nil {
+			// Whoever may set the mark may sign in as the owner
+			switch {
+			case !entry.IsOwner(caller):
+				return errNotOwner
+			case *req.SignIn && !models.IsSignInKeyType(entry.KeyType):
+				invalid = errors.New("only secp256k1 and ed25519 keys can sign in")
+				return invalid
+			}
+			entry.SignIn = *req.SignIn
+		}
+		if req.Label != nil {
+			entry.Label = *req.Label
+		}
+		tags := make(map[string]string, len(entry.Tags)+len(req.Tags))
+		for k, v := range entry.Tags {
+			tags[k] = v
+		}
+		for k, v := range req.Tags {
+			if v == nil {
+				delete(tags, k)
+			} else {
+				tags[k] = *v
+			}
+		}
+		if invalid = models.ValidateTags(tags); invalid != nil {
+			return invalid
+		}
+		if len(tags) == 0 {
+			tags = nil
+		}
+		entry.Tags = tags
+		return nil
+	})
+	switch {
+	case invalid != nil:
+		http.Error(w, invalid.Error(), http.StatusBadRequest)
+		return
+	case errors.Is(err, errNotOwner):
+		http.Error(w, "Only the owner can mark a sign-in key", http.StatusForbidden)
+		return
+	case errors.Is(err, storage.ErrNotFound):
+		http.Error(w, "Vault entry not found", http.StatusNotFound)
+		return
+	case errors.Is(err, storage.ErrExpired):
+		http.Error(w, "Vault entry expired", http.StatusGone)
+		return
+	case errors.Is(err, storage.ErrRevisionMismatch):
+		http.Error(w, "Vault entry was modified, fetch it again and retry", http.StatusPreconditionFailed)
+		return
+	case err != nil:
+		http.Error(w, "Failed to update entry: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	utils.Info("vault", "Updated metadata: id=%s user=%s revision=%d", id, entry.UserID, entry.Revision)
+
+	w.Header().Set("ETag", entryETag(entry.Revision))
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(entry.Info())
+}
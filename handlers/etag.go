@@ -0,0 +1,30 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// entryETag renders an entry revision as a strong ETag
+func entryETag(revision uint64) string {
+	return `"` + strconv.FormatUint(revision, 10) + `"`
+}
+
+// parseIfMatch returns the revision required by the If-Match header, or nil
+// when the header is absent or "*"
+func parseIfMatch(r *http.Request) (*uint64, error) {
+	header := strings.TrimSpace(r.Header.Get("If-Match"))
+	if header == "" || header == "*" {
+		return nil, nil
+	}
+	if strings.Contains(header, ",") || !strings.HasPrefix(header, `"`) || !strings.HasSuffix(header, `"`) || len(header) < 2 {
+		return nil, errors.New("If-Match must be a single strong ETag")
+	}
+	rev, err := strconv.ParseUint(strings.Trim(header, `"`), 10, 64)
+	if err != nil {
+		return nil, errors.New("If-Match does not hold a vault entry ETag")
+	}
+	return &rev, nil
+}
@@ -0,0 +1,122 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"secure-vault/middleware"
+	"secure-vault/models"
+	"secure-vault/storage"
+	"secure-vault/utils"
+
+	"github.com/gorilla/mux"
+)
+
+type createGrantRequest struct {
+	UserID    string     `json:"user_id"` // either a user
+	Group     string     `json:"group"`   // or a group
+	Rights    []string   `json:"rights"`  // "read", "rotate"
+	ExpiresAt *time.Time `json:"expires_at"`
+	TTL       string     `json:"ttl"`
+}
+
+// ListGrantsHandler lists the grants on one of the caller's entries
+func ListGrantsHandler(w http.ResponseWriter, r *http.Request) {
+	tenant := middleware.GetTenantFromContext(r)
+	entry, err := storage.GetKey(tenant, mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Vault entry not found", http.StatusNotFound)
+		return
+	}
+	if d, err := storage.Authorize(tenant, middleware.GetCallerFromContext(r), models.OpShare, &entry); err != nil {
+		http.Error(w, "Cannot check access: "+err.Error(), http.StatusInternalServerError)
+		return
+	} else if !d.Allowed {
+		http.Error(w, "Vault entry not found", http.StatusNotFound)
+		return
+	}
+
+	now := utils.Now()
+	grants := []models.Grant{}
+	for _, g := range entry.Grants {
+		if !g.IsExpired(now) {
+			grants = append(grants, g)
+		}
+	}
+
+	w.Header().Set("ETag", entryETag(entry.Revision))
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"id":     entry.ID,
+		"grants": grants,
+	})
+}
+
+// CreateGrantHandler shares read or rotate rights on one of the caller's
+// entries with a user or a group
+func CreateGrantHandler(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+
+	// 1. Decode and validate the grant
+	var req createGrantRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON body", http.StatusBadRequest)
+		return
+	}
+	expiresAt, err := resolveExpiry(req.ExpiresAt, req.TTL)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	grant := models.Grant{UserID: req.UserID, Group: req.Group, Rights: req.Rights, ExpiresAt: expiresAt}
+	if err := models.ValidateGrant(&grant); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// 2. Add it; the entry's envelopes are re-sealed with it
+	owner := middleware.GetCallerFromContext(r)
+	grant, entry, err := storage.AddGrant(middleware.GetTenantFromContext(r), id, owner, grant)
+	if err != nil {
+		writeGrantError(w, err)
+		return
+	}
+
+	utils.Info("vault", "Granted %v: id=%s user=%s grantee=%s%s", grant.Rights, id, owner.UserID, grant.UserID, grant.Group)
+
+	w.Header().Set("ETag", entryETag(entry.Revision))
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(grant)
+}
+
+// DeleteGrantHandler withdraws a grant on one of the caller's entries
+func DeleteGrantHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	owner := middleware.GetCallerFromContext(r)
+	entry, err := storage.RemoveGrant(middleware.GetTenantFromContext(r), vars["id"], owner, vars["grant"])
+	if err != nil {
+		writeGrantError(w, err)
+		return
+	}
+
+	utils.Info("vault", "Removed grant: id=%s user=%s grant=%s", vars["id"], owner.UserID, vars["grant"])
+
+	w.Header().Set("ETag", entryETag(entry.Revision))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func writeGrantError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, storage.ErrNotFound):
+		http.Error(w, "Vault entry or grant not found", http.StatusNotFound)
+	case errors.Is(err, storage.ErrExpired):
+		http.Error(w, "Vault entry expired", http.StatusGone)
+	case errors.Is(err, storage.ErrTooManyGrants):
+		http.Error(w, err.Error(), http.StatusConflict)
+	default:
+		http.Error(w, "Cannot update grants: "+err.Error(), http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,93 @@
+package handlers
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http"
+
+	"secure-vault/middleware"
+	"secure-vault/models"
+	"secure-vault/storage"
+	"secure-vault/utils"
+)
+
+// jwk describes a public key in the JSON Web Key format (RFC 7517)
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Alg string `json:"alg"`
+	Use string `json:"use"`
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+	Y   string `json:"y,omitempty"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+}
+
+func b64(b []byte) string { return base64.RawURLEncoding.EncodeToString(b) }
+
+func toJWK(k models.SigningKey) (jwk, bool) {
+	out := jwk{Kid: k.KID, Alg: k.Algorithm, Use: "sig"}
+	switch pub := k.Public.(type) {
+	case ed25519.PublicKey:
+		out.Kty, out.Crv, out.X = "OKP", "Ed25519", b64(pub)
+	case *ecdsa.PublicKey:
+		raw := make([]byte, 64)
+		pub.X.FillBytes(raw[:32])
+		pub.Y.FillBytes(raw[32:])
+		out.Kty, out.Crv, out.X, out.Y = "EC", "P-256", b64(raw[:32]), b64(raw[32:])
+	case *rsa.PublicKey:
+		out.Kty, out.N, out.E = "RSA", b64(pub.N.Bytes()), b64(big.NewInt(int64(pub.E)).Bytes())
+	default:
+		return out, false
+	}
+	return out, true
+}
+
+// JWKSHandler publishes the keys that verify tokens, so other services can
+// check them without holding a secret
+func JWKSHandler(w http.ResponseWriter, r *http.Request) {
+	keys := []jwk{}
+	for _, k := range storage.SigningKeys() {
+		if j, ok := toJWK(k); ok {
+			keys = append(keys, j)
+		}
+	}
+
+	// Verifiers refetch after a rotation; a short cache keeps them close
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"keys": keys})
+}
+
+// ListSigningKeysHandler lists the token signing keys, current and retired
+func ListSigningKeysHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"algorithm": storage.SigningAlgorithm(),
+		"keys":      storage.SigningKeys(),
+	})
+}
+
+// RotateSigningKeyHandler starts signing tokens with a new key. Tokens signed
+// with the previous one stay valid until JWT_KEY_RETENTION has passed.
+func RotateSigningKeyHandler(w http.ResponseWriter, r *http.Request) {
+	key, err := storage.RotateSigningKey()
+	if errors.Is(err, storage.ErrSymmetricSigning) {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Rotation failed: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	utils.Info("admin", "token signing key rotated by user=%s", middleware.GetUserIDFromContext(r))
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(key)
+}
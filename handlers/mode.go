@@ -4,16 +4,21 @@ import (
 	"encoding/json"
 	"net/http"
 
+	"secure-vault/middleware"
 	"secure-vault/models"
 	"secure-vault/storage"
 	"secure-vault/utils"
 )
 
 type setModeRequest struct {
-	Mode string `json:"mode"` // "classical" or "quantum-safe"
+	Mode      string `json:"mode"`      // "classical" or "quantum-safe"
+	Migration string `json:"migration"` // "eager" (default) or "lazy"
 }
 
+// SetCryptoModeHandler switches the crypto mode of the caller's tenant; other
+// tenants keep theirs
 func SetCryptoModeHandler(w http.ResponseWriter, r *http.Request) {
+	tenant := middleware.GetTenantFromContext(r)
 	var req setModeRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		http.Error(w, "Invalid JSON body", http.StatusBadRequest)
@@ -25,58 +30,122 @@ func SetCryptoModeHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	currentMode, err := storage.GetCryptoMode()
+	strategy, err := models.ToMigrationStrategy(req.Migration)
+	if err != nil {
+		http.Error(w, "Invalid migration: must be 'eager' or 'lazy'", http.StatusBadRequest)
+		return
+	}
+
+	currentMode, err := storage.GetCryptoMode(tenant)
 	if err != nil {
 		http.Error(w, "Failed to get current crypto mode", http.StatusInternalServerError)
 		return
 	}
 
+	currentStrategy, err := storage.GetMigrationStrategy(tenant)
+	if err != nil {
+		http.Error(w, "Failed to get current migration strategy", http.StatusInternalServerError)
+		return
+	}
+
 	mode, err := models.ToCryptoMode(req.Mode)
 	if err != nil {
 		http.Error(w, "Invalid mode: must be 'classical' or 'quantum-safe'", http.StatusBadRequest)
 		return
 	}
 
-	// Skip if same mode
-	if mode == currentMode {
+	// Skip if same mode and strategy
+	if mode == currentMode && strategy == currentStrategy {
 		json.NewEncoder(w).Encode(map[string]string{
-			"message": "Mode unchanged — already in " + req.Mode,
-			"mode":    req.Mode,
+			"message":   "Mode unchanged — already in " + req.Mode,
+			"mode":      req.Mode,
+			"migration": string(strategy),
 		})
 		return
 	}
 
-	// Migrate all stored keys
-	if err := storage.ReEncryptAllVaultEntries(mode); err != nil {
-		http.Error(w, "Failed to re-encrypt vault keys: "+err.Error(), http.StatusInternalServerError)
+	// Persist the new mode, the strategy and the job together: new writes use
+	// the mode right away, and existing entries stay readable under their own
+	// crypto_mode until they are migrated
+	job, err := storage.SwitchCryptoMode(tenant, mode, strategy)
+	if err != nil {
+		http.Error(w, "Failed to update mode: "+err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	// Persist new mode
-	if err := storage.SetCryptoMode(mode); err != nil {
-		http.Error(w, "Failed to update mode", http.StatusInternalServerError)
+	if strategy == models.LazyMigration {
+		// Entries are rewritten on next read or rotation instead
+		utils.Info("mode", "toggled crypto mode of tenant %s to %s with lazy migration", tenant, req.Mode)
+
+		json.NewEncoder(w).Encode(map[string]string{
+			"message":   "Crypto mode updated, keys will be re-encrypted on next read or rotation",
+			"mode":      req.Mode,
+			"migration": string(strategy),
+		})
 		return
 	}
 
-	utils.Info("mode", "toggled crypto mode to %s", req.Mode)
+	// All stored keys are migrated in the background
+	utils.Info("mode", "toggled crypto mode of tenant %s to %s, rekey job %s started", tenant, req.Mode, job.ID)
 
-	json.NewEncoder(w).Encode(map[string]string{
-		"message": "Crypto mode updated and all keys re-encrypted",
-		"mode":    req.Mode,
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"message":   "Crypto mode updated, re-encryption running in background",
+		"mode":      req.Mode,
+		"migration": string(strategy),
+		"job":       job,
 	})
 }
 
+// GetRekeyStatusHandler reports progress of the latest background re-encryption job
+func GetRekeyStatusHandler(w http.ResponseWriter, r *http.Request) {
+	job, err := storage.GetRekeyJob(middleware.GetTenantFromContext(r))
+	if err != nil {
+		http.Error(w, "Failed to read re-encryption status", http.StatusInternalServerError)
+		return
+	}
+	if job == nil {
+		http.Error(w, "No re-encryption job found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(job)
+}
+
 func GetCryptoModeHandler(w http.ResponseWriter, r *http.Request) {
-	mode, err := storage.GetCryptoMode()
+	tenant := middleware.GetTenantFromContext(r)
+	mode, err := storage.GetCryptoMode(tenant)
 	if err != nil {
 		http.Error(w, "Failed to retrieve crypto mode", http.StatusInternalServerError)
 		return
 	}
 
+	strategy, err := storage.GetMigrationStrategy(tenant)
+	if err != nil {
+		http.Error(w, "Failed to retrieve migration strategy", http.StatusInternalServerError)
+		return
+	}
+
 	resp := map[string]string{
-		"mode": string(mode),
+		"tenant":    tenant,
+		"mode":      string(mode),
+		"migration": string(strategy),
 	}
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(resp)
 }
+
+// GetVaultStatsHandler reports how many entries remain in each crypto mode
+func GetVaultStatsHandler(w http.ResponseWriter, r *http.Request) {
+	stats, err := storage.GetVaultStats(middleware.GetTenantFromContext(r))
+	if err != nil {
+		http.Error(w, "Failed to compute vault stats", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(stats)
+}
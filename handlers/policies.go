@@ -0,0 +1,202 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+
+	"secure-vault/middleware"
+	"secure-vault/models"
+	"secure-vault/storage"
+	"secure-vault/utils"
+
+	"github.com/gorilla/mux"
+)
+
+type putPolicyRequest struct {
+	Description string              `json:"description"`
+	Rules       []models.PolicyRule `json:"rules"`
+}
+
+type policyCheckRequest struct {
+	Subject   *models.Caller    `json:"subject"` // the caller when omitted
+	Operation string            `json:"operation"`
+	EntryID   string            `json:"entry_id"` // a stored entry
+	Entry     *policyCheckEntry `json:"entry"`    // or the attributes of one
+}
+
+type policyCheckEntry struct {
+	Owner      string            `json:"owner"`
+	Label      string            `json:"label"`
+	Tags       map[string]string `json:"tags"`
+	KeyType    string            `json:"key_type"`
+	CryptoMode string            `json:"crypto_mode"`
+}
+
+// ListPoliciesHandler lists the current version of every policy of the tenant
+func ListPoliciesHandler(w http.ResponseWriter, r *http.Request) {
+	policies, err := storage.ListPolicies(middleware.GetTenantFromContext(r))
+	if err != nil {
+		http.Error(w, "Cannot list policies: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if policies == nil {
+		policies = []models.Policy{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"policies": policies})
+}
+
+// GetPolicyHandler returns the current version of a policy, or with
+// ?version=<n> an earlier one
+func GetPolicyHandler(w http.ResponseWriter, r *http.Request) {
+	var version uint64
+	if v := r.URL.Query().Get("version"); v != "" {
+		var err error
+		if version, err = strconv.ParseUint(v, 10, 64); err != nil || version == 0 {
+			http.Error(w, "version must be a positive number", http.StatusBadRequest)
+			return
+		}
+	}
+
+	policy, err := storage.GetPolicy(middleware.GetTenantFromContext(r), mux.Vars(r)["name"], version)
+	if err != nil {
+		writePolicyError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(policy)
+}
+
+// ListPolicyVersionsHandler returns every version of a policy, oldest first
+func ListPolicyVersionsHandler(w http.ResponseWriter, r *http.Request) {
+	versions, err := storage.PolicyHistory(middleware.GetTenantFromContext(r), mux.Vars(r)["name"])
+	if err != nil {
+		writePolicyError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"versions": versions})
+}
+
+// PutPolicyHandler stores a new version of a policy
+func PutPolicyHandler(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+	if err := models.ValidatePolicyName(name); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var req putPolicyRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON body", http.StatusBadRequest)
+		return
+	}
+	policy := models.Policy{Name: name, Description: req.Description, Rules: req.Rules}
+	if err := models.ValidatePolicy(&policy); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	by := middleware.GetUserIDFromContext(r)
+	policy, err := storage.PutPolicy(middleware.GetTenantFromContext(r), policy, by)
+	if err != nil {
+		writePolicyError(w, err)
+		return
+	}
+
+	utils.Info("admin", "policy %s version %d stored by user=%s", policy.Name, policy.Version, by)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(policy)
+}
+
+// DeletePolicyHandler stops a policy from applying, keeping its versions
+func DeletePolicyHandler(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+	by := middleware.GetUserIDFromContext(r)
+	if err := storage.DeletePolicy(middleware.GetTenantFromContext(r), name, by); err != nil {
+		writePolicyError(w, err)
+		return
+	}
+
+	utils.Info("admin", "policy %s deleted by user=%s", name, by)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// CheckPolicyHandler explains whether a subject may do an operation on a
+// stored entry, or on one with the given attributes, without doing it
+func CheckPolicyHandler(w http.ResponseWriter, r *http.Request) {
+	tenant := middleware.GetTenantFromContext(r)
+
+	// 1. Decode and validate
+	var req policyCheckRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON body", http.StatusBadRequest)
+		return
+	}
+	if err := models.ValidateOperation(req.Operation); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if (req.EntryID == "") == (req.Entry == nil) {
+		http.Error(w, "give either entry_id or entry", http.StatusBadRequest)
+		return
+	}
+
+	// 2. Resolve the subject; an account named without groups or roles brings its own
+	subject := middleware.GetCallerFromContext(r)
+	if req.Subject != nil {
+		subject = *req.Subject
+		if subject.Groups == nil && subject.Roles == nil {
+			if u, err := storage.CheckUser(tenant, subject.UserID); err == nil {
+				subject.Groups, subject.Roles = u.Groups, []string{u.Role}
+			}
+		}
+	}
+
+	// 3. Resolve the entry
+	var entry models.VaultEntry
+	if req.EntryID != "" {
+		var err error
+		if entry, err = storage.GetKey(tenant, req.EntryID); err != nil {
+			http.Error(w, "Vault entry not found", http.StatusNotFound)
+			return
+		}
+	} else {
+		entry = models.VaultEntry{
+			Tenant:     tenant,
+			UserID:     req.Entry.Owner,
+			Label:      req.Entry.Label,
+			Tags:       req.Entry.Tags,
+			KeyType:    req.Entry.KeyType,
+			CryptoMode: req.Entry.CryptoMode,
+		}
+	}
+
+	// 4. Decide
+	d, err := storage.Authorize(tenant, subject, req.Operation, &entry)
+	if err != nil {
+		http.Error(w, "Cannot check access: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Subject   models.Caller `json:"subject"`
+		Operation string        `json:"operation"`
+		models.Decision
+	}{subject, req.Operation, d})
+}
+
+func writePolicyError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, storage.ErrPolicyNotFound):
+		http.Error(w, "Policy not found", http.StatusNotFound)
+	default:
+		http.Error(w, "Cannot update policy: "+err.Error(), http.StatusInternalServerError)
+	}
+}
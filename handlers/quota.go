@@ -0,0 +1,75 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"secure-vault/middleware"
+	"secure-vault/models"
+	"secure-vault/storage"
+	"secure-vault/utils"
+
+	"github.com/gorilla/mux"
+)
+
+// GetTenantQuotaHandler reports tenant-wide limits and usage
+func GetTenantQuotaHandler(w http.ResponseWriter, r *http.Request) {
+	report, err := storage.GetTenantQuota(middleware.GetTenantFromContext(r))
+	if err != nil {
+		http.Error(w, "Cannot read quota: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
+
+// GetUserQuotaHandler reports a user's effective limits, override and usage
+func GetUserQuotaHandler(w http.ResponseWriter, r *http.Request) {
+	report, err := storage.GetUserQuota(middleware.GetTenantFromContext(r), mux.Vars(r)["user"])
+	if err != nil {
+		http.Error(w, "Cannot read quota: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
+
+// SetUserQuotaHandler overrides individual limits for a user. Omitted fields
+// keep the default; 0 means unlimited, or no retained versions.
+func SetUserQuotaHandler(w http.ResponseWriter, r *http.Request) {
+	user := mux.Vars(r)["user"]
+
+	var override models.QuotaOverride
+	if err := json.NewDecoder(r.Body).Decode(&override); err != nil {
+		http.Error(w, "Invalid JSON body", http.StatusBadRequest)
+		return
+	}
+	if (override.MaxEntries != nil && *override.MaxEntries < 0) ||
+		(override.MaxBytes != nil && *override.MaxBytes < 0) ||
+		(override.MaxVersions != nil && *override.MaxVersions < 0) {
+		http.Error(w, "Limits must not be negative", http.StatusBadRequest)
+		return
+	}
+	override.UpdatedAt = utils.Now()
+	override.UpdatedBy = middleware.GetUserIDFromContext(r)
+
+	if err := storage.SetQuotaOverride(middleware.GetTenantFromContext(r), user, &override); err != nil {
+		http.Error(w, "Cannot save quota: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	utils.Info("admin", "quota override for user=%s set by user=%s", user, override.UpdatedBy)
+
+	GetUserQuotaHandler(w, r)
+}
+
+// DeleteUserQuotaHandler drops a user's override so the defaults apply again
+func DeleteUserQuotaHandler(w http.ResponseWriter, r *http.Request) {
+	user := mux.Vars(r)["user"]
+	if err := storage.SetQuotaOverride(middleware.GetTenantFromContext(r), user, nil); err != nil {
+		http.Error(w, "Cannot save quota: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	utils.Info("admin", "quota override for user=%s removed by user=%s", user, middleware.GetUserIDFromContext(r))
+
+	GetUserQuotaHandler(w, r)
+}
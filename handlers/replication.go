@@ -0,0 +1,74 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+
+	"secure-vault/middleware"
+	"secure-vault/storage"
+	"secure-vault/utils"
+)
+
+// ReplicationSeedHandler streams a copy of the database and keystore to a new
+// follower, named by ?follower=
+func ReplicationSeedHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/x-tar")
+	if err := storage.WriteSeed(w, r.URL.Query().Get("follower")); err != nil {
+		// Headers are already sent; the follower sees a truncated archive
+		utils.Error("replication", "seed failed: %v", err)
+		return
+	}
+	utils.Info("replication", "seed sent to %s", r.RemoteAddr)
+}
+
+// ReplicationLogHandler returns the changes after ?after= and ?keystore_after=,
+// which ?follower= has applied
+func ReplicationLogHandler(w http.ResponseWriter, r *http.Request) {
+	after, err1 := strconv.ParseUint(r.URL.Query().Get("after"), 10, 64)
+	keystoreAfter, err2 := strconv.ParseUint(r.URL.Query().Get("keystore_after"), 10, 64)
+	if err1 != nil || err2 != nil {
+		http.Error(w, "after and keystore_after must be change positions", http.StatusBadRequest)
+		return
+	}
+
+	batch, err := storage.ReadChanges(r.URL.Query().Get("follower"), after, keystoreAfter)
+	switch {
+	case errors.Is(err, storage.ErrLogTrimmed):
+		http.Error(w, err.Error(), http.StatusGone)
+		return
+	case errors.Is(err, storage.ErrFollowerAhead):
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	case err != nil:
+		http.Error(w, "Cannot read change log: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(batch)
+}
+
+// ReplicationStatusHandler reports the role of this instance and, on a follower, its lag
+func ReplicationStatusHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(storage.ReplicationStatus())
+}
+
+// PromoteHandler stops replication and makes this follower the leader
+func PromoteHandler(w http.ResponseWriter, r *http.Request) {
+	status, err := storage.Promote()
+	if err != nil {
+		if !storage.IsFollower() {
+			http.Error(w, "This instance is not a follower", http.StatusConflict)
+			return
+		}
+		http.Error(w, "Promotion failed: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	utils.Info("admin", "promoted to leader by user=%s", middleware.GetUserIDFromContext(r))
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(status)
+}
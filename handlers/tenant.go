@@ -0,0 +1,79 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"secure-vault/middleware"
+	"secure-vault/models"
+	"secure-vault/storage"
+	"secure-vault/utils"
+)
+
+type createTenantRequest struct {
+	Name string `json:"name"`
+	Mode string `json:"mode"` // initial crypto mode, "classical" by default
+
+	// The tenant's first admin, who creates its other accounts
+	AdminUser     string `json:"admin_user"`
+	AdminPassword string `json:"admin_password"`
+}
+
+// ListTenantsHandler lists every tenant with its crypto mode and entry count
+func ListTenantsHandler(w http.ResponseWriter, r *http.Request) {
+	tenants, err := storage.ListTenants()
+	if err != nil {
+		http.Error(w, "Cannot list tenants: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"tenants": tenants})
+}
+
+// CreateTenantHandler provisions an empty tenant with its own KEK and crypto
+// mode, and its first admin account
+func CreateTenantHandler(w http.ResponseWriter, r *http.Request) {
+	var req createTenantRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON body", http.StatusBadRequest)
+		return
+	}
+	if err := models.ValidateTenantName(req.Name); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := models.ValidateUserID(req.AdminUser); err != nil {
+		http.Error(w, "Invalid admin_user: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.Mode == "" {
+		req.Mode = string(models.ClassicalMode)
+	}
+	mode, err := models.ToCryptoMode(req.Mode)
+	if err != nil {
+		http.Error(w, "Invalid mode: must be 'classical' or 'quantum-safe'", http.StatusBadRequest)
+		return
+	}
+
+	by := middleware.GetUserIDFromContext(r)
+	tenant, err := storage.CreateTenant(req.Name, mode, req.AdminUser, req.AdminPassword, by)
+	switch {
+	case errors.Is(err, storage.ErrWeakPassword):
+		http.Error(w, "Invalid admin_password: "+err.Error(), http.StatusBadRequest)
+		return
+	case err != nil && storage.TenantExists(req.Name):
+		http.Error(w, "Tenant already exists", http.StatusConflict)
+		return
+	case err != nil:
+		http.Error(w, "Cannot create tenant: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	utils.Info("admin", "tenant %s created with admin %s by user=%s", tenant.Name, req.AdminUser, by)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(tenant)
+}
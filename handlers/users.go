@@ -0,0 +1,189 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"secure-vault/middleware"
+	"secure-vault/models"
+	"secure-vault/storage"
+	"secure-vault/utils"
+
+	"github.com/gorilla/mux"
+)
+
+type createUserRequest struct {
+	UserID   string `json:"user_id"`
+	Password string `json:"password"`
+	Role     string `json:"role"` // optional, AUTH_DEFAULT_ROLE when empty
+}
+
+type setRoleRequest struct {
+	Role string `json:"role"`
+}
+
+type setGroupsRequest struct {
+	Groups []string `json:"groups"`
+}
+
+type resetPasswordRequest struct {
+	Password string `json:"password"`
+}
+
+// ListUsersHandler lists the accounts of the caller's tenant
+func ListUsersHandler(w http.ResponseWriter, r *http.Request) {
+	users, err := storage.ListUsers(middleware.GetTenantFromContext(r))
+	if err != nil {
+		http.Error(w, "Cannot list users: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"users": users})
+}
+
+// CreateUserHandler adds an account to the caller's tenant
+func CreateUserHandler(w http.ResponseWriter, r *http.Request) {
+	var req createUserRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON body", http.StatusBadRequest)
+		return
+	}
+	if err := models.ValidateUserID(req.UserID); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.Role != "" {
+		if err := models.ValidateRole(req.Role); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	by := middleware.GetUserIDFromContext(r)
+	user, err := storage.CreateUser(middleware.GetTenantFromContext(r), req.UserID, req.Password, req.Role, by)
+	if err != nil {
+		writeUserError(w, err)
+		return
+	}
+
+	utils.Info("admin", "user %s created by user=%s", user.UserID, by)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(user)
+}
+
+// DisableUserHandler stops a user from logging in and from using issued tokens
+func DisableUserHandler(w http.ResponseWriter, r *http.Request) {
+	setUserDisabled(w, r, true)
+}
+
+// EnableUserHandler re-enables a disabled user
+func EnableUserHandler(w http.ResponseWriter, r *http.Request) {
+	setUserDisabled(w, r, false)
+}
+
+func setUserDisabled(w http.ResponseWriter, r *http.Request, disabled bool) {
+	user, err := storage.SetUserDisabled(middleware.GetTenantFromContext(r), mux.Vars(r)["user"], disabled)
+	if err != nil {
+		writeUserError(w, err)
+		return
+	}
+
+	utils.Info("admin", "user %s disabled=%t by user=%s", user.UserID, disabled, middleware.GetUserIDFromContext(r))
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(user)
+}
+
+// SetUserRoleHandler changes the role of a user
+func SetUserRoleHandler(w http.ResponseWriter, r *http.Request) {
+	var req setRoleRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON body", http.StatusBadRequest)
+		return
+	}
+	if err := models.ValidateRole(req.Role); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	user, err := storage.SetUserRole(middleware.GetTenantFromContext(r), mux.Vars(r)["user"], req.Role)
+	if err != nil {
+		writeUserError(w, err)
+		return
+	}
+
+	utils.Info("admin", "role of user %s set to %s by user=%s", user.UserID, user.Role, middleware.GetUserIDFromContext(r))
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(user)
+}
+
+// SetUserGroupsHandler replaces the groups of a user, which entry grants can name
+func SetUserGroupsHandler(w http.ResponseWriter, r *http.Request) {
+	var req setGroupsRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON body", http.StatusBadRequest)
+		return
+	}
+	for _, g := range req.Groups {
+		if err := models.ValidateGroup(g); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	user, err := storage.SetUserGroups(middleware.GetTenantFromContext(r), mux.Vars(r)["user"], req.Groups)
+	if err != nil {
+		writeUserError(w, err)
+		return
+	}
+
+	utils.Info("admin", "groups of user %s set to %v by user=%s", user.UserID, user.Groups, middleware.GetUserIDFromContext(r))
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(user)
+}
+
+// ResetPasswordHandler sets a new password for a user and lifts a lockout
+func ResetPasswordHandler(w http.ResponseWriter, r *http.Request) {
+	var req resetPasswordRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON body", http.StatusBadRequest)
+		return
+	}
+
+	user, err := storage.ResetPassword(middleware.GetTenantFromContext(r), mux.Vars(r)["user"], req.Password)
+	if err != nil {
+		writeUserError(w, err)
+		return
+	}
+
+	utils.Info("admin", "password of user %s reset by user=%s", user.UserID, middleware.GetUserIDFromContext(r))
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(user)
+}
+
+// RevokeUserTokensHandler voids every token issued to a user so far, including
+// refresh tokens. Users of an identity provider can be named as well.
+func RevokeUserTokensHandler(w http.ResponseWriter, r *http.Request) {
+	userID := mux.Vars(r)["user"]
+	if err := storage.RevokeUserTokens(middleware.GetTenantFromContext(r), userID); err != nil {
+		http.Error(w, "Cannot revoke tokens: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	utils.Info("admin", "tokens of user %s revoked by user=%s", userID, middleware.GetUserIDFromContext(r))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func writeUserError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, storage.ErrUserNotFound):
+		http.Error(w, "User not found", http.StatusNotFound)
+	case errors.Is(err, storage.ErrUserExists):
+		http.Error(w, "User already exists", http.StatusConflict)
+	case errors.Is(err, storage.ErrWeakPassword), errors.Is(err, storage.ErrServiceAccount):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	default:
+		http.Error(w, "Cannot update user: "+err.Error(), http.StatusInternalServerError)
+	}
+}
@@ -3,8 +3,12 @@ package handlers
 import (
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"log"
 	"net/http"
+	"strconv"
+	"time"
+
 	"secure-vault/crypto"
 	"secure-vault/middleware"
 	"secure-vault/models"
@@ -17,20 +21,51 @@ import (
 )
 
 type storeRequest struct {
-	Key         string `json:"key"`          // string-encoded key
-	Label       string `json:"label"`
-	KeyType  string `json:"key_type"`  // "secp256k1" or "kyber512"
-	KeyEncoding string `json:"key_encoding"` // "hex" or "string"
+	Key         string     `json:"key"` // string-encoded key
+	Label       string     `json:"label"`
+	KeyType     string     `json:"key_type"`     // "secp256k1" or "kyber512"
+	KeyEncoding string     `json:"key_encoding"` // "hex" or "string"
+	ExpiresAt   *time.Time `json:"expires_at"`   // optional deadline (RFC 3339)
+	TTL         string     `json:"ttl"`          // optional lifetime instead of expires_at, e.g. "12h"
+
+	Tags map[string]string `json:"tags"` // e.g. {"environment": "prod", "service": "payments"}
+
+	SignIn bool `json:"sign_in"` // sign in with this secp256k1 or ed25519 key
+}
+
+// resolveExpiry turns the optional expires_at/ttl pair of a request into a deadline
+func resolveExpiry(expiresAt *time.Time, ttl string) (*time.Time, error) {
+	now := utils.Now()
+	switch {
+	case expiresAt != nil && ttl != "":
+		return nil, errors.New("set either expires_at or ttl, not both")
+	case ttl != "":
+		d, err := time.ParseDuration(ttl)
+		if err != nil || d <= 0 {
+			return nil, errors.New("ttl must be a positive duration such as \"30m\" or \"24h\"")
+		}
+		deadline := now.Add(d)
+		return &deadline, nil
+	case expiresAt != nil:
+		if !expiresAt.After(now) {
+			return nil, errors.New("expires_at must be in the future")
+		}
+		deadline := expiresAt.UTC()
+		return &deadline, nil
+	}
+	return nil, nil
 }
+
 func StoreKey(w http.ResponseWriter, r *http.Request) {
 	UserId := middleware.GetUserIDFromContext(r)
+	tenant := middleware.GetTenantFromContext(r)
 	var payload storeRequest
 	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
 		http.Error(w, "Invalid request body", http.StatusBadRequest)
 		return
 	}
 
-	mode, err := storage.GetCryptoMode()
+	mode, err := storage.GetCryptoMode(tenant)
 	if err != nil {
 		http.Error(w, "Cannot read crypto mode", http.StatusInternalServerError)
 		return
@@ -58,121 +93,191 @@ func StoreKey(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	expiresAt, err := resolveExpiry(payload.ExpiresAt, payload.TTL)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := models.ValidateTags(payload.Tags); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(payload.Tags) == 0 {
+		payload.Tags = nil
+	}
+	if payload.SignIn && !models.IsSignInKeyType(payload.KeyType) {
+		http.Error(w, "Only secp256k1 and ed25519 keys can sign in", http.StatusBadRequest)
+		return
+	}
+
 	entry := models.VaultEntry{
-		ID:         uuid.NewString(),
-		Label:      payload.Label,
-		UserID:     UserId,
-		KeyType:    payload.KeyType,
+		Tenant:      tenant,
+		ID:          uuid.NewString(),
+		Label:       payload.Label,
+		UserID:      UserId,
+		KeyType:     payload.KeyType,
 		KeyEncoding: payload.KeyEncoding,
-		CryptoMode: string(mode),
-		CreatedAt:  utils.Now(),
+		CryptoMode:  string(mode),
+		CreatedAt:   utils.Now(),
+		ExpiresAt:   expiresAt,
+		Tags:        payload.Tags,
+		SignIn:      payload.SignIn,
 	}
 
-	switch mode {
-	case models.ClassicalMode:
-		ct, nonce, encPriv, encPrivNonce, pub, err := crypto.EncryptWithEphemeralECC(decodedKey)
-		if err != nil {
-			http.Error(w, "Encryption failed", http.StatusInternalServerError)
-			return
-		}
-		entry.Ciphertext = ct
-		entry.Nonce = nonce
-		entry.EncryptedEphemeralPrivKey = encPriv
-		entry.EphemeralPrivNonce = encPrivNonce
-		entry.EphemeralPubKey = pub
-
-	case models.QuantumSafeMode:
-		ct, nonce, kemCT, encPriv, encPrivNonce, pub, err := crypto.EncryptWithEphemeralKyber(decodedKey)
-		if err != nil {
-			http.Error(w, "Kyber encryption failed", http.StatusInternalServerError)
-			return
-		}
-		entry.Ciphertext = ct
-		entry.Nonce = nonce
-		entry.KyberCiphertext = kemCT
-		entry.EncryptedKyberPrivKey = encPriv
-		entry.KyberPrivNonce = encPrivNonce
-		entry.KyberPubKey = pub
+	d, err := storage.Authorize(tenant, middleware.GetCallerFromContext(r), models.OpStore, &entry)
+	if err != nil {
+		http.Error(w, "Cannot check access: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !d.Allowed {
+		http.Error(w, "Forbidden: "+d.Reason, http.StatusForbidden)
+		return
+	}
 
-	default:
-		http.Error(w, "Unsupported crypto mode", http.StatusBadRequest)
+	if err := storage.EncryptEntry(&entry, mode, "", decodedKey); err != nil {
+		http.Error(w, "Encryption failed", http.StatusInternalServerError)
 		return
 	}
 
 	if err := storage.SaveKey(entry); err != nil {
+		var quotaErr *models.QuotaError
+		if errors.As(err, &quotaErr) {
+			http.Error(w, quotaErr.Error(), http.StatusForbidden)
+			return
+		}
 		http.Error(w, "Failed to save entry", http.StatusInternalServerError)
 		return
 	}
 
-	utils.Info("vault", "Stored key: id=%s user=%s", entry.ID, entry.UserID)
+	utils.Info("vault", "Stored key: tenant=%s id=%s user=%s", tenant, entry.ID, entry.UserID)
 
+	w.Header().Set("ETag", entryETag(1))
 	w.WriteHeader(http.StatusCreated)
 	_ = json.NewEncoder(w).Encode(map[string]string{"id": entry.ID})
 }
 
+// GetKey returns the current key, or with ?version=<revision> a retained earlier
+// one. Entries the caller may not read are not found.
 func GetKey(w http.ResponseWriter, r *http.Request) {
 	id := mux.Vars(r)["id"]
-	entry, err := storage.GetKey(id)
+	tenant := middleware.GetTenantFromContext(r)
+	entry, err := storage.GetKey(tenant, id)
 	if err != nil {
 		http.Error(w, "Vault entry not found", http.StatusNotFound)
 		return
 	}
+	if d, err := storage.Authorize(tenant, middleware.GetCallerFromContext(r), models.OpRead, &entry); err != nil {
+		http.Error(w, "Cannot check access: "+err.Error(), http.StatusInternalServerError)
+		return
+	} else if !d.Allowed {
+		http.Error(w, "Vault entry not found", http.StatusNotFound)
+		return
+	}
 
-	var plainKey []byte
-
-	switch models.CryptoMode(entry.CryptoMode) {
-	case models.ClassicalMode:
-		plainKey, err = crypto.DecryptWithEphemeralECC(
-			entry.Ciphertext,
-			entry.Nonce,
-			entry.EncryptedEphemeralPrivKey,
-			entry.EphemeralPrivNonce,
-		)
-	case models.QuantumSafeMode:
-		plainKey, err = crypto.DecryptWithEphemeralKyber(
-			entry.Ciphertext,
-			entry.Nonce,
-			entry.KyberCiphertext,
-			entry.EncryptedKyberPrivKey,
-			entry.KyberPrivNonce,
-		)
-	default:
-		http.Error(w, "Unsupported mode", http.StatusBadRequest)
+	if entry.IsTombstone() || entry.IsExpired(utils.Now()) {
+		http.Error(w, "Vault entry expired", http.StatusGone)
+		return
+	}
+
+	if v := r.URL.Query().Get("version"); v != "" {
+		getKeyVersion(w, &entry, v)
 		return
 	}
 
+	plainKey, err := storage.DecryptEntry(&entry)
 	if err != nil {
 		http.Error(w, "Decryption failed: "+err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	var encoded string
-	switch entry.KeyEncoding {
-	case "hex":
-		encoded = hex.EncodeToString(plainKey)
-	case "string":
-		encoded = string(plainKey)
-	default:
+	// Lazy migration: bring the entry up to the current mode while we hold the plaintext
+	if err := storage.LazyMigrate(entry, plainKey); err != nil {
+		utils.Warn("vault", "Lazy migration failed: id=%s err=%v", id, err)
+	}
+
+	encoded, ok := encodeKey(plainKey, entry.KeyEncoding)
+	if !ok {
 		http.Error(w, "Unsupported key_encoding", http.StatusInternalServerError)
 		return
 	}
 
 	utils.Info("vault", "Get key: id=%s user=%s", id, entry.UserID)
 
+	w.Header().Set("ETag", entryETag(entry.Revision))
 	_ = json.NewEncoder(w).Encode(map[string]interface{}{
-		"id":  entry.ID,
-		"key": encoded,
+		"id":       entry.ID,
+		"key":      encoded,
+		"label":    entry.Label,
+		"tags":     entry.Tags,
+		"revision": entry.Revision,
 	})
 }
+
+func getKeyVersion(w http.ResponseWriter, entry *models.VaultEntry, v string) {
+	revision, err := strconv.ParseUint(v, 10, 64)
+	if err != nil {
+		http.Error(w, "version must be a revision number", http.StatusBadRequest)
+		return
+	}
+	version := entry.Version(revision)
+	if version == nil {
+		http.Error(w, "Key version not found", http.StatusNotFound)
+		return
+	}
+
+	plainKey, err := storage.DecryptVersion(entry, version)
+	if err != nil {
+		http.Error(w, "Decryption failed: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	encoded, ok := encodeKey(plainKey, version.KeyEncoding)
+	if !ok {
+		http.Error(w, "Unsupported key_encoding", http.StatusInternalServerError)
+		return
+	}
+
+	utils.Info("vault", "Get key version: id=%s user=%s version=%d", entry.ID, entry.UserID, revision)
+
+	w.Header().Set("ETag", entryETag(entry.Revision))
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{
+		"id":         entry.ID,
+		"key":        encoded,
+		"version":    version.Revision,
+		"key_type":   version.KeyType,
+		"rotated_at": version.RotatedAt,
+		"revision":   entry.Revision,
+	})
+}
+
+func encodeKey(plainKey []byte, encoding string) (string, bool) {
+	switch encoding {
+	case "hex":
+		return hex.EncodeToString(plainKey), true
+	case "string":
+		return string(plainKey), true
+	}
+	return "", false
+}
+
 type rotateRequest struct {
-	Key         string  `json:"key"`
-	KeyType     string  `json:"key_type"`     // e.g. "secp256k1", "kyber"
-	KeyEncoding string  `json:"key_encoding"` // "hex" or "string"`
+	Key         string     `json:"key"`
+	KeyType     string     `json:"key_type"`     // e.g. "secp256k1", "kyber"
+	KeyEncoding string     `json:"key_encoding"` // "hex" or "string"`
+	ExpiresAt   *time.Time `json:"expires_at"`   // optional new deadline; the current one is kept if neither is set
+	TTL         string     `json:"ttl"`
 }
+
 func RotateKeyHandler(w http.ResponseWriter, r *http.Request) {
 	id := mux.Vars(r)["id"]
 
-	// 1. Parse and decode body
+	// 1. Parse If-Match and decode body
+	ifMatch, err := parseIfMatch(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
 	var req rotateRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		http.Error(w, "Invalid JSON body", http.StatusBadRequest)
@@ -181,7 +286,6 @@ func RotateKeyHandler(w http.ResponseWriter, r *http.Request) {
 
 	// 2. Decode key based on encoding
 	var rawKey []byte
-	var err error
 	switch req.KeyEncoding {
 	case "hex":
 		rawKey, err = hex.DecodeString(req.Key)
@@ -202,68 +306,131 @@ func RotateKeyHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	expiresAt, err := resolveExpiry(req.ExpiresAt, req.TTL)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
 	// 4. Get current mode
-	mode, err := storage.GetCryptoMode()
+	tenant := middleware.GetTenantFromContext(r)
+	mode, err := storage.GetCryptoMode(tenant)
 	if err != nil {
 		http.Error(w, "Could not determine current crypto mode", http.StatusInternalServerError)
 		return
 	}
 
-	// 5. Encrypt new key
-	entry, err := storage.GetKey(id)
-	if err != nil {
+	// 5. Encrypt new key and swap it in, within one transaction
+	caller := middleware.GetCallerFromContext(r)
+	entry, err := storage.UpdateEntry(tenant, id, caller, models.OpRotate, ifMatch, func(entry *models.VaultEntry) error {
+		// Expired entries cannot be revived by rotating them
+		if entry.IsTombstone() || entry.IsExpired(utils.Now()) {
+			return storage.ErrExpired
+		}
+		if expiresAt != nil {
+			entry.ExpiresAt = expiresAt
+			entry.ExpiryNotified = false
+		}
+
+		// Entries pinned by a targeted re-encryption keep their own mode and parameter set
+		mode, params := mode, ""
+		if entry.ModePinned {
+			mode = models.CryptoMode(entry.CryptoMode)
+			params = entry.CryptoParams
+		}
+
+		// Keep the outgoing key as a version; storage drops it again, or the oldest
+		// one, unless the owner may retain one more
+		entry.Versions = append(entry.Versions, models.KeyVersion{
+			Revision:    entry.Revision,
+			KeyType:     entry.KeyType,
+			KeyEncoding: entry.KeyEncoding,
+			RotatedAt:   utils.Now(),
+			Envelope:    entry.Envelope,
+		})
+		entry.KeyType = req.KeyType
+		entry.KeyEncoding = req.KeyEncoding
+
+		// Only the owner's own key signs in as the owner
+		if !entry.IsOwner(caller) || !models.IsSignInKeyType(entry.KeyType) {
+			entry.SignIn = false
+		}
+		return storage.EncryptEntry(entry, mode, params, rawKey)
+	})
+	var quotaErr *models.QuotaError
+	switch {
+	case errors.Is(err, storage.ErrNotFound):
 		http.Error(w, "Vault entry not found", http.StatusNotFound)
 		return
+	case errors.As(err, &quotaErr):
+		http.Error(w, quotaErr.Error(), http.StatusForbidden)
+		return
+	case errors.Is(err, storage.ErrExpired):
+		http.Error(w, "Vault entry expired", http.StatusGone)
+		return
+	case errors.Is(err, storage.ErrRevisionMismatch):
+		http.Error(w, "Vault entry was modified, fetch it again and retry", http.StatusPreconditionFailed)
+		return
+	case err != nil:
+		http.Error(w, "Failed to rotate key: "+err.Error(), http.StatusInternalServerError)
+		return
 	}
 
-	switch mode {
-	case models.ClassicalMode:
-		entry.Ciphertext,
-			entry.Nonce,
-			entry.EncryptedEphemeralPrivKey,
-			entry.EphemeralPrivNonce,
-			entry.EphemeralPubKey,
-			err = crypto.EncryptWithEphemeralECC(rawKey)
-
-		// clear kyber fields
-		entry.KyberPubKey = nil
-		entry.KyberCiphertext = nil
-		entry.EncryptedKyberPrivKey = nil
-		entry.KyberPrivNonce = nil
-
-	case models.QuantumSafeMode:
-		entry.Ciphertext,
-			entry.Nonce,
-			entry.KyberCiphertext,
-			entry.EncryptedKyberPrivKey,
-			entry.KyberPrivNonce,
-			entry.KyberPubKey,
-			err = crypto.EncryptWithEphemeralKyber(rawKey)
-
-		// clear classical fields
-		entry.EphemeralPubKey = nil
-		entry.EncryptedEphemeralPrivKey = nil
-		entry.EphemeralPrivNonce = nil
+	utils.Info("vault", "Rotated key: id=%s user=%s revision=%d", id, entry.UserID, entry.Revision)
 
-	default:
-		http.Error(w, "Unsupported crypto mode", http.StatusInternalServerError)
+	w.Header().Set("ETag", entryETag(entry.Revision))
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"message":  "Key rotated successfully",
+		"id":       entry.ID,
+		"revision": entry.Revision,
+	})
+}
+
+// DeleteKeyVersionHandler discards a retained key version, freeing quota
+func DeleteKeyVersionHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id := vars["id"]
+
+	// 1. Parse revision and If-Match
+	revision, err := strconv.ParseUint(vars["revision"], 10, 64)
+	if err != nil {
+		http.Error(w, "revision must be a number", http.StatusBadRequest)
 		return
 	}
+	ifMatch, err := parseIfMatch(r)
 	if err != nil {
-		http.Error(w, "Encryption failed: "+err.Error(), http.StatusInternalServerError)
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	// 6. Update vault entry in DB
-	if err := storage.UpdateVaultEntry(id, &entry); err != nil {
-		http.Error(w, "Failed to rotate key", http.StatusInternalServerError)
+	// 2. Drop the version in one transaction
+	entry, err := storage.UpdateEntry(middleware.GetTenantFromContext(r), id, middleware.GetCallerFromContext(r), models.OpUpdate, ifMatch, func(entry *models.VaultEntry) error {
+		for i := range entry.Versions {
+			if entry.Versions[i].Revision == revision {
+				entry.Versions = append(entry.Versions[:i], entry.Versions[i+1:]...)
+				return nil
+			}
+		}
+		return storage.ErrNotFound
+	})
+	switch {
+	case errors.Is(err, storage.ErrNotFound):
+		http.Error(w, "Key version not found", http.StatusNotFound)
+		return
+	case errors.Is(err, storage.ErrRevisionMismatch):
+		http.Error(w, "Vault entry was modified, fetch it again and retry", http.StatusPreconditionFailed)
+		return
+	case err != nil:
+		http.Error(w, "Failed to delete version: "+err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	utils.Info("vault", "Rotated key: id=%s user=%s", id, entry.UserID)
+	utils.Info("vault", "Deleted key version: id=%s user=%s version=%d", id, entry.UserID, revision)
 
-	json.NewEncoder(w).Encode(map[string]string{
-		"message": "Key rotated successfully",
-		"id":      entry.ID,
+	w.Header().Set("ETag", entryETag(entry.Revision))
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"id":       entry.ID,
+		"revision": entry.Revision,
+		"versions": len(entry.Versions),
 	})
 }
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+const testKey = "0279be667ef9dcbbac55a06295ce870b07029bfcdb2dce28d959f2815b16f81798"
+
+// storeKeys stores n copies of testKey and returns their IDs
+func storeKeys(t *testing.T, v *vaultProcess, token string, n int) []string {
+	t.Helper()
+	key := map[string]string{"key": testKey, "key_type": "secp256k1", "key_encoding": "hex"}
+	var ids []string
+	for i := 0; i < n; i++ {
+		var stored struct {
+			ID string `json:"id"`
+		}
+		if status := v.call(t, "POST", "/vault/store", token, key, &stored); status != http.StatusCreated {
+			t.Fatalf("store: status %d", status)
+		}
+		ids = append(ids, stored.ID)
+	}
+	return ids
+}
+
+// pending returns how many entries are not yet in the tenant's crypto mode
+func pending(t *testing.T, v *vaultProcess, token string) int {
+	t.Helper()
+	var stats struct {
+		Pending int `json:"pending"`
+	}
+	if status := v.call(t, "GET", "/vault/stats", token, nil, &stats); status != http.StatusOK {
+		t.Fatalf("stats: status %d", status)
+	}
+	return stats.Pending
+}
+
+// switchLazily switches the tenant to the quantum-safe mode with lazy migration
+func switchLazily(t *testing.T, v *vaultProcess, token string) {
+	t.Helper()
+	req := map[string]string{"mode": "quantum-safe", "migration": "lazy"}
+	if status := v.call(t, "POST", "/vault/set-mode", token, req, nil); status != http.StatusOK {
+		t.Fatalf("set-mode: status %d", status)
+	}
+}
+
+// TestLazyMigrationOnRead checks that with lazy migration an entry is read
+// under its old mode and rewritten under the new one, and others are left alone
+func TestLazyMigrationOnRead(t *testing.T) {
+	vault := startVault(t, t.TempDir(), "vault")
+	admin := vault.token(t)
+	ids := storeKeys(t, vault, admin, 2)
+
+	switchLazily(t, vault, admin)
+	if n := pending(t, vault, admin); n != 2 {
+		t.Fatalf("pending after the switch: %d, want 2", n)
+	}
+
+	var read struct {
+		Key string `json:"key"`
+	}
+	if status := vault.call(t, "GET", "/vault/retrive/"+ids[0], admin, nil, &read); status != http.StatusOK {
+		t.Fatalf("read: status %d", status)
+	}
+	if read.Key != testKey {
+		t.Fatalf("read key %q, want %q", read.Key, testKey)
+	}
+	if n := pending(t, vault, admin); n != 1 {
+		t.Fatalf("pending after one read: %d, want 1", n)
+	}
+}
+
+// TestLazySweep checks that the sweeper migrates entries nobody reads, one
+// batch at a time
+func TestLazySweep(t *testing.T) {
+	vault := startVault(t, t.TempDir(), "vault", "LAZY_SWEEP_INTERVAL=200ms", "LAZY_SWEEP_BATCH=1")
+	admin := vault.token(t)
+	storeKeys(t, vault, admin, 3)
+
+	switchLazily(t, vault, admin)
+	eventually(t, 10*time.Second, "the sweep to migrate every entry", func() bool {
+		return pending(t, vault, admin) == 0
+	})
+}
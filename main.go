@@ -4,9 +4,12 @@ import (
 	"log"
 	"net/http"
 	"os"
+	"time"
 
+	"secure-vault/cli"
 	"secure-vault/handlers"
 	"secure-vault/middleware"
+	"secure-vault/models"
 	"secure-vault/storage"
 	"secure-vault/utils"
 
@@ -19,11 +22,49 @@ func main() {
 		log.Fatalf("Failed to load AES key: %v", err)
 	}
 
+	// Offline subcommands (backup, restore, fsck, compact) run instead of the server
+	if len(os.Args) > 1 {
+		if err := cli.Run(os.Args[1:]); err != nil {
+			log.Fatalf("%s failed: %v", os.Args[1], err)
+		}
+		return
+	}
+
+	// Refuse to serve with settings authentication cannot work with
+	if err := middleware.CheckConfig(); err != nil {
+		log.Fatalf("Invalid configuration: %v", err)
+	}
+
+	// A follower starts from a copy of the leader's files
+	role := utils.EnvString("REPLICATION_ROLE", models.RoleLeader)
+	if role == models.RoleFollower {
+		storage.ConfigureFollower(os.Getenv("REPLICATION_LEADER"), os.Getenv("REPLICATION_TOKEN"))
+		if err := storage.SeedFromLeader(); err != nil {
+			log.Fatalf("Failed to seed follower: %v", err)
+		}
+	}
+
 	// Init BoltDB storage
 	if err := storage.Init(); err != nil {
 		log.Fatalf("Failed to init storage: %v", err)
 	}
 
+	// Create the first account, which can then add the others
+	if user := os.Getenv("VAULT_ADMIN_USER"); user != "" && role != models.RoleFollower {
+		if err := storage.EnsureUser(models.DefaultTenant, user, os.Getenv("VAULT_ADMIN_PASSWORD")); err != nil {
+			log.Fatalf("Failed to create admin user: %v", err)
+		}
+	}
+
+	// Writing background jobs run on the leader only, or once a follower is promoted
+	if role == models.RoleFollower {
+		if err := storage.StartFollower(startLeaderJobs); err != nil {
+			log.Fatalf("Failed to start follower: %v", err)
+		}
+	} else {
+		startLeaderJobs()
+	}
+
 	// Create router
 	r := mux.NewRouter()
 
@@ -32,15 +73,130 @@ func main() {
 	public := r.PathPrefix("/").Subrouter()
 	public.Use(middleware.RateLimit) // optional
 	public.HandleFunc("/auth/token", handlers.GetToken).Methods("POST")
+	public.HandleFunc("/auth/apikey", handlers.ExchangeAPIKey).Methods("POST")
+	public.HandleFunc("/auth/refresh", handlers.RefreshToken).Methods("POST")
+	public.HandleFunc("/auth/challenge", handlers.GetChallenge).Methods("POST")
+	public.HandleFunc("/.well-known/jwks.json", handlers.JWKSHandler).Methods("GET")
 
 	secure := r.PathPrefix("/vault").Subrouter()
 	secure.Use(middleware.RateLimit)
 	secure.Use(middleware.RequireAuth)
-	secure.HandleFunc("/store", handlers.StoreKey).Methods("POST")
-	secure.HandleFunc("/retrive/{id}", handlers.GetKey).Methods("GET")
-	secure.HandleFunc("/set-mode", handlers.SetCryptoModeHandler).Methods("POST")
-	secure.HandleFunc("/get-mode", handlers.GetCryptoModeHandler).Methods("GET")
-	secure.HandleFunc("/rotate/{id}", handlers.RotateKeyHandler).Methods("POST")
+	secure.Use(middleware.RequireTenant)
+	secure.Use(middleware.RequireActiveUser)
+	secure.Use(middleware.RequireScope(models.ScopeVaultRead, models.ScopeVaultWrite))
+	secure.Use(middleware.RejectOnFollower)
+
+	// Changing the crypto mode re-encrypts every entry
+	modes := secure.NewRoute().Subrouter()
+	modes.Use(middleware.RequireRole(models.RoleOperator, models.RoleAdmin))
+	modes.HandleFunc("/set-mode", handlers.SetCryptoModeHandler).Methods("POST")
+	modes.HandleFunc("/set-mode/status", handlers.GetRekeyStatusHandler).Methods("GET")
+
+	entries := secure.NewRoute().Subrouter()
+	entries.Use(middleware.RequireRole(models.RoleReader, models.RoleWriter))
+	entries.HandleFunc("/store", handlers.StoreKey).Methods("POST")
+	entries.HandleFunc("/retrive/{id}", handlers.GetKey).Methods("GET")
+	entries.HandleFunc("/get-mode", handlers.GetCryptoModeHandler).Methods("GET")
+	entries.HandleFunc("/stats", handlers.GetVaultStatsHandler).Methods("GET")
+	entries.HandleFunc("/rotate/{id}", handlers.RotateKeyHandler).Methods("POST")
+	entries.HandleFunc("/versions/{id}/{revision}", handlers.DeleteKeyVersionHandler).Methods("DELETE")
+	entries.HandleFunc("/entries", handlers.ListEntriesHandler).Methods("GET")
+	entries.HandleFunc("/entries/{id}", handlers.UpdateMetadataHandler).Methods("PATCH")
+	entries.HandleFunc("/entries/{id}/grants", handlers.ListGrantsHandler).Methods("GET")
+	entries.HandleFunc("/entries/{id}/grants", handlers.CreateGrantHandler).Methods("POST")
+	entries.HandleFunc("/entries/{id}/grants/{grant}", handlers.DeleteGrantHandler).Methods("DELETE")
+
+	// Followers pull the change log; promotion is the one write a follower accepts
+	replication := r.PathPrefix("/replication").Subrouter()
+	replication.Use(middleware.RequireReplicationToken)
+	replication.HandleFunc("/seed", handlers.ReplicationSeedHandler).Methods("GET")
+	replication.HandleFunc("/log", handlers.ReplicationLogHandler).Methods("GET")
+
+	logout := r.Path("/auth/logout").Subrouter()
+	logout.Use(middleware.RateLimit)
+	logout.Use(middleware.RequireAuth)
+	logout.Use(middleware.RequireTenant)
+	logout.Use(middleware.RejectOnFollower)
+	logout.Methods("POST").HandlerFunc(handlers.Logout)
+
+	promote := r.Path("/admin/replication/promote").Subrouter()
+	promote.Use(middleware.RateLimit)
+	promote.Use(middleware.RequireAuth)
+	promote.Use(middleware.RequireTenant)
+	promote.Use(middleware.RequireActiveUser)
+	promote.Use(middleware.RequireScopeAll(models.ScopeAdmin))
+	promote.Use(middleware.RequireSystem)
+	promote.Use(middleware.RequireRoleAll(models.RoleAdmin))
+	promote.Methods("POST").HandlerFunc(handlers.PromoteHandler)
+
+	admin := r.PathPrefix("/admin").Subrouter()
+	admin.Use(middleware.RateLimit)
+	admin.Use(middleware.RequireAuth)
+	admin.Use(middleware.RequireTenant)
+	admin.Use(middleware.RequireActiveUser)
+	admin.Use(middleware.RequireScopeAll(models.ScopeAdmin))
+	admin.Use(middleware.RejectOnFollower)
+
+	// Maintenance that neither reveals nor re-keys entries
+	operations := admin.NewRoute().Subrouter()
+	operations.Use(middleware.RequireRoleAll(models.RoleOperator))
+	operations.HandleFunc("/quotas", handlers.GetTenantQuotaHandler).Methods("GET")
+	operations.HandleFunc("/quotas/{user}", handlers.GetUserQuotaHandler).Methods("GET")
+
+	// Instance-wide maintenance, for operators of the default tenant
+	systemOperations := admin.NewRoute().Subrouter()
+	systemOperations.Use(middleware.RequireSystem)
+	systemOperations.Use(middleware.RequireRoleAll(models.RoleOperator))
+	systemOperations.HandleFunc("/fsck", handlers.FsckHandler).Methods("GET")
+	systemOperations.HandleFunc("/compact", handlers.CompactHandler).Methods("POST")
+	systemOperations.HandleFunc("/replication/status", handlers.ReplicationStatusHandler).Methods("GET")
+
+	// Accounts, keys and master-key operations of the caller's tenant
+	management := admin.NewRoute().Subrouter()
+	management.Use(middleware.RequireRoleAll(models.RoleAdmin))
+	management.HandleFunc("/reencrypt", handlers.ReEncryptHandler).Methods("POST")
+	management.HandleFunc("/quotas/{user}", handlers.SetUserQuotaHandler).Methods("PUT")
+	management.HandleFunc("/quotas/{user}", handlers.DeleteUserQuotaHandler).Methods("DELETE")
+	management.HandleFunc("/users", handlers.ListUsersHandler).Methods("GET")
+	management.HandleFunc("/users", handlers.CreateUserHandler).Methods("POST")
+	management.HandleFunc("/users/{user}/role", handlers.SetUserRoleHandler).Methods("PUT")
+	management.HandleFunc("/users/{user}/groups", handlers.SetUserGroupsHandler).Methods("PUT")
+	management.HandleFunc("/users/{user}/disable", handlers.DisableUserHandler).Methods("POST")
+	management.HandleFunc("/users/{user}/enable", handlers.EnableUserHandler).Methods("POST")
+	management.HandleFunc("/users/{user}/password", handlers.ResetPasswordHandler).Methods("POST")
+	management.HandleFunc("/users/{user}/revoke-tokens", handlers.RevokeUserTokensHandler).Methods("POST")
+	management.HandleFunc("/users/{user}/shred", handlers.ShredUserHandler).Methods("POST")
+	management.HandleFunc("/service-accounts", handlers.CreateServiceAccountHandler).Methods("POST")
+	management.HandleFunc("/service-accounts/{user}/keys", handlers.ListAPIKeysHandler).Methods("GET")
+	management.HandleFunc("/service-accounts/{user}/keys", handlers.CreateAPIKeyHandler).Methods("POST")
+	management.HandleFunc("/service-accounts/{user}/keys/{id}", handlers.RevokeAPIKeyHandler).Methods("DELETE")
+
+	// Backups, tenants and token signing keys, for admins of the default tenant
+	system := admin.NewRoute().Subrouter()
+	system.Use(middleware.RequireSystem)
+	system.Use(middleware.RequireRoleAll(models.RoleAdmin))
+	system.HandleFunc("/backup", handlers.BackupHandler).Methods("GET")
+	system.HandleFunc("/tenants", handlers.ListTenantsHandler).Methods("GET")
+	system.HandleFunc("/tenants", handlers.CreateTenantHandler).Methods("POST")
+	system.HandleFunc("/jwt-keys", handlers.ListSigningKeysHandler).Methods("GET")
+	system.HandleFunc("/jwt-keys/rotate", handlers.RotateSigningKeyHandler).Methods("POST")
+
+	// Authorization policies of the caller's tenant
+	sys := r.PathPrefix("/sys").Subrouter()
+	sys.Use(middleware.RateLimit)
+	sys.Use(middleware.RequireAuth)
+	sys.Use(middleware.RequireTenant)
+	sys.Use(middleware.RequireActiveUser)
+	sys.Use(middleware.RequireScopeAll(models.ScopeAdmin))
+	sys.Use(middleware.RequireRoleAll(models.RoleAdmin))
+	sys.Use(middleware.RejectOnFollower)
+	sys.HandleFunc("/policies", handlers.ListPoliciesHandler).Methods("GET")
+	sys.HandleFunc("/policies/{name}", handlers.GetPolicyHandler).Methods("GET")
+	sys.HandleFunc("/policies/{name}", handlers.PutPolicyHandler).Methods("PUT")
+	sys.HandleFunc("/policies/{name}", handlers.DeletePolicyHandler).Methods("DELETE")
+	sys.HandleFunc("/policies/{name}/versions", handlers.ListPolicyVersionsHandler).Methods("GET")
+	sys.HandleFunc("/policy/check", handlers.CheckPolicyHandler).Methods("POST")
+
 	// Optional: Healthcheck
 	r.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
 		w.Write([]byte("ok"))
@@ -51,6 +207,31 @@ func main() {
 	if port == "" {
 		port = "8080"
 	}
-	log.Printf("Server running on http://localhost:%s", port)
-	log.Fatal(http.ListenAndServe(":"+port, r))
+	tlsConfig, err := utils.ServerTLSConfig()
+	if err != nil {
+		log.Fatalf("Failed to configure TLS: %v", err)
+	}
+	if tlsConfig == nil {
+		log.Printf("Server running on http://localhost:%s", port)
+		log.Fatal(http.ListenAndServe(":"+port, r))
+	}
+	server := &http.Server{Addr: ":" + port, Handler: r, TLSConfig: tlsConfig}
+	log.Printf("Server running on https://localhost:%s", port)
+	log.Fatal(server.ListenAndServeTLS("", ""))
+}
+
+// startLeaderJobs starts the background jobs that write to the database
+func startLeaderJobs() {
+	// Pick up a re-encryption job interrupted by a restart
+	if err := storage.ResumeRekeyJob(); err != nil {
+		log.Fatalf("Failed to resume rekey job: %v", err)
+	}
+
+	// Optional low-priority sweeper for lazy migration
+	if interval := utils.EnvDuration("LAZY_SWEEP_INTERVAL", 0); interval > 0 {
+		storage.StartLazySweeper(interval)
+	}
+
+	// Tombstone expired entries and send expiry notices
+	storage.StartExpiryReaper(utils.EnvDuration("EXPIRY_REAPER_INTERVAL", time.Minute))
 }
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestMain lets the test binary act as the vault server, so the tests can run
+// several instances as local processes
+func TestMain(m *testing.M) {
+	if os.Getenv("VAULT_TEST_SERVER") == "1" {
+		main()
+		return
+	}
+	os.Exit(m.Run())
+}
+
+const (
+	testAdmin    = "root"
+	testPassword = "correct horse battery"
+)
+
+// vaultProcess is a server started by startVault
+type vaultProcess struct {
+	url    string
+	client *http.Client // trusts the server's certificate when it serves TLS
+	log    *bytes.Buffer
+	stop   func() // kills the server; startVault's cleanup calls it too
+}
+
+// serverCommand prepares a server on a free port, or the PORT in env, with a
+// database in dir, the test master key and an admin account, plus env
+func serverCommand(t *testing.T, dir, name string, env ...string) (*exec.Cmd, int) {
+	t.Helper()
+	port := 0
+	for _, kv := range env {
+		if p, ok := strings.CutPrefix(kv, "PORT="); ok {
+			port, _ = strconv.Atoi(p)
+		}
+	}
+	if port == 0 {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		port = l.Addr().(*net.TCPAddr).Port
+		l.Close()
+	}
+
+	cmd := exec.Command(os.Args[0])
+	cmd.Env = append(os.Environ(),
+		"VAULT_TEST_SERVER=1",
+		"PRIVATE_KEY_AES="+hex.EncodeToString(bytes.Repeat([]byte{7}, 32)),
+		"VAULT_DB="+filepath.Join(dir, name+".db"),
+		fmt.Sprintf("PORT=%d", port),
+		"VAULT_ADMIN_USER="+testAdmin,
+		"VAULT_ADMIN_PASSWORD="+testPassword,
+	)
+	cmd.Env = append(cmd.Env, env...)
+	return cmd, port
+}
+
+// startFails runs a server with env that should refuse to start, and returns
+// its output, or "" if it was still running after a few seconds
+func startFails(t *testing.T, env ...string) string {
+	t.Helper()
+	cmd, _ := serverCommand(t, t.TempDir(), "vault", env...)
+	out := &bytes.Buffer{}
+	cmd.Stdout, cmd.Stderr = out, out
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	exited := make(chan struct{})
+	go func() {
+		cmd.Wait()
+		close(exited)
+	}()
+	select {
+	case <-exited:
+		return out.String()
+	case <-time.After(5 * time.Second):
+		cmd.Process.Kill()
+		<-exited
+		return ""
+	}
+}
+
+// runCommand runs an offline subcommand against the database in dir and
+// returns its output
+func runCommand(t *testing.T, dir, name string, env []string, args ...string) (string, error) {
+	t.Helper()
+	cmd, _ := serverCommand(t, dir, name, env...)
+	cmd.Args = append(cmd.Args, args...)
+	out, err := cmd.CombinedOutput()
+	return string(out), err
+}
+
+// startVault runs a server from serverCommand, over HTTPS when env names a
+// TLS_CERT_FILE, which must then be self-signed. It is stopped with the test.
+func startVault(t *testing.T, dir, name string, env ...string) *vaultProcess {
+	t.Helper()
+	cmd, port := serverCommand(t, dir, name, env...)
+	v := &vaultProcess{url: fmt.Sprintf("http://127.0.0.1:%d", port), client: http.DefaultClient, log: &bytes.Buffer{}}
+	for _, kv := range env {
+		if certFile, ok := strings.CutPrefix(kv, "TLS_CERT_FILE="); ok {
+			pem, err := os.ReadFile(certFile)
+			if err != nil {
+				t.Fatal(err)
+			}
+			roots := x509.NewCertPool()
+			roots.AppendCertsFromPEM(pem)
+			v.url = fmt.Sprintf("https://127.0.0.1:%d", port)
+			v.client = &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots}}}
+		}
+	}
+	cmd.Stdout, cmd.Stderr = v.log, v.log
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	var once sync.Once
+	v.stop = func() {
+		once.Do(func() {
+			cmd.Process.Kill()
+			cmd.Wait()
+		})
+	}
+	t.Cleanup(func() {
+		v.stop()
+		if t.Failed() {
+			t.Logf("%s log:\n%s", name, v.log)
+		}
+	})
+
+	eventually(t, 10*time.Second, name+" to start", func() bool {
+		resp, err := v.client.Get(v.url + "/healthz")
+		if err != nil {
+			return false
+		}
+		resp.Body.Close()
+		return resp.StatusCode == http.StatusOK
+	})
+	return v
+}
+
+// withCert returns v for requests presenting the client certificate cert
+func (v *vaultProcess) withCert(cert tls.Certificate) *vaultProcess {
+	config := v.client.Transport.(*http.Transport).TLSClientConfig.Clone()
+	config.Certificates = []tls.Certificate{cert}
+	withCert := *v
+	withCert.client = &http.Client{Transport: &http.Transport{TLSClientConfig: config}}
+	return &withCert
+}
+
+// call sends a JSON request, decodes a successful answer into out, if given
+// (a *[]byte takes it as is), and returns the status. Requests refused by the rate limiter are retried.
+func (v *vaultProcess) call(t *testing.T, method, path, token string, body, out interface{}) int {
+	t.Helper()
+	status, _ := v.request(t, method, path, token, nil, body, out)
+	return status
+}
+
+// request is call with extra request headers, also returning the response headers
+func (v *vaultProcess) request(t *testing.T, method, path, token string, header http.Header, body, out interface{}) (int, http.Header) {
+	t.Helper()
+	var data []byte
+	if body != nil {
+		var err error
+		if data, err = json.Marshal(body); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for {
+		req, err := http.NewRequest(method, v.url+path, bytes.NewReader(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for k, values := range header {
+			req.Header[k] = values
+		}
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := v.client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		raw, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode == http.StatusTooManyRequests && strings.HasPrefix(string(raw), "Too many requests") {
+			time.Sleep(time.Second)
+			continue
+		}
+		if body, ok := out.(*[]byte); ok && resp.StatusCode < 300 {
+			*body = raw
+		} else if out != nil && resp.StatusCode < 300 {
+			if err := json.Unmarshal(raw, out); err != nil {
+				t.Fatalf("%s %s: %v in %s", method, path, err, raw)
+			}
+		}
+		return resp.StatusCode, resp.Header
+	}
+}
+
+// token signs in as the admin account
+func (v *vaultProcess) token(t *testing.T) string {
+	t.Helper()
+	var resp struct {
+		Token string `json:"token"`
+	}
+	if status := v.call(t, "POST", "/auth/token", "", map[string]string{"user_id": testAdmin, "password": testPassword}, &resp); status != http.StatusOK {
+		t.Fatalf("sign-in: status %d", status)
+	}
+	return resp.Token
+}
+
+// user creates an account with role (the default one when empty) and signs in as it
+func (v *vaultProcess) user(t *testing.T, admin, userID, role string) string {
+	t.Helper()
+	account := map[string]string{"user_id": userID, "password": testPassword, "role": role}
+	if status := v.call(t, "POST", "/admin/users", admin, account, nil); status != http.StatusCreated {
+		t.Fatalf("create %s: status %d", userID, status)
+	}
+	var resp struct {
+		Token string `json:"token"`
+	}
+	if status := v.call(t, "POST", "/auth/token", "", map[string]string{"user_id": userID, "password": testPassword}, &resp); status != http.StatusOK {
+		t.Fatalf("sign-in as %s: status %d", userID, status)
+	}
+	return resp.Token
+}
+
+// eventually polls cond until it holds, failing the test after timeout
+func eventually(t *testing.T, timeout time.Duration, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(timeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
@@ -2,27 +2,174 @@ package middleware
 
 import (
 	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"math"
 	"net/http"
 	"os"
+	"secure-vault/models"
+	"secure-vault/storage"
 	"secure-vault/utils"
 	"strings"
+	"time"
 
 	"github.com/golang-jwt/jwt/v5"
 )
 
 type contextKey string
 
-const ContextUserID contextKey = "user_id"
+const (
+	ContextUserID contextKey = "user_id"
+	ContextTenant contextKey = "tenant"
+	ContextScopes contextKey = "scopes"
+	ContextRoles  contextKey = "roles"
+	ContextIssuer contextKey = "issuer"
+	ContextClaims contextKey = "claims"
+	ContextGroups contextKey = "groups"
+)
 
-// JWTMiddleware validates JWT tokens and attaches user info to the request context
-func RequireAuth(next http.Handler) http.Handler {
-	secret := os.Getenv("JWT_SECRET")
-	if secret == "" {
-		panic("JWT_SECRET is not set in environment")
+// TenantClaim names the JWT claim holding the caller's tenant (TENANT_CLAIM, default "tenant")
+var TenantClaim = utils.EnvString("TENANT_CLAIM", "tenant")
+
+// ScopeClaim holds the space-separated scopes of tokens traded for an API key
+const ScopeClaim = "scope"
+
+// SignToken signs claims with the current signing key, naming it in the kid
+// header. With JWT_SIGNING_ALG=HS256 tokens are signed with JWT_SECRET instead.
+// Every token gets a jti and iat, so it can be revoked on its own or with all
+// of its user's tokens.
+func SignToken(claims jwt.MapClaims) (string, error) {
+	jti := make([]byte, 16)
+	if _, err := rand.Read(jti); err != nil {
+		return "", err
+	}
+	claims["jti"] = hex.EncodeToString(jti)
+	claims["iat"] = float64(time.Now().UnixMilli()) / 1000 // to the millisecond, see revoked
+
+	if storage.SigningAlgorithm() == models.AlgHS256 {
+		secret := os.Getenv("JWT_SECRET")
+		if secret == "" {
+			return "", errors.New("JWT_SECRET not set")
+		}
+		return jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte(secret))
+	}
+	kid, signer, err := storage.CurrentSigningKey()
+	if err != nil {
+		return "", err
+	}
+	token := jwt.NewWithClaims(jwt.GetSigningMethod(storage.SigningAlgorithm()), claims)
+	token.Header["kid"] = kid
+	return token.SignedString(signer)
+}
+
+// secretAcceptedUntil reads JWT_SECRET_ACCEPT_UNTIL, an RFC 3339 time until
+// which tokens signed with JWT_SECRET are still accepted after switching to
+// signing keys. Zero when unset.
+func secretAcceptedUntil() (time.Time, error) {
+	v := os.Getenv("JWT_SECRET_ACCEPT_UNTIL")
+	if v == "" {
+		return time.Time{}, nil
+	}
+	until, err := time.Parse(time.RFC3339, v)
+	if err != nil {
+		return time.Time{}, errors.New("JWT_SECRET_ACCEPT_UNTIL is not an RFC 3339 time")
+	}
+	return until, nil
+}
+
+// acceptsSecret reports whether HS256 tokens are accepted: when they are what
+// the vault signs, or until JWT_SECRET_ACCEPT_UNTIL
+func acceptsSecret() bool {
+	if storage.SigningAlgorithm() == models.AlgHS256 {
+		return true
+	}
+	until, err := secretAcceptedUntil()
+	return err == nil && time.Now().Before(until)
+}
+
+// checkJWTConfig checks that JWT_SECRET is set where HS256 tokens are signed
+// or accepted
+func checkJWTConfig() error {
+	until, err := secretAcceptedUntil()
+	if err != nil {
+		return err
+	}
+	if os.Getenv("JWT_SECRET") != "" {
+		return nil
 	}
+	if storage.SigningAlgorithm() == models.AlgHS256 {
+		return errors.New("JWT_SIGNING_ALG=HS256 needs JWT_SECRET")
+	}
+	if !until.IsZero() {
+		return errors.New("JWT_SECRET_ACCEPT_UNTIL needs JWT_SECRET")
+	}
+	return nil
+}
+
+// verificationKey picks the key a token was signed with: a signing key by its
+// kid, or JWT_SECRET for HS256 tokens while they are accepted
+func verificationKey(secret string) jwt.Keyfunc {
+	return func(token *jwt.Token) (interface{}, error) {
+		if _, ok := token.Method.(*jwt.SigningMethodHMAC); ok {
+			if secret == "" || !acceptsSecret() {
+				return nil, jwt.ErrTokenUnverifiable
+			}
+			return []byte(secret), nil
+		}
+		kid, _ := token.Header["kid"].(string)
+		alg, key, err := storage.VerificationKey(kid)
+		if err != nil {
+			return nil, err
+		}
+		// The key decides the algorithm, not the token
+		if alg != token.Method.Alg() {
+			return nil, jwt.ErrTokenSignatureInvalid
+		}
+		return key, nil
+	}
+}
+
+// CheckConfig reports settings authentication cannot work with, for main to
+// refuse to start
+func CheckConfig() error {
+	for _, check := range []func() error{checkJWTConfig, checkOIDCConfig, checkMTLSConfig, storage.CheckChallengeConfig} {
+		if err := check(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
 
+// JWTMiddleware validates JWT tokens, or API keys sent as "ApiKey <key>", and
+// attaches user info to the request context. CheckConfig must have passed.
+func RequireAuth(next http.Handler) http.Handler {
+	secret := os.Getenv("JWT_SECRET")
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		authHeader := r.Header.Get("Authorization")
+		if strings.HasPrefix(authHeader, "ApiKey ") {
+			key, err := storage.AuthenticateAPIKey(strings.TrimPrefix(authHeader, "ApiKey "))
+			if err != nil {
+				http.Error(w, "Invalid or expired API key", http.StatusUnauthorized)
+				return
+			}
+			utils.Info("auth", "Authenticated service account: %s (key %s)", key.ServiceAccount, key.ID)
+			next.ServeHTTP(w, r.WithContext(withCaller(r.Context(), key.ServiceAccount, key.Tenant, append([]string{}, key.Scopes...))))
+			return
+		}
+		// A verified client certificate stands in for a token
+		if cert := clientCert(r); cert != nil && authHeader == "" {
+			ctx, err := certCaller(r.Context(), cert)
+			if err != nil {
+				utils.Warn("auth", "Certificate %s refused: %v", cert.Subject, err)
+				http.Error(w, "Client certificate names no vault identity", http.StatusUnauthorized)
+				return
+			}
+			r = r.WithContext(ctx)
+			utils.Info("auth", "Authenticated workload: %s (certificate %s)", GetUserIDFromContext(r), cert.SerialNumber)
+			next.ServeHTTP(w, r)
+			return
+		}
 		if !strings.HasPrefix(authHeader, "Bearer ") {
 			http.Error(w, "Missing or invalid Authorization header", http.StatusUnauthorized)
 			return
@@ -30,13 +177,36 @@ func RequireAuth(next http.Handler) http.Handler {
 
 		tokenString := strings.TrimPrefix(authHeader, "Bearer ")
 
-		token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
-			// Validate signing method
-			if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-				return nil, jwt.ErrTokenMalformed
+		// Tokens of a configured identity provider
+		if p := oidcProviderFor(tokenString); p != nil {
+			claims, err := p.verify(tokenString)
+			if err != nil {
+				utils.Warn("auth", "Token of %s refused: %v", p.issuer, err)
+				http.Error(w, "Invalid or expired token", http.StatusUnauthorized)
+				return
 			}
-			return []byte(secret), nil
-		})
+			ctx, err := oidcCaller(r.Context(), p, claims)
+			if err != nil {
+				utils.Warn("auth", "Token of %s refused: %v", p.issuer, err)
+				http.Error(w, "Invalid token claims", http.StatusUnauthorized)
+				return
+			}
+			r = r.WithContext(context.WithValue(ctx, ContextClaims, claims))
+			if !boundToCaller(r, claims) {
+				http.Error(w, "Token is bound to another client certificate", http.StatusUnauthorized)
+				return
+			}
+			if revoked(r, claims) {
+				http.Error(w, "Token revoked", http.StatusUnauthorized)
+				return
+			}
+			utils.Info("auth", "Authenticated user: %s (issuer %s)", GetUserIDFromContext(r), p.issuer)
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		token, err := jwt.Parse(tokenString, verificationKey(secret),
+			jwt.WithValidMethods([]string{models.AlgEdDSA, models.AlgES256, models.AlgRS256, models.AlgHS256}))
 
 		if err != nil || !token.Valid {
 			http.Error(w, "Invalid or expired token", http.StatusUnauthorized)
@@ -52,14 +222,99 @@ func RequireAuth(next http.Handler) http.Handler {
 		// Optional: extract user ID
 		utils.Info("auth", "Authenticated user: %s", claims["sub"])
 		userID, _ := claims["sub"].(string)
-		ctx := context.WithValue(r.Context(), ContextUserID, userID)
-		next.ServeHTTP(w, r.WithContext(ctx))
+
+		// Tokens without a tenant claim belong to the default tenant
+		tenant, _ := claims[TenantClaim].(string)
+		if tenant == "" {
+			tenant = models.DefaultTenant
+		}
+		if err := models.ValidateTenantName(tenant); err != nil {
+			http.Error(w, "Invalid tenant claim", http.StatusUnauthorized)
+			return
+		}
+
+		// Tokens of users have no scope claim and are not limited by scopes
+		var scopes []string
+		if scope, ok := claims[ScopeClaim].(string); ok {
+			scopes = strings.Fields(scope)
+		}
+
+		r = r.WithContext(context.WithValue(withCaller(r.Context(), userID, tenant, scopes), ContextClaims, claims))
+		if !boundToCaller(r, claims) {
+			http.Error(w, "Token is bound to another client certificate", http.StatusUnauthorized)
+			return
+		}
+		if revoked(r, claims) {
+			http.Error(w, "Token revoked", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
 	})
 }
 
+// revoked reports whether the caller's token, its session or all tokens of
+// its user were revoked. The iat is read to the millisecond: GetIssuedAt
+// would round it down to the second, voiding tokens issued right after a
+// cutoff.
+func revoked(r *http.Request, claims jwt.MapClaims) bool {
+	jti, _ := claims["jti"].(string)
+	sid, _ := claims["sid"].(string)
+	var issuedAt time.Time
+	if iat, ok := claims["iat"].(float64); ok {
+		issuedAt = time.UnixMilli(int64(math.Round(iat * 1000)))
+	}
+	return storage.TokenRevoked(GetTenantFromContext(r), GetUserIDFromContext(r), jti, sid, issuedAt)
+}
+
+func withCaller(ctx context.Context, userID, tenant string, scopes []string) context.Context {
+	ctx = context.WithValue(ctx, ContextUserID, userID)
+	ctx = context.WithValue(ctx, ContextTenant, tenant)
+	return context.WithValue(ctx, ContextScopes, scopes)
+}
+
 func GetUserIDFromContext(r *http.Request) string {
 	if val, ok := r.Context().Value(ContextUserID).(string); ok {
 		return val
 	}
 	return ""
 }
+
+// GetScopesFromContext returns the caller's scopes; nil means unrestricted
+func GetScopesFromContext(r *http.Request) []string {
+	scopes, _ := r.Context().Value(ContextScopes).([]string)
+	return scopes
+}
+
+// GetClaimsFromContext returns the claims of the caller's token, or nil for API keys
+func GetClaimsFromContext(r *http.Request) jwt.MapClaims {
+	claims, _ := r.Context().Value(ContextClaims).(jwt.MapClaims)
+	return claims
+}
+
+// GetRolesFromContext returns the caller's roles, from the user store or an identity provider
+func GetRolesFromContext(r *http.Request) []string {
+	roles, _ := r.Context().Value(ContextRoles).([]string)
+	return roles
+}
+
+// GetCallerFromContext returns the caller's user ID, groups and roles, for
+// checking access to entries
+func GetCallerFromContext(r *http.Request) models.Caller {
+	groups, _ := r.Context().Value(ContextGroups).([]string)
+	return models.Caller{UserID: GetUserIDFromContext(r), Groups: groups, Roles: GetRolesFromContext(r)}
+}
+
+// GetIssuerFromContext returns the identity provider of the caller, or "" for
+// callers authenticated by the vault
+func GetIssuerFromContext(r *http.Request) string {
+	issuer, _ := r.Context().Value(ContextIssuer).(string)
+	return issuer
+}
+
+// GetTenantFromContext returns the caller's tenant
+func GetTenantFromContext(r *http.Request) string {
+	if val, ok := r.Context().Value(ContextTenant).(string); ok {
+		return val
+	}
+	return models.DefaultTenant
+}
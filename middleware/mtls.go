@@ -0,0 +1,173 @@
+package middleware
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+
+	"secure-vault/models"
+	"secure-vault/utils"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Verified client certificates identify callers without a token. The caller is
+// taken from one certificate field (MTLS_USER_FIELD: uri, dns or email SANs,
+// or the subject's cn). MTLS_USER_PATTERN, a regular expression, may pick the
+// user and the tenant out of the field with the named groups "user" and
+// "tenant", e.g. ^spiffe://mesh/ns/(?P<tenant>[^/]+)/sa/(?P<user>[^/]+)$;
+// without it the whole value is the user ID of the default tenant. The user
+// must have an account, like any caller authenticated by the vault.
+//
+// With MTLS_BIND_TOKENS, tokens issued to a caller presenting a certificate
+// carry its SHA-256 thumbprint (cnf.x5t#S256, RFC 8705), and are only accepted
+// over a connection presenting the same certificate.
+const (
+	CertFieldURI   = "uri"
+	CertFieldDNS   = "dns"
+	CertFieldEmail = "email"
+	CertFieldCN    = "cn"
+)
+
+var (
+	mtlsUserField  = utils.EnvString("MTLS_USER_FIELD", CertFieldURI)
+	mtlsBindTokens = utils.EnvBool("MTLS_BIND_TOKENS", false)
+
+	// mtlsPatternErr is reported by checkMTLSConfig
+	mtlsUserRegexp, mtlsPatternErr = compileUserPattern(utils.EnvString("MTLS_USER_PATTERN", ""))
+)
+
+// thumbprintClaim names the thumbprint inside the cnf claim
+const thumbprintClaim = "x5t#S256"
+
+var errNoCertIdentity = errors.New("certificate names no vault identity")
+
+func compileUserPattern(pattern string) (*regexp.Regexp, error) {
+	if pattern == "" {
+		return nil, nil
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, fmt.Errorf("invalid MTLS_USER_PATTERN: %w", err)
+	}
+	if re.SubexpIndex("user") < 0 {
+		return nil, errors.New("MTLS_USER_PATTERN needs a (?P<user>...) group")
+	}
+	return re, nil
+}
+
+// checkMTLSConfig reports a certificate field or pattern RequireAuth cannot use
+func checkMTLSConfig() error {
+	if mtlsPatternErr != nil {
+		return mtlsPatternErr
+	}
+	switch mtlsUserField {
+	case CertFieldURI, CertFieldDNS, CertFieldEmail, CertFieldCN:
+		return nil
+	}
+	return fmt.Errorf("MTLS_USER_FIELD must be %s, %s, %s or %s", CertFieldURI, CertFieldDNS, CertFieldEmail, CertFieldCN)
+}
+
+// clientCert returns the client certificate of the connection once the TLS
+// handshake verified it against a client CA bundle
+func clientCert(r *http.Request) *x509.Certificate {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.PeerCertificates) == 0 {
+		return nil
+	}
+	return r.TLS.PeerCertificates[0]
+}
+
+// certThumbprint is the base64url SHA-256 of the certificate's DER encoding
+func certThumbprint(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.Raw)
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// certFieldValues returns the values of the configured field
+func certFieldValues(cert *x509.Certificate) []string {
+	switch mtlsUserField {
+	case CertFieldURI:
+		values := make([]string, 0, len(cert.URIs))
+		for _, u := range cert.URIs {
+			values = append(values, u.String())
+		}
+		return values
+	case CertFieldDNS:
+		return cert.DNSNames
+	case CertFieldEmail:
+		return cert.EmailAddresses
+	case CertFieldCN:
+		if cert.Subject.CommonName != "" {
+			return []string{cert.Subject.CommonName}
+		}
+	}
+	return nil
+}
+
+// certIdentity maps a certificate to a user and tenant: the first value of
+// the field that MTLS_USER_PATTERN matches
+func certIdentity(cert *x509.Certificate) (userID, tenant string, err error) {
+	for _, v := range certFieldValues(cert) {
+		userID, tenant = v, ""
+		if mtlsUserRegexp != nil {
+			m := mtlsUserRegexp.FindStringSubmatch(v)
+			if m == nil {
+				continue
+			}
+			userID = m[mtlsUserRegexp.SubexpIndex("user")]
+			if i := mtlsUserRegexp.SubexpIndex("tenant"); i >= 0 {
+				tenant = m[i]
+			}
+		}
+		if tenant == "" {
+			tenant = models.DefaultTenant
+		}
+		if err := models.ValidateUserID(userID); err != nil {
+			return "", "", err
+		}
+		if err := models.ValidateTenantName(tenant); err != nil {
+			return "", "", err
+		}
+		return userID, tenant, nil
+	}
+	return "", "", errNoCertIdentity
+}
+
+// certCaller attaches the identity of a client certificate to the request.
+// Certificates carry no scopes.
+func certCaller(ctx context.Context, cert *x509.Certificate) (context.Context, error) {
+	userID, tenant, err := certIdentity(cert)
+	if err != nil {
+		return nil, err
+	}
+	return withCaller(ctx, userID, tenant, nil), nil
+}
+
+// BindToken adds the thumbprint of the caller's client certificate to claims
+// when MTLS_BIND_TOKENS is on and the caller presented one
+func BindToken(r *http.Request, claims jwt.MapClaims) {
+	if cert := clientCert(r); cert != nil && mtlsBindTokens {
+		claims["cnf"] = map[string]interface{}{thumbprintClaim: certThumbprint(cert)}
+	}
+}
+
+// boundToCaller reports whether a token bound to a certificate came over a
+// connection presenting that certificate. Unbound tokens always pass.
+func boundToCaller(r *http.Request, claims jwt.MapClaims) bool {
+	cnf, ok := claims["cnf"].(map[string]interface{})
+	if !ok {
+		return true
+	}
+	want, ok := cnf[thumbprintClaim].(string)
+	if !ok {
+		return true
+	}
+	cert := clientCert(r)
+	return cert != nil && subtle.ConstantTimeCompare([]byte(certThumbprint(cert)), []byte(want)) == 1
+}
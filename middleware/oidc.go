@@ -0,0 +1,427 @@
+package middleware
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"math/big"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"secure-vault/models"
+	"secure-vault/utils"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Tokens whose iss claim names one of OIDC_ISSUERS are verified against that
+// provider's published keys instead of the vault's own. The provider is found
+// through its discovery document; its JWKS is cached and fetched again after
+// OIDC_JWKS_REFRESH, or sooner when a token names an unknown kid. Each issuer
+// has a name, given as name=issuer or else its host, and its users and groups
+// are known as "<name>:<user>" and "<name>:<group>", apart from the vault's
+// accounts and other providers'. Tenants and roles are never taken from a
+// token as they are: OIDC_TENANTS and OIDC_ROLES map the values each provider
+// may send to the vault's, and a tenant that is not mapped is refused.
+var (
+	oidcAudiences   = splitList(os.Getenv("OIDC_AUDIENCE"))
+	oidcUserClaim   = utils.EnvString("OIDC_USER_CLAIM", "sub")
+	oidcTenantClaim = utils.EnvString("OIDC_TENANT_CLAIM", TenantClaim)
+	oidcRolesClaim  = utils.EnvString("OIDC_ROLES_CLAIM", "roles")
+	oidcGroupsClaim = utils.EnvString("OIDC_GROUPS_CLAIM", "groups")
+	oidcJWKSRefresh = utils.EnvDuration("OIDC_JWKS_REFRESH", time.Hour)
+	oidcLeeway      = utils.EnvDuration("OIDC_CLOCK_SKEW", time.Minute)
+)
+
+// A token with an unknown kid triggers a fetch at most this often
+const oidcMinRefresh = 30 * time.Second
+
+var oidcMethods = []string{"RS256", "RS384", "RS512", "PS256", "PS384", "PS512", "ES256", "ES384", "ES512", "EdDSA"}
+
+var oidcClient = &http.Client{Timeout: 10 * time.Second}
+
+// oidcProviders maps issuers to providers; oidcIssuersErr is reported by checkOIDCConfig
+var oidcProviders, oidcIssuersErr = loadProviders(
+	splitList(os.Getenv("OIDC_ISSUERS")),
+	splitList(os.Getenv("OIDC_TENANTS")),
+	splitList(os.Getenv("OIDC_ROLES")),
+)
+
+type oidcProvider struct {
+	issuer string
+	name   string // prefix of its users' IDs and groups
+
+	// Claim values mapped to the vault's tenants and roles; "" maps every user
+	tenants map[string]string
+	roles   map[string]string
+
+	mu        sync.Mutex
+	jwksURI   string
+	keys      map[string]jwkKey
+	fetchedAt time.Time
+	triedAt   time.Time
+}
+
+func splitList(s string) []string {
+	var out []string
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			out = append(out, v)
+		}
+	}
+	return out
+}
+
+// loadProviders names each issuer of OIDC_ISSUERS and maps its tenants and
+// roles. Two issuers on one host must be named explicitly, so their users stay
+// apart.
+func loadProviders(issuers, tenants, roles []string) (map[string]*oidcProvider, error) {
+	providers := map[string]*oidcProvider{}
+	named := map[string]*oidcProvider{}
+	for _, v := range issuers {
+		name, iss, ok := strings.Cut(v, "=")
+		if !ok || strings.Contains(name, "://") {
+			iss = v
+			u, err := url.Parse(iss)
+			if err != nil || u.Hostname() == "" {
+				return nil, fmt.Errorf("OIDC_ISSUERS: %q is not an issuer URL", iss)
+			}
+			name = strings.ToLower(u.Hostname())
+		}
+		if err := models.ValidateProviderName(name); err != nil {
+			return nil, fmt.Errorf("OIDC_ISSUERS: %s: %w", iss, err)
+		}
+		if other, ok := named[name]; ok {
+			return nil, fmt.Errorf("OIDC_ISSUERS: %s and %s are both named %q; name them as name=issuer", other.issuer, iss, name)
+		}
+		if providers[iss] != nil {
+			return nil, fmt.Errorf("OIDC_ISSUERS: %s is listed twice", iss)
+		}
+		p := &oidcProvider{issuer: iss, name: name, tenants: map[string]string{}, roles: map[string]string{}}
+		named[name] = p
+		providers[iss] = p
+	}
+
+	if err := mapClaimValues("OIDC_TENANTS", tenants, named, models.ValidateTenantName, func(p *oidcProvider) map[string]string { return p.tenants }); err != nil {
+		return nil, err
+	}
+	if err := mapClaimValues("OIDC_ROLES", roles, named, models.ValidateRole, func(p *oidcProvider) map[string]string { return p.roles }); err != nil {
+		return nil, err
+	}
+	for _, name := range slices.Sorted(maps.Keys(named)) {
+		if len(named[name].tenants) == 0 {
+			return nil, fmt.Errorf("OIDC_TENANTS maps no tenant for %s; add %s=<tenant> or %s:<claim value>=<tenant>", name, name, name)
+		}
+	}
+	return providers, nil
+}
+
+// mapClaimValues reads the entries of setting into the providers' maps that
+// field picks: <provider>=<target> for every user of the provider, or
+// <provider>:<claim value>=<target> for users sending that value
+func mapClaimValues(setting string, entries []string, named map[string]*oidcProvider, validate func(string) error, field func(*oidcProvider) map[string]string) error {
+	for _, e := range entries {
+		i := strings.LastIndex(e, "=")
+		if i < 0 {
+			return fmt.Errorf("%s: %q is not <provider>[:<claim value>]=<target>", setting, e)
+		}
+		from, target := e[:i], e[i+1:]
+		name, value, _ := strings.Cut(from, ":")
+		p := named[name]
+		if p == nil {
+			return fmt.Errorf("%s: %q names no provider of OIDC_ISSUERS", setting, e)
+		}
+		if err := validate(target); err != nil {
+			return fmt.Errorf("%s: %q: %w", setting, e, err)
+		}
+		m := field(p)
+		if _, dup := m[value]; dup {
+			return fmt.Errorf("%s: %q is mapped twice", setting, from)
+		}
+		m[value] = target
+	}
+	return nil
+}
+
+// checkOIDCConfig refuses issuers that cannot be named or have no tenant
+// mapped, and issuers without an audience: any token the provider issued, for
+// whichever client, would be accepted
+func checkOIDCConfig() error {
+	if oidcIssuersErr != nil {
+		return oidcIssuersErr
+	}
+	if len(oidcProviders) > 0 && len(oidcAudiences) == 0 {
+		return errors.New("OIDC_AUDIENCE must be set with OIDC_ISSUERS")
+	}
+	return nil
+}
+
+// oidcProviderFor returns the configured provider that issued tokenString, or
+// nil for tokens of the vault itself. The signature is checked later.
+func oidcProviderFor(tokenString string) *oidcProvider {
+	if len(oidcProviders) == 0 {
+		return nil
+	}
+	claims := jwt.MapClaims{}
+	if _, _, err := jwt.NewParser().ParseUnverified(tokenString, claims); err != nil {
+		return nil
+	}
+	iss, _ := claims["iss"].(string)
+	return oidcProviders[iss]
+}
+
+// verify checks signature, issuer, audience and expiry of a provider's token
+func (p *oidcProvider) verify(tokenString string) (jwt.MapClaims, error) {
+	claims := jwt.MapClaims{}
+	_, err := jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) {
+		kid, _ := token.Header["kid"].(string)
+		return p.key(kid, token.Method.Alg())
+	}, jwt.WithValidMethods(oidcMethods), jwt.WithIssuer(p.issuer), jwt.WithExpirationRequired(), jwt.WithLeeway(oidcLeeway))
+	if err != nil {
+		return nil, err
+	}
+
+	aud, err := claims.GetAudience()
+	if err != nil || !slices.ContainsFunc(aud, func(a string) bool { return slices.Contains(oidcAudiences, a) }) {
+		return nil, jwt.ErrTokenInvalidAudience
+	}
+	return claims, nil
+}
+
+// key returns the provider's key kid, fetching the JWKS when it is stale or
+// lacks kid. A provider that cannot be reached keeps its cached keys.
+func (p *oidcProvider) key(kid, alg string) (interface{}, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	k, ok := p.lookup(kid)
+	now := time.Now()
+	if (!ok || now.Sub(p.fetchedAt) > oidcJWKSRefresh) && now.Sub(p.triedAt) >= oidcMinRefresh {
+		p.triedAt = now
+		if err := p.refresh(); err != nil {
+			utils.Warn("oidc", "cannot fetch keys of %s: %v", p.issuer, err)
+		} else {
+			p.fetchedAt = now
+			k, ok = p.lookup(kid)
+		}
+	}
+	if !ok {
+		return nil, fmt.Errorf("no key %q of issuer %s", kid, p.issuer)
+	}
+	if k.alg != "" && k.alg != alg {
+		return nil, jwt.ErrTokenSignatureInvalid
+	}
+	return k.pub, nil
+}
+
+// lookup finds a key by kid; tokens without a kid match a provider's only key
+func (p *oidcProvider) lookup(kid string) (jwkKey, bool) {
+	if kid == "" && len(p.keys) == 1 {
+		for _, k := range p.keys {
+			return k, true
+		}
+	}
+	k, ok := p.keys[kid]
+	return k, ok
+}
+
+type jwkKey struct {
+	alg string
+	pub interface{}
+}
+
+type oidcJWK struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Alg string `json:"alg"`
+	Use string `json:"use"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+}
+
+// refresh reads the discovery document once, then the JWKS it points to
+func (p *oidcProvider) refresh() error {
+	if p.jwksURI == "" {
+		var doc struct {
+			Issuer  string `json:"issuer"`
+			JWKSURI string `json:"jwks_uri"`
+		}
+		if err := getJSON(strings.TrimSuffix(p.issuer, "/")+"/.well-known/openid-configuration", &doc); err != nil {
+			return err
+		}
+		if doc.Issuer != p.issuer || doc.JWKSURI == "" {
+			return fmt.Errorf("discovery document names issuer %q and jwks_uri %q", doc.Issuer, doc.JWKSURI)
+		}
+		p.jwksURI = doc.JWKSURI
+	}
+
+	var set struct {
+		Keys []oidcJWK `json:"keys"`
+	}
+	if err := getJSON(p.jwksURI, &set); err != nil {
+		return err
+	}
+	keys := map[string]jwkKey{}
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		pub, err := k.publicKey()
+		if err != nil {
+			utils.Warn("oidc", "skipping key %q of %s: %v", k.Kid, p.issuer, err)
+			continue
+		}
+		keys[k.Kid] = jwkKey{alg: k.Alg, pub: pub}
+	}
+	p.keys = keys
+	utils.Info("oidc", "loaded %d keys of %s", len(keys), p.issuer)
+	return nil
+}
+
+func getJSON(url string, v interface{}) error {
+	resp, err := oidcClient.Get(url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: %s", url, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+func (k oidcJWK) publicKey() (interface{}, error) {
+	b64 := base64.RawURLEncoding.DecodeString
+	switch k.Kty {
+	case "RSA":
+		n, err1 := b64(k.N)
+		e, err2 := b64(k.E)
+		if err1 != nil || err2 != nil || len(n) == 0 || len(e) == 0 || len(e) > 4 {
+			return nil, errors.New("invalid RSA key")
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+	case "EC":
+		curves := map[string]elliptic.Curve{"P-256": elliptic.P256(), "P-384": elliptic.P384(), "P-521": elliptic.P521()}
+		curve, ok := curves[k.Crv]
+		x, err1 := b64(k.X)
+		y, err2 := b64(k.Y)
+		if !ok || err1 != nil || err2 != nil {
+			return nil, errors.New("invalid EC key")
+		}
+		pub := &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if !curve.IsOnCurve(pub.X, pub.Y) {
+			return nil, errors.New("EC key is not on its curve")
+		}
+		return pub, nil
+	case "OKP":
+		x, err := b64(k.X)
+		if k.Crv != "Ed25519" || err != nil || len(x) != ed25519.PublicKeySize {
+			return nil, errors.New("invalid OKP key")
+		}
+		return ed25519.PublicKey(x), nil
+	}
+	return nil, fmt.Errorf("unsupported key type %q", k.Kty)
+}
+
+// claimAt reads a claim by a dotted path, e.g. "realm_access.roles"
+func claimAt(claims jwt.MapClaims, path string) interface{} {
+	var v interface{} = map[string]interface{}(claims)
+	for _, name := range strings.Split(path, ".") {
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		v = m[name]
+	}
+	return v
+}
+
+// oidcCaller maps a provider's claims to the caller: user ID, tenant, roles
+// and groups. The user ID and groups carry the provider's name; the tenant
+// and roles are what OIDC_TENANTS and OIDC_ROLES make of the claims.
+func oidcCaller(ctx context.Context, p *oidcProvider, claims jwt.MapClaims) (context.Context, error) {
+	external, _ := claimAt(claims, oidcUserClaim).(string)
+	if external == "" {
+		return nil, fmt.Errorf("token has no %s claim", oidcUserClaim)
+	}
+	userID := models.ExternalUserID(p.name, external)
+	if err := models.ValidateCallerID(userID); err != nil {
+		return nil, err
+	}
+	tenant, err := p.tenant(claims)
+	if err != nil {
+		return nil, err
+	}
+
+	var groups []string
+	for _, g := range claimList(claims, oidcGroupsClaim) {
+		if group := models.ExternalGroup(p.name, g); models.ValidateGroupRef(group) == nil {
+			groups = append(groups, group)
+		}
+	}
+
+	// The provider's scopes are its own; they do not limit vault access
+	ctx = withCaller(ctx, userID, tenant, nil)
+	ctx = context.WithValue(ctx, ContextIssuer, p.issuer)
+	ctx = context.WithValue(ctx, ContextGroups, groups)
+	return context.WithValue(ctx, ContextRoles, p.mappedRoles(claims)), nil
+}
+
+// tenant maps the tenant claim to a tenant; without a mapping for its value
+// the provider's catch-all applies, if it has one, or the token is refused
+func (p *oidcProvider) tenant(claims jwt.MapClaims) (string, error) {
+	value, _ := claimAt(claims, oidcTenantClaim).(string)
+	if tenant, ok := p.tenants[value]; ok && value != "" {
+		return tenant, nil
+	}
+	if tenant, ok := p.tenants[""]; ok {
+		return tenant, nil
+	}
+	return "", fmt.Errorf("%s %q of %s is not mapped by OIDC_TENANTS", oidcTenantClaim, value, p.name)
+}
+
+// mappedRoles returns the roles mapped from the roles claim, and the one every
+// user of the provider gets, if any. Values not mapped grant nothing.
+func (p *oidcProvider) mappedRoles(claims jwt.MapClaims) []string {
+	var roles []string
+	if role, ok := p.roles[""]; ok {
+		roles = append(roles, role)
+	}
+	for _, v := range claimList(claims, oidcRolesClaim) {
+		if role, ok := p.roles[v]; ok && v != "" {
+			roles = append(roles, role)
+		}
+	}
+	return roles
+}
+
+// claimList reads a claim holding a list of names, or a space-separated string
+func claimList(claims jwt.MapClaims, path string) []string {
+	var names []string
+	switch v := claimAt(claims, path).(type) {
+	case string:
+		names = strings.Fields(v)
+	case []interface{}:
+		for _, n := range v {
+			if s, ok := n.(string); ok {
+				names = append(names, s)
+			}
+		}
+	}
+	return names
+}
@@ -0,0 +1,39 @@
+package middleware
+
+import (
+	"crypto/hmac"
+	"net/http"
+	"os"
+	"strings"
+
+	"secure-vault/storage"
+)
+
+// RequireReplicationToken admits followers presenting REPLICATION_TOKEN as a
+// bearer token. Replication is disabled while the token is unset.
+func RequireReplicationToken(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := os.Getenv("REPLICATION_TOKEN")
+		if token == "" {
+			http.Error(w, "Replication is not enabled", http.StatusNotFound)
+			return
+		}
+		presented := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !hmac.Equal([]byte(presented), []byte(token)) {
+			http.Error(w, "Invalid replication token", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// RejectOnFollower turns away writes while this instance is a read-only follower
+func RejectOnFollower(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if storage.IsFollower() && r.Method != http.MethodGet && r.Method != http.MethodHead {
+			http.Error(w, "Read-only follower: send writes to the leader", http.StatusServiceUnavailable)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
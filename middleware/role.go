@@ -0,0 +1,31 @@
+package middleware
+
+import (
+	"net/http"
+
+	"secure-vault/models"
+)
+
+// RequireRole rejects callers lacking the role of the request: read for GET
+// and HEAD, write otherwise. Roles come from the user store, or from the
+// token of an identity provider.
+func RequireRole(read, write string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			role := write
+			if r.Method == http.MethodGet || r.Method == http.MethodHead {
+				role = read
+			}
+			if !models.HasRole(GetRolesFromContext(r), role) {
+				http.Error(w, "Requires role "+role, http.StatusForbidden)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// RequireRoleAll rejects callers lacking role, whatever the method
+func RequireRoleAll(role string) func(http.Handler) http.Handler {
+	return RequireRole(role, role)
+}
@@ -0,0 +1,30 @@
+package middleware
+
+import (
+	"net/http"
+
+	"secure-vault/models"
+)
+
+// RequireScope rejects API key callers lacking the scope of the request: read
+// for GET and HEAD, write otherwise
+func RequireScope(read, write string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			scope := write
+			if r.Method == http.MethodGet || r.Method == http.MethodHead {
+				scope = read
+			}
+			if !models.HasScope(GetScopesFromContext(r), scope) {
+				http.Error(w, "API key lacks scope "+scope, http.StatusForbidden)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// RequireScopeAll rejects API key callers lacking scope, whatever the method
+func RequireScopeAll(scope string) func(http.Handler) http.Handler {
+	return RequireScope(scope, scope)
+}
@@ -0,0 +1,21 @@
+package middleware
+
+import (
+	"net/http"
+
+	"secure-vault/models"
+)
+
+// RequireSystem limits routes acting on the whole instance, every tenant
+// included, to accounts of the default tenant; the role is checked as well.
+// Users of an identity provider are refused, since their tenant and roles are
+// only claims of the provider.
+func RequireSystem(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if GetTenantFromContext(r) != models.DefaultTenant || GetIssuerFromContext(r) != "" {
+			http.Error(w, "Requires an account of the default tenant", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,18 @@
+package middleware
+
+import (
+	"net/http"
+
+	"secure-vault/storage"
+)
+
+// RequireTenant rejects callers whose tenant claim names a tenant that was never created
+func RequireTenant(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !storage.TenantExists(GetTenantFromContext(r)) {
+			http.Error(w, "Unknown tenant", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,36 @@
+package middleware
+
+import (
+	"context"
+	"errors"
+	"net/http"
+
+	"secure-vault/storage"
+)
+
+// RequireActiveUser rejects tokens of users that were disabled or no longer
+// have an account, and attaches the account's role and groups to the request
+// context. Users of an identity provider have their account, roles and groups
+// there.
+func RequireActiveUser(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if GetIssuerFromContext(r) != "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		user, err := storage.CheckUser(GetTenantFromContext(r), GetUserIDFromContext(r))
+		switch {
+		case errors.Is(err, storage.ErrUserDisabled):
+			http.Error(w, "User is disabled", http.StatusUnauthorized)
+			return
+		case errors.Is(err, storage.ErrUserNotFound):
+			http.Error(w, "Unknown user", http.StatusUnauthorized)
+			return
+		case err != nil:
+			http.Error(w, "Cannot check user", http.StatusInternalServerError)
+			return
+		}
+		ctx := context.WithValue(r.Context(), ContextRoles, []string{user.Role})
+		next.ServeHTTP(w, r.WithContext(context.WithValue(ctx, ContextGroups, user.Groups)))
+	})
+}
@@ -0,0 +1,61 @@
+package models
+
+import (
+	"fmt"
+	"time"
+)
+
+// Scopes limit what a service account's API key may do. Tokens of users carry
+// no scopes and are not limited by them.
+const (
+	ScopeVaultRead  = "vault:read"  // GET requests under /vault
+	ScopeVaultWrite = "vault:write" // other requests under /vault
+	ScopeAdmin      = "admin"       // everything under /admin
+)
+
+var knownScopes = map[string]bool{ScopeVaultRead: true, ScopeVaultWrite: true, ScopeAdmin: true}
+
+// ValidateScopes checks the scopes requested for a new API key
+func ValidateScopes(scopes []string) error {
+	if len(scopes) == 0 {
+		return fmt.Errorf("at least one scope is required: %s, %s or %s", ScopeVaultRead, ScopeVaultWrite, ScopeAdmin)
+	}
+	for _, s := range scopes {
+		if !knownScopes[s] {
+			return fmt.Errorf("unknown scope %q", s)
+		}
+	}
+	return nil
+}
+
+// HasScope reports whether scopes grant scope; nil scopes grant everything
+func HasScope(scopes []string, scope string) bool {
+	if scopes == nil {
+		return true
+	}
+	for _, s := range scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// APIKey describes a long-lived credential of a service account. The key
+// itself is only shown when it is created; the vault keeps a hash of it.
+type APIKey struct {
+	ID             string     `json:"id"`
+	Name           string     `json:"name,omitempty"`
+	Tenant         string     `json:"tenant"`
+	ServiceAccount string     `json:"service_account"`
+	Scopes         []string   `json:"scopes"`
+	CreatedAt      time.Time  `json:"created_at"`
+	CreatedBy      string     `json:"created_by"`
+	ExpiresAt      *time.Time `json:"expires_at,omitempty"`
+	LastUsedAt     *time.Time `json:"last_used_at,omitempty"`
+}
+
+// IsExpired reports whether the key is past its expiry at now
+func (k *APIKey) IsExpired(now time.Time) bool {
+	return k.ExpiresAt != nil && !now.Before(*k.ExpiresAt)
+}
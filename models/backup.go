@@ -0,0 +1,32 @@
+package models
+
+import "time"
+
+const BackupFormatVersion = 1
+
+// BackupManifest is written as manifest.json at the end of every snapshot archive
+type BackupManifest struct {
+	FormatVersion  int        `json:"format_version"`
+	CreatedAt      time.Time  `json:"created_at"`
+	DBSize         int64      `json:"db_size"`
+	DBSHA256       string     `json:"db_sha256"` // checksum of the plain bbolt file
+	Payload        string     `json:"payload"`   // archive member holding the database
+	PayloadSize    int64      `json:"payload_size"`
+	PayloadSHA256  string     `json:"payload_sha256"` // checksum of the member as stored (encrypted or not)
+	Encrypted      bool       `json:"encrypted"`
+	Cipher         string     `json:"cipher,omitempty"`
+	RecipientKey   string     `json:"recipient_key,omitempty"` // hex secp256k1 public key of the operator
+	EphemeralKey   string     `json:"ephemeral_key,omitempty"`
+	KeyFingerprint string     `json:"key_fingerprint"` // master key the entries are wrapped with
+	CryptoMode     CryptoMode `json:"crypto_mode"`
+	Entries        int        `json:"entries"`
+}
+
+// RestoreReport summarises the checks run on a snapshot before it replaced the live database
+type RestoreReport struct {
+	Manifest   BackupManifest    `json:"manifest"`
+	Verified   int               `json:"verified"`
+	Failures   map[string]string `json:"failures,omitempty"` // entry ID -> error
+	Restored   bool              `json:"restored"`
+	PreviousDB string            `json:"previous_db,omitempty"` // where the replaced database was moved
+}
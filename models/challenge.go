@@ -0,0 +1,47 @@
+package models
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Key types a user can sign in with
+const (
+	SignInSecp256k1 = "secp256k1" // EIP-4361 message, EIP-191 signature
+	SignInEd25519   = "ed25519"   // the same text, raw signature
+)
+
+// IsSignInKeyType reports whether entries of keyType can be sign-in keys
+func IsSignInKeyType(keyType string) bool {
+	return keyType == SignInSecp256k1 || keyType == SignInEd25519
+}
+
+// Challenge is a single-use sign-in nonce for one of a user's stored keys. The
+// client signs Message with the key and trades the signature for a token. The
+// key is only looked up then: Address is what the client claimed.
+type Challenge struct {
+	Nonce     string    `json:"nonce"`
+	Tenant    string    `json:"tenant"`
+	UserID    string    `json:"user_id"`
+	KeyID     string    `json:"key_id"`
+	KeyType   string    `json:"key_type"`
+	Address   string    `json:"address"` // Ethereum address, or hex Ed25519 key
+	Message   string    `json:"message"`
+	IssuedAt  time.Time `json:"issued_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// SignInMessage is the text a challenge asks to sign, in the EIP-4361 layout
+func (c *Challenge) SignInMessage(domain, uri string, chainID int) string {
+	account := "Ethereum account"
+	if c.KeyType == SignInEd25519 {
+		account = "Ed25519 key"
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s wants you to sign in with your %s:\n%s\n\n", domain, account, c.Address)
+	fmt.Fprintf(&b, "Sign in to the vault as %s.\n\n", c.UserID)
+	fmt.Fprintf(&b, "URI: %s\nVersion: 1\nChain ID: %d\nNonce: %s\n", uri, chainID, c.Nonce)
+	fmt.Fprintf(&b, "Issued At: %s\nExpiration Time: %s", c.IssuedAt.UTC().Format(time.RFC3339), c.ExpiresAt.UTC().Format(time.RFC3339))
+	return b.String()
+}
@@ -0,0 +1,14 @@
+package models
+
+import "time"
+
+// CompactReport describes a database compaction
+type CompactReport struct {
+	StartedAt  time.Time     `json:"started_at"`
+	Online     bool          `json:"online"`
+	SizeBefore int64         `json:"size_before"`
+	SizeAfter  int64         `json:"size_after"`
+	Reclaimed  int64         `json:"reclaimed"`
+	WritePause time.Duration `json:"write_pause_ns,omitempty"` // online only: how long writes were held
+	Wiped      bool          `json:"wiped"`                    // the replaced file was overwritten with zeros before release
+}
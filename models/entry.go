@@ -2,27 +2,163 @@ package models
 
 import "time"
 
+// EntrySchemaVersion is the record layout written by this build. Older records
+// are upgraded through the storage migration registry when read.
+//
+//	0: flat JSON with per-mode fields (legacy)
+//	1: binary record, crypto material in Envelope
+//	2: envelopes bind the entry's metadata as AES-GCM additional data
+//	3: sensitive metadata may be sealed in SealedMetadata
+const EntrySchemaVersion = 3
+
 type VaultEntry struct {
-	ID         string    `json:"id"`
-	UserID     string    `json:"user_id"`
-	Label      string    `json:"label"`
-	KeyType    string    `json:"key_type"`    // e.g., "secp256k1", "rsa", etc.
-	KeyEncoding string    `json:"key_encoding"` // e.g., "hex", "base64", etc.
-	CryptoMode string    `json:"crypto_mode"` // "classical" or "quantum-safe"
-	CreatedAt  time.Time `json:"created_at"`
-
-	// Shared across both modes
-	Ciphertext []byte `json:"ciphertext"`
-	Nonce      []byte `json:"nonce"`
-
-	// Classical mode fields (ECC)
-	EphemeralPubKey            []byte `json:"ephemeral_pub_key"`
-	EncryptedEphemeralPrivKey []byte `json:"encrypted_ephemeral_priv_key"`
-	EphemeralPrivNonce        []byte `json:"ephemeral_priv_nonce"`
-
-	// Quantum-safe mode fields (Kyber)
-	KyberPubKey           []byte `json:"kyber_pub_key"`
-	KyberCiphertext       []byte `json:"kyber_ciphertext"`
-	EncryptedKyberPrivKey []byte `json:"encrypted_kyber_priv_key"`
-	KyberPrivNonce        []byte `json:"kyber_priv_nonce"`
+	SchemaVersion int       `cbor:"1,keyasint" json:"schema_version"`
+	ID            string    `cbor:"2,keyasint" json:"id"`
+	UserID        string    `cbor:"3,keyasint" json:"user_id"`
+	Label         string    `cbor:"4,keyasint" json:"label"`
+	KeyType       string    `cbor:"5,keyasint" json:"key_type"`                          // e.g., "secp256k1", "rsa", etc.
+	KeyEncoding   string    `cbor:"6,keyasint" json:"key_encoding"`                      // e.g., "hex", "base64", etc.
+	CryptoMode    string    `cbor:"7,keyasint" json:"crypto_mode"`                       // "classical" or "quantum-safe"
+	CryptoParams  string    `cbor:"8,keyasint,omitempty" json:"crypto_params,omitempty"` // e.g. "Kyber768"; empty means the mode's default
+	ModePinned    bool      `cbor:"9,keyasint,omitempty" json:"mode_pinned,omitempty"`   // set by targeted re-encryption; skipped by global migrations
+	CreatedAt     time.Time `cbor:"10,keyasint" json:"created_at"`
+	Envelope      Envelope  `cbor:"11,keyasint" json:"envelope"`
+
+	// Revision increases with every change to the key or its metadata and is served
+	// as the ETag. Background re-encryption leaves it unchanged.
+	Revision uint64 `cbor:"12,keyasint" json:"revision"`
+
+	// Optional expiry. Once reaped, the envelope is wiped and DeletedAt is set
+	// (tombstone); ExpiryNotified records that the advance notice went out.
+	ExpiresAt      *time.Time `cbor:"13,keyasint,omitempty" json:"expires_at,omitempty"`
+	DeletedAt      *time.Time `cbor:"14,keyasint,omitempty" json:"deleted_at,omitempty"`
+	ExpiryNotified bool       `cbor:"15,keyasint,omitempty" json:"expiry_notified,omitempty"`
+
+	// Superseded keys kept by rotation, oldest first, sealed under the entry's crypto mode
+	Versions []KeyVersion `cbor:"16,keyasint,omitempty" json:"versions,omitempty"`
+
+	// Structured key/value metadata, e.g. {"environment": "prod", "chain-id": "1"}
+	Tags map[string]string `cbor:"17,keyasint,omitempty" json:"tags,omitempty"`
+
+	// Set on disk only, when metadata encryption is enabled: the owner, label,
+	// key types, tags, timestamps and versions, sealed under the metadata key.
+	// Decoding restores the fields and clears it.
+	Sealed *SealedMetadata `cbor:"18,keyasint,omitempty" json:"-"`
+
+	// Rights the owner shared with other users or groups
+	Grants []Grant `cbor:"19,keyasint,omitempty" json:"grants,omitempty"`
+
+	// Set by the owner on a secp256k1 or ed25519 entry to sign in with it.
+	// Cleared when anyone else rotates the key.
+	SignIn bool `cbor:"20,keyasint,omitempty" json:"sign_in,omitempty"`
+
+	// Tenant the entry was read from or is stored into. Not persisted: it is
+	// implied by the bucket tree, and selects the KEK.
+	Tenant string `cbor:"-" json:"-"`
+}
+
+// SealedMetadata is AES-GCM ciphertext of an entry's sensitive fields
+type SealedMetadata struct {
+	Nonce      []byte `cbor:"1,keyasint"`
+	Ciphertext []byte `cbor:"2,keyasint"`
+}
+
+// KeyVersion is a previous key of an entry, retained after rotation
+type KeyVersion struct {
+	Revision    uint64    `cbor:"1,keyasint" json:"revision"` // entry revision the key was current at
+	KeyType     string    `cbor:"2,keyasint" json:"key_type"`
+	KeyEncoding string    `cbor:"3,keyasint" json:"key_encoding"`
+	RotatedAt   time.Time `cbor:"4,keyasint" json:"rotated_at"`
+	Envelope    Envelope  `cbor:"5,keyasint" json:"envelope"`
+}
+
+// KeyBytes returns the size of the stored key (current plus retained versions),
+// derived from the AES-GCM ciphertexts
+func (e *VaultEntry) KeyBytes() int64 {
+	if e.IsTombstone() {
+		return 0
+	}
+	n := e.Envelope.PlaintextSize()
+	for i := range e.Versions {
+		n += e.Versions[i].Envelope.PlaintextSize()
+	}
+	return n
+}
+
+// Version returns the retained version that was current at revision, or nil
+func (e *VaultEntry) Version(revision uint64) *KeyVersion {
+	for i := range e.Versions {
+		if e.Versions[i].Revision == revision {
+			return &e.Versions[i]
+		}
+	}
+	return nil
+}
+
+// EntryInfo is the metadata of an entry without its key material, as listed to clients
+type EntryInfo struct {
+	ID          string            `json:"id"`
+	Label       string            `json:"label"`
+	Tags        map[string]string `json:"tags,omitempty"`
+	KeyType     string            `json:"key_type"`
+	KeyEncoding string            `json:"key_encoding"`
+	CryptoMode  string            `json:"crypto_mode"`
+	CreatedAt   time.Time         `json:"created_at"`
+	ExpiresAt   *time.Time        `json:"expires_at,omitempty"`
+	Revision    uint64            `json:"revision"`
+	Versions    []uint64          `json:"versions,omitempty"` // revisions of retained keys
+	SignIn      bool              `json:"sign_in,omitempty"`
+}
+
+// Info returns the entry's listable metadata
+func (e *VaultEntry) Info() EntryInfo {
+	info := EntryInfo{
+		ID:          e.ID,
+		Label:       e.Label,
+		Tags:        e.Tags,
+		KeyType:     e.KeyType,
+		KeyEncoding: e.KeyEncoding,
+		CryptoMode:  e.CryptoMode,
+		CreatedAt:   e.CreatedAt,
+		ExpiresAt:   e.ExpiresAt,
+		Revision:    e.Revision,
+		SignIn:      e.SignIn,
+	}
+	for _, v := range e.Versions {
+		info.Versions = append(info.Versions, v.Revision)
+	}
+	return info
+}
+
+// IsExpired reports whether the entry's deadline has passed at now
+func (e *VaultEntry) IsExpired(now time.Time) bool {
+	return e.ExpiresAt != nil && !now.Before(*e.ExpiresAt)
+}
+
+// IsTombstone reports whether the entry was reaped and no longer holds key material
+func (e *VaultEntry) IsTombstone() bool {
+	return e.DeletedAt != nil
+}
+
+// Envelope is the algorithm-independent crypto material of an entry. The key is
+// sealed with AES-GCM under a data key derived from an ephemeral keypair (ECC or
+// KEM); the ephemeral private key is wrapped with the master key.
+type Envelope struct {
+	Ciphertext       []byte `cbor:"1,keyasint" json:"ciphertext"`
+	Nonce            []byte `cbor:"2,keyasint" json:"nonce"`
+	EphemeralPubKey  []byte `cbor:"3,keyasint,omitempty" json:"ephemeral_pub_key,omitempty"` // secp256k1 or Kyber public key
+	KEMCiphertext    []byte `cbor:"4,keyasint,omitempty" json:"kem_ciphertext,omitempty"`    // KEM modes only
+	WrappedPrivKey   []byte `cbor:"5,keyasint" json:"wrapped_priv_key"`
+	WrappedPrivNonce []byte `cbor:"6,keyasint" json:"wrapped_priv_nonce"`
+	KEKID            string `cbor:"7,keyasint,omitempty" json:"kek_id,omitempty"` // user KEK that wrapped WrappedPrivKey; empty: the tenant KEK
+}
+
+const gcmTagSize = 16
+
+// PlaintextSize is the length of the sealed key, 0 for an empty envelope
+func (env *Envelope) PlaintextSize() int64 {
+	if len(env.Ciphertext) < gcmTagSize {
+		return 0
+	}
+	return int64(len(env.Ciphertext) - gcmTagSize)
 }
@@ -0,0 +1,19 @@
+package models
+
+import "time"
+
+const (
+	EventEntryExpiring = "entry.expiring"
+	EventEntryExpired  = "entry.expired"
+)
+
+// ExpiryEvent is logged to the audit trail and posted to the expiry webhook
+type ExpiryEvent struct {
+	Type      string    `json:"type"`
+	Tenant    string    `json:"tenant"`
+	EntryID   string    `json:"entry_id"`
+	UserID    string    `json:"user_id"`
+	Label     string    `json:"label"`
+	ExpiresAt time.Time `json:"expires_at"`
+	At        time.Time `json:"at"`
+}
@@ -0,0 +1,33 @@
+package models
+
+import "time"
+
+// Checks run by the integrity scan, in order; the first failing one is reported
+const (
+	FsckCheckDecode = "decode" // record parses (CBOR, or JSON for legacy records)
+	FsckCheckMode   = "mode"   // crypto mode and parameter set are supported
+	FsckCheckUnwrap = "unwrap" // ephemeral private key unwraps with the owner's KEK
+	FsckCheckAEAD   = "aead"   // key ciphertext opens, metadata binding included
+	FsckCheckPubKey = "pubkey" // decrypted key is still a valid public key of its type
+)
+
+// FsckIssue is one failed check. Version is set when a retained key version failed.
+type FsckIssue struct {
+	Tenant  string `json:"tenant"`
+	EntryID string `json:"entry_id"`
+	Version uint64 `json:"version,omitempty"`
+	Check   string `json:"check"`
+	Error   string `json:"error"`
+}
+
+// FsckReport is the machine-readable result of an integrity scan. It never holds key material.
+type FsckReport struct {
+	StartedAt      time.Time   `json:"started_at"`
+	FinishedAt     time.Time   `json:"finished_at"`
+	KeyFingerprint string      `json:"key_fingerprint"`
+	Checked        int         `json:"checked"` // entries, tombstones included
+	OK             int         `json:"ok"`
+	Tombstones     int         `json:"tombstones"`
+	Failed         int         `json:"failed"` // entries with at least one issue
+	Issues         []FsckIssue `json:"issues"`
+}
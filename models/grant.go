@@ -0,0 +1,97 @@
+package models
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Rights an entry's owner can share. The owner holds all of them, and alone
+// may change the entry's metadata, versions and grants unless a policy allows
+// others to.
+const (
+	GrantRead   = "read"   // retrieve the key and its retained versions
+	GrantRotate = "rotate" // replace the key
+)
+
+// MaxGrants bounds the grants of one entry
+const MaxGrants = 100
+
+// Grant shares rights on one entry with a user or with every member of a group
+type Grant struct {
+	ID        string     `cbor:"1,keyasint" json:"id"`
+	UserID    string     `cbor:"2,keyasint,omitempty" json:"user_id,omitempty"`
+	Group     string     `cbor:"3,keyasint,omitempty" json:"group,omitempty"`
+	Rights    []string   `cbor:"4,keyasint" json:"rights"`
+	CreatedAt time.Time  `cbor:"5,keyasint" json:"created_at"`
+	ExpiresAt *time.Time `cbor:"6,keyasint,omitempty" json:"expires_at,omitempty"`
+}
+
+// Caller is who asks for an entry: a user, the groups it belongs to and its roles
+type Caller struct {
+	UserID string   `json:"user_id"`
+	Groups []string `json:"groups,omitempty"`
+	Roles  []string `json:"roles,omitempty"`
+}
+
+// ValidateGrant checks a grant an owner is adding
+func ValidateGrant(g *Grant) error {
+	if (g.UserID == "") == (g.Group == "") {
+		return errors.New("a grant names either user_id or group")
+	}
+	if g.UserID != "" {
+		if err := ValidateCallerID(g.UserID); err != nil {
+			return err
+		}
+	} else if err := ValidateGroupRef(g.Group); err != nil {
+		return err
+	}
+	if len(g.Rights) == 0 {
+		return fmt.Errorf("at least one right is required: %s or %s", GrantRead, GrantRotate)
+	}
+	for _, r := range g.Rights {
+		if r != GrantRead && r != GrantRotate {
+			return fmt.Errorf("unknown right %q", r)
+		}
+	}
+	return nil
+}
+
+// IsExpired reports whether the grant's deadline has passed at now
+func (g *Grant) IsExpired(now time.Time) bool {
+	return g.ExpiresAt != nil && !now.Before(*g.ExpiresAt)
+}
+
+// covers reports whether the grant is to the caller
+func (g *Grant) covers(c Caller) bool {
+	if g.UserID != "" {
+		return g.UserID == c.UserID
+	}
+	for _, group := range c.Groups {
+		if group == g.Group {
+			return true
+		}
+	}
+	return false
+}
+
+// IsOwner reports whether the caller owns the entry
+func (e *VaultEntry) IsOwner(c Caller) bool {
+	return c.UserID != "" && e.UserID == c.UserID
+}
+
+// grantFor returns an unexpired grant giving the caller right on the entry
+func (e *VaultEntry) grantFor(c Caller, right string, now time.Time) *Grant {
+	for i := range e.Grants {
+		g := &e.Grants[i]
+		if g.IsExpired(now) || !g.covers(c) {
+			continue
+		}
+		for _, r := range g.Rights {
+			if r == right {
+				return g
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,26 @@
+package models
+
+import (
+	"crypto"
+	"time"
+)
+
+// Token signing algorithms. HS256 is the shared JWT_SECRET; the others use
+// signing keys kept by the vault and published as a JWKS.
+const (
+	AlgEdDSA = "EdDSA"
+	AlgES256 = "ES256"
+	AlgRS256 = "RS256"
+	AlgHS256 = "HS256"
+)
+
+// SigningKey describes a token signing key. Only the current key signs; keys
+// retired by a rotation still verify until their retention ends.
+type SigningKey struct {
+	KID       string           `json:"kid"`
+	Algorithm string           `json:"alg"`
+	CreatedAt time.Time        `json:"created_at"`
+	RetiredAt *time.Time       `json:"retired_at,omitempty"`
+	Current   bool             `json:"current"`
+	Public    crypto.PublicKey `json:"-"`
+}
@@ -14,6 +14,29 @@ var ValidCryptoModes = []CryptoMode{
 	QuantumSafeMode,
 }
 
+// CryptoParamSets lists the parameter sets supported by each mode; the first one is the default
+var CryptoParamSets = map[CryptoMode][]string{
+	ClassicalMode:   {"secp256k1"},
+	QuantumSafeMode: {"Kyber512", "Kyber768", "Kyber1024"},
+}
+
+// DefaultCryptoParams returns the parameter set used for mode when none is given
+func DefaultCryptoParams(mode CryptoMode) string {
+	if sets := CryptoParamSets[mode]; len(sets) > 0 {
+		return sets[0]
+	}
+	return ""
+}
+
+func IsValidCryptoParams(mode CryptoMode, params string) bool {
+	for _, p := range CryptoParamSets[mode] {
+		if params == p {
+			return true
+		}
+	}
+	return false
+}
+
 func IsValidCryptoMode(input string) bool {
 	for _, mode := range ValidCryptoModes {
 		if input == string(mode) {
@@ -33,3 +56,33 @@ func ToCryptoMode(mode string) (CryptoMode, error) {
 		return "", errors.New("invalid crypto mode")
 	}
 }
+
+// MigrationStrategy controls how existing entries follow a crypto mode switch
+type MigrationStrategy string
+
+const (
+	EagerMigration MigrationStrategy = "eager" // background job rewrites every entry
+	LazyMigration  MigrationStrategy = "lazy"  // entries are rewritten on next read or rotation
+)
+
+func ToMigrationStrategy(s string) (MigrationStrategy, error) {
+	switch s {
+	case "", string(EagerMigration):
+		return EagerMigration, nil
+	case string(LazyMigration):
+		return LazyMigration, nil
+	default:
+		return "", errors.New("invalid migration strategy")
+	}
+}
+
+// VaultStats summarises how many entries are stored under each crypto mode
+type VaultStats struct {
+	Mode       CryptoMode        `json:"mode"`
+	Migration  MigrationStrategy `json:"migration"`
+	Total      int               `json:"total"`
+	ByMode     map[string]int    `json:"by_mode"`
+	Pending    int               `json:"pending"`    // entries not yet in the current mode
+	Pinned     int               `json:"pinned"`     // entries kept in their own mode by targeted re-encryption
+	Tombstones int               `json:"tombstones"` // expired entries whose key material was wiped
+}
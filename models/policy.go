@@ -0,0 +1,270 @@
+package models
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"time"
+)
+
+// Operations on an entry that policies name. The owner may do all of them;
+// grants give read and rotate.
+const (
+	OpRead   = GrantRead
+	OpRotate = GrantRotate
+	OpStore  = "store"
+	OpUpdate = "update" // label, tags and retained versions
+	OpShare  = "share"  // grants
+)
+
+var policyOps = []string{OpRead, OpRotate, OpStore, OpUpdate, OpShare}
+
+// Rule effects. A matching deny wins over everything, including ownership.
+const (
+	EffectAllow = "allow"
+	EffectDeny  = "deny"
+)
+
+// PolicySelf as a rule's owner matches the caller's own entries
+const PolicySelf = "self"
+
+// MaxPolicyRules bounds the rules of one policy
+const MaxPolicyRules = 100
+
+// Policy is a named, versioned set of rules of a tenant. Every change stores
+// a new version; a deleted policy keeps its history.
+type Policy struct {
+	Name        string       `json:"name"`
+	Version     uint64       `json:"version"`
+	Description string       `json:"description,omitempty"`
+	Rules       []PolicyRule `json:"rules"`
+	Deleted     bool         `json:"deleted,omitempty"`
+	UpdatedAt   time.Time    `json:"updated_at"`
+	UpdatedBy   string       `json:"updated_by"`
+}
+
+// PolicyRule lets or forbids subjects to do operations on matching entries
+type PolicyRule struct {
+	Effect     string         `json:"effect"`
+	Subjects   PolicySubjects `json:"subjects"`
+	Operations []string       `json:"operations"` // "*" for all
+	Entries    PolicyEntries  `json:"entries"`    // empty matches every entry
+}
+
+// PolicySubjects matches a caller named in any of the lists
+type PolicySubjects struct {
+	Users  []string `json:"users,omitempty"` // "*" for anyone
+	Groups []string `json:"groups,omitempty"`
+	Roles  []string `json:"roles,omitempty"` // the role or one above it
+}
+
+// PolicyEntries matches entries having all the given attributes
+type PolicyEntries struct {
+	Labels     []string          `json:"labels,omitempty"` // path patterns, e.g. "payments/prod/*"
+	Owner      string            `json:"owner,omitempty"`  // a user ID, or "self"
+	Tags       map[string]string `json:"tags,omitempty"`   // "*" matches any value
+	KeyType    string            `json:"key_type,omitempty"`
+	CryptoMode string            `json:"crypto_mode,omitempty"`
+}
+
+// PolicyMatch is a rule that applied to a request
+type PolicyMatch struct {
+	Policy  string `json:"policy"`
+	Version uint64 `json:"version"`
+	Rule    int    `json:"rule"` // index into the policy's rules
+	Effect  string `json:"effect"`
+}
+
+// Decision is whether a caller may do an operation on an entry, and why
+type Decision struct {
+	Allowed bool          `json:"allowed"`
+	Reason  string        `json:"reason"`
+	Grant   string        `json:"grant,omitempty"` // the grant that allowed it
+	Matches []PolicyMatch `json:"matches,omitempty"`
+}
+
+// ValidateOperation checks an operation named in a policy check
+func ValidateOperation(op string) error {
+	if !contains(policyOps, op) {
+		return fmt.Errorf("unknown operation %q: use %s, %s, %s, %s or %s", op, OpRead, OpRotate, OpStore, OpUpdate, OpShare)
+	}
+	return nil
+}
+
+// ValidatePolicyName checks the name a policy is stored under
+func ValidatePolicyName(name string) error {
+	if !userIDPattern.MatchString(name) {
+		return errors.New("invalid policy name: use 1-128 letters, digits or '.', '_', '@', '-'")
+	}
+	return nil
+}
+
+// ValidatePolicy checks the rules of a policy being stored
+func ValidatePolicy(p *Policy) error {
+	if len(p.Rules) == 0 {
+		return errors.New("a policy needs at least one rule")
+	}
+	if len(p.Rules) > MaxPolicyRules {
+		return fmt.Errorf("a policy has at most %d rules", MaxPolicyRules)
+	}
+	for i := range p.Rules {
+		if err := validateRule(&p.Rules[i]); err != nil {
+			return fmt.Errorf("rule %d: %w", i, err)
+		}
+	}
+	return nil
+}
+
+func validateRule(r *PolicyRule) error {
+	if r.Effect != EffectAllow && r.Effect != EffectDeny {
+		return fmt.Errorf("effect must be %s or %s", EffectAllow, EffectDeny)
+	}
+
+	s := &r.Subjects
+	if len(s.Users)+len(s.Groups)+len(s.Roles) == 0 {
+		return errors.New("subjects must name users, groups or roles")
+	}
+	for _, g := range s.Groups {
+		if err := ValidateGroupRef(g); err != nil {
+			return err
+		}
+	}
+	for _, role := range s.Roles {
+		if err := ValidateRole(role); err != nil {
+			return err
+		}
+	}
+
+	if len(r.Operations) == 0 {
+		return errors.New("operations must not be empty")
+	}
+	for _, op := range r.Operations {
+		if op == "*" {
+			continue
+		}
+		if err := ValidateOperation(op); err != nil {
+			return err
+		}
+	}
+
+	e := &r.Entries
+	for _, l := range e.Labels {
+		if _, err := path.Match(l, ""); err != nil {
+			return fmt.Errorf("invalid label pattern %q", l)
+		}
+	}
+	for k, v := range e.Tags {
+		if err := ValidateTag(k, v); err != nil {
+			return err
+		}
+	}
+	if e.CryptoMode != "" && !IsValidCryptoMode(e.CryptoMode) {
+		return fmt.Errorf("unknown crypto_mode %q", e.CryptoMode)
+	}
+	return nil
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *PolicySubjects) match(c Caller) bool {
+	for _, u := range s.Users {
+		if u == "*" || u == c.UserID {
+			return true
+		}
+	}
+	for _, g := range s.Groups {
+		if contains(c.Groups, g) {
+			return true
+		}
+	}
+	for _, role := range s.Roles {
+		if HasRole(c.Roles, role) {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *PolicyEntries) match(c Caller, e *VaultEntry) bool {
+	if len(m.Labels) > 0 {
+		matched := false
+		for _, l := range m.Labels {
+			if ok, _ := path.Match(l, e.Label); ok {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+	switch m.Owner {
+	case "":
+	case PolicySelf:
+		if !e.IsOwner(c) {
+			return false
+		}
+	default:
+		if e.UserID != m.Owner {
+			return false
+		}
+	}
+	for k, v := range m.Tags {
+		got, ok := e.Tags[k]
+		if !ok || (v != "*" && got != v) {
+			return false
+		}
+	}
+	if m.KeyType != "" && e.KeyType != m.KeyType {
+		return false
+	}
+	return m.CryptoMode == "" || e.CryptoMode == m.CryptoMode
+}
+
+// Authorize decides whether the caller may do op on the entry at now. A
+// matching deny rule refuses it; otherwise the owner, a grant or a matching
+// allow rule permits it. Every matching rule is reported.
+func Authorize(policies []Policy, c Caller, op string, e *VaultEntry, now time.Time) Decision {
+	var d Decision
+	var deny, allow *PolicyMatch
+	for _, p := range policies {
+		for i := range p.Rules {
+			r := &p.Rules[i]
+			if !(contains(r.Operations, "*") || contains(r.Operations, op)) || !r.Subjects.match(c) || !r.Entries.match(c, e) {
+				continue
+			}
+			d.Matches = append(d.Matches, PolicyMatch{Policy: p.Name, Version: p.Version, Rule: i, Effect: r.Effect})
+		}
+	}
+	for i := range d.Matches {
+		m := &d.Matches[i]
+		if m.Effect == EffectDeny && deny == nil {
+			deny = m
+		} else if m.Effect == EffectAllow && allow == nil {
+			allow = m
+		}
+	}
+
+	switch g := e.grantFor(c, op, now); {
+	case deny != nil:
+		d.Reason = fmt.Sprintf("denied by rule %d of policy %q", deny.Rule, deny.Policy)
+	case e.IsOwner(c):
+		d.Allowed, d.Reason = true, "the caller owns the entry"
+	case g != nil:
+		d.Allowed, d.Grant = true, g.ID
+		d.Reason = fmt.Sprintf("grant %s gives %s", g.ID, op)
+	case allow != nil:
+		d.Allowed = true
+		d.Reason = fmt.Sprintf("allowed by rule %d of policy %q", allow.Rule, allow.Policy)
+	default:
+		d.Reason = fmt.Sprintf("the caller does not own the entry, and no grant or policy allows %s", op)
+	}
+	return d
+}
@@ -0,0 +1,69 @@
+package models
+
+import (
+	"fmt"
+	"time"
+)
+
+// Usage is what a user (or the whole tenant) currently stores
+type Usage struct {
+	Entries int64 `json:"entries"`
+	Bytes   int64 `json:"bytes"` // key bytes, including retained versions
+}
+
+func (u Usage) Add(o Usage) Usage { return Usage{u.Entries + o.Entries, u.Bytes + o.Bytes} }
+func (u Usage) Sub(o Usage) Usage { return Usage{u.Entries - o.Entries, u.Bytes - o.Bytes} }
+
+// QuotaLimits caps what may be stored. Zero means unlimited for entries and bytes.
+type QuotaLimits struct {
+	MaxEntries  int64 `json:"max_entries"`
+	MaxBytes    int64 `json:"max_bytes"`
+	MaxVersions int   `json:"max_versions"` // retained versions per entry, the oldest are dropped beyond it
+}
+
+// QuotaOverride replaces individual default limits for one user; nil fields inherit
+type QuotaOverride struct {
+	MaxEntries  *int64    `json:"max_entries,omitempty"`
+	MaxBytes    *int64    `json:"max_bytes,omitempty"`
+	MaxVersions *int      `json:"max_versions,omitempty"`
+	UpdatedAt   time.Time `json:"updated_at"`
+	UpdatedBy   string    `json:"updated_by"`
+}
+
+// Apply returns the limits with the override's fields taking precedence
+func (l QuotaLimits) Apply(o *QuotaOverride) QuotaLimits {
+	if o == nil {
+		return l
+	}
+	if o.MaxEntries != nil {
+		l.MaxEntries = *o.MaxEntries
+	}
+	if o.MaxBytes != nil {
+		l.MaxBytes = *o.MaxBytes
+	}
+	if o.MaxVersions != nil {
+		l.MaxVersions = *o.MaxVersions
+	}
+	return l
+}
+
+// QuotaReport is the admin view of one user's or the tenant's quota
+type QuotaReport struct {
+	UserID   string         `json:"user_id,omitempty"`
+	Tenant   string         `json:"tenant,omitempty"`
+	Limits   QuotaLimits    `json:"limits"`
+	Override *QuotaOverride `json:"override,omitempty"`
+	Usage    Usage          `json:"usage"`
+}
+
+// QuotaError explains which limit a write would exceed
+type QuotaError struct {
+	Scope string // "user alice" or "tenant default"
+	Limit string // "entries" or "key bytes"
+	Max   int64
+	Would int64
+}
+
+func (e *QuotaError) Error() string {
+	return fmt.Sprintf("quota exceeded: %s may store at most %d %s (would be %d)", e.Scope, e.Max, e.Limit, e.Would)
+}
@@ -0,0 +1,88 @@
+package models
+
+import "time"
+
+type RekeyStatus string
+
+const (
+	RekeyRunning             RekeyStatus = "running"
+	RekeyCompleted           RekeyStatus = "completed"
+	RekeyCompletedWithErrors RekeyStatus = "completed_with_errors"
+	RekeyCancelled           RekeyStatus = "cancelled"
+)
+
+// RekeyFailure tracks a single entry that could not be re-encrypted
+type RekeyFailure struct {
+	Attempts    int       `json:"attempts"`
+	LastError   string    `json:"last_error"`
+	NextAttempt time.Time `json:"next_attempt"`
+}
+
+// RekeyJob is the persisted state of a background re-encryption run.
+// Cursor is the ID of the last entry handled by the forward pass, so a
+// restarted server picks up right after it.
+type RekeyJob struct {
+	ID         string                  `json:"id"`
+	TargetMode CryptoMode              `json:"target_mode"`
+	Status     RekeyStatus             `json:"status"`
+	Cursor     string                  `json:"cursor"`
+	PassDone   bool                    `json:"pass_done"`
+	Total      int                     `json:"total"`
+	Processed  int                     `json:"processed"`
+	Migrated   int                     `json:"migrated"`
+	Failures   map[string]RekeyFailure `json:"failures,omitempty"`
+	StartedAt  time.Time               `json:"started_at"`
+	UpdatedAt  time.Time               `json:"updated_at"`
+	FinishedAt *time.Time              `json:"finished_at,omitempty"`
+}
+
+// ReEncryptFilter selects entries for a targeted re-encryption. Empty fields match anything.
+type ReEncryptFilter struct {
+	ID            string     `json:"id,omitempty"`
+	UserID        string     `json:"user_id,omitempty"`
+	KeyType       string     `json:"key_type,omitempty"`
+	Label         string     `json:"label,omitempty"`
+	CreatedAfter  *time.Time `json:"created_after,omitempty"`
+	CreatedBefore *time.Time `json:"created_before,omitempty"`
+
+	Tags map[string]string `json:"tags,omitempty"` // all must be present with these values
+}
+
+// IsEmpty reports whether the filter would select the whole vault
+func (f ReEncryptFilter) IsEmpty() bool {
+	return f.ID == "" && f.UserID == "" && f.KeyType == "" && f.Label == "" &&
+		f.CreatedAfter == nil && f.CreatedBefore == nil && len(f.Tags) == 0
+}
+
+func (f ReEncryptFilter) Matches(e *VaultEntry) bool {
+	switch {
+	case f.ID != "" && e.ID != f.ID,
+		f.UserID != "" && e.UserID != f.UserID,
+		f.KeyType != "" && e.KeyType != f.KeyType,
+		f.Label != "" && e.Label != f.Label,
+		f.CreatedAfter != nil && !e.CreatedAt.After(*f.CreatedAfter),
+		f.CreatedBefore != nil && !e.CreatedAt.Before(*f.CreatedBefore):
+		return false
+	}
+	return HasTags(e, f.Tags)
+}
+
+// ReEncryptResult describes what happened (or would happen, on dry run) to one entry
+type ReEncryptResult struct {
+	ID         string `json:"id"`
+	FromMode   string `json:"from_mode"`
+	FromParams string `json:"from_params"`
+	ToMode     string `json:"to_mode"`
+	ToParams   string `json:"to_params"`
+	Status     string `json:"status"` // "would_change", "changed", "unchanged" or "failed"
+	Error      string `json:"error,omitempty"`
+}
+
+type ReEncryptReport struct {
+	DryRun    bool              `json:"dry_run"`
+	Matched   int               `json:"matched"`
+	Changed   int               `json:"changed"`
+	Unchanged int               `json:"unchanged"`
+	Failed    int               `json:"failed"`
+	Entries   []ReEncryptResult `json:"entries"`
+}
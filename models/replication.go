@@ -0,0 +1,75 @@
+package models
+
+import "time"
+
+// Replication roles; a follower serves reads and applies the leader's change log
+const (
+	RoleLeader   = "leader"
+	RoleFollower = "follower"
+)
+
+// Change log event types
+const (
+	ChangeEntry   = "entry"   // Value is the stored record; stores, rotations, tombstones and re-encryptions. Nil once purged
+	ChangeSetting = "setting" // Value is the new setting, e.g. the crypto mode
+	ChangeQuota   = "quota"   // Value is the override JSON, nil when removed
+	ChangeTenant  = "tenant"  // Value holds the new tenant's settings
+	ChangeUser    = "user"    // Value is the account record
+	ChangeAPIKey  = "apikey"  // Value is the key record, nil when revoked
+	ChangeJWTKey  = "jwtkey"  // Value is the signing key record, nil when pruned; not tenant-scoped
+
+	ChangeRefreshToken = "refreshtoken" // Value is the token record, nil when revoked
+	ChangeRevocation   = "revocation"   // Value is the revocation's time, nil when pruned; not tenant-scoped
+	ChangePolicy       = "policy"       // Value is a policy version
+)
+
+// ChangeEvent is one write recorded by the leader, in commit order. Key is the
+// entry ID, setting name or blinded user token, depending on Type.
+type ChangeEvent struct {
+	Seq    uint64    `json:"seq"`
+	Type   string    `json:"type"`
+	Tenant string    `json:"tenant"`
+	Key    []byte    `json:"key"`
+	Value  []byte    `json:"value,omitempty"`
+	At     time.Time `json:"at"`
+}
+
+// Keystore change operations. Put events carry the wrapped KEK only while it
+// exists, so a shredded key is never replayed.
+const (
+	KeystorePut    = "put"
+	KeystoreDelete = "delete"
+)
+
+// KeystoreEvent is one user KEK creation or destruction
+type KeystoreEvent struct {
+	Seq   uint64 `json:"seq"`
+	Op    string `json:"op"`
+	ID    string `json:"id"`
+	User  []byte `json:"user"` // tenant NUL blinded user token
+	Value []byte `json:"value,omitempty"`
+}
+
+// ReplicationBatch is what a follower pulls: changes after its position, and the
+// leader's head positions
+type ReplicationBatch struct {
+	Seq            uint64          `json:"seq"`
+	Events         []ChangeEvent   `json:"events"`
+	KeystoreSeq    uint64          `json:"keystore_seq"`
+	KeystoreEvents []KeystoreEvent `json:"keystore_events"`
+}
+
+// ReplicationStatus describes this instance's role and, on a follower, how far
+// it trails the leader
+type ReplicationStatus struct {
+	Role        string     `json:"role"`
+	Seq         uint64     `json:"seq"` // last change written or applied
+	KeystoreSeq uint64     `json:"keystore_seq"`
+	Leader      string     `json:"leader,omitempty"`
+	LeaderSeq   uint64     `json:"leader_seq,omitempty"`
+	LagEvents   uint64     `json:"lag_events"`
+	LagSeconds  float64    `json:"lag_seconds"` // time since the follower was last caught up
+	LastContact *time.Time `json:"last_contact,omitempty"`
+	LastError   string     `json:"last_error,omitempty"`
+	PromotedAt  *time.Time `json:"promoted_at,omitempty"`
+}
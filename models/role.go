@@ -0,0 +1,33 @@
+package models
+
+import "fmt"
+
+// Roles decide which routes a caller may use. Each role includes the ones
+// below it: readers read entries, writers store and rotate them, operators run
+// maintenance, and admins manage accounts, crypto modes, keys and backups.
+const (
+	RoleReader   = "reader"
+	RoleWriter   = "writer"
+	RoleOperator = "operator"
+	RoleAdmin    = "admin"
+)
+
+var roleRank = map[string]int{RoleReader: 1, RoleWriter: 2, RoleOperator: 3, RoleAdmin: 4}
+
+// ValidateRole checks a role given to an account
+func ValidateRole(role string) error {
+	if roleRank[role] == 0 {
+		return fmt.Errorf("unknown role %q: use %s, %s, %s or %s", role, RoleReader, RoleWriter, RoleOperator, RoleAdmin)
+	}
+	return nil
+}
+
+// HasRole reports whether one of roles is role or above it. Unknown roles grant nothing.
+func HasRole(roles []string, role string) bool {
+	for _, r := range roles {
+		if roleRank[r] >= roleRank[role] && roleRank[r] > 0 {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,14 @@
+package models
+
+import "time"
+
+// ShredReport is the result of crypto-shredding one user of a tenant
+type ShredReport struct {
+	Tenant        string    `json:"tenant"`
+	UserID        string    `json:"user_id"`
+	ShreddedAt    time.Time `json:"shredded_at"`
+	KEKDestroyed  bool      `json:"kek_destroyed"`  // false if the user never had a KEK
+	KeystoreWiped bool      `json:"keystore_wiped"` // old keystore file overwritten with zeros
+	Entries       int       `json:"entries"`        // entries tombstoned
+	Changes       int       `json:"changes"`        // earlier copies of the entries blanked in the change log
+}
@@ -0,0 +1,71 @@
+package models
+
+import (
+	"errors"
+	"regexp"
+	"strings"
+)
+
+const (
+	MaxTags        = 32
+	MaxTagValueLen = 256
+)
+
+// Tag keys are short lowercase identifiers such as "environment" or "owner-team"
+var tagKeyPattern = regexp.MustCompile(`^[a-z0-9][a-z0-9._-]{0,62}$`)
+
+// ValidateTags checks a complete tag set against the naming and size rules
+func ValidateTags(tags map[string]string) error {
+	if len(tags) > MaxTags {
+		return errors.New("too many tags, at most 32 are allowed")
+	}
+	for k, v := range tags {
+		if err := ValidateTag(k, v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ValidateTag checks a single key/value pair
+func ValidateTag(key, value string) error {
+	if !tagKeyPattern.MatchString(key) {
+		return errors.New("invalid tag key " + key + ": use lowercase letters, digits, '.', '_' or '-'")
+	}
+	if value == "" || len(value) > MaxTagValueLen {
+		return errors.New("tag " + key + " must have a value of 1 to 256 bytes")
+	}
+	if strings.ContainsRune(value, 0) {
+		return errors.New("tag " + key + " must not contain NUL bytes")
+	}
+	return nil
+}
+
+// ParseTagFilter turns "key:value" query parameters into a tag set
+func ParseTagFilter(params []string) (map[string]string, error) {
+	if len(params) == 0 {
+		return nil, nil
+	}
+	tags := make(map[string]string, len(params))
+	for _, p := range params {
+		key, value, ok := strings.Cut(p, ":")
+		if !ok {
+			return nil, errors.New("tag filter must look like key:value")
+		}
+		if err := ValidateTag(key, value); err != nil {
+			return nil, err
+		}
+		tags[key] = value
+	}
+	return tags, nil
+}
+
+// HasTags reports whether the entry carries every tag in want
+func HasTags(e *VaultEntry, want map[string]string) bool {
+	for k, v := range want {
+		if e.Tags[k] != v {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,30 @@
+package models
+
+import (
+	"errors"
+	"regexp"
+	"time"
+)
+
+// DefaultTenant owns the root-level buckets, which is where all data lived
+// before tenants existed. Tokens without a tenant claim act in it.
+const DefaultTenant = "default"
+
+var tenantNamePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9-]{0,62}$`)
+
+// ValidateTenantName checks a tenant name used in tokens and bucket names
+func ValidateTenantName(name string) error {
+	if !tenantNamePattern.MatchString(name) {
+		return errors.New("invalid tenant name: use 1-63 lowercase letters, digits or '-'")
+	}
+	return nil
+}
+
+// Tenant describes an isolated namespace
+type Tenant struct {
+	Name       string     `json:"name"`
+	CreatedAt  *time.Time `json:"created_at,omitempty"` // unset for the default tenant
+	CryptoMode CryptoMode `json:"crypto_mode"`
+	Entries    int        `json:"entries"`
+	KEK        string     `json:"kek"` // "master" (default tenant) or "wrapped"
+}
@@ -0,0 +1,101 @@
+package models
+
+import (
+	"errors"
+	"regexp"
+	"strings"
+	"time"
+	"unicode"
+)
+
+var (
+	userIDPattern   = regexp.MustCompile(`^[A-Za-z0-9._@-]{1,128}$`)
+	providerPattern = regexp.MustCompile(`^[a-z0-9][a-z0-9.-]{0,62}$`)
+)
+
+// ValidateUserID checks a user ID chosen when an account is created
+func ValidateUserID(id string) error {
+	if !userIDPattern.MatchString(id) {
+		return errors.New("invalid user_id: use 1-128 letters, digits or '.', '_', '@', '-'")
+	}
+	return nil
+}
+
+// ValidateProviderName checks the name an identity provider's users are
+// known by in the vault
+func ValidateProviderName(name string) error {
+	if !providerPattern.MatchString(name) {
+		return errors.New("invalid provider name: use up to 63 lowercase letters, digits, '.' or '-'")
+	}
+	return nil
+}
+
+// ExternalUserID is the user ID of a user of identity provider provider. The
+// colon keeps it apart from the IDs of the vault's own accounts.
+func ExternalUserID(provider, id string) string {
+	return provider + ":" + id
+}
+
+// ValidateCallerID checks a user ID that names either an account or, as
+// "<provider>:<id>", a user of an identity provider
+func ValidateCallerID(id string) error {
+	provider, external, ok := strings.Cut(id, ":")
+	if !ok {
+		return ValidateUserID(id)
+	}
+	if err := ValidateProviderName(provider); err != nil {
+		return err
+	}
+	if external == "" || len(external) > 255 || strings.IndexFunc(external, unicode.IsControl) >= 0 {
+		return errors.New("invalid user_id: the provider's user ID must have 1-255 printable characters")
+	}
+	return nil
+}
+
+// ValidateGroup checks a group name an admin gives to an account
+func ValidateGroup(group string) error {
+	if !userIDPattern.MatchString(group) {
+		return errors.New("invalid group: use 1-128 letters, digits or '.', '_', '@', '-'")
+	}
+	return nil
+}
+
+// ExternalGroup is the group of identity provider provider named group; like
+// ExternalUserID it never matches a group of the vault's own accounts
+func ExternalGroup(provider, group string) string {
+	return provider + ":" + group
+}
+
+// ValidateGroupRef checks a group named by a grant or a policy: a group of
+// accounts or, as "<provider>:<group>", a group of an identity provider
+func ValidateGroupRef(group string) error {
+	provider, external, ok := strings.Cut(group, ":")
+	if !ok {
+		return ValidateGroup(group)
+	}
+	if err := ValidateProviderName(provider); err != nil {
+		return err
+	}
+	if external == "" || len(external) > 255 || strings.IndexFunc(external, unicode.IsControl) >= 0 {
+		return errors.New("invalid group: the provider's group must have 1-255 printable characters")
+	}
+	return nil
+}
+
+// User is an account of a tenant that may obtain tokens. The password hash is
+// never part of it. Service accounts have no password and use API keys instead.
+type User struct {
+	UserID            string     `json:"user_id"`
+	Tenant            string     `json:"tenant"`
+	ServiceAccount    bool       `json:"service_account,omitempty"`
+	Role              string     `json:"role"`
+	Groups            []string   `json:"groups,omitempty"`
+	Disabled          bool       `json:"disabled"`
+	CreatedAt         time.Time  `json:"created_at"`
+	CreatedBy         string     `json:"created_by,omitempty"`
+	PasswordChangedAt *time.Time `json:"password_changed_at,omitempty"`
+	LastLogin         *time.Time `json:"last_login,omitempty"`
+	FailedLogins      int        `json:"failed_logins"` // since the last successful login
+	LastFailedLogin   *time.Time `json:"last_failed_login,omitempty"`
+	LockedUntil       *time.Time `json:"locked_until,omitempty"`
+}
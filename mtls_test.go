@@ -0,0 +1,142 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testCert is a certificate with its key, as made by newCert
+type testCert struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+// newCert creates a certificate for template, signed by parent, or self-signed
+// when parent is nil, and writes it and its key as PEM to <name>.pem and
+// <name>.key in dir
+func newCert(t *testing.T, dir, name string, template *x509.Certificate, parent *testCert) *testCert {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	if err != nil {
+		t.Fatal(err)
+	}
+	template.SerialNumber = serial
+	template.NotBefore = time.Now().Add(-time.Minute)
+	template.NotAfter = time.Now().Add(time.Hour)
+	signer, signerKey := template, key
+	if parent != nil {
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	if err := os.WriteFile(filepath.Join(dir, name+".pem"), certPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, name+".key"), keyPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return &testCert{cert: cert, key: key}
+}
+
+// tlsCert returns c for a client to present
+func (c *testCert) tlsCert() tls.Certificate {
+	return tls.Certificate{Certificate: [][]byte{c.cert.Raw}, PrivateKey: c.key, Leaf: c.cert}
+}
+
+// TestMTLSTokenBinding checks that a certificate stands in for a token, and
+// that with MTLS_BIND_TOKENS a token issued over a certificate only works
+// with that certificate
+func TestMTLSTokenBinding(t *testing.T) {
+	dir := t.TempDir()
+	newCert(t, dir, "server", &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "vault"},
+		IPAddresses: []net.IP{net.IPv4(127, 0, 0, 1)},
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}, nil)
+	ca := newCert(t, dir, "ca", &x509.Certificate{
+		Subject:               pkix.Name{CommonName: "clients"},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}, nil)
+	client := func(name string) tls.Certificate {
+		return newCert(t, dir, name, &x509.Certificate{
+			Subject:     pkix.Name{CommonName: name},
+			KeyUsage:    x509.KeyUsageDigitalSignature,
+			ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		}, ca).tlsCert()
+	}
+
+	v := startVault(t, dir, "vault",
+		"TLS_CERT_FILE="+filepath.Join(dir, "server.pem"),
+		"TLS_KEY_FILE="+filepath.Join(dir, "server.key"),
+		"TLS_CLIENT_CA_FILES="+filepath.Join(dir, "ca.pem"),
+		"MTLS_USER_FIELD=cn",
+		"MTLS_BIND_TOKENS=true",
+	)
+	admin := v.token(t)
+	unbound := v.user(t, admin, "alice", "")
+	v.user(t, admin, "bob", "")
+	alice, bob := v.withCert(client("alice")), v.withCert(client("bob"))
+
+	// 1. A token issued over alice's certificate is bound to it
+	var signedIn struct {
+		Token string `json:"token"`
+	}
+	creds := map[string]string{"user_id": "alice", "password": testPassword}
+	if status := alice.call(t, "POST", "/auth/token", "", creds, &signedIn); status != http.StatusOK {
+		t.Fatalf("sign-in over a certificate: status %d", status)
+	}
+	bound := signedIn.Token
+	id := storeKeys(t, alice, bound, 1)[0]
+	for name, caller := range map[string]*vaultProcess{"no certificate": v, "bob's certificate": bob} {
+		if status := caller.call(t, "GET", "/vault/retrive/"+id, bound, nil, nil); status != http.StatusUnauthorized {
+			t.Fatalf("bound token over %s: status %d, want 401", name, status)
+		}
+	}
+
+	// 2. Tokens issued without a certificate work without one
+	if status := v.call(t, "GET", "/vault/retrive/"+id, unbound, nil, nil); status != http.StatusOK {
+		t.Fatalf("unbound token: status %d", status)
+	}
+
+	// 3. The certificate alone names its account
+	if status := alice.call(t, "GET", "/vault/retrive/"+id, "", nil, nil); status != http.StatusOK {
+		t.Fatalf("alice's certificate: status %d", status)
+	}
+	if status := bob.call(t, "GET", "/vault/retrive/"+id, "", nil, nil); status != http.StatusNotFound {
+		t.Fatalf("bob's certificate: status %d, want 404", status)
+	}
+	if status := v.call(t, "GET", "/vault/retrive/"+id, "", nil, nil); status != http.StatusUnauthorized {
+		t.Fatalf("neither token nor certificate: status %d, want 401", status)
+	}
+}
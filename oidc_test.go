@@ -0,0 +1,183 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// mockIssuer is an OpenID Connect provider publishing one Ed25519 key
+type mockIssuer struct {
+	url string
+	key ed25519.PrivateKey
+}
+
+func startIssuer(t *testing.T) *mockIssuer {
+	t.Helper()
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	iss := &mockIssuer{key: priv}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{"issuer": iss.url, "jwks_uri": iss.url + "/jwks"})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{"keys": []map[string]string{{
+			"kty": "OKP", "crv": "Ed25519", "kid": "k1", "alg": "EdDSA", "use": "sig",
+			"x": base64.RawURLEncoding.EncodeToString(pub),
+		}}})
+	})
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+	iss.url = srv.URL
+	return iss
+}
+
+// token signs claims on top of valid defaults for sub
+func (iss *mockIssuer) token(t *testing.T, sub string, claims jwt.MapClaims) string {
+	t.Helper()
+	all := jwt.MapClaims{"iss": iss.url, "sub": sub, "aud": "secure-vault", "exp": time.Now().Add(time.Minute).Unix()}
+	for k, v := range claims {
+		all[k] = v
+	}
+	token := jwt.NewWithClaims(jwt.SigningMethodEdDSA, all)
+	token.Header["kid"] = "k1"
+	signed, err := token.SignedString(iss.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed
+}
+
+// TestOIDC signs in with tokens of a provider: its users and groups are known
+// by the provider's name, so one whose sub matches a local account gets none
+// of that account's entries, and its tenants and roles are only those mapped
+func TestOIDC(t *testing.T) {
+	iss := startIssuer(t)
+	vault := startVault(t, t.TempDir(), "vault",
+		"OIDC_ISSUERS=mock="+iss.url,
+		"OIDC_AUDIENCE=secure-vault",
+		"OIDC_TENANTS=mock:main=default,mock:acme-corp=acme",
+		"OIDC_ROLES=mock:vault-writers=writer,mock:vault-admins=admin",
+	)
+	admin := vault.token(t)
+
+	key := map[string]string{
+		"key":          "0279be667ef9dcbbac55a06295ce870b07029bfcdb2dce28d959f2815b16f81798",
+		"key_type":     "secp256k1",
+		"key_encoding": "hex",
+	}
+	var stored struct {
+		ID string `json:"id"`
+	}
+	if status := vault.call(t, "POST", "/vault/store", admin, key, &stored); status != http.StatusCreated {
+		t.Fatalf("store as the local admin: status %d", status)
+	}
+
+	// 1. A provider user named like the local admin is someone else
+	writer := iss.token(t, testAdmin, jwt.MapClaims{"tenant": "main", "roles": []string{"vault-writers"}})
+	if status := vault.call(t, "GET", "/vault/retrive/"+stored.ID, writer, nil, nil); status != http.StatusNotFound {
+		t.Fatalf("read of the local admin's entry: status %d, want 404", status)
+	}
+	if status := vault.call(t, "GET", "/admin/users", writer, nil, nil); status != http.StatusForbidden {
+		t.Fatalf("admin route with the writer role: status %d, want 403", status)
+	}
+	if status := vault.call(t, "POST", "/vault/store", writer, key, nil); status != http.StatusCreated {
+		t.Fatalf("store as a provider user: status %d", status)
+	}
+	admins := iss.token(t, "carol", jwt.MapClaims{"tenant": "main", "roles": []string{"vault-admins"}})
+	if status := vault.call(t, "GET", "/admin/tenants", admins, nil, nil); status != http.StatusForbidden {
+		t.Fatalf("instance-wide route with the admin claim: status %d, want 403", status)
+	}
+
+	// 2. Grants name provider users by the provider's name
+	grant := map[string]interface{}{"user_id": "mock:" + testAdmin, "rights": []string{"read"}}
+	if status := vault.call(t, "POST", "/vault/entries/"+stored.ID+"/grants", admin, grant, nil); status != http.StatusCreated {
+		t.Fatalf("grant to a provider user: status %d", status)
+	}
+	if status := vault.call(t, "GET", "/vault/retrive/"+stored.ID, writer, nil, nil); status != http.StatusOK {
+		t.Fatalf("read after the grant: status %d", status)
+	}
+
+	// 3. Groups are the provider's too
+	ops := iss.token(t, "dave", jwt.MapClaims{"tenant": "main", "roles": []string{"vault-writers"}, "groups": []string{"ops"}})
+	local := map[string]interface{}{"group": "ops", "rights": []string{"read"}}
+	if status := vault.call(t, "POST", "/vault/entries/"+stored.ID+"/grants", admin, local, nil); status != http.StatusCreated {
+		t.Fatalf("grant to the accounts' group: status %d", status)
+	}
+	if status := vault.call(t, "GET", "/vault/retrive/"+stored.ID, ops, nil, nil); status != http.StatusNotFound {
+		t.Fatalf("read through the accounts' group: status %d, want 404", status)
+	}
+	provider := map[string]interface{}{"group": "mock:ops", "rights": []string{"read"}}
+	if status := vault.call(t, "POST", "/vault/entries/"+stored.ID+"/grants", admin, provider, nil); status != http.StatusCreated {
+		t.Fatalf("grant to the provider's group: status %d", status)
+	}
+	if status := vault.call(t, "GET", "/vault/retrive/"+stored.ID, ops, nil, nil); status != http.StatusOK {
+		t.Fatalf("read through the provider's group: status %d", status)
+	}
+
+	// 4. Tenants come from OIDC_TENANTS only, and roles not mapped grant nothing
+	tenant := map[string]string{"name": "acme", "admin_user": "acme-admin", "admin_password": testPassword}
+	if status := vault.call(t, "POST", "/admin/tenants", admin, tenant, nil); status != http.StatusCreated {
+		t.Fatalf("create tenant acme: status %d", status)
+	}
+	acme := iss.token(t, "erin", jwt.MapClaims{"tenant": "acme-corp", "roles": []string{"vault-writers"}})
+	if status := vault.call(t, "GET", "/vault/retrive/"+stored.ID, acme, nil, nil); status != http.StatusNotFound {
+		t.Fatalf("read of a default tenant entry from acme: status %d, want 404", status)
+	}
+	if status := vault.call(t, "POST", "/vault/store", acme, key, nil); status != http.StatusCreated {
+		t.Fatalf("store in acme: status %d", status)
+	}
+	if status := vault.call(t, "POST", "/vault/store", iss.token(t, "frank", jwt.MapClaims{"tenant": "main", "roles": []string{"writer", "admin"}}), key, nil); status != http.StatusForbidden {
+		t.Fatalf("store with roles that are not mapped: status %d, want 403", status)
+	}
+
+	// 5. Tokens for another audience, expired or forged ones, and tenants not mapped are refused
+	refused := map[string]string{
+		"another audience": iss.token(t, "bob", jwt.MapClaims{"tenant": "main", "aud": "another-service"}),
+		"expired":          iss.token(t, "bob", jwt.MapClaims{"tenant": "main", "exp": time.Now().Add(-time.Hour).Unix()}),
+		"forged":           writer[:len(writer)-4] + "AAAA",
+		"no tenant claim":  iss.token(t, "bob", nil),
+		"unmapped tenant":  iss.token(t, "bob", jwt.MapClaims{"tenant": "acme"}),
+	}
+	for what, token := range refused {
+		if status := vault.call(t, "GET", "/vault/stats", token, nil, nil); status != http.StatusUnauthorized {
+			t.Errorf("%s token: status %d, want 401", what, status)
+		}
+	}
+}
+
+// TestOIDCIssuerNames checks that the vault refuses to start when two issuers
+// would share a name, and so their users' IDs
+func TestOIDCIssuerNames(t *testing.T) {
+	out := startFails(t, "OIDC_ISSUERS=https://idp.example.com/a,https://idp.example.com/b", "OIDC_AUDIENCE=secure-vault", "OIDC_TENANTS=idp.example.com=default")
+	if !strings.Contains(out, "are both named") {
+		t.Fatalf("two issuers named idp.example.com: %q", out)
+	}
+}
+
+// TestOIDCTenantMapping checks that the vault refuses to start when a provider
+// has no tenant mapped, or a mapping names an unknown provider or role
+func TestOIDCTenantMapping(t *testing.T) {
+	for env, want := range map[string]string{
+		"OIDC_TENANTS=":                          "maps no tenant for mock",
+		"OIDC_TENANTS=other=default":             "names no provider",
+		"OIDC_TENANTS=mock=default,mock=acme":    "mapped twice",
+		"OIDC_ROLES=mock:vault-admins=superuser": "unknown role",
+	} {
+		settings := []string{"OIDC_ISSUERS=mock=https://idp.example.com", "OIDC_AUDIENCE=secure-vault", "OIDC_TENANTS=mock=default", env}
+		if out := startFails(t, settings...); !strings.Contains(out, want) {
+			t.Errorf("%s: %q, want %q", env, out, want)
+		}
+	}
+}
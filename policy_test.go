@@ -0,0 +1,60 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+// TestPolicyDenyPrecedence checks that a matching deny wins over an allow and
+// over ownership, and that changes to policies apply at once
+func TestPolicyDenyPrecedence(t *testing.T) {
+	vault := startVault(t, t.TempDir(), "vault")
+	admin := vault.token(t)
+	bob := vault.user(t, admin, "bob", "")
+
+	key := map[string]interface{}{
+		"key":          "0279be667ef9dcbbac55a06295ce870b07029bfcdb2dce28d959f2815b16f81798",
+		"key_type":     "secp256k1",
+		"key_encoding": "hex",
+		"tags":         map[string]string{"env": "prod"},
+	}
+	var stored struct {
+		ID string `json:"id"`
+	}
+	if status := vault.call(t, "POST", "/vault/store", admin, key, &stored); status != http.StatusCreated {
+		t.Fatalf("store: status %d", status)
+	}
+	read := func(token string) int {
+		return vault.call(t, "GET", "/vault/retrive/"+stored.ID, token, nil, nil)
+	}
+
+	allow := map[string]interface{}{"rules": []map[string]interface{}{
+		{"effect": "allow", "subjects": map[string]interface{}{"users": []string{"bob"}}, "operations": []string{"read"}},
+	}}
+	if status := vault.call(t, "PUT", "/sys/policies/readers", admin, allow, nil); status != http.StatusOK {
+		t.Fatalf("store the allow policy: status %d", status)
+	}
+	if status := read(bob); status != http.StatusOK {
+		t.Fatalf("read allowed by a policy: status %d", status)
+	}
+
+	deny := map[string]interface{}{"rules": []map[string]interface{}{
+		{"effect": "deny", "subjects": map[string]interface{}{"users": []string{"*"}}, "operations": []string{"read"}, "entries": map[string]interface{}{"tags": map[string]string{"env": "prod"}}},
+	}}
+	if status := vault.call(t, "PUT", "/sys/policies/freeze-prod", admin, deny, nil); status != http.StatusOK {
+		t.Fatalf("store the deny policy: status %d", status)
+	}
+	if status := read(bob); status != http.StatusNotFound {
+		t.Fatalf("read allowed and denied: status %d, want 404", status)
+	}
+	if status := read(admin); status != http.StatusNotFound {
+		t.Fatalf("read by the owner, denied: status %d, want 404", status)
+	}
+
+	if status := vault.call(t, "DELETE", "/sys/policies/freeze-prod", admin, nil, nil); status != http.StatusNoContent {
+		t.Fatalf("delete the deny policy: status %d", status)
+	}
+	if status := read(bob); status != http.StatusOK {
+		t.Fatalf("read after the deny policy went: status %d", status)
+	}
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+// TestQuotaLimits checks that a user over QUOTA_MAX_ENTRIES gets 403, that the
+// limit is per user, and that only admins move it
+func TestQuotaLimits(t *testing.T) {
+	v := startVault(t, t.TempDir(), "vault", "QUOTA_MAX_ENTRIES=2")
+	admin := v.token(t)
+	alice := v.user(t, admin, "alice", "")
+	key := map[string]string{"key": testKey, "key_type": "secp256k1", "key_encoding": "hex"}
+
+	// 1. The default limit, for alice only
+	storeKeys(t, v, alice, 2)
+	if status := v.call(t, "POST", "/vault/store", alice, key, nil); status != http.StatusForbidden {
+		t.Fatalf("store over the limit: status %d, want 403", status)
+	}
+	storeKeys(t, v, admin, 1)
+
+	// 2. An override raises it; alice cannot set her own
+	if status := v.call(t, "PUT", "/admin/quotas/alice", alice, map[string]int{"max_entries": 10}, nil); status != http.StatusForbidden {
+		t.Fatalf("override by alice: status %d, want 403", status)
+	}
+	if status := v.call(t, "PUT", "/admin/quotas/alice", admin, map[string]int{"max_entries": 3}, nil); status != http.StatusOK {
+		t.Fatalf("override: status %d", status)
+	}
+	storeKeys(t, v, alice, 1)
+	if status := v.call(t, "POST", "/vault/store", alice, key, nil); status != http.StatusForbidden {
+		t.Fatalf("store over the override: status %d, want 403", status)
+	}
+
+	// 3. Without the override the default applies again
+	var quota struct {
+		Limits struct {
+			MaxEntries int64 `json:"max_entries"`
+		} `json:"limits"`
+		Usage struct {
+			Entries int64 `json:"entries"`
+		} `json:"usage"`
+	}
+	if status := v.call(t, "DELETE", "/admin/quotas/alice", admin, nil, &quota); status != http.StatusOK {
+		t.Fatalf("remove override: status %d", status)
+	}
+	if quota.Limits.MaxEntries != 2 || quota.Usage.Entries != 3 {
+		t.Fatalf("quota after removing the override: %+v", quota)
+	}
+	if status := v.call(t, "POST", "/vault/store", alice, key, nil); status != http.StatusForbidden {
+		t.Fatalf("store over the default: status %d, want 403", status)
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"net/http"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"go.etcd.io/bbolt"
+)
+
+type rekeyJob struct {
+	ID        string `json:"id"`
+	Status    string `json:"status"`
+	Total     int    `json:"total"`
+	Processed int    `json:"processed"`
+	Migrated  int    `json:"migrated"`
+	Failures  map[string]struct {
+		Attempts int `json:"attempts"`
+	} `json:"failures"`
+	FinishedAt *time.Time `json:"finished_at"`
+}
+
+func rekeyStatus(t *testing.T, v *vaultProcess, token string) rekeyJob {
+	t.Helper()
+	var job rekeyJob
+	if status := v.call(t, "GET", "/vault/set-mode/status", token, nil, &job); status != http.StatusOK {
+		t.Fatalf("rekey status: status %d", status)
+	}
+	return job
+}
+
+// TestRekeyJobResume stops the server in the middle of a re-encryption job:
+// the restarted server carries on with the same job, and retries an entry it
+// cannot migrate with growing delays until it gives up on it
+func TestRekeyJobResume(t *testing.T) {
+	dir := t.TempDir()
+	vault := startVault(t, dir, "vault")
+	storeKeys(t, vault, vault.token(t), 3)
+	vault.stop()
+
+	// An entry of a schema this server does not know fails every attempt
+	db, err := bbolt.Open(filepath.Join(dir, "vault.db"), 0600, &bbolt.Options{Timeout: time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.Update(func(tx *bbolt.Tx) error {
+		return tx.Bucket([]byte("vault")).Put([]byte("unreadable"), []byte("SV\xff"))
+	})
+	db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 1. The job handles one entry, then waits longer than the test
+	vault = startVault(t, dir, "vault", "REKEY_BATCH_SIZE=1", "REKEY_BATCH_PAUSE=1h")
+	admin := vault.token(t)
+	var started struct {
+		Job rekeyJob `json:"job"`
+	}
+	if status := vault.call(t, "POST", "/vault/set-mode", admin, map[string]string{"mode": "quantum-safe"}, &started); status != http.StatusAccepted {
+		t.Fatalf("set-mode: status %d", status)
+	}
+	eventually(t, 5*time.Second, "the first batch", func() bool {
+		return rekeyStatus(t, vault, admin).Processed == 1
+	})
+	vault.stop()
+
+	// 2. The restarted server resumes it
+	restarted := time.Now()
+	vault = startVault(t, dir, "vault", "REKEY_BATCH_SIZE=1", "REKEY_BATCH_PAUSE=10ms", "REKEY_RETRY_DELAY=200ms", "REKEY_MAX_ATTEMPTS=3")
+	admin = vault.token(t)
+	var job rekeyJob
+	eventually(t, 10*time.Second, "the job to finish", func() bool {
+		job = rekeyStatus(t, vault, admin)
+		return job.FinishedAt != nil
+	})
+	if job.ID != started.Job.ID {
+		t.Fatalf("finished job %s, want the one started before the restart, %s", job.ID, started.Job.ID)
+	}
+	if job.Status != "completed_with_errors" || job.Processed != 4 || job.Migrated != 3 {
+		t.Fatalf("job finished as %s with %d processed and %d migrated, want completed_with_errors, 4 and 3", job.Status, job.Processed, job.Migrated)
+	}
+	if f := job.Failures["unreadable"]; f.Attempts != 3 {
+		t.Fatalf("unreadable entry tried %d times, want 3", f.Attempts)
+	}
+
+	// 3. The first attempt after the restart was followed by retries 200ms, then 400ms later
+	if took := job.FinishedAt.Sub(restarted); took < 600*time.Millisecond {
+		t.Fatalf("job finished %v after the restart, want at least 600ms of backoff", took)
+	}
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestReplication runs a leader and a follower as two processes: the follower
+// seeds from the leader, serves its reads, refuses writes, follows a rotation
+// and takes writes once promoted
+func TestReplication(t *testing.T) {
+	dir := t.TempDir()
+	const secret = "replication-test-secret"
+	leader := startVault(t, dir, "leader", "REPLICATION_TOKEN="+secret)
+	token := leader.token(t)
+
+	var stored struct {
+		ID string `json:"id"`
+	}
+	key := map[string]string{
+		"key":          "0279be667ef9dcbbac55a06295ce870b07029bfcdb2dce28d959f2815b16f81798",
+		"key_type":     "secp256k1",
+		"key_encoding": "hex",
+		"label":        "replicated",
+	}
+	if status := leader.call(t, "POST", "/vault/store", token, key, &stored); status != http.StatusCreated {
+		t.Fatalf("store on leader: status %d", status)
+	}
+
+	follower := startVault(t, dir, "follower",
+		"REPLICATION_ROLE=follower",
+		"REPLICATION_LEADER="+leader.url,
+		"REPLICATION_TOKEN="+secret,
+		"REPLICATION_POLL_INTERVAL=100ms",
+	)
+
+	// 1. Seeded data and the leader's tokens work on the follower
+	var got struct {
+		Label    string `json:"label"`
+		Revision uint64 `json:"revision"`
+	}
+	if status := follower.call(t, "GET", "/vault/retrive/"+stored.ID, token, nil, &got); status != http.StatusOK || got.Label != "replicated" {
+		t.Fatalf("read on follower: status %d, label %q", status, got.Label)
+	}
+	if status := follower.call(t, "POST", "/vault/store", token, key, nil); status != http.StatusServiceUnavailable {
+		t.Fatalf("write on follower: status %d, want 503", status)
+	}
+
+	// 2. A rotation on the leader reaches the follower
+	if status := leader.call(t, "POST", "/vault/rotate/"+stored.ID, token, key, nil); status != http.StatusOK {
+		t.Fatalf("rotate on leader: status %d", status)
+	}
+	eventually(t, 10*time.Second, "the rotation to replicate", func() bool {
+		follower.call(t, "GET", "/vault/retrive/"+stored.ID, token, nil, &got)
+		return got.Revision == 2
+	})
+
+	var status struct {
+		Role      string `json:"role"`
+		Seq       uint64 `json:"seq"`
+		LeaderSeq uint64 `json:"leader_seq"`
+		LagEvents uint64 `json:"lag_events"`
+	}
+	if code := follower.call(t, "GET", "/admin/replication/status", token, nil, &status); code != http.StatusOK {
+		t.Fatalf("replication status: status %d", code)
+	}
+	if status.Role != "follower" || status.Seq != status.LeaderSeq || status.LagEvents != 0 {
+		t.Fatalf("replication status: %+v", status)
+	}
+
+	// 3. Once promoted, the follower accepts writes
+	if code := follower.call(t, "POST", "/admin/replication/promote", token, nil, &status); code != http.StatusOK || status.Role != "leader" {
+		t.Fatalf("promote: status %d, role %q", code, status.Role)
+	}
+	key["label"] = fmt.Sprintf("written after promotion at %d", status.Seq)
+	if code := follower.call(t, "POST", "/vault/store", token, key, nil); code != http.StatusCreated {
+		t.Fatalf("store on promoted follower: status %d", code)
+	}
+}
+
+// TestReplicationLogNeedsToken checks that nothing is kept for followers, and
+// none can attach, while replication is not enabled
+func TestReplicationLogNeedsToken(t *testing.T) {
+	leader := startVault(t, t.TempDir(), "leader")
+	if status := leader.call(t, "GET", "/replication/log?after=0&keystore_after=0", "", nil, nil); status != http.StatusNotFound {
+		t.Fatalf("change log without REPLICATION_TOKEN: status %d, want 404", status)
+	}
+}
+
+// TestReplicationLeaderRestart runs a leader and two followers. A follower
+// that was down while the leader restarted still finds its changes, as its
+// acknowledgement outlives the restart, and one that fell behind what the
+// leader keeps is seeded again.
+func TestReplicationLeaderRestart(t *testing.T) {
+	dir := t.TempDir()
+	const secret = "replication-test-secret"
+	leaderEnv := []string{"REPLICATION_TOKEN=" + secret, "REPLICATION_LOG_RETAIN=8", "REPLICATION_LOG_MIN_RETAIN=1"}
+	leader := startVault(t, dir, "leader", leaderEnv...)
+	token := leader.token(t)
+	u, err := url.Parse(leader.url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaderEnv = append(leaderEnv, "PORT="+u.Port())
+
+	followerEnv := []string{
+		"REPLICATION_ROLE=follower",
+		"REPLICATION_LEADER=" + leader.url,
+		"REPLICATION_TOKEN=" + secret,
+		"REPLICATION_POLL_INTERVAL=100ms",
+	}
+	a := startVault(t, dir, "a", followerEnv...)
+	b := startVault(t, dir, "b", followerEnv...)
+	replicated := func(f *vaultProcess, id string) {
+		t.Helper()
+		eventually(t, 10*time.Second, id+" to replicate", func() bool {
+			return f.call(t, "GET", "/vault/retrive/"+id, token, nil, nil) == http.StatusOK
+		})
+	}
+	first := storeKeys(t, leader, token, 1)
+	replicated(a, first[0])
+	replicated(b, first[0])
+
+	// 1. b misses changes on both sides of a leader restart; a applies them all
+	b.stop()
+	missed := storeKeys(t, leader, token, 2)
+	replicated(a, missed[1])
+	leader.stop()
+	leader = startVault(t, dir, "leader", leaderEnv...)
+	missed = append(missed, storeKeys(t, leader, token, 2)...)
+	replicated(a, missed[3])
+
+	b = startVault(t, dir, "b", followerEnv...)
+	for _, id := range missed {
+		replicated(b, id)
+	}
+	if strings.Contains(b.log.String(), "seeding again") {
+		t.Fatalf("b was seeded again although the leader held its changes:\n%s", b.log)
+	}
+
+	// 2. b misses more changes than the leader keeps
+	b.stop()
+	missed = storeKeys(t, leader, token, 9)
+	replicated(a, missed[8])
+	b = startVault(t, dir, "b", followerEnv...)
+	for _, id := range missed {
+		replicated(b, id)
+	}
+	if !strings.Contains(b.log.String(), "re-seeded") {
+		t.Fatalf("b caught up without being seeded again:\n%s", b.log)
+	}
+	if status := b.call(t, "POST", "/vault/store", token, map[string]string{"key": testKey, "key_type": "secp256k1", "key_encoding": "hex"}, nil); status != http.StatusServiceUnavailable {
+		t.Fatalf("write on re-seeded follower: status %d, want 503", status)
+	}
+}
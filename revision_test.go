@@ -0,0 +1,48 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+// TestRotateIfMatch checks that rotate and metadata edits only apply to the
+// revision named by If-Match, and refuse a stale one with 412
+func TestRotateIfMatch(t *testing.T) {
+	v := startVault(t, t.TempDir(), "vault")
+	token := v.token(t)
+	id := storeKeys(t, v, token, 1)[0]
+	key := map[string]string{"key": testKey, "key_type": "secp256k1", "key_encoding": "hex"}
+	ifMatch := func(etag string) http.Header {
+		return http.Header{"If-Match": {etag}}
+	}
+
+	status, header := v.request(t, "GET", "/vault/retrive/"+id, token, nil, nil, nil)
+	if status != http.StatusOK || header.Get("ETag") != `"1"` {
+		t.Fatalf("retrieve: status %d, ETag %s", status, header.Get("ETag"))
+	}
+
+	// 1. The current revision
+	status, header = v.request(t, "POST", "/vault/rotate/"+id, token, ifMatch(`"1"`), key, nil)
+	if status != http.StatusOK || header.Get("ETag") != `"2"` {
+		t.Fatalf("rotate at the current revision: status %d, ETag %s", status, header.Get("ETag"))
+	}
+
+	// 2. A stale one, for both kinds of change
+	if status, _ := v.request(t, "POST", "/vault/rotate/"+id, token, ifMatch(`"1"`), key, nil); status != http.StatusPreconditionFailed {
+		t.Fatalf("rotate at a stale revision: status %d, want 412", status)
+	}
+	label := map[string]string{"label": "stale"}
+	if status, _ := v.request(t, "PATCH", "/vault/entries/"+id, token, ifMatch(`"1"`), label, nil); status != http.StatusPreconditionFailed {
+		t.Fatalf("metadata edit at a stale revision: status %d, want 412", status)
+	}
+
+	// 3. Something that is not an entry ETag
+	if status, _ := v.request(t, "POST", "/vault/rotate/"+id, token, ifMatch(`W/"2"`), key, nil); status != http.StatusBadRequest {
+		t.Fatalf("rotate with a weak ETag: status %d, want 400", status)
+	}
+
+	status, header = v.request(t, "GET", "/vault/retrive/"+id, token, nil, nil, nil)
+	if status != http.StatusOK || header.Get("ETag") != `"2"` {
+		t.Fatalf("refused changes moved the revision: status %d, ETag %s", status, header.Get("ETag"))
+	}
+}
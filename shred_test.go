@@ -0,0 +1,67 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TestShredUser checks that shredding a user tombstones their entries, leaves
+// other users alone, and makes the copies in an earlier backup undecryptable
+func TestShredUser(t *testing.T) {
+	dir := t.TempDir()
+	v := startVault(t, dir, "vault")
+	admin := v.token(t)
+	alice := v.user(t, admin, "alice", "")
+	bob := v.user(t, admin, "bob", "")
+	aliceKeys := storeKeys(t, v, alice, 2)
+	bobKey := storeKeys(t, v, bob, 1)[0]
+
+	// A backup from before the shred
+	snapshot := filepath.Join(dir, "snapshot.tar")
+	var data []byte
+	if status := v.call(t, "GET", "/admin/backup", admin, nil, &data); status != http.StatusOK {
+		t.Fatalf("backup: status %d", status)
+	}
+	if err := os.WriteFile(snapshot, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	// 1. Shred alice
+	var report struct {
+		KEKDestroyed  bool `json:"kek_destroyed"`
+		KeystoreWiped bool `json:"keystore_wiped"`
+		Entries       int  `json:"entries"`
+	}
+	if status := v.call(t, "POST", "/admin/users/alice/shred", admin, nil, &report); status != http.StatusOK {
+		t.Fatalf("shred: status %d", status)
+	}
+	if !report.KEKDestroyed || !report.KeystoreWiped || report.Entries != 2 {
+		t.Fatalf("shred report: %+v", report)
+	}
+	for _, id := range aliceKeys {
+		if status := v.call(t, "GET", "/vault/retrive/"+id, alice, nil, nil); status != http.StatusGone {
+			t.Fatalf("shredded entry %s: status %d, want 410", id, status)
+		}
+	}
+	if status := v.call(t, "GET", "/vault/retrive/"+bobKey, bob, nil, nil); status != http.StatusOK {
+		t.Fatalf("another user's entry after the shred: status %d", status)
+	}
+	v.stop()
+
+	// 2. The backup still holds alice's entries, but they no longer decrypt
+	out, err := runCommand(t, dir, "vault", nil, "restore", "-in", snapshot)
+	if err == nil || !strings.Contains(out, "cannot be decrypted") {
+		t.Fatalf("restore of a backup from before the shred: %v\n%s", err, out)
+	}
+	for _, id := range aliceKeys {
+		if !strings.Contains(out, id) {
+			t.Fatalf("restore report does not name shredded entry %s:\n%s", id, out)
+		}
+	}
+	if strings.Contains(out, bobKey) {
+		t.Fatalf("restore report names an entry of another user:\n%s", out)
+	}
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/decred/dcrd/dcrec/secp256k1/v4"
+	"github.com/decred/dcrd/dcrec/secp256k1/v4/ecdsa"
+	"golang.org/x/crypto/sha3"
+)
+
+// signInKey is the secp256k1 private key 1; its public key is the generator
+var signInKey = secp256k1.PrivKeyFromBytes(append(bytes.Repeat([]byte{0}, 31), 1))
+
+const signInAddress = "0x7E5F4552091A69125d5DfCb7b8C2659029395Bdf"
+
+// personalSign signs message as EIP-191 personal_sign does: r || s || v
+func personalSign(message string) string {
+	h := sha3.NewLegacyKeccak256()
+	h.Write([]byte("\x19Ethereum Signed Message:\n" + strconv.Itoa(len(message)) + message))
+	compact := ecdsa.SignCompact(signInKey, h.Sum(nil), false) // v || r || s
+	return "0x" + hex.EncodeToString(append(compact[1:], compact[0]))
+}
+
+// signIn asks for a challenge for keyID, signs it and returns the status of the token request
+func signIn(t *testing.T, v *vaultProcess, user, keyID string) int {
+	t.Helper()
+	var challenge struct {
+		Nonce   string `json:"nonce"`
+		Message string `json:"message"`
+	}
+	req := map[string]string{"user_id": user, "key_id": keyID, "address": signInAddress}
+	if status := v.call(t, "POST", "/auth/challenge", "", req, &challenge); status != http.StatusOK {
+		t.Fatalf("challenge: status %d", status)
+	}
+	signed := map[string]string{"user_id": user, "nonce": challenge.Nonce, "signature": personalSign(challenge.Message)}
+	return v.call(t, "POST", "/auth/token", "", signed, nil)
+}
+
+// TestSignInKey signs in with a stored secp256k1 key: only once its owner
+// marked it, and no longer after someone else rotated it
+func TestSignInKey(t *testing.T) {
+	vault := startVault(t, t.TempDir(), "vault")
+	admin := vault.token(t)
+
+	key := map[string]string{
+		"key":          hex.EncodeToString(signInKey.PubKey().SerializeCompressed()),
+		"key_type":     "secp256k1",
+		"key_encoding": "hex",
+	}
+	var stored struct {
+		ID string `json:"id"`
+	}
+	if status := vault.call(t, "POST", "/vault/store", admin, key, &stored); status != http.StatusCreated {
+		t.Fatalf("store: status %d", status)
+	}
+
+	// 1. Unknown users and keys get a challenge too, but no token
+	if status := signIn(t, vault, "nobody", "no-such-entry"); status != http.StatusUnauthorized {
+		t.Fatalf("sign-in with an unknown key: status %d, want 401", status)
+	}
+
+	// 2. The key signs in once its owner marked it
+	if status := signIn(t, vault, testAdmin, stored.ID); status != http.StatusUnauthorized {
+		t.Fatalf("sign-in with an unmarked key: status %d, want 401", status)
+	}
+	mark := map[string]bool{"sign_in": true}
+	if status := vault.call(t, "PATCH", "/vault/entries/"+stored.ID, admin, mark, nil); status != http.StatusOK {
+		t.Fatalf("mark as sign-in key: status %d", status)
+	}
+	if status := signIn(t, vault, testAdmin, stored.ID); status != http.StatusOK {
+		t.Fatalf("sign-in with a marked key: status %d", status)
+	}
+
+	// 3. A user allowed to rotate the key cannot mark it, and a rotation of theirs clears the mark
+	bob := map[string]string{"user_id": "bob", "password": testPassword}
+	if status := vault.call(t, "POST", "/admin/users", admin, bob, nil); status != http.StatusCreated {
+		t.Fatalf("create bob: status %d", status)
+	}
+	grant := map[string]interface{}{"user_id": "bob", "rights": []string{"read", "rotate"}}
+	if status := vault.call(t, "POST", "/vault/entries/"+stored.ID+"/grants", admin, grant, nil); status != http.StatusCreated {
+		t.Fatalf("grant to bob: status %d", status)
+	}
+	var signedIn struct {
+		Token string `json:"token"`
+	}
+	if status := vault.call(t, "POST", "/auth/token", "", bob, &signedIn); status != http.StatusOK {
+		t.Fatalf("bob's sign-in: status %d", status)
+	}
+	if status := vault.call(t, "PATCH", "/vault/entries/"+stored.ID, signedIn.Token, mark, nil); status != http.StatusNotFound {
+		t.Fatalf("mark by a user without the update right: status %d, want 404", status)
+	}
+	if status := vault.call(t, "POST", "/vault/rotate/"+stored.ID, signedIn.Token, key, nil); status != http.StatusOK {
+		t.Fatalf("rotate by bob: status %d", status)
+	}
+	if status := signIn(t, vault, testAdmin, stored.ID); status != http.StatusUnauthorized {
+		t.Fatalf("sign-in after bob's rotation: status %d, want 401", status)
+	}
+}
+
+// TestChallengeLimit checks that past AUTH_MAX_PENDING_CHALLENGES new
+// challenges are refused, so the pending ones stay usable, and that a used
+// one makes room
+func TestChallengeLimit(t *testing.T) {
+	vault := startVault(t, t.TempDir(), "vault", "AUTH_MAX_PENDING_CHALLENGES=2")
+	req := map[string]string{"user_id": testAdmin, "key_id": "some-entry", "address": signInAddress}
+	var first struct {
+		Nonce string `json:"nonce"`
+	}
+	if status := vault.call(t, "POST", "/auth/challenge", "", req, &first); status != http.StatusOK {
+		t.Fatalf("first challenge: status %d", status)
+	}
+	if status := vault.call(t, "POST", "/auth/challenge", "", req, nil); status != http.StatusOK {
+		t.Fatalf("second challenge: status %d", status)
+	}
+	if status := vault.call(t, "POST", "/auth/challenge", "", req, nil); status != http.StatusTooManyRequests {
+		t.Fatalf("third challenge: status %d, want 429", status)
+	}
+	other := map[string]string{"user_id": "bob", "key_id": "some-entry", "address": signInAddress}
+	if status := vault.call(t, "POST", "/auth/challenge", "", other, nil); status != http.StatusOK {
+		t.Fatalf("challenge for another user: status %d", status)
+	}
+
+	signed := map[string]string{"user_id": testAdmin, "nonce": first.Nonce, "signature": "0x00"}
+	if status := vault.call(t, "POST", "/auth/token", "", signed, nil); status != http.StatusUnauthorized {
+		t.Fatalf("badly signed challenge: status %d, want 401", status)
+	}
+	if status := vault.call(t, "POST", "/auth/challenge", "", req, nil); status != http.StatusOK {
+		t.Fatalf("challenge after one was used: status %d", status)
+	}
+}
+
+// TestChallengeLimitConfig checks that the vault refuses to start with a
+// limit below one
+func TestChallengeLimitConfig(t *testing.T) {
+	out := startFails(t, "AUTH_MAX_PENDING_CHALLENGES=0")
+	if !strings.Contains(out, "AUTH_MAX_PENDING_CHALLENGES must be") {
+		t.Fatalf("AUTH_MAX_PENDING_CHALLENGES=0: %q", out)
+	}
+}
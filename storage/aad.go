@@ -0,0 +1,77 @@
+package storage
+
+import (
+	"secure-vault/models"
+
+	"github.com/fxamacker/cbor/v2"
+)
+
+// Every envelope authenticates the entry's metadata as AES-GCM additional data,
+// so a record whose owner, label, tags, key type or grants were altered on disk
+// no longer decrypts. Mode, pinning, expiry and revision are not bound: they
+// change without the key being re-sealed.
+var aadContext = []byte("secure-vault/entry-aad/v1")
+
+var aadEnc cbor.EncMode
+
+func init() {
+	var err error
+	if aadEnc, err = cbor.CoreDetEncOptions().EncMode(); err != nil {
+		panic(err)
+	}
+}
+
+type boundMetadata struct {
+	ID          string            `cbor:"1,keyasint"`
+	UserID      string            `cbor:"2,keyasint"`
+	Label       string            `cbor:"3,keyasint"`
+	Tags        map[string]string `cbor:"4,keyasint,omitempty"`
+	CreatedAt   int64             `cbor:"5,keyasint"` // unix nanoseconds; stable across encodings
+	KeyType     string            `cbor:"6,keyasint"`
+	KeyEncoding string            `cbor:"7,keyasint"`
+	Grants      []boundGrant      `cbor:"8,keyasint,omitempty"`
+}
+
+type boundGrant struct {
+	ID        string   `cbor:"1,keyasint"`
+	UserID    string   `cbor:"2,keyasint,omitempty"`
+	Group     string   `cbor:"3,keyasint,omitempty"`
+	Rights    []string `cbor:"4,keyasint"`
+	ExpiresAt int64    `cbor:"5,keyasint,omitempty"` // unix nanoseconds
+}
+
+// entryAAD is the additional data of the entry's current envelope
+func entryAAD(entry *models.VaultEntry) []byte {
+	return metadataAAD(entry, entry.KeyType, entry.KeyEncoding)
+}
+
+// versionAAD is the additional data of a retained version. It matches what the
+// envelope was sealed with while current, so rotation can move it unchanged.
+func versionAAD(entry *models.VaultEntry, version *models.KeyVersion) []byte {
+	return metadataAAD(entry, version.KeyType, version.KeyEncoding)
+}
+
+func metadataAAD(entry *models.VaultEntry, keyType, keyEncoding string) []byte {
+	var grants []boundGrant
+	for _, g := range entry.Grants {
+		bg := boundGrant{ID: g.ID, UserID: g.UserID, Group: g.Group, Rights: g.Rights}
+		if g.ExpiresAt != nil {
+			bg.ExpiresAt = g.ExpiresAt.UnixNano()
+		}
+		grants = append(grants, bg)
+	}
+	body, err := aadEnc.Marshal(boundMetadata{
+		ID:          entry.ID,
+		UserID:      entry.UserID,
+		Label:       entry.Label,
+		Tags:        entry.Tags,
+		CreatedAt:   entry.CreatedAt.UnixNano(),
+		KeyType:     keyType,
+		KeyEncoding: keyEncoding,
+		Grants:      grants,
+	})
+	if err != nil {
+		panic("cannot encode entry metadata: " + err.Error()) // only strings and integers
+	}
+	return append(append([]byte(nil), aadContext...), body...)
+}
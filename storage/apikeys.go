@@ -0,0 +1,191 @@
+package storage
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"sort"
+	"strings"
+	"time"
+
+	"secure-vault/models"
+	"secure-vault/utils"
+)
+
+// API keys read sv_<tenant>_<id>_<secret>. Each tenant's apikeys bucket maps
+// the ID to the key's description and a SHA-256 hash of the secret; the secret
+// is random, so a slow hash adds nothing. Revoking a key deletes it.
+const (
+	apiKeysBucket = "apikeys"
+	apiKeyPrefix  = "sv_"
+)
+
+var (
+	ErrInvalidAPIKey = errors.New("invalid API key")
+	ErrAPIKeyExpired = errors.New("API key expired")
+	ErrNotService    = errors.New("not a service account")
+)
+
+// Last-used timestamps are written at most this often per key
+var apiKeyTouchInterval = utils.EnvDuration("API_KEY_LAST_USED_INTERVAL", time.Minute)
+
+type storedAPIKey struct {
+	models.APIKey
+	SecretHash string `json:"secret_hash"`
+}
+
+func hashSecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// parseSecretToken splits a presented API key or refresh token into its
+// tenant, ID and secret
+func parseSecretToken(prefix, raw string) (tenant, id, secret string, ok bool) {
+	parts := strings.Split(strings.TrimPrefix(raw, prefix), "_")
+	if !strings.HasPrefix(raw, prefix) || len(parts) != 3 {
+		return "", "", "", false
+	}
+	return parts[0], parts[1], parts[2], parts[0] != "" && parts[1] != "" && parts[2] != ""
+}
+
+// putAPIKey stores a key record and records it in the change log
+func putAPIKey(tx *tenantTx, k *storedAPIKey) error {
+	b := tx.Bucket([]byte(apiKeysBucket))
+	if err := putJSON(b, []byte(k.ID), k); err != nil {
+		return err
+	}
+	return logChange(tx.Tx, models.ChangeAPIKey, tx.tenant, []byte(k.ID), b.Get([]byte(k.ID)))
+}
+
+// CreateAPIKey issues a key for a service account of tenant. The returned key
+// is the only copy.
+func CreateAPIKey(tenant, serviceAccount, name string, scopes []string, expiresAt *time.Time, createdBy string) (string, models.APIKey, error) {
+	idBytes := make([]byte, 8)
+	secretBytes := make([]byte, 32)
+	if _, err := rand.Read(idBytes); err != nil {
+		return "", models.APIKey{}, err
+	}
+	if _, err := rand.Read(secretBytes); err != nil {
+		return "", models.APIKey{}, err
+	}
+	id, secret := hex.EncodeToString(idBytes), hex.EncodeToString(secretBytes)
+
+	k := storedAPIKey{
+		APIKey: models.APIKey{
+			ID:             id,
+			Name:           name,
+			Tenant:         tenant,
+			ServiceAccount: serviceAccount,
+			Scopes:         scopes,
+			CreatedAt:      utils.Now(),
+			CreatedBy:      createdBy,
+			ExpiresAt:      expiresAt,
+		},
+		SecretHash: hashSecret(secret),
+	}
+	err := update(tenant, func(tx *tenantTx) error {
+		u := getUser(tx, serviceAccount)
+		switch {
+		case u == nil:
+			return ErrUserNotFound
+		case !u.ServiceAccount:
+			return ErrNotService
+		}
+		return putAPIKey(tx, &k)
+	})
+	if err != nil {
+		return "", k.APIKey, err
+	}
+
+	utils.Info("audit", "API key issued: tenant=%s service_account=%s id=%s scopes=%s by=%s",
+		tenant, serviceAccount, id, strings.Join(scopes, ","), createdBy)
+	return apiKeyPrefix + tenant + "_" + id + "_" + secret, k.APIKey, nil
+}
+
+// ListAPIKeys returns the keys of a service account, oldest first
+func ListAPIKeys(tenant, serviceAccount string) ([]models.APIKey, error) {
+	keys := []models.APIKey{}
+	err := view(tenant, func(tx *tenantTx) error {
+		if getUser(tx, serviceAccount) == nil {
+			return ErrUserNotFound
+		}
+		return tx.Bucket([]byte(apiKeysBucket)).ForEach(func(_, v []byte) error {
+			var k storedAPIKey
+			if err := json.Unmarshal(v, &k); err != nil {
+				return err
+			}
+			if k.ServiceAccount == serviceAccount {
+				keys = append(keys, k.APIKey)
+			}
+			return nil
+		})
+	})
+	sort.Slice(keys, func(i, j int) bool { return keys[i].CreatedAt.Before(keys[j].CreatedAt) })
+	return keys, err
+}
+
+// RevokeAPIKey deletes a key of a service account
+func RevokeAPIKey(tenant, serviceAccount, id string) error {
+	err := update(tenant, func(tx *tenantTx) error {
+		b := tx.Bucket([]byte(apiKeysBucket))
+		var k storedAPIKey
+		data := b.Get([]byte(id))
+		if data == nil || json.Unmarshal(data, &k) != nil || k.ServiceAccount != serviceAccount {
+			return ErrNotFound
+		}
+		if err := b.Delete([]byte(id)); err != nil {
+			return err
+		}
+		return logChange(tx.Tx, models.ChangeAPIKey, tx.tenant, []byte(id), nil)
+	})
+	if err == nil {
+		utils.Info("audit", "API key revoked: tenant=%s service_account=%s id=%s", tenant, serviceAccount, id)
+	}
+	return err
+}
+
+// AuthenticateAPIKey checks a presented key and returns its description. The
+// last-used time is refreshed on the leader.
+func AuthenticateAPIKey(raw string) (models.APIKey, error) {
+	tenant, id, secret, ok := parseSecretToken(apiKeyPrefix, raw)
+	if !ok || !TenantExists(tenant) {
+		return models.APIKey{}, ErrInvalidAPIKey
+	}
+
+	var k storedAPIKey
+	err := view(tenant, func(tx *tenantTx) error {
+		data := tx.Bucket([]byte(apiKeysBucket)).Get([]byte(id))
+		if data == nil {
+			return ErrInvalidAPIKey
+		}
+		return json.Unmarshal(data, &k)
+	})
+	if err != nil {
+		return models.APIKey{}, ErrInvalidAPIKey
+	}
+	if subtle.ConstantTimeCompare([]byte(hashSecret(secret)), []byte(k.SecretHash)) != 1 {
+		return models.APIKey{}, ErrInvalidAPIKey
+	}
+	now := utils.Now()
+	if k.IsExpired(now) {
+		return k.APIKey, ErrAPIKeyExpired
+	}
+
+	if !IsFollower() && (k.LastUsedAt == nil || now.Sub(*k.LastUsedAt) >= apiKeyTouchInterval) {
+		err := update(tenant, func(tx *tenantTx) error {
+			if tx.Bucket([]byte(apiKeysBucket)).Get([]byte(id)) == nil {
+				return nil // revoked meanwhile
+			}
+			k.LastUsedAt = &now
+			return putAPIKey(tx, &k)
+		})
+		if err != nil {
+			utils.Warn("auth", "cannot record use of API key %s: %v", id, err)
+		}
+	}
+	return k.APIKey, nil
+}
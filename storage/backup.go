@@ -0,0 +1,345 @@
+package storage
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"secure-vault/crypto"
+	"secure-vault/models"
+	"secure-vault/utils"
+
+	"go.etcd.io/bbolt"
+)
+
+const (
+	snapshotPayload          = "vault.db"
+	snapshotEncryptedPayload = "vault.db.enc"
+	snapshotManifest         = "manifest.json"
+)
+
+// WriteSnapshot streams a consistent copy of the database to w as a tar archive:
+// the database (encrypted when recipientPub is set) followed by manifest.json.
+// It runs in a read transaction, so writers are not blocked.
+func WriteSnapshot(w io.Writer, recipientPub []byte) (models.BackupManifest, error) {
+	var manifest models.BackupManifest
+
+	err := viewRoot(func(tx *bbolt.Tx) error {
+		manifest = models.BackupManifest{
+			FormatVersion:  models.BackupFormatVersion,
+			CreatedAt:      utils.Now(),
+			DBSize:         tx.Size(),
+			Payload:        snapshotPayload,
+			PayloadSize:    tx.Size(),
+			KeyFingerprint: utils.MasterKeyFingerprint(),
+			CryptoMode:     cryptoMode(&tenantTx{Tx: tx, tenant: models.DefaultTenant}),
+			Entries:        countEntries(tx),
+		}
+		if recipientPub != nil {
+			manifest.Encrypted = true
+			manifest.Cipher = crypto.SnapshotCipher
+			manifest.RecipientKey = hex.EncodeToString(recipientPub)
+			manifest.Payload = snapshotEncryptedPayload
+			manifest.PayloadSize = crypto.SealedSnapshotSize(manifest.DBSize)
+		}
+
+		tw := tar.NewWriter(w)
+		if err := tw.WriteHeader(&tar.Header{
+			Name:    manifest.Payload,
+			Mode:    0600,
+			Size:    manifest.PayloadSize,
+			ModTime: manifest.CreatedAt,
+		}); err != nil {
+			return err
+		}
+
+		// 1. Stream the database, hashing both the plain file and the stored payload
+		payloadHash, dbHash := sha256.New(), sha256.New()
+		var dst io.Writer = io.MultiWriter(tw, payloadHash)
+		var enc io.WriteCloser
+		if manifest.Encrypted {
+			var ephPub []byte
+			var err error
+			enc, ephPub, err = crypto.NewSnapshotEncrypter(dst, recipientPub)
+			if err != nil {
+				return err
+			}
+			manifest.EphemeralKey = hex.EncodeToString(ephPub)
+			dst = enc
+		}
+		if _, err := tx.WriteTo(io.MultiWriter(dst, dbHash)); err != nil {
+			return err
+		}
+		if enc != nil {
+			if err := enc.Close(); err != nil {
+				return err
+			}
+		}
+		manifest.DBSHA256 = hex.EncodeToString(dbHash.Sum(nil))
+		manifest.PayloadSHA256 = hex.EncodeToString(payloadHash.Sum(nil))
+
+		// 2. Manifest last, once the checksums are known
+		data, err := json.MarshalIndent(manifest, "", "  ")
+		if err != nil {
+			return err
+		}
+		if err := tw.WriteHeader(&tar.Header{
+			Name:    snapshotManifest,
+			Mode:    0600,
+			Size:    int64(len(data)),
+			ModTime: manifest.CreatedAt,
+		}); err != nil {
+			return err
+		}
+		if _, err := tw.Write(data); err != nil {
+			return err
+		}
+		return tw.Close()
+	})
+
+	return manifest, err
+}
+
+// RestoreSnapshot replaces the database at DBPath with the snapshot read from r.
+// The server must be stopped. Before the swap the archive checksums are verified,
+// the snapshot must have been taken under the currently loaded master key, and
+// every entry must decrypt; unless force is set, any failure aborts the restore.
+// recipientPriv is the operator's secp256k1 private key for encrypted snapshots.
+func RestoreSnapshot(r io.Reader, recipientPriv []byte, force bool) (models.RestoreReport, error) {
+	report := models.RestoreReport{}
+	livePath := DBPath()
+
+	// 1. Make sure nothing is serving the live database, and hold its lock meanwhile
+	if _, err := os.Stat(livePath); err == nil {
+		live, err := bbolt.Open(livePath, 0600, &bbolt.Options{Timeout: time.Second})
+		if err != nil {
+			return report, errors.New("live database is in use, stop the server before restoring")
+		}
+		defer live.Close()
+	}
+
+	// 2. Unpack into temp files next to the live database
+	stamp := utils.Now().Format("20060102T150405")
+	payloadPath := livePath + ".restore-" + stamp + ".payload"
+	dbPath := livePath + ".restore-" + stamp
+	defer os.Remove(payloadPath)
+	defer os.Remove(dbPath)
+
+	manifest, payloadSum, err := unpackSnapshot(r, payloadPath)
+	if err != nil {
+		return report, err
+	}
+	report.Manifest = manifest
+	if payloadSum != manifest.PayloadSHA256 {
+		return report, errors.New("snapshot payload checksum mismatch")
+	}
+
+	if manifest.Encrypted {
+		if recipientPriv == nil {
+			return report, errors.New("snapshot is encrypted, operator private key required")
+		}
+		if err := decryptSnapshotFile(payloadPath, dbPath, manifest, recipientPriv); err != nil {
+			return report, err
+		}
+	} else if err := os.Rename(payloadPath, dbPath); err != nil {
+		return report, err
+	}
+	if dbSum, err := fileSHA256(dbPath); err != nil {
+		return report, err
+	} else if dbSum != manifest.DBSHA256 {
+		return report, errors.New("snapshot database checksum mismatch")
+	}
+
+	// 3. Check the snapshot against the current master key
+	if manifest.KeyFingerprint != utils.MasterKeyFingerprint() {
+		return report, errors.New("snapshot was taken under a different master key (fingerprint " + manifest.KeyFingerprint + ")")
+	}
+	// User KEKs are not part of snapshots: entries open with the live keystore,
+	// so those of shredded users fail here
+	if keystore == nil {
+		if err := openKeystore(true); err != nil {
+			return report, err
+		}
+		defer closeKeystore()
+	}
+	if err := verifySnapshotEntries(dbPath, &report); err != nil {
+		return report, err
+	}
+	if len(report.Failures) > 0 && !force {
+		return report, errors.New("snapshot has entries that cannot be decrypted with the current master key and keystore")
+	}
+
+	// 4. Swap: keep the replaced database next to it
+	if _, err := os.Stat(livePath); err == nil {
+		report.PreviousDB = livePath + ".pre-restore-" + stamp
+		if err := os.Rename(livePath, report.PreviousDB); err != nil {
+			return report, err
+		}
+	}
+	if err := os.Rename(dbPath, livePath); err != nil {
+		return report, err
+	}
+	report.Restored = true
+	utils.Info("backup", "restored snapshot from %s (%d entries)", manifest.CreatedAt.Format(time.RFC3339), manifest.Entries)
+	return report, nil
+}
+
+// unpackSnapshot writes the payload member to payloadPath and returns the manifest
+// along with the payload's checksum
+func unpackSnapshot(r io.Reader, payloadPath string) (models.BackupManifest, string, error) {
+	var manifest models.BackupManifest
+	var payloadSum string
+	seenManifest := false
+
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return manifest, "", err
+		}
+		switch filepath.Base(hdr.Name) {
+		case snapshotPayload, snapshotEncryptedPayload:
+			f, err := os.OpenFile(payloadPath, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+			if err != nil {
+				return manifest, "", err
+			}
+			h := sha256.New()
+			_, err = io.Copy(io.MultiWriter(f, h), tr)
+			if cerr := f.Close(); err == nil {
+				err = cerr
+			}
+			if err != nil {
+				return manifest, "", err
+			}
+			payloadSum = hex.EncodeToString(h.Sum(nil))
+		case snapshotManifest:
+			if err := json.NewDecoder(tr).Decode(&manifest); err != nil {
+				return manifest, "", errors.New("invalid snapshot manifest: " + err.Error())
+			}
+			seenManifest = true
+		}
+	}
+
+	if !seenManifest || payloadSum == "" {
+		return manifest, "", errors.New("snapshot archive is incomplete")
+	}
+	if manifest.FormatVersion != models.BackupFormatVersion {
+		return manifest, "", errors.New("unsupported snapshot format version")
+	}
+	return manifest, payloadSum, nil
+}
+
+func decryptSnapshotFile(payloadPath, dbPath string, manifest models.BackupManifest, recipientPriv []byte) error {
+	ephPub, err := hex.DecodeString(manifest.EphemeralKey)
+	if err != nil {
+		return errors.New("invalid ephemeral key in manifest")
+	}
+	in, err := os.Open(payloadPath)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	plain, err := crypto.NewSnapshotDecrypter(in, manifest.PayloadSize, recipientPriv, ephPub)
+	if err != nil {
+		return err
+	}
+	out, err := os.OpenFile(dbPath, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, plain)
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// verifySnapshotEntries opens the unpacked snapshot read-only and decrypts every entry
+func verifySnapshotEntries(path string, report *models.RestoreReport) error {
+	snap, err := bbolt.Open(path, 0600, &bbolt.Options{ReadOnly: true, Timeout: time.Second})
+	if err != nil {
+		return errors.New("snapshot is not a valid database: " + err.Error())
+	}
+	defer snap.Close()
+
+	return snap.View(func(tx *bbolt.Tx) error {
+		if err := verifyKeyCheck(tx); err != nil {
+			return err
+		}
+		// Sealed metadata in the snapshot opens with the snapshot's own metadata key
+		if err := loadMetadataKey(tx); err != nil {
+			return err
+		}
+		if err := loadTenantKeys(tx); err != nil {
+			return err
+		}
+		return forEachTenant(func(tenant string) error {
+			b := (&tenantTx{Tx: tx, tenant: tenant}).Bucket([]byte(vaultBucket))
+			if b == nil {
+				return errors.New("snapshot has no vault bucket for tenant " + tenant)
+			}
+			return b.ForEach(func(k, v []byte) error {
+				entry, err := decodeEntry(tenant, v)
+				if err == nil && entry.IsTombstone() {
+					return nil // nothing left to decrypt
+				}
+				if err == nil {
+					_, err = DecryptEntry(&entry)
+				}
+				if err != nil {
+					if report.Failures == nil {
+						report.Failures = map[string]string{}
+					}
+					report.Failures[failureKey(tenant, string(k))] = err.Error()
+					return nil
+				}
+				report.Verified++
+				return nil
+			})
+		})
+	})
+}
+
+// countEntries counts the records of every tenant
+func countEntries(tx *bbolt.Tx) int {
+	n := tx.Bucket([]byte(vaultBucket)).Stats().KeyN
+	if tenants := tx.Bucket([]byte(tenantsBucket)); tenants != nil {
+		tenants.ForEach(func(name, _ []byte) error {
+			n += (&tenantTx{Tx: tx, tenant: string(name)}).Bucket([]byte(vaultBucket)).Stats().KeyN
+			return nil
+		})
+	}
+	return n
+}
+
+// failureKey names an entry in reports: the ID alone for the default tenant,
+// tenant/ID otherwise
+func failureKey(tenant, id string) string {
+	if tenant == models.DefaultTenant {
+		return id
+	}
+	return tenant + "/" + id
+}
+
+func fileSHA256(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
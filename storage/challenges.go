@@ -0,0 +1,176 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"secure-vault/models"
+	"secure-vault/utils"
+)
+
+// Sign-in challenges are kept in memory only: each works once, for a few
+// minutes, on the node that issued it. A user has at most
+// AUTH_MAX_PENDING_CHALLENGES pending, and the node maxChallenges; past either
+// new ones are refused until some are used or expire, so nobody can push out
+// someone else's.
+const maxChallenges = 10000
+
+var (
+	ErrNoSignInKey       = errors.New("no such sign-in key")
+	ErrTooManyChallenges = errors.New("too many pending challenges")
+)
+
+var (
+	challengeTTL                        = utils.EnvDuration("AUTH_CHALLENGE_TTL", 5*time.Minute)
+	maxUserChallenges, maxChallengesErr = envCount("AUTH_MAX_PENDING_CHALLENGES", 5)
+)
+
+// Pending challenges by nonce, their nonces by tenant and user, and all nonces
+// in the order they were issued, which is also the order they expire in
+var (
+	challengesMu    sync.Mutex
+	challenges      = map[string]models.Challenge{}
+	userChallenges  = map[string]map[string]struct{}{}
+	challengesQueue []string
+)
+
+// envCount reads a number of at least 1 from the environment, def when unset
+func envCount(name string, def int) (int, error) {
+	v := os.Getenv(name)
+	if v == "" {
+		return def, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 1 {
+		return def, fmt.Errorf("%s must be a whole number of at least 1", name)
+	}
+	return n, nil
+}
+
+// CheckChallengeConfig reports a malformed AUTH_MAX_PENDING_CHALLENGES
+func CheckChallengeConfig() error {
+	return maxChallengesErr
+}
+
+func challengeOwner(tenant, userID string) string {
+	return tenant + "/" + userID
+}
+
+// SignInKey returns the public key a user signs in with: an unexpired
+// secp256k1 or ed25519 entry the user owns and marked for signing in
+func SignInKey(tenant, userID, keyID string) (keyType string, pubKey []byte, err error) {
+	if !TenantExists(tenant) {
+		return "", nil, ErrNoSignInKey
+	}
+	entry, err := GetKey(tenant, keyID)
+	if err != nil {
+		return "", nil, ErrNoSignInKey
+	}
+	switch {
+	case !entry.IsOwner(models.Caller{UserID: userID}), !entry.SignIn,
+		entry.IsTombstone() || entry.IsExpired(utils.Now()),
+		!models.IsSignInKeyType(entry.KeyType):
+		return "", nil, ErrNoSignInKey
+	}
+	pubKey, err = DecryptEntry(&entry)
+	return entry.KeyType, pubKey, err
+}
+
+// IssueChallenge completes c with a fresh nonce and its lifetime, lets message
+// write the text to sign, and keeps it until it is used or expires. It fails
+// with ErrTooManyChallenges when the user or the node has too many pending.
+func IssueChallenge(c *models.Challenge, message func(c *models.Challenge) string) error {
+	nonce, err := randomHex(16)
+	if err != nil {
+		return err
+	}
+	c.Nonce = nonce
+	c.IssuedAt = utils.Now()
+	c.ExpiresAt = c.IssuedAt.Add(challengeTTL)
+	c.Message = message(c)
+
+	challengesMu.Lock()
+	defer challengesMu.Unlock()
+	dropExpiredChallenges(c.IssuedAt)
+	owner := challengeOwner(c.Tenant, c.UserID)
+	if len(userChallenges[owner]) >= maxUserChallenges || len(challenges) >= maxChallenges {
+		return ErrTooManyChallenges
+	}
+	challenges[nonce] = *c
+	if userChallenges[owner] == nil {
+		userChallenges[owner] = map[string]struct{}{}
+	}
+	userChallenges[owner][nonce] = struct{}{}
+	challengesQueue = append(challengesQueue, nonce)
+	return nil
+}
+
+// dropExpiredChallenges forgets the challenges expired by now, from the front
+// of the queue. challengesMu must be held.
+func dropExpiredChallenges(now time.Time) {
+	for len(challengesQueue) > 0 {
+		nonce := challengesQueue[0]
+		if c, ok := challenges[nonce]; ok {
+			if now.Before(c.ExpiresAt) {
+				return
+			}
+			deleteChallenge(nonce, c)
+		}
+		challengesQueue = challengesQueue[1:]
+	}
+}
+
+// deleteChallenge removes a pending challenge and its index entry; its nonce
+// leaves the queue when it reaches the front. challengesMu must be held.
+func deleteChallenge(nonce string, c models.Challenge) {
+	delete(challenges, nonce)
+	owner := challengeOwner(c.Tenant, c.UserID)
+	delete(userChallenges[owner], nonce)
+	if len(userChallenges[owner]) == 0 {
+		delete(userChallenges, owner)
+	}
+}
+
+// TakeChallenge removes and returns a pending challenge; a nonce works once
+func TakeChallenge(nonce string) (models.Challenge, bool) {
+	challengesMu.Lock()
+	defer challengesMu.Unlock()
+	c, ok := challenges[nonce]
+	if !ok {
+		return models.Challenge{}, false
+	}
+	deleteChallenge(nonce, c)
+	if !utils.Now().Before(c.ExpiresAt) {
+		return models.Challenge{}, false
+	}
+	return c, true
+}
+
+// RecordSignIn checks that a user who proved a key may sign in, and records
+// the login. Service accounts never sign in this way: they are limited to the
+// scopes of their API keys. A follower cannot record it.
+func RecordSignIn(tenant, userID string) (models.User, error) {
+	user, err := CheckUser(tenant, userID)
+	if err != nil {
+		return user, err
+	}
+	if user.ServiceAccount {
+		return user, ErrServiceAccount
+	}
+	now := utils.Now()
+	recorded, err := updateUser(tenant, userID, func(u *storedUser) error {
+		u.LastLogin = &now
+		return nil
+	})
+	switch {
+	case err == nil:
+		return recorded, nil
+	case errors.Is(err, ErrReadOnlyReplica):
+		return user, nil
+	}
+	return user, err
+}
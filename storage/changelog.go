@@ -0,0 +1,430 @@
+package storage
+
+import (
+	"archive/tar"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"time"
+
+	"secure-vault/models"
+	"secure-vault/utils"
+
+	"go.etcd.io/bbolt"
+)
+
+// Every replicated write appends an event to the changelog bucket in the same
+// transaction, keyed by the bucket's sequence. The keystore keeps its own log.
+// Events hold copies of what was written, so they are only kept while
+// replication is enabled (REPLICATION_TOKEN), and only until every follower
+// acknowledged them (keeping at least the last REPLICATION_LOG_MIN_RETAIN), or
+// at most the last REPLICATION_LOG_RETAIN. Without
+// replication only the position advances, so a follower that missed changes
+// finds the gap. A follower that falls behind what is kept is seeded again.
+const changelogBucket = "changelog"
+
+var (
+	changelogRetain    = uint64(utils.EnvInt("REPLICATION_LOG_RETAIN", 100000))
+	changelogBatch     = utils.EnvInt("REPLICATION_BATCH_SIZE", 500)
+	replicationEnabled = os.Getenv("REPLICATION_TOKEN") != ""
+
+	// Events acknowledged by every follower are still kept this many back
+	changelogMinRetain = uint64(utils.EnvInt("REPLICATION_LOG_MIN_RETAIN", 1000))
+
+	// A follower not heard from for this long no longer holds events back
+	followerAckTTL = utils.EnvDuration("REPLICATION_ACK_TTL", 24*time.Hour)
+)
+
+// followerAck is how far a follower applied both logs, as of its last pull.
+// Acks live in the followeracks bucket, which is neither replicated nor
+// logged, so a restarted leader still holds the changes its followers need.
+type followerAck struct {
+	Seq         uint64    `json:"seq"`
+	KeystoreSeq uint64    `json:"keystore_seq"`
+	At          time.Time `json:"at"`
+}
+
+const followerAcksBucket = "followeracks"
+
+var (
+	ErrLogTrimmed      = errors.New("change log no longer holds the requested position, seed the follower again")
+	ErrFollowerAhead   = errors.New("follower is ahead of the leader")
+	ErrReadOnlyReplica = errors.New("read-only follower")
+)
+
+func seqKey(seq uint64) []byte {
+	return binary.BigEndian.AppendUint64(nil, seq)
+}
+
+// appendLog stores the event built by v under the next sequence of b, and drops
+// the event that fell out of the retention window
+func appendLog(b *bbolt.Bucket, v func(seq uint64) interface{}) error {
+	seq, err := b.NextSequence()
+	if err != nil {
+		return err
+	}
+	if !replicationEnabled {
+		return trimLog(b, seq) // normally empty already
+	}
+	if err := putJSON(b, seqKey(seq), v(seq)); err != nil {
+		return err
+	}
+	if seq <= changelogRetain {
+		return nil
+	}
+	return trimLog(b, seq-changelogRetain)
+}
+
+// trimLog drops the events of b up to position seq: normally one, more once
+// REPLICATION_LOG_RETAIN was lowered or followers acknowledged a batch
+func trimLog(b *bbolt.Bucket, seq uint64) error {
+	c := b.Cursor()
+	for k, _ := c.First(); k != nil && binary.BigEndian.Uint64(k) <= seq; k, _ = c.First() {
+		if err := c.Delete(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// putAck records the positions follower applied and returns how far every
+// follower heard from within REPLICATION_ACK_TTL got, dropping the others
+func putAck(acks *bbolt.Bucket, follower string, ack followerAck) (minSeq, minKeystoreSeq uint64, err error) {
+	if err := putJSON(acks, []byte(follower), ack); err != nil {
+		return 0, 0, err
+	}
+	minSeq, minKeystoreSeq = ack.Seq, ack.KeystoreSeq
+	var expired [][]byte
+	err = acks.ForEach(func(id, v []byte) error {
+		var other followerAck
+		if err := json.Unmarshal(v, &other); err != nil {
+			return err
+		}
+		if ack.At.Sub(other.At) > followerAckTTL {
+			expired = append(expired, append([]byte(nil), id...))
+			return nil
+		}
+		minSeq = min(minSeq, other.Seq)
+		minKeystoreSeq = min(minKeystoreSeq, other.KeystoreSeq)
+		return nil
+	})
+	for _, id := range expired {
+		if err == nil {
+			err = acks.Delete(id)
+		}
+	}
+	return minSeq, minKeystoreSeq, err
+}
+
+// trimTarget returns the position up to which the events of b every live
+// follower applied can go, keeping the last REPLICATION_LOG_MIN_RETAIN, and
+// whether any event is that old
+func trimTarget(b *bbolt.Bucket, acked uint64) (uint64, bool) {
+	if b.Sequence() <= changelogMinRetain {
+		return 0, false
+	}
+	upTo := min(acked, b.Sequence()-changelogMinRetain)
+	first, _ := b.Cursor().First()
+	return upTo, first != nil && binary.BigEndian.Uint64(first) <= upTo
+}
+
+// acknowledge records the positions a follower pulled after and drops the
+// events every follower has applied. A follower that keeps pulling at the same
+// positions only refreshes its ack once a minute.
+func acknowledge(follower string, seq, keystoreSeq uint64) error {
+	now := utils.Now()
+	var stored followerAck
+	err := viewRoot(func(tx *bbolt.Tx) error {
+		if v := tx.Bucket([]byte(followerAcksBucket)).Get([]byte(follower)); v != nil {
+			return json.Unmarshal(v, &stored)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if stored.Seq == seq && stored.KeystoreSeq == keystoreSeq && now.Sub(stored.At) < time.Minute {
+		return nil
+	}
+
+	var minKeystoreSeq uint64
+	err = updateRoot(func(tx *bbolt.Tx) error {
+		minSeq, minKS, err := putAck(tx.Bucket([]byte(followerAcksBucket)), follower, followerAck{Seq: seq, KeystoreSeq: keystoreSeq, At: now})
+		if err != nil {
+			return err
+		}
+		minKeystoreSeq = minKS
+		log := tx.Bucket([]byte(changelogBucket))
+		if upTo, ok := trimTarget(log, minSeq); ok {
+			return trimLog(log, upTo)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// The keystore's write lock is only taken when there is something to drop
+	var trim bool
+	keystoreMu.RLock()
+	err = keystore.View(func(tx *bbolt.Tx) error {
+		_, trim = trimTarget(tx.Bucket([]byte(changelogBucket)), minKeystoreSeq)
+		return nil
+	})
+	keystoreMu.RUnlock()
+	if err != nil || !trim {
+		return err
+	}
+	keystoreMu.Lock()
+	defer keystoreMu.Unlock()
+	return keystore.Update(func(tx *bbolt.Tx) error {
+		log := tx.Bucket([]byte(changelogBucket))
+		if upTo, ok := trimTarget(log, minKeystoreSeq); ok {
+			return trimLog(log, upTo)
+		}
+		return nil
+	})
+}
+
+// holdForSeed acknowledges the current positions for a follower about to be
+// seeded, so the events after its seed are kept until it pulls them
+func holdForSeed(follower string) error {
+	var keystoreSeq uint64
+	keystoreMu.RLock()
+	err := keystore.View(func(tx *bbolt.Tx) error {
+		keystoreSeq = tx.Bucket([]byte(changelogBucket)).Sequence()
+		return nil
+	})
+	keystoreMu.RUnlock()
+	if err != nil {
+		return err
+	}
+	return updateRoot(func(tx *bbolt.Tx) error {
+		seq := tx.Bucket([]byte(changelogBucket)).Sequence()
+		_, _, err := putAck(tx.Bucket([]byte(followerAcksBucket)), follower, followerAck{Seq: seq, KeystoreSeq: keystoreSeq, At: utils.Now()})
+		return err
+	})
+}
+
+// purgeEntryEvents blanks the logged records of the given entries of tenant up
+// to position seq, so copies of what was destroyed since do not outlive it.
+// The events stay, keeping the log contiguous; followers skip them and apply
+// the later events, which supersede them.
+func purgeEntryEvents(tenant string, ids []string, seq uint64) (int, error) {
+	if len(ids) == 0 {
+		return 0, nil
+	}
+	purge := make(map[string]bool, len(ids))
+	for _, id := range ids {
+		purge[id] = true
+	}
+	purged := 0
+	err := updateRoot(func(tx *bbolt.Tx) error {
+		b := tx.Bucket([]byte(changelogBucket))
+		var blanked []models.ChangeEvent
+		c := b.Cursor()
+		for k, v := c.First(); k != nil && binary.BigEndian.Uint64(k) <= seq; k, v = c.Next() {
+			var ev models.ChangeEvent
+			if err := json.Unmarshal(v, &ev); err != nil {
+				return err
+			}
+			if ev.Type == models.ChangeEntry && ev.Tenant == tenant && purge[string(ev.Key)] && ev.Value != nil {
+				ev.Value = nil
+				blanked = append(blanked, ev)
+			}
+		}
+		for _, ev := range blanked {
+			if err := putJSON(b, seqKey(ev.Seq), ev); err != nil {
+				return err
+			}
+		}
+		purged = len(blanked)
+		return nil
+	})
+	return purged, err
+}
+
+// logChange records a replicated write in the caller's transaction
+func logChange(tx *bbolt.Tx, typ, tenant string, key, value []byte) error {
+	return appendLog(tx.Bucket([]byte(changelogBucket)), func(seq uint64) interface{} {
+		return models.ChangeEvent{Seq: seq, Type: typ, Tenant: tenant, Key: key, Value: value, At: utils.Now()}
+	})
+}
+
+// logKeystoreChange records a user KEK creation or destruction in the keystore
+// transaction. The key itself is not logged.
+func logKeystoreChange(tx *bbolt.Tx, op, id string, user []byte) error {
+	return appendLog(tx.Bucket([]byte(changelogBucket)), func(seq uint64) interface{} {
+		return models.KeystoreEvent{Seq: seq, Op: op, ID: id, User: user}
+	})
+}
+
+// readLog decodes up to limit events of b after position after
+func readLog(b *bbolt.Bucket, after uint64, limit int, decode func(v []byte) error) error {
+	if after > b.Sequence() {
+		return ErrFollowerAhead
+	}
+	c := b.Cursor()
+	first, _ := c.First()
+	switch {
+	case first != nil && binary.BigEndian.Uint64(first) > after+1, first == nil && after < b.Sequence():
+		return ErrLogTrimmed
+	}
+	n := 0
+	for k, v := c.Seek(seqKey(after + 1)); k != nil && n < limit; k, v = c.Next() {
+		if err := decode(v); err != nil {
+			return err
+		}
+		n++
+	}
+	return nil
+}
+
+// ReadChanges returns the changes after the given positions of the change log
+// and the keystore log. The change log is read first: every KEK its entries
+// name was created before they were committed, so the keystore read that
+// follows includes it. The positions acknowledge what follower applied, and
+// events all followers applied are dropped.
+func ReadChanges(follower string, after, keystoreAfter uint64) (models.ReplicationBatch, error) {
+	batch := models.ReplicationBatch{Events: []models.ChangeEvent{}, KeystoreEvents: []models.KeystoreEvent{}}
+
+	err := viewRoot(func(tx *bbolt.Tx) error {
+		b := tx.Bucket([]byte(changelogBucket))
+		batch.Seq = b.Sequence()
+		return readLog(b, after, changelogBatch, func(v []byte) error {
+			var ev models.ChangeEvent
+			if err := json.Unmarshal(v, &ev); err != nil {
+				return err
+			}
+			batch.Events = append(batch.Events, ev)
+			return nil
+		})
+	})
+	if err != nil {
+		return batch, err
+	}
+
+	keystoreMu.RLock()
+	err = keystore.View(func(tx *bbolt.Tx) error {
+		b := tx.Bucket([]byte(changelogBucket))
+		batch.KeystoreSeq = b.Sequence()
+		keks := tx.Bucket([]byte(kekBucket))
+		return readLog(b, keystoreAfter, changelogBatch, func(v []byte) error {
+			var ev models.KeystoreEvent
+			if err := json.Unmarshal(v, &ev); err != nil {
+				return err
+			}
+			if ev.Op == models.KeystorePut {
+				// Nil once shredded; the follower then skips it
+				if stored := keks.Get([]byte(ev.ID)); stored != nil {
+					ev.Value = append([]byte(nil), stored...)
+				}
+			}
+			batch.KeystoreEvents = append(batch.KeystoreEvents, ev)
+			return nil
+		})
+	})
+	keystoreMu.RUnlock()
+	if err != nil || follower == "" || IsFollower() {
+		return batch, err
+	}
+	if err := acknowledge(follower, after, keystoreAfter); err != nil {
+		utils.Warn("replication", "cannot drop acknowledged changes: %v", err)
+	}
+	return batch, nil
+}
+
+// Members of a follower seed archive
+const (
+	seedDatabase = "vault.db"
+	seedKeystore = "vault.db.keys"
+)
+
+// WriteSeed streams a consistent copy of the database and the keystore as a tar
+// archive, from which a follower starts replicating. Unlike a backup it holds
+// the user KEKs, so it must only travel over the authenticated replication channel.
+// The change log is kept from the seed's position on for follower, if named.
+func WriteSeed(w io.Writer, follower string) error {
+	if follower != "" && !IsFollower() {
+		if err := holdForSeed(follower); err != nil {
+			return err
+		}
+	}
+	tw := tar.NewWriter(w)
+	write := func(name string, tx *bbolt.Tx) error {
+		if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0600, Size: tx.Size(), ModTime: utils.Now()}); err != nil {
+			return err
+		}
+		_, err := tx.WriteTo(tw)
+		return err
+	}
+
+	// The database first: a newer keystore only holds more KEKs
+	if err := viewRoot(func(tx *bbolt.Tx) error { return write(seedDatabase, tx) }); err != nil {
+		return err
+	}
+	keystoreMu.RLock()
+	err := keystore.View(func(tx *bbolt.Tx) error { return write(seedKeystore, tx) })
+	keystoreMu.RUnlock()
+	if err != nil {
+		return err
+	}
+	return tw.Close()
+}
+
+// readSeed unpacks a seed archive into a database and a keystore file
+func readSeed(r io.Reader, dbPath, keystorePath string) error {
+	tr := tar.NewReader(r)
+	seen := 0
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		var path string
+		switch hdr.Name {
+		case seedDatabase:
+			path = dbPath
+		case seedKeystore:
+			path = keystorePath
+		default:
+			continue
+		}
+		if err := writeFileAtomic(path, tr); err != nil {
+			return err
+		}
+		seen++
+	}
+	if seen != 2 {
+		return errors.New("seed archive is incomplete")
+	}
+	return nil
+}
+
+// writeFileAtomic copies r into a new file that replaces path once complete
+func writeFileAtomic(path string, r io.Reader) error {
+	tmp := path + ".seed"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f, r)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		os.Remove(tmp)
+	}
+	return err
+}
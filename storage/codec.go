@@ -0,0 +1,100 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+
+	"secure-vault/models"
+
+	"github.com/fxamacker/cbor/v2"
+)
+
+// Records are stored as a 3-byte header ("SV" + schema version) followed by the
+// CBOR-encoded entry. Legacy records are plain JSON and always start with '{'.
+var recordMagic = []byte("SV")
+
+var (
+	cborEnc cbor.EncMode
+	cborDec cbor.DecMode
+)
+
+func init() {
+	var err error
+	if cborEnc, err = (cbor.EncOptions{Time: cbor.TimeRFC3339Nano}).EncMode(); err != nil {
+		panic(err)
+	}
+	if cborDec, err = (cbor.DecOptions{}).DecMode(); err != nil {
+		panic(err)
+	}
+}
+
+// encodeEntry serialises an entry at the current schema version
+func encodeEntry(entry *models.VaultEntry) ([]byte, error) {
+	entry.SchemaVersion = models.EntrySchemaVersion
+	record := entry
+	if encryptMetadata {
+		var err error
+		if record, err = sealMetadata(entry); err != nil {
+			return nil, err
+		}
+	}
+	body, err := cborEnc.Marshal(record)
+	if err != nil {
+		return nil, err
+	}
+	data := make([]byte, 0, len(recordMagic)+1+len(body))
+	data = append(data, recordMagic...)
+	data = append(data, byte(models.EntrySchemaVersion))
+	return append(data, body...), nil
+}
+
+// decodeEntry parses a stored record of tenant in any known schema version and
+// upgrades it in memory to the current one
+func decodeEntry(tenant string, data []byte) (models.VaultEntry, error) {
+	entry := models.VaultEntry{Tenant: tenant}
+
+	version, err := recordVersion(data)
+	if err != nil {
+		return entry, err
+	}
+	raw := data
+	if version < models.EntrySchemaVersion {
+		if upgraded, ok := upgradedRecord(tenant, raw); ok {
+			data, version = upgraded, models.EntrySchemaVersion
+		}
+	}
+	if version > models.EntrySchemaVersion {
+		return entry, fmt.Errorf("record schema version %d is newer than supported %d", version, models.EntrySchemaVersion)
+	}
+	if version > 0 {
+		if err := cborDec.Unmarshal(data[len(recordMagic)+1:], &entry); err != nil {
+			return entry, err
+		}
+		if entry.Sealed != nil {
+			if err := openMetadata(&entry); err != nil {
+				return entry, err
+			}
+		}
+	}
+
+	if version == models.EntrySchemaVersion {
+		return entry, nil
+	}
+	if err := upgradeEntry(data, version, &entry); err != nil {
+		return entry, err
+	}
+	rememberUpgrade(raw, &entry)
+	return entry, nil
+}
+
+// recordVersion reports the schema version a record was written with
+func recordVersion(data []byte) (int, error) {
+	switch {
+	case len(data) > 0 && data[0] == '{':
+		return 0, nil
+	case len(data) > len(recordMagic) && string(data[:len(recordMagic)]) == string(recordMagic):
+		return int(data[len(recordMagic)]), nil
+	default:
+		return 0, errors.New("unrecognised record format")
+	}
+}
@@ -0,0 +1,208 @@
+package storage
+
+import (
+	"errors"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"secure-vault/models"
+	"secure-vault/utils"
+
+	"go.etcd.io/bbolt"
+)
+
+// Online compaction replaces the open database, so every transaction goes through
+// these gates: writes are held while live data is copied, and reads only for
+// the swap itself.
+var (
+	writeGate  sync.RWMutex // update: RLock; compaction: Lock while copying
+	txGate     sync.RWMutex // view and update: RLock; compaction: Lock while swapping
+	compacting sync.Mutex
+)
+
+var (
+	compactTxMaxSize = int64(utils.EnvInt("COMPACT_TX_MAX_BYTES", 64<<20))
+	compactWipe      = utils.EnvBool("COMPACT_WIPE", true)
+)
+
+// view runs fn in a read transaction scoped to tenant
+func view(tenant string, fn func(*tenantTx) error) error {
+	if _, err := kekFor(tenant); err != nil {
+		return err
+	}
+	return viewRoot(func(tx *bbolt.Tx) error {
+		return fn(&tenantTx{Tx: tx, tenant: tenant})
+	})
+}
+
+// update runs fn in a write transaction scoped to tenant
+func update(tenant string, fn func(*tenantTx) error) error {
+	if _, err := kekFor(tenant); err != nil {
+		return err
+	}
+	return updateRoot(func(tx *bbolt.Tx) error {
+		return fn(&tenantTx{Tx: tx, tenant: tenant})
+	})
+}
+
+// viewRoot runs fn in a read transaction over the whole database
+func viewRoot(fn func(*bbolt.Tx) error) error {
+	txGate.RLock()
+	defer txGate.RUnlock()
+	return db.View(fn)
+}
+
+// updateRoot runs fn in a write transaction over the whole database. A follower
+// only writes what it replicates, through writeRoot.
+func updateRoot(fn func(*bbolt.Tx) error) error {
+	if IsFollower() {
+		return ErrReadOnlyReplica
+	}
+	return writeRoot(fn)
+}
+
+// writeRoot is updateRoot without the follower check
+func writeRoot(fn func(*bbolt.Tx) error) error {
+	writeGate.RLock()
+	defer writeGate.RUnlock()
+	txGate.RLock()
+	defer txGate.RUnlock()
+	return db.Update(fn)
+}
+
+// Compact copies the live data of the running database into a fresh file and
+// swaps it in. Writes wait while the copy runs; reads only during the swap.
+func Compact() (models.CompactReport, error) {
+	compacting.Lock()
+	defer compacting.Unlock()
+
+	report := models.CompactReport{StartedAt: utils.Now(), Online: true}
+	path := DBPath()
+
+	writeGate.Lock()
+	defer writeGate.Unlock()
+	paused := time.Now()
+
+	// 1. Copy; readers continue on the old file meanwhile
+	tmp, err := compactInto(db, path)
+	if err != nil {
+		return report, err
+	}
+
+	// 2. Swap under a full pause
+	txGate.Lock()
+	defer txGate.Unlock()
+	if err := db.Close(); err != nil {
+		os.Remove(tmp)
+		return report, err
+	}
+	report.Wiped, err = swapCompacted(path, tmp, &report)
+	reopened, openErr := bbolt.Open(path, 0600, nil)
+	if openErr != nil {
+		// Nothing can be served without the database; this needs an operator
+		utils.Error("compact", "cannot reopen %s after compaction: %v", path, openErr)
+		return report, openErr
+	}
+	db = reopened
+	report.WritePause = time.Since(paused)
+	if err != nil {
+		return report, err
+	}
+
+	utils.Info("compact", "compacted %s: %d -> %d bytes, writes paused %s", path, report.SizeBefore, report.SizeAfter, report.WritePause)
+	return report, nil
+}
+
+// CompactOffline compacts the database file while no server is running
+func CompactOffline() (models.CompactReport, error) {
+	report := models.CompactReport{StartedAt: utils.Now()}
+	path := DBPath()
+
+	src, err := bbolt.Open(path, 0600, &bbolt.Options{Timeout: time.Second})
+	if err != nil {
+		return report, errors.New("database is in use, stop the server or use the admin endpoint: " + err.Error())
+	}
+	tmp, err := compactInto(src, path)
+	if cerr := src.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return report, err
+	}
+	report.Wiped, err = swapCompacted(path, tmp, &report)
+	if err == nil {
+		utils.Info("compact", "compacted %s: %d -> %d bytes", path, report.SizeBefore, report.SizeAfter)
+	}
+	return report, err
+}
+
+// compactInto writes the live data of src into a new file next to path
+func compactInto(src *bbolt.DB, path string) (string, error) {
+	tmp := path + ".compact-" + utils.Now().Format("20060102T150405")
+	dst, err := bbolt.Open(tmp, 0600, &bbolt.Options{NoSync: true})
+	if err != nil {
+		return "", err
+	}
+	err = bbolt.Compact(dst, src, compactTxMaxSize)
+	if err == nil {
+		err = dst.Sync()
+	}
+	if cerr := dst.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return "", err
+	}
+	return tmp, nil
+}
+
+// swapCompacted atomically replaces path with tmp, then overwrites the replaced
+// file's blocks with zeros (COMPACT_WIPE, default on) before releasing them, as
+// its free pages can still hold superseded ciphertexts and wrapped keys.
+// Reports whether the old file was wiped.
+func swapCompacted(path, tmp string, report *models.CompactReport) (bool, error) {
+	old, err := os.OpenFile(path, os.O_WRONLY, 0)
+	if err != nil {
+		os.Remove(tmp)
+		return false, err
+	}
+	defer old.Close()
+
+	if fi, err := old.Stat(); err == nil {
+		report.SizeBefore = fi.Size()
+	}
+	if fi, err := os.Stat(tmp); err == nil {
+		report.SizeAfter = fi.Size()
+	}
+	report.Reclaimed = report.SizeBefore - report.SizeAfter
+
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return false, err
+	}
+	if !compactWipe {
+		return false, nil
+	}
+
+	// The old inode is unlinked now; our handle keeps it alive until it is zeroed
+	if _, err := io.CopyN(old, zeroReader{}, report.SizeBefore); err != nil {
+		utils.Warn("compact", "cannot wipe replaced database file: %v", err)
+		return false, nil
+	}
+	if err := old.Sync(); err != nil {
+		utils.Warn("compact", "cannot sync wiped database file: %v", err)
+		return false, nil
+	}
+	return true, nil
+}
+
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	clear(p)
+	return len(p), nil
+}
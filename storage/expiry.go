@@ -0,0 +1,168 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"secure-vault/models"
+	"secure-vault/utils"
+)
+
+var ErrExpired = errors.New("key expired")
+
+var (
+	expiryNotifyLead = utils.EnvDuration("EXPIRY_NOTIFY_LEAD", 24*time.Hour)
+	expiryWebhookURL = os.Getenv("EXPIRY_WEBHOOK_URL")
+	webhookClient    = &http.Client{Timeout: 5 * time.Second}
+)
+
+// StartExpiryReaper tombstones expired entries of every tenant and sends advance
+// notices every interval
+func StartExpiryReaper(interval time.Duration) {
+	go func() {
+		for range time.Tick(interval) {
+			for _, tenant := range Tenants() {
+				if err := reapExpired(tenant); err != nil {
+					utils.Error("expiry", "reaper run for tenant %s failed: %v", tenant, err)
+				}
+			}
+		}
+	}()
+}
+
+func reapExpired(tenant string) error {
+	now := utils.Now()
+
+	// 1. Find due entries without holding the write lock
+	var expiring, expired []models.ExpiryEvent
+	err := view(tenant, func(tx *tenantTx) error {
+		return tx.Bucket([]byte(vaultBucket)).ForEach(func(k, v []byte) error {
+			entry, err := decodeEntry(tenant, v)
+			if err != nil || entry.ExpiresAt == nil || entry.IsTombstone() {
+				return nil
+			}
+			ev := models.ExpiryEvent{
+				Tenant:    tenant,
+				EntryID:   entry.ID,
+				UserID:    entry.UserID,
+				Label:     entry.Label,
+				ExpiresAt: *entry.ExpiresAt,
+			}
+			switch {
+			case entry.IsExpired(now):
+				ev.Type = models.EventEntryExpired
+				expired = append(expired, ev)
+			case !entry.ExpiryNotified && !now.Add(expiryNotifyLead).Before(*entry.ExpiresAt):
+				ev.Type = models.EventEntryExpiring
+				expiring = append(expiring, ev)
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return err
+	}
+
+	// 2. Advance notices; only delivered ones are marked, the rest retry next run
+	var notified []models.ExpiryEvent
+	for _, ev := range expiring {
+		if err := emitExpiryEvent(ev, now); err != nil {
+			utils.Warn("expiry", "notice for entry %s not delivered: %v", ev.EntryID, err)
+			continue
+		}
+		notified = append(notified, ev)
+	}
+	err = updateExpiryBatches(tenant, notified, func(entry *models.VaultEntry, ev models.ExpiryEvent) bool {
+		if entry.ExpiresAt == nil || !entry.ExpiresAt.Equal(ev.ExpiresAt) {
+			return false // expiry changed meanwhile
+		}
+		entry.ExpiryNotified = true
+		return true
+	})
+	if err != nil {
+		return err
+	}
+
+	// 3. Tombstone expired entries, then announce them
+	var reaped []models.ExpiryEvent
+	err = updateExpiryBatches(tenant, expired, func(entry *models.VaultEntry, ev models.ExpiryEvent) bool {
+		if entry.IsTombstone() || !entry.IsExpired(now) {
+			return false // extended or reaped meanwhile
+		}
+		entry.Envelope = models.Envelope{}
+		entry.Versions = nil
+		entry.DeletedAt = &now
+		entry.Revision++
+		reaped = append(reaped, ev)
+		return true
+	})
+	if err != nil {
+		return err
+	}
+	for _, ev := range reaped {
+		if err := emitExpiryEvent(ev, now); err != nil {
+			utils.Warn("expiry", "expiry event for entry %s not delivered: %v", ev.EntryID, err)
+		}
+	}
+	if len(reaped) > 0 {
+		utils.Info("expiry", "tombstoned %d expired entries of tenant %s", len(reaped), tenant)
+	}
+	return nil
+}
+
+// updateExpiryBatches re-reads each event's entry of tenant inside a write
+// transaction and stores it when apply reports a change
+func updateExpiryBatches(tenant string, events []models.ExpiryEvent, apply func(entry *models.VaultEntry, ev models.ExpiryEvent) bool) error {
+	for start := 0; start < len(events); start += rekeyBatchSize {
+		batch := events[start:min(start+rekeyBatchSize, len(events))]
+		err := update(tenant, func(tx *tenantTx) error {
+			b := tx.Bucket([]byte(vaultBucket))
+			for _, ev := range batch {
+				data := b.Get([]byte(ev.EntryID))
+				if data == nil {
+					continue
+				}
+				entry, err := decodeEntry(tenant, data)
+				if err != nil || !apply(&entry, ev) {
+					continue
+				}
+				if err := putEntry(tx, &entry); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// emitExpiryEvent writes the event to the audit log and posts it to EXPIRY_WEBHOOK_URL if set
+func emitExpiryEvent(ev models.ExpiryEvent, now time.Time) error {
+	ev.At = now
+	utils.Info("audit", "%s: tenant=%s entry=%s user=%s expires_at=%s", ev.Type, ev.Tenant, ev.EntryID, ev.UserID, ev.ExpiresAt.Format(time.RFC3339))
+
+	if expiryWebhookURL == "" {
+		return nil
+	}
+	body, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+	resp, err := webhookClient.Post(expiryWebhookURL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return errors.New("webhook returned status " + strconv.Itoa(resp.StatusCode))
+	}
+	return nil
+}
@@ -0,0 +1,657 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"secure-vault/models"
+	"secure-vault/utils"
+
+	"go.etcd.io/bbolt"
+)
+
+// A follower starts from a seed of the leader's database and keystore, then
+// polls the leader's change logs and applies them to its own files, taking over
+// the leader's positions but not the events. It serves reads only until it is
+// promoted.
+const (
+	promotedKey   = "promotedat" // default settings; set once a follower was promoted
+	followerIDKey = "followerid" // default settings; names the follower to the leader
+)
+
+var (
+	replPollInterval = utils.EnvDuration("REPLICATION_POLL_INTERVAL", time.Second)
+	replSeedTimeout  = utils.EnvDuration("REPLICATION_SEED_TIMEOUT", 10*time.Minute)
+)
+
+var (
+	follower  atomic.Bool
+	promoteMu sync.Mutex
+	repl      followerState
+)
+
+type followerState struct {
+	mu                sync.Mutex
+	leader, token, id string
+	stop, done        chan struct{}
+	onPromote         func()
+	leaderSeq         uint64
+	leaderKeystoreSeq uint64
+	lastContact       *time.Time
+	caughtUp          time.Time
+	lastErr           string
+}
+
+// IsFollower reports whether this instance replicates from a leader
+func IsFollower() bool {
+	return follower.Load()
+}
+
+// ConfigureFollower makes this instance a read-only follower of leader. It runs
+// before Init, which then leaves every migration to the leader.
+func ConfigureFollower(leader, token string) {
+	repl.leader = strings.TrimRight(leader, "/")
+	repl.token = token
+	follower.Store(true)
+}
+
+// SeedFromLeader copies the leader's database and keystore to the local paths,
+// unless there is a local database already
+func SeedFromLeader() error {
+	if _, err := os.Stat(DBPath()); err == nil {
+		return nil
+	}
+	id, err := randomHex(8)
+	if err != nil {
+		return err
+	}
+	if err := downloadSeed(id, DBPath(), KeystorePath()); err != nil {
+		return errors.New("cannot seed from leader: " + err.Error())
+	}
+	utils.Info("replication", "seeded %s from %s", DBPath(), repl.leader)
+	return nil
+}
+
+// downloadSeed fetches a seed for follower id into the given files, ready to
+// be opened as this follower's database and keystore
+func downloadSeed(id, dbPath, keystorePath string) error {
+	resp, err := leaderGet(&http.Client{Timeout: replSeedTimeout}, "/replication/seed?follower="+id)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if err := readSeed(resp.Body, dbPath, keystorePath); err != nil {
+		return err
+	}
+
+	// The leader may be a promoted follower itself. Only its log position is
+	// needed, not the events, nor the acks of its own followers.
+	seeded, err := bbolt.Open(dbPath, 0600, &bbolt.Options{Timeout: time.Second})
+	if err != nil {
+		return err
+	}
+	err = seeded.Update(func(tx *bbolt.Tx) error {
+		log := tx.Bucket([]byte(changelogBucket))
+		if err := trimLog(log, log.Sequence()); err != nil {
+			return err
+		}
+		if err := tx.DeleteBucket([]byte(followerAcksBucket)); err != nil && err != bbolt.ErrBucketNotFound {
+			return err
+		}
+		if _, err := tx.CreateBucket([]byte(followerAcksBucket)); err != nil {
+			return err
+		}
+		settings := tx.Bucket([]byte(settingsBucket))
+		if err := settings.Delete([]byte(promotedKey)); err != nil {
+			return err
+		}
+		if err := settings.Put([]byte(followerIDKey), []byte(id)); err != nil {
+			return err
+		}
+		return verifyKeyCheck(tx)
+	})
+	if cerr := seeded.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// reseed replaces this follower's database and keystore with a new seed from
+// the leader, once the leader no longer holds the changes it needs. Reads
+// wait for the swap, as with an online compaction.
+func reseed() error {
+	repl.mu.Lock()
+	id := repl.id
+	repl.mu.Unlock()
+	dbTmp, keystoreTmp := DBPath()+".reseed", KeystorePath()+".reseed"
+	if err := downloadSeed(id, dbTmp, keystoreTmp); err != nil {
+		os.Remove(dbTmp)
+		os.Remove(keystoreTmp)
+		return err
+	}
+
+	// The keystore first: a newer keystore only holds more KEKs
+	if err := swapKeystore(keystoreTmp); err != nil {
+		os.Remove(dbTmp)
+		return err
+	}
+	if err := swapDatabase(dbTmp); err != nil {
+		return err
+	}
+
+	// Drop what was loaded from the replaced database
+	err := viewRoot(func(tx *bbolt.Tx) error {
+		for _, load := range []func(*bbolt.Tx) error{loadMetadataKey, loadTenantKeys, loadJWTKeys, loadRevocations} {
+			if err := load(tx); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	policyCacheMu.Lock()
+	policyCache = map[string]cachedPolicies{}
+	policyCacheMu.Unlock()
+	if err != nil {
+		return err
+	}
+	utils.Info("replication", "re-seeded %s from %s", DBPath(), repl.leader)
+	return nil
+}
+
+// swapKeystore replaces the open keystore with the file at tmp, wiping the old one
+func swapKeystore(tmp string) error {
+	keystoreMu.Lock()
+	defer keystoreMu.Unlock()
+	if err := keystore.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	var scratch models.CompactReport
+	_, err := swapCompacted(KeystorePath(), tmp, &scratch)
+	reopened, openErr := bbolt.Open(KeystorePath(), 0600, nil)
+	if openErr != nil {
+		keystore = nil
+		utils.Error("replication", "cannot reopen keystore %s: %v", KeystorePath(), openErr)
+		return openErr
+	}
+	keystore = reopened
+	return err
+}
+
+// swapDatabase replaces the open database with the file at tmp under a full
+// pause, wiping the old one
+func swapDatabase(tmp string) error {
+	compacting.Lock()
+	defer compacting.Unlock()
+	writeGate.Lock()
+	defer writeGate.Unlock()
+	txGate.Lock()
+	defer txGate.Unlock()
+	if err := db.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	var scratch models.CompactReport
+	_, err := swapCompacted(DBPath(), tmp, &scratch)
+	reopened, openErr := bbolt.Open(DBPath(), 0600, nil)
+	if openErr != nil {
+		// Nothing can be served without the database; this needs an operator
+		utils.Error("replication", "cannot reopen %s: %v", DBPath(), openErr)
+		return openErr
+	}
+	db = reopened
+	return err
+}
+
+// StartFollower starts applying the leader's changes in the background.
+// onPromote runs once Promote made this instance a leader.
+func StartFollower(onPromote func()) error {
+	if promoted := promotedAt(); promoted != nil {
+		return fmt.Errorf("database was promoted to leader at %s, start it as a leader or seed a new follower", promoted.Format(time.RFC3339))
+	}
+	id, err := followerID()
+	if err != nil {
+		return err
+	}
+	repl.mu.Lock()
+	repl.id = id
+	repl.stop = make(chan struct{})
+	repl.done = make(chan struct{})
+	repl.onPromote = onPromote
+	repl.caughtUp = utils.Now()
+	stop, done := repl.stop, repl.done
+	repl.mu.Unlock()
+
+	go follow(stop, done)
+	utils.Info("replication", "following %s every %s", repl.leader, replPollInterval)
+	return nil
+}
+
+// follow polls the leader until stopped. A backlog is drained without waiting.
+// A follower the leader's log no longer covers is seeded again; a leader behind
+// this follower ends replication.
+func follow(stop, done chan struct{}) {
+	defer close(done)
+	ticker := time.NewTicker(replPollInterval)
+	defer ticker.Stop()
+
+	for {
+		caughtUp, err := pullChanges()
+		if err != nil {
+			repl.mu.Lock()
+			repl.lastErr = err.Error()
+			repl.mu.Unlock()
+			switch {
+			case errors.Is(err, ErrFollowerAhead):
+				utils.Error("replication", "replication stopped: %v", err)
+				return
+			case errors.Is(err, ErrLogTrimmed):
+				utils.Warn("replication", "%v; seeding again", err)
+				if err = reseed(); err != nil {
+					utils.Warn("replication", "cannot seed again: %v", err)
+					repl.mu.Lock()
+					repl.lastErr = err.Error()
+					repl.mu.Unlock()
+				}
+			default:
+				utils.Warn("replication", "cannot pull changes: %v", err)
+			}
+		}
+
+		if err == nil && !caughtUp {
+			select {
+			case <-stop:
+				return
+			default:
+				continue
+			}
+		}
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// pullChanges fetches and applies one batch, and reports whether this follower
+// has now caught up with the leader
+func pullChanges() (bool, error) {
+	seq, keystoreSeq, err := localPositions()
+	if err != nil {
+		return false, err
+	}
+	client := &http.Client{Timeout: 30 * time.Second}
+	resp, err := leaderGet(client, fmt.Sprintf("/replication/log?after=%d&keystore_after=%d&follower=%s", seq, keystoreSeq, repl.id))
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	var batch models.ReplicationBatch
+	if err := json.NewDecoder(resp.Body).Decode(&batch); err != nil {
+		return false, err
+	}
+
+	now := utils.Now()
+	repl.mu.Lock()
+	repl.leaderSeq, repl.leaderKeystoreSeq = batch.Seq, batch.KeystoreSeq
+	repl.lastContact = &now
+	repl.mu.Unlock()
+
+	// Keys first, so the entries that name them can be opened
+	if err := applyKeystoreChanges(batch.KeystoreEvents); err != nil {
+		return false, err
+	}
+	if err := applyChanges(batch.Events); err != nil {
+		return false, err
+	}
+
+	if seq, keystoreSeq, err = localPositions(); err != nil {
+		return false, err
+	}
+	caughtUp := seq >= batch.Seq && keystoreSeq >= batch.KeystoreSeq
+	if caughtUp {
+		repl.mu.Lock()
+		repl.caughtUp = now
+		repl.lastErr = ""
+		repl.mu.Unlock()
+	}
+	return caughtUp, nil
+}
+
+// leaderGet sends an authenticated replication request to the leader
+func leaderGet(client *http.Client, path string) (*http.Response, error) {
+	req, err := http.NewRequest(http.MethodGet, repl.leader+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+repl.token)
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return resp, nil
+	case http.StatusGone:
+		err = ErrLogTrimmed
+	case http.StatusConflict:
+		err = ErrFollowerAhead
+	default:
+		err = errors.New("leader returned " + resp.Status)
+	}
+	resp.Body.Close()
+	return nil, err
+}
+
+// localPositions returns the last change applied to the database and the keystore
+func localPositions() (seq, keystoreSeq uint64, err error) {
+	err = viewRoot(func(tx *bbolt.Tx) error {
+		seq = tx.Bucket([]byte(changelogBucket)).Sequence()
+		return nil
+	})
+	if err != nil {
+		return 0, 0, err
+	}
+	keystoreMu.RLock()
+	defer keystoreMu.RUnlock()
+	if keystore == nil {
+		return seq, 0, errors.New("keystore is not open")
+	}
+	err = keystore.View(func(tx *bbolt.Tx) error {
+		keystoreSeq = tx.Bucket([]byte(changelogBucket)).Sequence()
+		return nil
+	})
+	return seq, keystoreSeq, err
+}
+
+// applyKeystoreChanges stores and destroys user KEKs as the leader did. A
+// destroyed key is wiped from the follower's keystore file as well.
+func applyKeystoreChanges(events []models.KeystoreEvent) error {
+	if len(events) == 0 {
+		return nil
+	}
+	keystoreMu.Lock()
+	defer keystoreMu.Unlock()
+
+	destroyed := false
+	err := keystore.Update(func(tx *bbolt.Tx) error {
+		keks := tx.Bucket([]byte(kekBucket))
+		users := tx.Bucket([]byte(userKEKBucket))
+		log := tx.Bucket([]byte(changelogBucket))
+		for _, ev := range events {
+			if ev.Seq <= log.Sequence() {
+				continue
+			}
+			switch ev.Op {
+			case models.KeystorePut:
+				// No value: the key was destroyed since, and its delete follows
+				if ev.Value != nil {
+					if err := keks.Put([]byte(ev.ID), ev.Value); err != nil {
+						return err
+					}
+					if err := users.Put(ev.User, []byte(ev.ID)); err != nil {
+						return err
+					}
+				}
+			case models.KeystoreDelete:
+				if err := keks.Delete([]byte(ev.ID)); err != nil {
+					return err
+				}
+				if bytes.Equal(users.Get(ev.User), []byte(ev.ID)) {
+					if err := users.Delete(ev.User); err != nil {
+						return err
+					}
+				}
+				destroyed = true
+			default:
+				return fmt.Errorf("keystore change %d: unknown operation %q", ev.Seq, ev.Op)
+			}
+			if err := log.SetSequence(ev.Seq); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil || !destroyed {
+		return err
+	}
+	_, err = wipeKeystore()
+	return err
+}
+
+// applyChanges writes the leader's changes in one transaction, bypassing the
+// follower check, and records them at the leader's positions
+func applyChanges(events []models.ChangeEvent) error {
+	if len(events) == 0 {
+		return nil
+	}
+	newTenant, newJWTKey, newRevocation := false, false, false
+	err := writeRoot(func(tx *bbolt.Tx) error {
+		log := tx.Bucket([]byte(changelogBucket))
+		for _, ev := range events {
+			if ev.Seq <= log.Sequence() {
+				continue
+			}
+			if err := applyChange(tx, ev); err != nil {
+				return fmt.Errorf("change %d: %w", ev.Seq, err)
+			}
+			newTenant = newTenant || ev.Type == models.ChangeTenant
+			newJWTKey = newJWTKey || ev.Type == models.ChangeJWTKey
+			newRevocation = newRevocation || ev.Type == models.ChangeRevocation
+			if err := log.SetSequence(ev.Seq); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if newTenant {
+		if err := viewRoot(loadTenantKeys); err != nil {
+			return err
+		}
+	}
+	if newJWTKey {
+		if err := viewRoot(loadJWTKeys); err != nil {
+			return err
+		}
+	}
+	if newRevocation {
+		return viewRoot(loadRevocations)
+	}
+	return nil
+}
+
+func applyChange(tx *bbolt.Tx, ev models.ChangeEvent) error {
+	switch ev.Type {
+	case models.ChangeTenant:
+		return applyTenant(tx, ev)
+	case models.ChangeJWTKey:
+		if ev.Value == nil {
+			return tx.Bucket([]byte(jwtKeysBucket)).Delete(ev.Key)
+		}
+		return tx.Bucket([]byte(jwtKeysBucket)).Put(ev.Key, ev.Value)
+	case models.ChangeRevocation:
+		if ev.Value == nil {
+			return tx.Bucket([]byte(revocationsBucket)).Delete(ev.Key)
+		}
+		return tx.Bucket([]byte(revocationsBucket)).Put(ev.Key, ev.Value)
+	}
+	ttx := &tenantTx{Tx: tx, tenant: ev.Tenant}
+	if ttx.Bucket([]byte(settingsBucket)) == nil {
+		return ErrUnknownTenant
+	}
+
+	switch ev.Type {
+	case models.ChangeEntry:
+		if ev.Value == nil {
+			return nil // purged by a shred; a tombstone follows
+		}
+		entry, err := decodeEntry(ev.Tenant, ev.Value)
+		if err != nil {
+			return err
+		}
+		old := storedEntry(ttx, string(ev.Key))
+		if err := ttx.Bucket([]byte(vaultBucket)).Put(ev.Key, ev.Value); err != nil {
+			return err
+		}
+		return updateIndexes(ttx, old, &entry)
+	case models.ChangeSetting:
+		return ttx.Bucket([]byte(settingsBucket)).Put(ev.Key, ev.Value)
+	case models.ChangeQuota:
+		if ev.Value == nil {
+			return ttx.Bucket([]byte(quotaBucket)).Delete(ev.Key)
+		}
+		return ttx.Bucket([]byte(quotaBucket)).Put(ev.Key, ev.Value)
+	case models.ChangeUser:
+		return ttx.Bucket([]byte(usersBucket)).Put(ev.Key, ev.Value)
+	case models.ChangeAPIKey:
+		if ev.Value == nil {
+			return ttx.Bucket([]byte(apiKeysBucket)).Delete(ev.Key)
+		}
+		return ttx.Bucket([]byte(apiKeysBucket)).Put(ev.Key, ev.Value)
+	case models.ChangeRefreshToken:
+		if ev.Value == nil {
+			return ttx.Bucket([]byte(refreshTokensBucket)).Delete(ev.Key)
+		}
+		return ttx.Bucket([]byte(refreshTokensBucket)).Put(ev.Key, ev.Value)
+	case models.ChangePolicy:
+		b := ttx.Bucket([]byte(policiesBucket))
+		if _, err := b.NextSequence(); err != nil { // invalidates cached policies
+			return err
+		}
+		return b.Put(ev.Key, ev.Value)
+	}
+	return fmt.Errorf("unknown change type %q", ev.Type)
+}
+
+// applyTenant creates a tenant's tree with the settings it was created with
+func applyTenant(tx *bbolt.Tx, ev models.ChangeEvent) error {
+	var settings map[string][]byte
+	if err := json.Unmarshal(ev.Value, &settings); err != nil {
+		return err
+	}
+	root, err := tx.Bucket([]byte(tenantsBucket)).CreateBucketIfNotExists([]byte(ev.Tenant))
+	if err != nil {
+		return err
+	}
+	for _, b := range tenantBuckets {
+		if _, err := root.CreateBucketIfNotExists([]byte(b)); err != nil {
+			return err
+		}
+	}
+	b := root.Bucket([]byte(settingsBucket))
+	for k, v := range settings {
+		if err := b.Put([]byte(k), v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Promote stops replication and lets this instance accept writes, continuing
+// the change log where the leader's left off. The database records the
+// promotion, so it will not start as a follower again.
+func Promote() (models.ReplicationStatus, error) {
+	promoteMu.Lock()
+	defer promoteMu.Unlock()
+	if !IsFollower() {
+		return ReplicationStatus(), errors.New("this instance is not a follower")
+	}
+
+	repl.mu.Lock()
+	stop, done, onPromote := repl.stop, repl.done, repl.onPromote
+	repl.mu.Unlock()
+	close(stop)
+	<-done
+
+	now := utils.Now()
+	err := writeRoot(func(tx *bbolt.Tx) error {
+		return tx.Bucket([]byte(settingsBucket)).Put([]byte(promotedKey), []byte(now.Format(time.RFC3339Nano)))
+	})
+	if err != nil {
+		return ReplicationStatus(), err
+	}
+	follower.Store(false)
+
+	status := ReplicationStatus()
+	utils.Info("replication", "promoted to leader at change %d (keystore %d)", status.Seq, status.KeystoreSeq)
+	if onPromote != nil {
+		onPromote()
+	}
+	return status, nil
+}
+
+// followerID returns the name this follower acknowledges changes under,
+// creating it on first start
+func followerID() (string, error) {
+	var id []byte
+	err := writeRoot(func(tx *bbolt.Tx) error {
+		settings := tx.Bucket([]byte(settingsBucket))
+		if id = settings.Get([]byte(followerIDKey)); id != nil {
+			id = append([]byte(nil), id...)
+			return nil
+		}
+		token, err := randomHex(8)
+		if err != nil {
+			return err
+		}
+		id = []byte(token)
+		return settings.Put([]byte(followerIDKey), id)
+	})
+	return string(id), err
+}
+
+// promotedAt returns when this database was promoted, if it was
+func promotedAt() *time.Time {
+	var promoted *time.Time
+	viewRoot(func(tx *bbolt.Tx) error {
+		if v := tx.Bucket([]byte(settingsBucket)).Get([]byte(promotedKey)); v != nil {
+			if t, err := time.Parse(time.RFC3339Nano, string(v)); err == nil {
+				promoted = &t
+			}
+		}
+		return nil
+	})
+	return promoted
+}
+
+// ReplicationStatus describes this instance's role and replication lag
+func ReplicationStatus() models.ReplicationStatus {
+	status := models.ReplicationStatus{Role: models.RoleLeader, PromotedAt: promotedAt()}
+	var err error
+	if status.Seq, status.KeystoreSeq, err = localPositions(); err != nil {
+		status.LastError = err.Error()
+	}
+	if !IsFollower() {
+		return status
+	}
+
+	repl.mu.Lock()
+	defer repl.mu.Unlock()
+	status.Role = models.RoleFollower
+	status.Leader = repl.leader
+	status.LeaderSeq = repl.leaderSeq
+	status.LastContact = repl.lastContact
+	if repl.lastErr != "" {
+		status.LastError = repl.lastErr
+	}
+	if repl.leaderSeq > status.Seq {
+		status.LagEvents += repl.leaderSeq - status.Seq
+	}
+	if repl.leaderKeystoreSeq > status.KeystoreSeq {
+		status.LagEvents += repl.leaderKeystoreSeq - status.KeystoreSeq
+	}
+	status.LagSeconds = float64(time.Since(repl.caughtUp).Milliseconds()) / 1000
+	return status
+}
@@ -0,0 +1,127 @@
+package storage
+
+import (
+	"secure-vault/crypto"
+	"secure-vault/models"
+	"secure-vault/utils"
+
+	"go.etcd.io/bbolt"
+)
+
+// Fsck walks every entry of every tenant in a read transaction and checks that it
+// still decodes and decrypts under the loaded master key and tenant KEKs. Plaintext keys are only held long
+// enough to revalidate them and are wiped afterwards.
+func Fsck() (models.FsckReport, error) {
+	report := models.FsckReport{
+		StartedAt:      utils.Now(),
+		KeyFingerprint: utils.MasterKeyFingerprint(),
+		Issues:         []models.FsckIssue{},
+	}
+
+	err := viewRoot(func(tx *bbolt.Tx) error {
+		if err := verifyKeyCheck(tx); err != nil {
+			return err
+		}
+		for _, tenant := range Tenants() {
+			b := (&tenantTx{Tx: tx, tenant: tenant}).Bucket([]byte(vaultBucket))
+			if b == nil {
+				continue // created after this transaction started
+			}
+			err := b.ForEach(func(k, v []byte) error {
+				report.Checked++
+				issues := fsckEntry(tenant, string(k), v, &report)
+				if len(issues) > 0 {
+					report.Failed++
+					report.Issues = append(report.Issues, issues...)
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+
+	report.FinishedAt = utils.Now()
+	if err == nil {
+		utils.Info("fsck", "checked %d entries: %d ok, %d tombstones, %d failed", report.Checked, report.OK, report.Tombstones, report.Failed)
+	}
+	return report, err
+}
+
+func fsckEntry(tenant, id string, raw []byte, report *models.FsckReport) []models.FsckIssue {
+	issue := func(version uint64, check string, err error) []models.FsckIssue {
+		return []models.FsckIssue{{Tenant: tenant, EntryID: id, Version: version, Check: check, Error: err.Error()}}
+	}
+
+	// 1. Record format
+	entry, err := decodeEntry(tenant, raw)
+	if err != nil {
+		return issue(0, models.FsckCheckDecode, err)
+	}
+	if entry.IsTombstone() {
+		report.Tombstones++
+		return nil
+	}
+
+	// 2. Mode and parameter set
+	mode, err := models.ToCryptoMode(entry.CryptoMode)
+	if err != nil {
+		return issue(0, models.FsckCheckMode, err)
+	}
+	params := entry.CryptoParams
+	if params == "" {
+		params = models.DefaultCryptoParams(mode)
+	}
+	if !models.IsValidCryptoParams(mode, params) {
+		return issue(0, models.FsckCheckMode, errUnsupportedParams(mode, params))
+	}
+
+	// 3. Current key, then every retained version
+	var issues []models.FsckIssue
+	if check, err := fsckEnvelope(tenant, &entry.Envelope, entry.KeyType, func() ([]byte, error) { return DecryptEntry(&entry) }); err != nil {
+		issues = append(issues, issue(0, check, err)...)
+	}
+	for i := range entry.Versions {
+		v := &entry.Versions[i]
+		if check, err := fsckEnvelope(tenant, &v.Envelope, v.KeyType, func() ([]byte, error) { return DecryptVersion(&entry, v) }); err != nil {
+			issues = append(issues, issue(v.Revision, check, err)...)
+		}
+	}
+	if len(issues) == 0 {
+		report.OK++
+	}
+	return issues
+}
+
+// fsckEnvelope runs the unwrap, AEAD and public key checks on one envelope and
+// names the first one that failed
+func fsckEnvelope(tenant string, env *models.Envelope, keyType string, open func() ([]byte, error)) (string, error) {
+	kek, err := envelopeKEK(tenant, env)
+	if err != nil {
+		return models.FsckCheckUnwrap, err
+	}
+	priv, err := kek.Unwrap(env.WrappedPrivKey, env.WrappedPrivNonce)
+	if err != nil {
+		return models.FsckCheckUnwrap, err
+	}
+	wipe(priv)
+
+	plain, err := open()
+	if err != nil {
+		return models.FsckCheckAEAD, err
+	}
+	defer wipe(plain)
+
+	if err := crypto.ValidatePublicKey(plain, keyType); err != nil {
+		return models.FsckCheckPubKey, err
+	}
+	return "", nil
+}
+
+func wipe(b []byte) {
+	for i := range b {
+		b[i] = 0
+	}
+}
@@ -0,0 +1,76 @@
+package storage
+
+import (
+	"errors"
+
+	"secure-vault/models"
+	"secure-vault/utils"
+)
+
+// Grants live in the entry itself and are bound into its envelopes like the
+// owner, so changing them re-seals the key. Expired grants are dropped
+// whenever the owner changes the grants.
+
+var ErrTooManyGrants = errors.New("too many grants on this entry")
+
+// dropExpiredGrants removes the grants whose deadline has passed
+func dropExpiredGrants(entry *models.VaultEntry) {
+	now := utils.Now()
+	kept := entry.Grants[:0]
+	for _, g := range entry.Grants {
+		if !g.IsExpired(now) {
+			kept = append(kept, g)
+		}
+	}
+	if len(kept) == 0 {
+		kept = nil
+	}
+	entry.Grants = kept
+}
+
+// AddGrant shares rights on an entry the caller may share: its own, unless a
+// policy says otherwise. Other entries are reported as not found.
+func AddGrant(tenant, id string, caller models.Caller, grant models.Grant) (models.Grant, models.VaultEntry, error) {
+	entry, err := UpdateMetadata(tenant, id, caller, models.OpShare, nil, func(entry *models.VaultEntry) error {
+		if entry.IsExpired(utils.Now()) {
+			return ErrExpired
+		}
+		dropExpiredGrants(entry)
+		if len(entry.Grants) >= models.MaxGrants {
+			return ErrTooManyGrants
+		}
+
+		var err error
+		if grant.ID, err = randomHex(8); err != nil {
+			return err
+		}
+		grant.CreatedAt = utils.Now()
+		entry.Grants = append(entry.Grants, grant)
+		return nil
+	})
+	if err != nil {
+		return grant, entry, err
+	}
+
+	utils.Info("audit", "grant added: tenant=%s entry=%s grant=%s user=%s group=%s rights=%v",
+		tenant, id, grant.ID, grant.UserID, grant.Group, grant.Rights)
+	return grant, entry, nil
+}
+
+// RemoveGrant withdraws a grant on an entry the caller may share
+func RemoveGrant(tenant, id string, caller models.Caller, grantID string) (models.VaultEntry, error) {
+	entry, err := UpdateMetadata(tenant, id, caller, models.OpShare, nil, func(entry *models.VaultEntry) error {
+		for i := range entry.Grants {
+			if entry.Grants[i].ID == grantID {
+				entry.Grants = append(entry.Grants[:i], entry.Grants[i+1:]...)
+				dropExpiredGrants(entry)
+				return nil
+			}
+		}
+		return ErrNotFound
+	})
+	if err == nil {
+		utils.Info("audit", "grant removed: tenant=%s entry=%s grant=%s", tenant, id, grantID)
+	}
+	return entry, err
+}
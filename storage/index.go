@@ -0,0 +1,108 @@
+package storage
+
+import (
+	"strconv"
+
+	"secure-vault/models"
+	"secure-vault/utils"
+)
+
+// indexVersion is bumped whenever derived buckets change shape, so they are
+// rebuilt from the vault bucket on the next start
+const (
+	indexVersion    = 3
+	indexVersionKey = "indexversion"
+)
+
+// derivedBuckets are recomputed from the vault bucket by rebuildIndexes
+var derivedBuckets = []string{usageBucket, tagIndexBucket, ownerIndexBucket}
+
+// putEntry writes entry and keeps the derived buckets (usage counters, tag and
+// owner indexes) in step with it, in the caller's transaction, then records the
+// write in the change log. Every write to the vault bucket goes through here.
+func putEntry(tx *tenantTx, entry *models.VaultEntry) error {
+	b := tx.Bucket([]byte(vaultBucket))
+	old := storedEntry(tx, entry.ID)
+
+	data, err := encodeEntry(entry)
+	if err != nil {
+		return err
+	}
+	if err := b.Put([]byte(entry.ID), data); err != nil {
+		return err
+	}
+	if err := updateIndexes(tx, old, entry); err != nil {
+		return err
+	}
+	return logChange(tx.Tx, models.ChangeEntry, tx.tenant, []byte(entry.ID), data)
+}
+
+func updateIndexes(tx *tenantTx, old, entry *models.VaultEntry) error {
+	if err := updateUsage(tx, old, entry); err != nil {
+		return err
+	}
+	if err := updateOwnerIndex(tx, old, entry); err != nil {
+		return err
+	}
+	return updateTagIndex(tx, old, entry)
+}
+
+// storedEntry decodes the current record for id, or nil if absent or unreadable
+func storedEntry(tx *tenantTx, id string) *models.VaultEntry {
+	data := tx.Bucket([]byte(vaultBucket)).Get([]byte(id))
+	if data == nil {
+		return nil
+	}
+	entry, err := decodeEntry(tx.tenant, data)
+	if err != nil {
+		return nil
+	}
+	return &entry
+}
+
+// ensureIndexes rebuilds the derived buckets of tenant when they were written by
+// an older build, or never written at all
+func ensureIndexes(tenant string) error {
+	return update(tenant, func(tx *tenantTx) error {
+		settings := tx.Bucket([]byte(settingsBucket))
+		built, _ := strconv.Atoi(string(settings.Get([]byte(indexVersionKey))))
+		if built == indexVersion {
+			return nil
+		}
+		// Quota overrides are not derived; they were keyed by plain user ID before version 3
+		if built > 0 && built < 3 {
+			if err := blindQuotaKeys(tx); err != nil {
+				return err
+			}
+		}
+		if err := rebuildIndexes(tx); err != nil {
+			return err
+		}
+		return settings.Put([]byte(indexVersionKey), []byte(strconv.Itoa(indexVersion)))
+	})
+}
+
+// rebuildIndexes recomputes every derived bucket from the stored entries
+func rebuildIndexes(tx *tenantTx) error {
+	for _, name := range derivedBuckets {
+		if err := tx.resetBucket([]byte(name)); err != nil {
+			return err
+		}
+	}
+
+	entries := 0
+	err := tx.Bucket([]byte(vaultBucket)).ForEach(func(k, v []byte) error {
+		entry, err := decodeEntry(tx.tenant, v)
+		if err != nil {
+			utils.Warn("index", "skipping unreadable entry %s: %v", k, err)
+			return nil
+		}
+		entries++
+		return updateIndexes(tx, nil, &entry)
+	})
+	if err != nil {
+		return err
+	}
+	utils.Info("index", "rebuilt derived data of tenant %s from %d entries", tx.tenant, entries)
+	return nil
+}
@@ -0,0 +1,258 @@
+package storage
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"secure-vault/models"
+	"secure-vault/utils"
+
+	"go.etcd.io/bbolt"
+)
+
+// Token signing keys live in the root jwtkeys bucket, private keys wrapped by
+// the master key. The newest key that is not retired signs; a rotation retires
+// it, and retired keys keep verifying for JWT_KEY_RETENTION so that tokens
+// issued before the rotation stay valid. They are replicated like any other
+// write, so followers issue and verify the same tokens.
+const jwtKeysBucket = "jwtkeys"
+
+var (
+	jwtSigningAlg   = utils.EnvString("JWT_SIGNING_ALG", models.AlgEdDSA)
+	jwtKeyRetention = utils.EnvDuration("JWT_KEY_RETENTION", 48*time.Hour)
+)
+
+var (
+	ErrUnknownSigningKey = errors.New("unknown or expired signing key")
+	ErrSymmetricSigning  = errors.New("tokens are signed with JWT_SECRET; set JWT_SIGNING_ALG to use signing keys")
+)
+
+type storedJWTKey struct {
+	models.SigningKey
+	Private wrappedKEK `json:"private"` // PKCS #8, wrapped by the master key
+}
+
+type loadedJWTKey struct {
+	models.SigningKey
+	signer crypto.Signer
+}
+
+var (
+	jwtKeysMu  sync.RWMutex
+	jwtKeys    = map[string]*loadedJWTKey{}
+	jwtCurrent *loadedJWTKey
+)
+
+// SigningAlgorithm returns the algorithm new tokens are signed with
+func SigningAlgorithm() string {
+	return jwtSigningAlg
+}
+
+func generateSigningKey(alg string) (crypto.Signer, error) {
+	switch alg {
+	case models.AlgEdDSA:
+		_, priv, err := ed25519.GenerateKey(rand.Reader)
+		return priv, err
+	case models.AlgES256:
+		return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case models.AlgRS256:
+		return rsa.GenerateKey(rand.Reader, 3072)
+	}
+	return nil, fmt.Errorf("JWT_SIGNING_ALG %q is not one of EdDSA, ES256, RS256, HS256", alg)
+}
+
+// loadJWTKeys unwraps the signing keys still within their retention
+func loadJWTKeys(tx *bbolt.Tx) error {
+	keys := map[string]*loadedJWTKey{}
+	var current *loadedJWTKey
+	now := utils.Now()
+	err := tx.Bucket([]byte(jwtKeysBucket)).ForEach(func(_, v []byte) error {
+		var stored storedJWTKey
+		if err := json.Unmarshal(v, &stored); err != nil {
+			return err
+		}
+		if stored.RetiredAt != nil && now.Sub(*stored.RetiredAt) > jwtKeyRetention {
+			return nil
+		}
+		der, err := utils.DecryptWithMasterKey(stored.Private.Ciphertext, stored.Private.Nonce)
+		if err != nil {
+			return errors.New("cannot unwrap signing key " + stored.KID + ": " + err.Error())
+		}
+		parsed, err := x509.ParsePKCS8PrivateKey(der)
+		wipe(der)
+		if err != nil {
+			return err
+		}
+		signer, ok := parsed.(crypto.Signer)
+		if !ok {
+			return errors.New("signing key " + stored.KID + " cannot sign")
+		}
+		k := &loadedJWTKey{SigningKey: stored.SigningKey, signer: signer}
+		k.Public = signer.Public()
+		keys[k.KID] = k
+		if k.RetiredAt == nil && (current == nil || k.CreatedAt.After(current.CreatedAt)) {
+			current = k
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	jwtKeysMu.Lock()
+	jwtKeys, jwtCurrent = keys, current
+	jwtKeysMu.Unlock()
+	return nil
+}
+
+// ensureSigningKey creates a signing key when there is none for the configured
+// algorithm, e.g. on the first start or after JWT_SIGNING_ALG changed
+func ensureSigningKey() error {
+	if jwtSigningAlg == models.AlgHS256 {
+		return nil
+	}
+	jwtKeysMu.RLock()
+	current := jwtCurrent
+	jwtKeysMu.RUnlock()
+	if current != nil && current.Algorithm == jwtSigningAlg {
+		return nil
+	}
+	_, err := RotateSigningKey()
+	return err
+}
+
+// RotateSigningKey retires the current signing key and creates a new one. Keys
+// retired longer than JWT_KEY_RETENTION ago are deleted.
+func RotateSigningKey() (models.SigningKey, error) {
+	if jwtSigningAlg == models.AlgHS256 {
+		return models.SigningKey{}, ErrSymmetricSigning
+	}
+	signer, err := generateSigningKey(jwtSigningAlg)
+	if err != nil {
+		return models.SigningKey{}, err
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(signer)
+	if err != nil {
+		return models.SigningKey{}, err
+	}
+	defer wipe(der)
+	kidBytes := make([]byte, 8)
+	if _, err := rand.Read(kidBytes); err != nil {
+		return models.SigningKey{}, err
+	}
+
+	now := utils.Now()
+	stored := storedJWTKey{SigningKey: models.SigningKey{KID: hex.EncodeToString(kidBytes), Algorithm: jwtSigningAlg, CreatedAt: now}}
+	if stored.Private.Ciphertext, stored.Private.Nonce, err = utils.EncryptWithMasterKey(der); err != nil {
+		return models.SigningKey{}, err
+	}
+
+	err = updateRoot(func(tx *bbolt.Tx) error {
+		b := tx.Bucket([]byte(jwtKeysBucket))
+		var retire []storedJWTKey
+		var prune [][]byte
+		err := b.ForEach(func(k, v []byte) error {
+			var old storedJWTKey
+			if err := json.Unmarshal(v, &old); err != nil {
+				return err
+			}
+			switch {
+			case old.RetiredAt == nil:
+				old.RetiredAt = &now
+				retire = append(retire, old)
+			case now.Sub(*old.RetiredAt) > jwtKeyRetention:
+				prune = append(prune, append([]byte(nil), k...))
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for i := range retire {
+			if err := putJWTKey(tx, &retire[i]); err != nil {
+				return err
+			}
+		}
+		for _, k := range prune {
+			if err := b.Delete(k); err != nil {
+				return err
+			}
+			if err := logChange(tx, models.ChangeJWTKey, "", k, nil); err != nil {
+				return err
+			}
+		}
+		if err := putJWTKey(tx, &stored); err != nil {
+			return err
+		}
+		return loadJWTKeys(tx)
+	})
+	if err != nil {
+		return models.SigningKey{}, err
+	}
+
+	utils.Info("audit", "token signing key rotated: kid=%s alg=%s", stored.KID, stored.Algorithm)
+	stored.Current = true
+	stored.Public = signer.Public()
+	return stored.SigningKey, nil
+}
+
+// putJWTKey stores a signing key and records it in the change log
+func putJWTKey(tx *bbolt.Tx, k *storedJWTKey) error {
+	b := tx.Bucket([]byte(jwtKeysBucket))
+	if err := putJSON(b, []byte(k.KID), k); err != nil {
+		return err
+	}
+	return logChange(tx, models.ChangeJWTKey, "", []byte(k.KID), b.Get([]byte(k.KID)))
+}
+
+// CurrentSigningKey returns the key new tokens are signed with
+func CurrentSigningKey() (string, crypto.Signer, error) {
+	jwtKeysMu.RLock()
+	defer jwtKeysMu.RUnlock()
+	if jwtCurrent == nil {
+		return "", nil, errors.New("no token signing key")
+	}
+	return jwtCurrent.KID, jwtCurrent.signer, nil
+}
+
+// VerificationKey returns the algorithm and public key of a signing key that
+// is current or still within its retention
+func VerificationKey(kid string) (string, crypto.PublicKey, error) {
+	jwtKeysMu.RLock()
+	defer jwtKeysMu.RUnlock()
+	k, ok := jwtKeys[kid]
+	if !ok || (k.RetiredAt != nil && utils.Now().Sub(*k.RetiredAt) > jwtKeyRetention) {
+		return "", nil, ErrUnknownSigningKey
+	}
+	return k.Algorithm, k.Public, nil
+}
+
+// SigningKeys lists the keys that verify tokens, newest first
+func SigningKeys() []models.SigningKey {
+	jwtKeysMu.RLock()
+	defer jwtKeysMu.RUnlock()
+	now := utils.Now()
+	keys := []models.SigningKey{}
+	for _, k := range jwtKeys {
+		if k.RetiredAt != nil && now.Sub(*k.RetiredAt) > jwtKeyRetention {
+			continue
+		}
+		desc := k.SigningKey
+		desc.Current = k == jwtCurrent
+		keys = append(keys, desc)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].CreatedAt.After(keys[j].CreatedAt) })
+	return keys
+}
@@ -0,0 +1,64 @@
+package storage
+
+import (
+	"encoding/json"
+	"errors"
+
+	"secure-vault/utils"
+
+	"go.etcd.io/bbolt"
+)
+
+const keyCheckKey = "keycheck"
+
+var keyCheckPlaintext = []byte("secure-vault master key check")
+
+// keyCheck is a known value sealed with the master key, used to detect a
+// database and master key that do not belong together.
+type keyCheck struct {
+	Fingerprint string `json:"fingerprint"`
+	Ciphertext  []byte `json:"ciphertext"`
+	Nonce       []byte `json:"nonce"`
+}
+
+// ensureKeyCheck writes the key check value on first start and verifies it afterwards
+func ensureKeyCheck(tx *bbolt.Tx) error {
+	settings := tx.Bucket([]byte(settingsBucket))
+	if settings.Get([]byte(keyCheckKey)) != nil {
+		return verifyKeyCheck(tx)
+	}
+
+	ct, nonce, err := utils.EncryptWithMasterKey(keyCheckPlaintext)
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(keyCheck{
+		Fingerprint: utils.MasterKeyFingerprint(),
+		Ciphertext:  ct,
+		Nonce:       nonce,
+	})
+	if err != nil {
+		return err
+	}
+	return settings.Put([]byte(keyCheckKey), data)
+}
+
+// verifyKeyCheck confirms the loaded master key opens the database's key check value
+func verifyKeyCheck(tx *bbolt.Tx) error {
+	settings := tx.Bucket([]byte(settingsBucket))
+	if settings == nil {
+		return errors.New("settings bucket not found")
+	}
+	data := settings.Get([]byte(keyCheckKey))
+	if data == nil {
+		return errors.New("database has no master key check value")
+	}
+	var kc keyCheck
+	if err := json.Unmarshal(data, &kc); err != nil {
+		return err
+	}
+	if _, err := utils.DecryptWithMasterKey(kc.Ciphertext, kc.Nonce); err != nil {
+		return errors.New("master key does not match database (fingerprint " + kc.Fingerprint + ")")
+	}
+	return nil
+}
@@ -0,0 +1,178 @@
+package storage
+
+import (
+	"bytes"
+	"errors"
+	"time"
+
+	"secure-vault/models"
+	"secure-vault/utils"
+)
+
+// lazySweepBatch is at least one, or the sweep would never move on
+var lazySweepBatch = max(1, utils.EnvInt("LAZY_SWEEP_BATCH", 10))
+
+// LazyMigrate rewrites an entry that was just decrypted on read under the current
+// crypto mode. It is a no-op unless lazy migration is active and the entry is
+// behind. If the entry changed since it was read (e.g. rotated), it is left alone.
+func LazyMigrate(read models.VaultEntry, plainKey []byte) error {
+	if IsFollower() {
+		return nil // the leader migrates, and replicates the result
+	}
+	if read.ModePinned {
+		return nil
+	}
+
+	// Decide in a read transaction, so reads of up-to-date entries never wait
+	// for the write lock
+	var behind bool
+	err := view(read.Tenant, func(tx *tenantTx) error {
+		behind = migrationStrategy(tx) == models.LazyMigration && read.CryptoMode != string(cryptoMode(tx))
+		return nil
+	})
+	if err != nil || !behind {
+		return err
+	}
+
+	return update(read.Tenant, func(tx *tenantTx) error {
+		mode := cryptoMode(tx)
+		if migrationStrategy(tx) != models.LazyMigration || read.CryptoMode == string(mode) || read.ModePinned {
+			return nil
+		}
+
+		b := tx.Bucket([]byte(vaultBucket))
+		if b == nil {
+			return errors.New("vault bucket not found")
+		}
+		data := b.Get([]byte(read.ID))
+		if data == nil {
+			return nil
+		}
+		entry, err := decodeEntry(read.Tenant, data)
+		if err != nil {
+			return err
+		}
+		if entry.CryptoMode != read.CryptoMode || !bytes.Equal(entry.Envelope.Ciphertext, read.Envelope.Ciphertext) {
+			return nil
+		}
+
+		if err := EncryptEntry(&entry, mode, "", plainKey); err != nil {
+			return err
+		}
+		utils.Info("rekey", "lazily migrated key %s to %s", entry.ID, mode)
+		return putEntry(tx, &entry)
+	})
+}
+
+// GetVaultStats counts the stored entries of tenant per crypto mode
+func GetVaultStats(tenant string) (models.VaultStats, error) {
+	stats := models.VaultStats{ByMode: map[string]int{}}
+
+	err := view(tenant, func(tx *tenantTx) error {
+		stats.Mode = cryptoMode(tx)
+		stats.Migration = migrationStrategy(tx)
+
+		b := tx.Bucket([]byte(vaultBucket))
+		if b == nil {
+			return errors.New("vault bucket not found")
+		}
+		return b.ForEach(func(k, v []byte) error {
+			entry, err := decodeEntry(tenant, v)
+			if err != nil {
+				return err
+			}
+			if entry.IsTombstone() {
+				stats.Tombstones++
+				return nil
+			}
+			stats.Total++
+			stats.ByMode[entry.CryptoMode]++
+			if entry.ModePinned {
+				stats.Pinned++
+			} else if entry.CryptoMode != string(stats.Mode) {
+				stats.Pending++
+			}
+			return nil
+		})
+	})
+
+	return stats, err
+}
+
+// StartLazySweeper migrates a few lagging entries of every tenant each interval
+// while lazy migration is active for it, so rarely read entries eventually catch up too.
+func StartLazySweeper(interval time.Duration) {
+	go func() {
+		cursors := map[string]string{}
+		for range time.Tick(interval) {
+			for _, tenant := range Tenants() {
+				next, err := lazySweep(tenant, cursors[tenant])
+				if err != nil {
+					utils.Error("rekey", "lazy sweep of tenant %s failed: %v", tenant, err)
+					continue
+				}
+				cursors[tenant] = next
+			}
+		}
+	}()
+}
+
+// lazySweep migrates up to lazySweepBatch entries of tenant after cursor and
+// returns the new cursor, wrapping around at the end of the bucket so a failing
+// entry does not stall the sweep. The batch is picked in a read transaction and
+// each entry is rewritten in its own short write transaction, so reads and
+// writes of the tenant never wait for a whole batch.
+func lazySweep(tenant, cursor string) (string, error) {
+	var keys [][]byte
+	next := cursor
+	err := view(tenant, func(tx *tenantTx) error {
+		mode := cryptoMode(tx)
+		if migrationStrategy(tx) != models.LazyMigration {
+			return nil
+		}
+		b := tx.Bucket([]byte(vaultBucket))
+		if b == nil {
+			return errors.New("vault bucket not found")
+		}
+
+		c := b.Cursor()
+		k, v := c.Seek([]byte(cursor))
+		if k != nil && string(k) == cursor {
+			k, v = c.Next()
+		}
+		for ; k != nil && len(keys) < lazySweepBatch; k, v = c.Next() {
+			if entry, err := decodeEntry(tenant, v); err == nil && (entry.CryptoMode == string(mode) || entry.ModePinned || entry.IsTombstone()) {
+				continue
+			}
+			keys = append(keys, append([]byte(nil), k...))
+		}
+		if k == nil || len(keys) == 0 {
+			next = ""
+		} else {
+			next = string(keys[len(keys)-1])
+		}
+		return nil
+	})
+	if err != nil {
+		return cursor, err
+	}
+
+	for _, k := range keys {
+		err := update(tenant, func(tx *tenantTx) error {
+			// The mode, the strategy or the entry may have changed since the batch was picked
+			if migrationStrategy(tx) != models.LazyMigration {
+				return nil
+			}
+			v := tx.Bucket([]byte(vaultBucket)).Get(k)
+			if v == nil {
+				return nil
+			}
+			_, err := rekeyOne(tx, k, v, cryptoMode(tx))
+			return err
+		})
+		if err != nil {
+			utils.Warn("rekey", "lazy sweep: entry %s failed: %v", k, err)
+		}
+	}
+	return next, nil
+}
@@ -0,0 +1,143 @@
+package storage
+
+import (
+	"crypto/rand"
+	"errors"
+	"time"
+
+	"secure-vault/models"
+	"secure-vault/utils"
+
+	"go.etcd.io/bbolt"
+)
+
+const metadataEncryptionKey = "metadataencryption"
+
+var errNoMetadataKey = errors.New("metadata key not loaded")
+
+// sensitiveMetadata is what METADATA_ENCRYPTION keeps out of plaintext records:
+// everything that tells who owns which kind of key, since when, and who else
+// may use it
+type sensitiveMetadata struct {
+	UserID      string              `cbor:"1,keyasint"`
+	Label       string              `cbor:"2,keyasint,omitempty"`
+	KeyType     string              `cbor:"3,keyasint"`
+	KeyEncoding string              `cbor:"4,keyasint"`
+	Tags        map[string]string   `cbor:"5,keyasint,omitempty"`
+	CreatedAt   time.Time           `cbor:"6,keyasint"`
+	ExpiresAt   *time.Time          `cbor:"7,keyasint,omitempty"`
+	DeletedAt   *time.Time          `cbor:"8,keyasint,omitempty"`
+	Versions    []models.KeyVersion `cbor:"9,keyasint,omitempty"`
+	Grants      []models.Grant      `cbor:"10,keyasint,omitempty"`
+	SignIn      bool                `cbor:"11,keyasint,omitempty"`
+}
+
+// The record ID is bound as additional data so sealed metadata cannot be moved
+// to another record
+func metadataSealAAD(id string) []byte {
+	return []byte("secure-vault/metadata/v1\x00" + id)
+}
+
+// sealMetadata returns a copy of entry with its sensitive fields replaced by
+// their ciphertext
+func sealMetadata(entry *models.VaultEntry) (*models.VaultEntry, error) {
+	if metadataAEAD == nil {
+		return nil, errNoMetadataKey
+	}
+	plain, err := cborEnc.Marshal(sensitiveMetadata{
+		UserID:      entry.UserID,
+		Label:       entry.Label,
+		KeyType:     entry.KeyType,
+		KeyEncoding: entry.KeyEncoding,
+		Tags:        entry.Tags,
+		CreatedAt:   entry.CreatedAt,
+		ExpiresAt:   entry.ExpiresAt,
+		DeletedAt:   entry.DeletedAt,
+		Versions:    entry.Versions,
+		Grants:      entry.Grants,
+		SignIn:      entry.SignIn,
+	})
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, metadataAEAD.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	sealed := *entry
+	sealed.UserID, sealed.Label, sealed.KeyType, sealed.KeyEncoding = "", "", "", ""
+	sealed.Tags, sealed.Versions, sealed.Grants, sealed.SignIn = nil, nil, nil, false
+	sealed.CreatedAt, sealed.ExpiresAt, sealed.DeletedAt = time.Time{}, nil, nil
+	sealed.Sealed = &models.SealedMetadata{
+		Nonce:      nonce,
+		Ciphertext: metadataAEAD.Seal(nil, nonce, plain, metadataSealAAD(entry.ID)),
+	}
+	return &sealed, nil
+}
+
+// openMetadata restores the fields of a record written with sealed metadata
+func openMetadata(entry *models.VaultEntry) error {
+	if metadataAEAD == nil {
+		return errNoMetadataKey
+	}
+	plain, err := metadataAEAD.Open(nil, entry.Sealed.Nonce, entry.Sealed.Ciphertext, metadataSealAAD(entry.ID))
+	if err != nil {
+		return errors.New("cannot open sealed metadata of entry " + entry.ID)
+	}
+	var m sensitiveMetadata
+	if err := cborDec.Unmarshal(plain, &m); err != nil {
+		return err
+	}
+	entry.UserID, entry.Label, entry.KeyType, entry.KeyEncoding = m.UserID, m.Label, m.KeyType, m.KeyEncoding
+	entry.Tags, entry.Versions, entry.Grants, entry.SignIn = m.Tags, m.Versions, m.Grants, m.SignIn
+	entry.CreatedAt, entry.ExpiresAt, entry.DeletedAt = m.CreatedAt, m.ExpiresAt, m.DeletedAt
+	entry.Sealed = nil
+	return nil
+}
+
+// isSealed reports whether a current-version record carries sealed metadata,
+// without decrypting it
+func isSealed(raw []byte) bool {
+	var probe struct {
+		Sealed *models.SealedMetadata `cbor:"18,keyasint"`
+	}
+	if version, err := recordVersion(raw); err != nil || version == 0 {
+		return false
+	}
+	return cborDec.Unmarshal(raw[len(recordMagic)+1:], &probe) == nil && probe.Sealed != nil
+}
+
+// applyMetadataEncryption rewrites records whose sealing does not match
+// METADATA_ENCRYPTION, after the setting was switched. The applied setting is
+// recorded once every record was rewritten, so an interrupted pass resumes.
+func applyMetadataEncryption() error {
+	want := "off"
+	if encryptMetadata {
+		want = "on"
+	}
+	var applied []byte
+	if err := viewRoot(func(tx *bbolt.Tx) error {
+		applied = tx.Bucket([]byte(settingsBucket)).Get([]byte(metadataEncryptionKey))
+		return nil
+	}); err != nil {
+		return err
+	}
+	if string(applied) == want || (applied == nil && !encryptMetadata) {
+		return nil
+	}
+
+	rewritten, failed, err := rewriteEntries("metadata", func(raw []byte) bool {
+		return isSealed(raw) != encryptMetadata
+	}, nil)
+	if err != nil {
+		return err
+	}
+	utils.Info("metadata", "metadata encryption %s: rewrote %d entries (%d failed)", want, rewritten, failed)
+	if failed > 0 {
+		return nil // retried on the next start
+	}
+	return update(models.DefaultTenant, func(tx *tenantTx) error {
+		return putSetting(tx, metadataEncryptionKey, []byte(want))
+	})
+}
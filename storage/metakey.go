@@ -0,0 +1,94 @@
+package storage
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+
+	"secure-vault/utils"
+
+	"go.etcd.io/bbolt"
+)
+
+// The metadata DEK is a random key stored in settings, wrapped with the master
+// key. Two keys are derived from it: one seals entry metadata at rest
+// (METADATA_ENCRYPTION), the other blinds index keys so user IDs and tags never
+// appear in bucket keys.
+const metadataKeyName = "metadatakey"
+
+var encryptMetadata = utils.EnvBool("METADATA_ENCRYPTION", false)
+
+type wrappedMetadataKey struct {
+	Ciphertext []byte `json:"ciphertext"`
+	Nonce      []byte `json:"nonce"`
+}
+
+var (
+	metadataAEAD cipher.AEAD
+	blindKey     []byte
+)
+
+// ensureMetadataKey creates the metadata DEK on first start and loads it
+func ensureMetadataKey(tx *bbolt.Tx) error {
+	settings := tx.Bucket([]byte(settingsBucket))
+	if settings.Get([]byte(metadataKeyName)) == nil {
+		dek := make([]byte, 32)
+		if _, err := rand.Read(dek); err != nil {
+			return err
+		}
+		ct, nonce, err := utils.EncryptWithMasterKey(dek)
+		if err != nil {
+			return err
+		}
+		if err := putJSON(settings, []byte(metadataKeyName), wrappedMetadataKey{Ciphertext: ct, Nonce: nonce}); err != nil {
+			return err
+		}
+	}
+	return loadMetadataKey(tx)
+}
+
+// loadMetadataKey unwraps the database's metadata DEK. Databases written before
+// it existed have none; they hold no sealed metadata and no blinded index yet.
+func loadMetadataKey(tx *bbolt.Tx) error {
+	data := tx.Bucket([]byte(settingsBucket)).Get([]byte(metadataKeyName))
+	if data == nil {
+		metadataAEAD, blindKey = nil, nil
+		return nil
+	}
+	var wrapped wrappedMetadataKey
+	if err := json.Unmarshal(data, &wrapped); err != nil {
+		return err
+	}
+	dek, err := utils.DecryptWithMasterKey(wrapped.Ciphertext, wrapped.Nonce)
+	if err != nil {
+		return errors.New("cannot unwrap metadata key: " + err.Error())
+	}
+
+	block, err := aes.NewCipher(deriveKey(dek, "metadata-encryption"))
+	if err != nil {
+		return err
+	}
+	if metadataAEAD, err = cipher.NewGCM(block); err != nil {
+		return err
+	}
+	blindKey = deriveKey(dek, "blind-index")
+	return nil
+}
+
+func deriveKey(dek []byte, purpose string) []byte {
+	mac := hmac.New(sha256.New, dek)
+	mac.Write([]byte(purpose))
+	return mac.Sum(nil)
+}
+
+// blindToken is the lookup token for a sensitive value in an index key: a
+// 32-byte HMAC, so equal values still meet without the value being stored
+func blindToken(kind, value string) []byte {
+	mac := hmac.New(sha256.New, blindKey)
+	mac.Write([]byte(kind + "\x00" + value))
+	return mac.Sum(nil)
+}
@@ -0,0 +1,293 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"secure-vault/models"
+	"secure-vault/utils"
+)
+
+// migration upgrades a record from schema version v to v+1. raw is the record as
+// stored; only migrations out of a different on-disk format need to look at it.
+type migration struct {
+	name string
+	up   func(raw []byte, entry *models.VaultEntry) error
+}
+
+// migrations is keyed by the version a migration upgrades from
+var migrations = map[int]migration{}
+
+func registerMigration(from int, name string, up func(raw []byte, entry *models.VaultEntry) error) {
+	if _, dup := migrations[from]; dup {
+		panic(fmt.Sprintf("duplicate schema migration from version %d", from))
+	}
+	migrations[from] = migration{name: name, up: up}
+}
+
+func init() {
+	registerMigration(0, "legacy JSON to envelope", migrateLegacyJSON)
+	registerMigration(1, "bind metadata as AAD", migrateBindMetadata)
+	registerMigration(2, "optional sealed metadata", func([]byte, *models.VaultEntry) error { return nil })
+}
+
+// upgradeEntry runs every migration between version and the current schema
+func upgradeEntry(raw []byte, version int, entry *models.VaultEntry) error {
+	for v := version; v < models.EntrySchemaVersion; v++ {
+		m, ok := migrations[v]
+		if !ok {
+			return fmt.Errorf("no schema migration from version %d", v)
+		}
+		if err := m.up(raw, entry); err != nil {
+			return fmt.Errorf("schema migration %q: %w", m.name, err)
+		}
+	}
+	entry.SchemaVersion = models.EntrySchemaVersion
+	return nil
+}
+
+// legacyEntry is the schema version 0 layout: flat JSON with per-mode fields
+type legacyEntry struct {
+	ID           string    `json:"id"`
+	UserID       string    `json:"user_id"`
+	Label        string    `json:"label"`
+	KeyType      string    `json:"key_type"`
+	KeyEncoding  string    `json:"key_encoding"`
+	CryptoMode   string    `json:"crypto_mode"`
+	CryptoParams string    `json:"crypto_params,omitempty"`
+	ModePinned   bool      `json:"mode_pinned,omitempty"`
+	CreatedAt    time.Time `json:"created_at"`
+
+	Ciphertext []byte `json:"ciphertext"`
+	Nonce      []byte `json:"nonce"`
+
+	EphemeralPubKey           []byte `json:"ephemeral_pub_key"`
+	EncryptedEphemeralPrivKey []byte `json:"encrypted_ephemeral_priv_key"`
+	EphemeralPrivNonce        []byte `json:"ephemeral_priv_nonce"`
+
+	KyberPubKey           []byte `json:"kyber_pub_key"`
+	KyberCiphertext       []byte `json:"kyber_ciphertext"`
+	EncryptedKyberPrivKey []byte `json:"encrypted_kyber_priv_key"`
+	KyberPrivNonce        []byte `json:"kyber_priv_nonce"`
+}
+
+func migrateLegacyJSON(raw []byte, entry *models.VaultEntry) error {
+	var old legacyEntry
+	if err := json.Unmarshal(raw, &old); err != nil {
+		return err
+	}
+
+	*entry = models.VaultEntry{
+		Tenant:       entry.Tenant,
+		ID:           old.ID,
+		UserID:       old.UserID,
+		Label:        old.Label,
+		KeyType:      old.KeyType,
+		KeyEncoding:  old.KeyEncoding,
+		CryptoMode:   old.CryptoMode,
+		CryptoParams: old.CryptoParams,
+		ModePinned:   old.ModePinned,
+		CreatedAt:    old.CreatedAt,
+		Revision:     1,
+		Envelope: models.Envelope{
+			Ciphertext: old.Ciphertext,
+			Nonce:      old.Nonce,
+		},
+	}
+
+	switch models.CryptoMode(old.CryptoMode) {
+	case models.ClassicalMode:
+		entry.Envelope.EphemeralPubKey = old.EphemeralPubKey
+		entry.Envelope.WrappedPrivKey = old.EncryptedEphemeralPrivKey
+		entry.Envelope.WrappedPrivNonce = old.EphemeralPrivNonce
+	case models.QuantumSafeMode:
+		entry.Envelope.EphemeralPubKey = old.KyberPubKey
+		entry.Envelope.KEMCiphertext = old.KyberCiphertext
+		entry.Envelope.WrappedPrivKey = old.EncryptedKyberPrivKey
+		entry.Envelope.WrappedPrivNonce = old.KyberPrivNonce
+	default:
+		return fmt.Errorf("unknown crypto_mode %q", old.CryptoMode)
+	}
+	return nil
+}
+
+// Records left in an older schema (SCHEMA_MIGRATE_ON_START=false) are upgraded
+// once: the first decode keeps the upgraded record, so later decodes return the
+// same envelopes without re-sealing them, and queues it to be written back.
+const maxPendingUpgrades = 1024
+
+type pendingUpgrade struct {
+	tenant, id string
+	raw        []byte
+}
+
+var (
+	upgradesMu      sync.Mutex
+	upgradedRecords = map[string][]byte{} // upgradeKey(tenant, raw) -> upgraded record
+	upgradeQueue    = make(chan pendingUpgrade, maxPendingUpgrades)
+	upgradeWorker   sync.Once
+)
+
+func upgradeKey(tenant string, raw []byte) string {
+	sum := sha256.Sum256(raw)
+	return tenant + "/" + string(sum[:])
+}
+
+// upgradedRecord returns the record an earlier decode upgraded raw to
+func upgradedRecord(tenant string, raw []byte) ([]byte, bool) {
+	upgradesMu.Lock()
+	defer upgradesMu.Unlock()
+	data, ok := upgradedRecords[upgradeKey(tenant, raw)]
+	return data, ok
+}
+
+// rememberUpgrade keeps the upgrade of raw and queues it to be persisted. When
+// too many are pending, later decodes upgrade the record again.
+func rememberUpgrade(raw []byte, entry *models.VaultEntry) {
+	upgraded := *entry
+	data, err := encodeEntry(&upgraded)
+	if err != nil {
+		return
+	}
+	upgradesMu.Lock()
+	defer upgradesMu.Unlock()
+	key := upgradeKey(entry.Tenant, raw)
+	if _, ok := upgradedRecords[key]; ok || len(upgradedRecords) >= maxPendingUpgrades {
+		return
+	}
+	upgradedRecords[key] = data
+
+	// A follower takes the upgrade from the leader, offline tools write nothing
+	if IsFollower() || db.IsReadOnly() {
+		return
+	}
+	upgradeWorker.Do(func() { go persistUpgrades() })
+	upgradeQueue <- pendingUpgrade{tenant: entry.Tenant, id: entry.ID, raw: append([]byte(nil), raw...)}
+}
+
+// persistUpgrades writes queued upgrades back, unless the record changed since
+// it was read. Failures are only logged: reads keep using the upgrade in memory.
+func persistUpgrades() {
+	for p := range upgradeQueue {
+		key := upgradeKey(p.tenant, p.raw)
+		err := update(p.tenant, func(tx *tenantTx) error {
+			b := tx.Bucket([]byte(vaultBucket))
+			if !bytes.Equal(b.Get([]byte(p.id)), p.raw) {
+				return nil
+			}
+			data, _ := upgradedRecord(p.tenant, p.raw)
+			entry, err := decodeEntry(p.tenant, data)
+			if err != nil {
+				return err
+			}
+			return putEntry(tx, &entry)
+		})
+		if err != nil {
+			utils.Warn("schema", "cannot persist upgraded entry %s: %v", p.id, err)
+			continue
+		}
+		upgradesMu.Lock()
+		delete(upgradedRecords, key)
+		upgradesMu.Unlock()
+	}
+}
+
+// MigrateSchema rewrites every record older than the current schema version,
+// in batches of rekeyBatchSize per transaction. Records that fail to upgrade are
+// logged and left as they are.
+func MigrateSchema() error {
+	upgraded, failed, err := rewriteEntries("schema", func(raw []byte) bool {
+		version, err := recordVersion(raw)
+		return err != nil || version != models.EntrySchemaVersion
+	}, nil)
+	if upgraded > 0 || failed > 0 {
+		utils.Info("schema", "upgraded %d entries to schema version %d (%d failed)", upgraded, models.EntrySchemaVersion, failed)
+	}
+	return err
+}
+
+// rewriteEntries decodes and re-encodes every record selected by stale in every
+// tenant, in batches of rekeyBatchSize per transaction, applying fix in between
+// when set. Failures are logged under tag and the record is left as it is.
+func rewriteEntries(tag string, stale func(raw []byte) bool, fix func(entry *models.VaultEntry) error) (rewritten, failed int, err error) {
+	err = forEachTenant(func(tenant string) error {
+		r, f, err := rewriteTenantEntries(tenant, tag, stale, fix)
+		rewritten += r
+		failed += f
+		return err
+	})
+	return rewritten, failed, err
+}
+
+// rewriteTenantEntries is rewriteEntries for the entries of one tenant
+func rewriteTenantEntries(tenant, tag string, stale func(raw []byte) bool, fix func(entry *models.VaultEntry) error) (rewritten, failed int, err error) {
+	var next []byte // first key of the next batch
+
+	for {
+		done := true
+		err = update(tenant, func(tx *tenantTx) error {
+			b := tx.Bucket([]byte(vaultBucket))
+			c := b.Cursor()
+
+			var keys, values [][]byte
+			k, v := c.First()
+			if next != nil {
+				k, v = c.Seek(next)
+			}
+			for ; k != nil && len(keys) < rekeyBatchSize; k, v = c.Next() {
+				if !stale(v) {
+					continue
+				}
+				keys = append(keys, append([]byte(nil), k...))
+				values = append(values, append([]byte(nil), v...))
+			}
+			if k != nil {
+				done = false
+				next = append([]byte(nil), k...)
+			}
+
+			for i, k := range keys {
+				entry, err := decodeEntry(tenant, values[i])
+				if err == nil && fix != nil {
+					err = fix(&entry)
+				}
+				if err == nil {
+					err = putEntry(tx, &entry)
+				}
+				if err != nil {
+					utils.Warn(tag, "cannot rewrite entry %s: %v", k, err)
+					failed++
+					continue
+				}
+				rewritten++
+			}
+			return nil
+		})
+		if err != nil || done {
+			return rewritten, failed, err
+		}
+	}
+}
+
+// migrateBindMetadata re-seals envelopes written without additional data so they
+// authenticate the entry's metadata. Tombstones hold no key material to re-seal.
+func migrateBindMetadata(_ []byte, entry *models.VaultEntry) error {
+	if entry.IsTombstone() {
+		return nil
+	}
+	plainKey, err := decryptEnvelope(entry, &entry.Envelope, nil)
+	if err != nil {
+		return err
+	}
+	versions := make([][]byte, len(entry.Versions))
+	for i := range entry.Versions {
+		if versions[i], err = decryptEnvelope(entry, &entry.Versions[i].Envelope, nil); err != nil {
+			return err
+		}
+	}
+	return resealEntry(entry, plainKey, versions)
+}
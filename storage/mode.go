@@ -3,21 +3,20 @@ package storage
 import (
 	"errors"
 	"secure-vault/models"
-
-	"go.etcd.io/bbolt"
 )
 
 const (
 	settingsBucket = "settings"
 	modeKey        = "cryptomode"
+	migrationKey   = "migration"
 	defaultMode    = models.ClassicalMode
 )
 
-// GetCryptoMode reads the current crypto mode from BoltDB
-func GetCryptoMode() (models.CryptoMode, error) {
+// GetCryptoMode reads the current crypto mode of tenant from BoltDB
+func GetCryptoMode(tenant string) (models.CryptoMode, error) {
 	var mode models.CryptoMode
 
-	err := db.View(func(tx *bbolt.Tx) error {
+	err := view(tenant, func(tx *tenantTx) error {
 		b := tx.Bucket([]byte(settingsBucket))
 		v := b.Get([]byte(modeKey))
 		if v == nil {
@@ -31,13 +30,73 @@ func GetCryptoMode() (models.CryptoMode, error) {
 	return mode, err
 }
 
-// SetCryptoMode updates the stored crypto mode
-func SetCryptoMode(mode models.CryptoMode) error {
+// GetMigrationStrategy reads how entries follow a mode switch (eager by default)
+func GetMigrationStrategy(tenant string) (models.MigrationStrategy, error) {
+	var strategy models.MigrationStrategy
+	err := view(tenant, func(tx *tenantTx) error {
+		strategy = migrationStrategy(tx)
+		return nil
+	})
+	return strategy, err
+}
+
+// SwitchCryptoMode stores the crypto mode and migration strategy of tenant
+// together with what follows from them, all in one transaction: with lazy
+// migration a running re-encryption job is cancelled, with eager migration a
+// new one is recorded and started once the switch is committed. The job is
+// nil with lazy migration.
+func SwitchCryptoMode(tenant string, mode models.CryptoMode, strategy models.MigrationStrategy) (*models.RekeyJob, error) {
 	if mode != models.ClassicalMode && mode != models.QuantumSafeMode {
-		return errors.New("invalid crypto mode")
+		return nil, errors.New("invalid crypto mode")
 	}
-	return db.Update(func(tx *bbolt.Tx) error {
-		b := tx.Bucket([]byte(settingsBucket))
-		return b.Put([]byte(modeKey), []byte(mode))
+	if strategy != models.EagerMigration && strategy != models.LazyMigration {
+		return nil, errors.New("invalid migration strategy")
+	}
+
+	var job *models.RekeyJob
+	err := update(tenant, func(tx *tenantTx) error {
+		if err := putSetting(tx, modeKey, []byte(mode)); err != nil {
+			return err
+		}
+		if err := putSetting(tx, migrationKey, []byte(strategy)); err != nil {
+			return err
+		}
+		if strategy == models.LazyMigration {
+			return cancelRekeyJob(tx)
+		}
+		var err error
+		job, err = newRekeyJob(tx, mode)
+		return err
 	})
+	if err != nil {
+		return nil, err
+	}
+	if job != nil {
+		go runRekeyJob(tenant, job.ID)
+	}
+	return job, nil
+}
+
+// putSetting stores a replicated setting of the tenant
+func putSetting(tx *tenantTx, key string, value []byte) error {
+	if err := tx.Bucket([]byte(settingsBucket)).Put([]byte(key), value); err != nil {
+		return err
+	}
+	return logChange(tx.Tx, models.ChangeSetting, tx.tenant, []byte(key), value)
+}
+
+func migrationStrategy(tx *tenantTx) models.MigrationStrategy {
+	v := tx.Bucket([]byte(settingsBucket)).Get([]byte(migrationKey))
+	if v == nil {
+		return models.EagerMigration
+	}
+	return models.MigrationStrategy(v)
+}
+
+func cryptoMode(tx *tenantTx) models.CryptoMode {
+	v := tx.Bucket([]byte(settingsBucket)).Get([]byte(modeKey))
+	if v == nil {
+		return defaultMode
+	}
+	return models.CryptoMode(v)
 }
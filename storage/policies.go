@@ -0,0 +1,221 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+
+	"secure-vault/models"
+	"secure-vault/utils"
+
+	"go.etcd.io/bbolt"
+)
+
+// Policies live in each tenant's policies bucket, one record per version under
+// <name>/<version as 20 digits>, so a name's versions sort together and in
+// order. The last version is the current one; deleting a policy stores a
+// version marked deleted.
+//
+// Every write bumps the bucket's sequence, which the in-memory cache of each
+// tenant's current policies is checked against, so authorizing does not read
+// the bucket unless it changed.
+const policiesBucket = "policies"
+
+var ErrPolicyNotFound = errors.New("policy not found")
+
+type cachedPolicies struct {
+	sequence uint64
+	policies []models.Policy
+}
+
+var (
+	policyCacheMu sync.Mutex
+	policyCache   = map[string]cachedPolicies{}
+)
+
+func policyKey(name string, version uint64) []byte {
+	return []byte(fmt.Sprintf("%s/%020d", name, version))
+}
+
+// policyVersions returns every version of a policy, oldest first
+func policyVersions(tx *tenantTx, name string) ([]models.Policy, error) {
+	var versions []models.Policy
+	prefix := []byte(name + "/")
+	c := tx.Bucket([]byte(policiesBucket)).Cursor()
+	for k, v := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+		var p models.Policy
+		if err := json.Unmarshal(v, &p); err != nil {
+			return nil, err
+		}
+		versions = append(versions, p)
+	}
+	return versions, nil
+}
+
+// currentPolicies returns the current version of every policy not deleted.
+// The slice may be shared with other callers and must not be modified.
+func currentPolicies(tx *tenantTx) ([]models.Policy, error) {
+	b := tx.Bucket([]byte(policiesBucket))
+	sequence := b.Sequence()
+	policyCacheMu.Lock()
+	cached, ok := policyCache[tx.tenant]
+	policyCacheMu.Unlock()
+	if ok && cached.sequence == sequence {
+		return cached.policies, nil
+	}
+
+	policies, err := readCurrentPolicies(b)
+	if err != nil {
+		return nil, err
+	}
+	policyCacheMu.Lock()
+	policyCache[tx.tenant] = cachedPolicies{sequence: sequence, policies: policies}
+	policyCacheMu.Unlock()
+	return policies, nil
+}
+
+// readCurrentPolicies reads the current version of every policy not deleted
+func readCurrentPolicies(b *bbolt.Bucket) ([]models.Policy, error) {
+	var policies []models.Policy
+	err := b.ForEach(func(k, v []byte) error {
+		var p models.Policy
+		if err := json.Unmarshal(v, &p); err != nil {
+			return err
+		}
+		// Versions of a name come in order: a later one replaces the one before
+		if n := len(policies); n > 0 && policies[n-1].Name == p.Name {
+			policies = policies[:n-1]
+		}
+		policies = append(policies, p)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	current := policies[:0]
+	for _, p := range policies {
+		if !p.Deleted {
+			current = append(current, p)
+		}
+	}
+	return current, nil
+}
+
+// putPolicy stores p as the next version of its name
+func putPolicy(tx *tenantTx, p *models.Policy, by string) error {
+	versions, err := policyVersions(tx, p.Name)
+	if err != nil {
+		return err
+	}
+	p.Version = uint64(len(versions)) + 1
+	p.UpdatedAt = utils.Now()
+	p.UpdatedBy = by
+
+	b := tx.Bucket([]byte(policiesBucket))
+	key := policyKey(p.Name, p.Version)
+	if err := putJSON(b, key, p); err != nil {
+		return err
+	}
+	if _, err := b.NextSequence(); err != nil {
+		return err
+	}
+	return logChange(tx.Tx, models.ChangePolicy, tx.tenant, key, b.Get(key))
+}
+
+// PutPolicy stores a new version of a policy, creating it if needed
+func PutPolicy(tenant string, p models.Policy, by string) (models.Policy, error) {
+	p.Deleted = false
+	err := update(tenant, func(tx *tenantTx) error {
+		return putPolicy(tx, &p, by)
+	})
+	if err == nil {
+		utils.Info("audit", "policy stored: tenant=%s policy=%s version=%d by=%s", tenant, p.Name, p.Version, by)
+	}
+	return p, err
+}
+
+// DeletePolicy stops a policy from applying; its versions are kept
+func DeletePolicy(tenant, name, by string) error {
+	err := update(tenant, func(tx *tenantTx) error {
+		versions, err := policyVersions(tx, name)
+		if err != nil {
+			return err
+		}
+		if len(versions) == 0 || versions[len(versions)-1].Deleted {
+			return ErrPolicyNotFound
+		}
+		return putPolicy(tx, &models.Policy{Name: name, Deleted: true}, by)
+	})
+	if err == nil {
+		utils.Info("audit", "policy deleted: tenant=%s policy=%s by=%s", tenant, name, by)
+	}
+	return err
+}
+
+// GetPolicy returns a version of a policy, or with version 0 the current one
+func GetPolicy(tenant, name string, version uint64) (models.Policy, error) {
+	var p models.Policy
+	err := view(tenant, func(tx *tenantTx) error {
+		versions, err := policyVersions(tx, name)
+		if err != nil {
+			return err
+		}
+		switch {
+		case version == 0 && len(versions) > 0 && !versions[len(versions)-1].Deleted:
+			p = versions[len(versions)-1]
+		case version > 0 && version <= uint64(len(versions)):
+			p = versions[version-1]
+		default:
+			return ErrPolicyNotFound
+		}
+		return nil
+	})
+	return p, err
+}
+
+// PolicyHistory returns every version of a policy, oldest first
+func PolicyHistory(tenant, name string) ([]models.Policy, error) {
+	var versions []models.Policy
+	err := view(tenant, func(tx *tenantTx) error {
+		var err error
+		versions, err = policyVersions(tx, name)
+		return err
+	})
+	if err == nil && len(versions) == 0 {
+		err = ErrPolicyNotFound
+	}
+	return versions, err
+}
+
+// ListPolicies returns the current version of each policy of a tenant
+func ListPolicies(tenant string) ([]models.Policy, error) {
+	var policies []models.Policy
+	err := view(tenant, func(tx *tenantTx) error {
+		var err error
+		policies, err = currentPolicies(tx)
+		return err
+	})
+	return policies, err
+}
+
+// authorize decides on op against the tenant's current policies
+func authorize(tx *tenantTx, caller models.Caller, op string, entry *models.VaultEntry) (models.Decision, error) {
+	policies, err := currentPolicies(tx)
+	if err != nil {
+		return models.Decision{}, err
+	}
+	return models.Authorize(policies, caller, op, entry, utils.Now()), nil
+}
+
+// Authorize decides whether caller may do op on entry, with the reason
+func Authorize(tenant string, caller models.Caller, op string, entry *models.VaultEntry) (models.Decision, error) {
+	var d models.Decision
+	err := view(tenant, func(tx *tenantTx) error {
+		var err error
+		d, err = authorize(tx, caller, op, entry)
+		return err
+	})
+	return d, err
+}
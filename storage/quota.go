@@ -0,0 +1,201 @@
+package storage
+
+import (
+	"encoding/json"
+
+	"secure-vault/models"
+	"secure-vault/utils"
+
+	"go.etcd.io/bbolt"
+)
+
+const (
+	usageBucket = "usage"
+	quotaBucket = "quotas"
+)
+
+// Default limits, overridable per user through the admin API. Zero means unlimited,
+// except for versions: rotation keeps no earlier key unless KEY_RETAIN_VERSIONS is
+// on, and then at most MaxVersions of them, dropping the oldest.
+// Tenant limits apply to each tenant separately.
+var (
+	retainVersions = utils.EnvBool("KEY_RETAIN_VERSIONS", false)
+	defaultQuota   = models.QuotaLimits{
+		MaxEntries:  int64(utils.EnvInt("QUOTA_MAX_ENTRIES", 0)),
+		MaxBytes:    int64(utils.EnvInt("QUOTA_MAX_BYTES", 0)),
+		MaxVersions: utils.EnvInt("QUOTA_MAX_VERSIONS", 3),
+	}
+	tenantQuota = models.QuotaLimits{
+		MaxEntries: int64(utils.EnvInt("QUOTA_TENANT_MAX_ENTRIES", 0)),
+		MaxBytes:   int64(utils.EnvInt("QUOTA_TENANT_MAX_BYTES", 0)),
+	}
+)
+
+// Usage and override keys hold the user's blinded token, never the user ID
+func userUsageKey(userID string) []byte   { return append([]byte("u/"), blindToken("user", userID)...) }
+func quotaKey(userID string) []byte       { return blindToken("user", userID) }
+func tenantUsageKey(tenant string) []byte { return []byte("t/" + tenant) }
+
+// usageOf is what an entry counts against its owner's quota
+func usageOf(entry *models.VaultEntry) models.Usage {
+	if entry == nil || entry.IsTombstone() {
+		return models.Usage{}
+	}
+	return models.Usage{Entries: 1, Bytes: entry.KeyBytes()}
+}
+
+// updateUsage moves an entry's contribution from its previous owner and size to
+// the new ones; old is nil for a new entry
+func updateUsage(tx *tenantTx, old, entry *models.VaultEntry) error {
+	before, after := usageOf(old), usageOf(entry)
+	if before == after && (old == nil || old.UserID == entry.UserID) {
+		return nil
+	}
+	if old != nil {
+		if err := addUsage(tx, userUsageKey(old.UserID), models.Usage{}.Sub(before)); err != nil {
+			return err
+		}
+	}
+	if err := addUsage(tx, userUsageKey(entry.UserID), after); err != nil {
+		return err
+	}
+	return addUsage(tx, tenantUsageKey(tx.tenant), after.Sub(before))
+}
+
+func addUsage(tx *tenantTx, key []byte, delta models.Usage) error {
+	if delta == (models.Usage{}) {
+		return nil
+	}
+	b := tx.Bucket([]byte(usageBucket))
+	return putJSON(b, key, loadUsage(b, key).Add(delta))
+}
+
+func loadUsage(b *bbolt.Bucket, key []byte) models.Usage {
+	var u models.Usage
+	if v := b.Get(key); v != nil {
+		_ = json.Unmarshal(v, &u)
+	}
+	return u
+}
+
+// userLimits returns the limits of a user: the defaults with their override
+func userLimits(tx *tenantTx, userID string) models.QuotaLimits {
+	limits := defaultQuota.Apply(loadQuotaOverride(tx, userID))
+	if !retainVersions {
+		limits.MaxVersions = 0
+	}
+	return limits
+}
+
+// pruneVersions drops the oldest retained versions of entry beyond what its
+// owner may keep
+func pruneVersions(tx *tenantTx, entry *models.VaultEntry) {
+	max := userLimits(tx, entry.UserID).MaxVersions
+	if n := len(entry.Versions); n > max {
+		entry.Versions = append([]models.KeyVersion(nil), entry.Versions[n-max:]...)
+	}
+}
+
+// checkQuota rejects writing entry if it would take its owner or the tenant over
+// a limit. Only growth is checked, so lowering a limit never blocks shrinking.
+func checkQuota(tx *tenantTx, entry *models.VaultEntry) error {
+	delta := usageOf(entry).Sub(usageOf(storedEntry(tx, entry.ID)))
+	usage := tx.Bucket([]byte(usageBucket))
+
+	limits := userLimits(tx, entry.UserID)
+	if err := checkLimits("user "+entry.UserID, limits, loadUsage(usage, userUsageKey(entry.UserID)), delta); err != nil {
+		return err
+	}
+	return checkLimits("tenant "+tx.tenant, tenantQuota, loadUsage(usage, tenantUsageKey(tx.tenant)), delta)
+}
+
+func checkLimits(scope string, limits models.QuotaLimits, usage, delta models.Usage) error {
+	if would := usage.Entries + delta.Entries; delta.Entries > 0 && limits.MaxEntries > 0 && would > limits.MaxEntries {
+		return &models.QuotaError{Scope: scope, Limit: "entries", Max: limits.MaxEntries, Would: would}
+	}
+	if would := usage.Bytes + delta.Bytes; delta.Bytes > 0 && limits.MaxBytes > 0 && would > limits.MaxBytes {
+		return &models.QuotaError{Scope: scope, Limit: "key bytes", Max: limits.MaxBytes, Would: would}
+	}
+	return nil
+}
+
+func loadQuotaOverride(tx *tenantTx, userID string) *models.QuotaOverride {
+	v := tx.Bucket([]byte(quotaBucket)).Get(quotaKey(userID))
+	if v == nil {
+		return nil
+	}
+	var o models.QuotaOverride
+	if err := json.Unmarshal(v, &o); err != nil {
+		utils.Warn("quota", "ignoring unreadable override for %s: %v", userID, err)
+		return nil
+	}
+	return &o
+}
+
+// GetUserQuota reports the effective limits, override and usage of a user of tenant
+func GetUserQuota(tenant, userID string) (models.QuotaReport, error) {
+	report := models.QuotaReport{Tenant: tenant, UserID: userID}
+	err := view(tenant, func(tx *tenantTx) error {
+		report.Override = loadQuotaOverride(tx, userID)
+		report.Limits = userLimits(tx, userID)
+		report.Usage = loadUsage(tx.Bucket([]byte(usageBucket)), userUsageKey(userID))
+		return nil
+	})
+	return report, err
+}
+
+// GetTenantQuota reports the tenant-wide limits and usage
+func GetTenantQuota(tenant string) (models.QuotaReport, error) {
+	report := models.QuotaReport{Tenant: tenant, Limits: tenantQuota}
+	err := view(tenant, func(tx *tenantTx) error {
+		report.Usage = loadUsage(tx.Bucket([]byte(usageBucket)), tenantUsageKey(tenant))
+		return nil
+	})
+	return report, err
+}
+
+// SetQuotaOverride stores per-user limits in tenant; nil removes the override
+func SetQuotaOverride(tenant, userID string, override *models.QuotaOverride) error {
+	return update(tenant, func(tx *tenantTx) error {
+		b := tx.Bucket([]byte(quotaBucket))
+		if override == nil {
+			if err := b.Delete(quotaKey(userID)); err != nil {
+				return err
+			}
+			return logChange(tx.Tx, models.ChangeQuota, tenant, quotaKey(userID), nil)
+		}
+		if err := putJSON(b, quotaKey(userID), override); err != nil {
+			return err
+		}
+		return logChange(tx.Tx, models.ChangeQuota, tenant, quotaKey(userID), b.Get(quotaKey(userID)))
+	})
+}
+
+func putJSON(b *bbolt.Bucket, key []byte, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return b.Put(key, data)
+}
+
+// blindQuotaKeys re-keys overrides written by plain user ID under the user's token
+func blindQuotaKeys(tx *tenantTx) error {
+	b := tx.Bucket([]byte(quotaBucket))
+	overrides := map[string][]byte{}
+	if err := b.ForEach(func(k, v []byte) error {
+		overrides[string(k)] = append([]byte(nil), v...)
+		return nil
+	}); err != nil {
+		return err
+	}
+	for userID, v := range overrides {
+		if err := b.Delete([]byte(userID)); err != nil {
+			return err
+		}
+		if err := b.Put(quotaKey(userID), v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
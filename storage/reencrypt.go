@@ -0,0 +1,136 @@
+package storage
+
+import (
+	"errors"
+
+	"secure-vault/models"
+	"secure-vault/utils"
+)
+
+var ErrNoMatch = errors.New("no vault entry matches")
+
+// ReEncryptEntries moves the entries of tenant selected by filter to mode/params, in batches of
+// rekeyBatchSize per transaction. With pin set, the entries are excluded from later
+// global migrations. With dryRun set, nothing is written and the report lists what
+// would change.
+func ReEncryptEntries(tenant string, filter models.ReEncryptFilter, mode models.CryptoMode, params string, pin, dryRun bool) (models.ReEncryptReport, error) {
+	report := models.ReEncryptReport{DryRun: dryRun}
+	if params == "" {
+		params = models.DefaultCryptoParams(mode)
+	}
+	if !models.IsValidCryptoParams(mode, params) {
+		return report, errors.New("unsupported parameter set " + params + " for " + string(mode))
+	}
+
+	// 1. Collect matching IDs without holding the write lock
+	var ids []string
+	err := view(tenant, func(tx *tenantTx) error {
+		b := tx.Bucket([]byte(vaultBucket))
+		if b == nil {
+			return errors.New("vault bucket not found")
+		}
+		if filter.ID != "" {
+			if b.Get([]byte(filter.ID)) != nil {
+				ids = append(ids, filter.ID)
+			}
+			return nil
+		}
+		return b.ForEach(func(k, v []byte) error {
+			entry, err := decodeEntry(tenant, v)
+			if err != nil {
+				utils.Warn("rekey", "skipping unreadable entry %s: %v", k, err)
+				return nil
+			}
+			if filter.Matches(&entry) && !entry.IsTombstone() {
+				ids = append(ids, string(k))
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return report, err
+	}
+	if len(ids) == 0 {
+		return report, ErrNoMatch
+	}
+
+	// 2. Re-check and convert each batch inside its own write transaction
+	for start := 0; start < len(ids); start += rekeyBatchSize {
+		end := min(start+rekeyBatchSize, len(ids))
+		batch := ids[start:end]
+
+		apply := func(tx *tenantTx) error {
+			b := tx.Bucket([]byte(vaultBucket))
+			if b == nil {
+				return errors.New("vault bucket not found")
+			}
+			for _, id := range batch {
+				data := b.Get([]byte(id))
+				if data == nil {
+					continue // deleted meanwhile
+				}
+				entry, err := decodeEntry(tenant, data)
+				if err != nil {
+					return err
+				}
+				if !filter.Matches(&entry) || entry.IsTombstone() {
+					continue // changed meanwhile
+				}
+
+				res := models.ReEncryptResult{
+					ID:         entry.ID,
+					FromMode:   entry.CryptoMode,
+					FromParams: entry.CryptoParams,
+					ToMode:     string(mode),
+					ToParams:   params,
+				}
+				if res.FromParams == "" {
+					res.FromParams = models.DefaultCryptoParams(models.CryptoMode(entry.CryptoMode))
+				}
+				report.Matched++
+
+				switch {
+				case res.FromMode == res.ToMode && res.FromParams == res.ToParams && entry.ModePinned == pin:
+					res.Status = "unchanged"
+					report.Unchanged++
+				case dryRun:
+					res.Status = "would_change"
+					report.Changed++
+				default:
+					if res.FromMode != res.ToMode || res.FromParams != res.ToParams {
+						if err := reEncryptEntry(&entry, mode, params); err != nil {
+							res.Status = "failed"
+							res.Error = err.Error()
+							report.Failed++
+							report.Entries = append(report.Entries, res)
+							continue
+						}
+					}
+					entry.ModePinned = pin
+					if err := putEntry(tx, &entry); err != nil {
+						return err
+					}
+					res.Status = "changed"
+					report.Changed++
+				}
+				report.Entries = append(report.Entries, res)
+			}
+			return nil
+		}
+
+		if dryRun {
+			err = view(tenant, apply)
+		} else {
+			err = update(tenant, apply)
+		}
+		if err != nil {
+			return report, err
+		}
+	}
+
+	if !dryRun {
+		utils.Info("rekey", "targeted re-encryption to %s/%s: changed=%d unchanged=%d failed=%d",
+			mode, params, report.Changed, report.Unchanged, report.Failed)
+	}
+	return report, nil
+}
@@ -1,117 +1,188 @@
 package storage
 
 import (
-	"encoding/json"
 	"errors"
 
 	"secure-vault/crypto"
 	"secure-vault/models"
 	"secure-vault/utils"
-
-	"go.etcd.io/bbolt"
 )
 
-func ReEncryptAllVaultEntries(newMode models.CryptoMode) error {
-	return db.Update(func(tx *bbolt.Tx) error {
-		b := tx.Bucket([]byte(vaultBucket))
-		if b == nil {
-			return errors.New("vault bucket not found")
+// reEncryptEntry decrypts an entry with its own mode and re-encrypts it under newMode/params
+func reEncryptEntry(entry *models.VaultEntry, newMode models.CryptoMode, params string) error {
+	plainKey, err := DecryptEntry(entry)
+	if err != nil {
+		return err
+	}
+	return EncryptEntry(entry, newMode, params, plainKey)
+}
+
+// DecryptEntry recovers the stored key using the entry's own crypto mode and parameter set
+func DecryptEntry(entry *models.VaultEntry) ([]byte, error) {
+	return decryptEnvelope(entry, &entry.Envelope, entryAAD(entry))
+}
+
+// DecryptVersion recovers a superseded key kept in the entry's version history
+func DecryptVersion(entry *models.VaultEntry, version *models.KeyVersion) ([]byte, error) {
+	return decryptEnvelope(entry, &version.Envelope, versionAAD(entry, version))
+}
+
+// openEntry decrypts the current key and every retained version, so the entry
+// can be re-sealed after a metadata change
+func openEntry(entry *models.VaultEntry) ([]byte, [][]byte, error) {
+	plainKey, err := DecryptEntry(entry)
+	if err != nil {
+		return nil, nil, err
+	}
+	versions := make([][]byte, len(entry.Versions))
+	for i := range entry.Versions {
+		if versions[i], err = DecryptVersion(entry, &entry.Versions[i]); err != nil {
+			return nil, nil, err
 		}
+	}
+	return plainKey, versions, nil
+}
 
-		return b.ForEach(func(k, v []byte) error {
-			var entry models.VaultEntry
-			if err := json.Unmarshal(v, &entry); err != nil {
-				return err
-			}
+// resealEntry seals the keys returned by openEntry again under the entry's own
+// mode and parameter set, binding its current metadata
+func resealEntry(entry *models.VaultEntry, plainKey []byte, versions [][]byte) error {
+	mode := models.CryptoMode(entry.CryptoMode)
+	var err error
+	for i := range entry.Versions {
+		v := &entry.Versions[i]
+		if v.Envelope, err = sealEnvelope(entry, mode, entry.CryptoParams, versions[i], versionAAD(entry, v)); err != nil {
+			return err
+		}
+	}
+	entry.Envelope, err = sealEnvelope(entry, mode, entry.CryptoParams, plainKey, entryAAD(entry))
+	return err
+}
 
-			var plainKey []byte
-			var err error
-
-			// Decrypt based on old mode
-			utils.Info("rekey", "decrypting key with old mode: %s %v", entry.CryptoMode, entry)
-			switch entry.CryptoMode {
-			case string(models.ClassicalMode):
-				plainKey, err = crypto.DecryptWithEphemeralECC(
-					entry.Ciphertext,
-					entry.Nonce,
-					entry.EncryptedEphemeralPrivKey,
-					entry.EphemeralPrivNonce,
-				)
-				if err != nil {
-					utils.Error("rekey", "failed to ECC decrypt key: %v", err)
-					return err
-				}
-			case string(models.QuantumSafeMode):
-				plainKey, err = crypto.DecryptWithEphemeralKyber(
-					entry.Ciphertext,
-					entry.Nonce,
-					entry.KyberCiphertext,
-					entry.EncryptedKyberPrivKey,
-					entry.KyberPrivNonce,
-				)
-				if err != nil {
-					utils.Error("rekey", "failed to KEM decrypt key: %v", err)
-					return err
-					
-				}
-			default:
-				return errors.New("invalid crypto_mode: " + entry.CryptoMode)
-			}
+// EncryptEntry seals plainKey into a new envelope for entry under newMode.
+// An empty params selects the mode's default parameter set. Retained versions
+// follow the entry, so they are re-sealed when the mode or parameter set changes.
+func EncryptEntry(entry *models.VaultEntry, newMode models.CryptoMode, params string, plainKey []byte) error {
+	if params == "" {
+		params = models.DefaultCryptoParams(newMode)
+	}
+	if !models.IsValidCryptoParams(newMode, params) {
+		return errUnsupportedParams(newMode, params)
+	}
+
+	oldParams := entry.CryptoParams
+	if oldParams == "" {
+		oldParams = models.DefaultCryptoParams(models.CryptoMode(entry.CryptoMode))
+	}
+	if len(entry.Versions) > 0 && (entry.CryptoMode != string(newMode) || oldParams != params) {
+		for i := range entry.Versions {
+			v := &entry.Versions[i]
+			plain, err := DecryptVersion(entry, v)
 			if err != nil {
 				return err
 			}
-
-			// Re-encrypt based on new mode
-			switch newMode {
-			case models.ClassicalMode:
-				entry.Ciphertext,
-					entry.Nonce,
-					entry.EncryptedEphemeralPrivKey,
-					entry.EphemeralPrivNonce,
-					entry.EphemeralPubKey,
-					err = crypto.EncryptWithEphemeralECC(plainKey)
-
-					if err != nil {
-						utils.Error("rekey", "failed to ECC encrypt  key: %v", err)
-						return err
-					}
-				// Cleanup quantum-safe fields
-				entry.KyberPubKey = nil
-				entry.KyberCiphertext = nil
-				entry.EncryptedKyberPrivKey = nil
-				entry.KyberPrivNonce = nil
-
-			case models.QuantumSafeMode:
-				entry.Ciphertext,
-					entry.Nonce,
-					entry.KyberCiphertext,
-					entry.EncryptedKyberPrivKey,
-					entry.KyberPrivNonce,
-					entry.KyberPubKey,
-					err = crypto.EncryptWithEphemeralKyber(plainKey)
-					if err != nil {
-						utils.Error("rekey", "failed to KEM encrypt key: %v", err)
-						return err
-					}
-				// Cleanup classical fields
-				entry.EphemeralPubKey = nil
-				entry.EncryptedEphemeralPrivKey = nil
-				entry.EphemeralPrivNonce = nil
-
-			default:
-				return errors.New("unsupported crypto_mode: " + string(newMode))
-			}
-			if err != nil {
+			if v.Envelope, err = sealEnvelope(entry, newMode, params, plain, versionAAD(entry, v)); err != nil {
 				return err
 			}
+		}
+	}
 
-			entry.CryptoMode = string(newMode) // for further extensibility
+	env, err := sealEnvelope(entry, newMode, params, plainKey, entryAAD(entry))
+	if err != nil {
+		return err
+	}
 
-			updated, err := json.Marshal(entry)
-			if err != nil {
-				return err
-			}
-			return b.Put(k, updated)
-		})
-	})
+	entry.Envelope = env
+	entry.CryptoMode = string(newMode) // for further extensibility
+	entry.CryptoParams = params
+	return nil
+}
+
+func errUnsupportedParams(mode models.CryptoMode, params string) error {
+	return errors.New("unsupported parameter set " + params + " for " + string(mode))
+}
+
+// decryptEnvelope opens env, one of entry's envelopes, under the entry's mode and
+// parameter set and the KEK the envelope names
+func decryptEnvelope(entry *models.VaultEntry, env *models.Envelope, aad []byte) ([]byte, error) {
+	id, mode, params := entry.ID, entry.CryptoMode, entry.CryptoParams
+	kek, err := envelopeKEK(entry.Tenant, env)
+	if err != nil {
+		utils.Error("rekey", "no KEK for key %s: %v", id, err)
+		return nil, err
+	}
+
+	switch mode {
+	case string(models.ClassicalMode):
+		plainKey, err := crypto.DecryptWithEphemeralECC(
+			env.Ciphertext,
+			env.Nonce,
+			env.WrappedPrivKey,
+			env.WrappedPrivNonce,
+			aad,
+			kek,
+		)
+		if err != nil {
+			utils.Error("rekey", "failed to ECC decrypt key %s: %v", id, err)
+		}
+		return plainKey, err
+	case string(models.QuantumSafeMode):
+		plainKey, err := crypto.DecryptWithEphemeralKyber(
+			env.Ciphertext,
+			env.Nonce,
+			env.KEMCiphertext,
+			env.WrappedPrivKey,
+			env.WrappedPrivNonce,
+			params,
+			aad,
+			kek,
+		)
+		if err != nil {
+			utils.Error("rekey", "failed to KEM decrypt key %s: %v", id, err)
+		}
+		return plainKey, err
+	default:
+		return nil, errors.New("invalid crypto_mode: " + mode)
+	}
+}
+
+// sealEnvelope encrypts plainKey for entry into a fresh envelope under the owner's
+// KEK, so no field of a previous mode survives
+func sealEnvelope(entry *models.VaultEntry, mode models.CryptoMode, params string, plainKey, aad []byte) (models.Envelope, error) {
+	var env models.Envelope
+	id := entry.ID
+	kekID, kek, err := userKEK(entry.Tenant, entry.UserID)
+	if err != nil {
+		return env, err
+	}
+	env.KEKID = kekID
+
+	switch mode {
+	case models.ClassicalMode:
+		env.Ciphertext,
+			env.Nonce,
+			env.WrappedPrivKey,
+			env.WrappedPrivNonce,
+			env.EphemeralPubKey,
+			err = crypto.EncryptWithEphemeralECC(plainKey, aad, kek)
+		if err != nil {
+			utils.Error("rekey", "failed to ECC encrypt key %s: %v", id, err)
+		}
+
+	case models.QuantumSafeMode:
+		env.Ciphertext,
+			env.Nonce,
+			env.KEMCiphertext,
+			env.WrappedPrivKey,
+			env.WrappedPrivNonce,
+			env.EphemeralPubKey,
+			err = crypto.EncryptWithEphemeralKyber(plainKey, params, aad, kek)
+		if err != nil {
+			utils.Error("rekey", "failed to KEM encrypt key %s: %v", id, err)
+		}
+
+	default:
+		err = errors.New("unsupported crypto_mode: " + string(mode))
+	}
+
+	return env, err
 }
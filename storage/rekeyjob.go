@@ -0,0 +1,251 @@
+package storage
+
+import (
+	"encoding/json"
+	"errors"
+	"time"
+
+	"secure-vault/models"
+	"secure-vault/utils"
+
+	"github.com/google/uuid"
+)
+
+const rekeyJobKey = "rekeyjob"
+
+var (
+	rekeyBatchSize   = utils.EnvInt("REKEY_BATCH_SIZE", 50)
+	rekeyMaxAttempts = utils.EnvInt("REKEY_MAX_ATTEMPTS", 5)
+	rekeyBatchPause  = utils.EnvDuration("REKEY_BATCH_PAUSE", 100*time.Millisecond)
+	rekeyRetryDelay  = utils.EnvDuration("REKEY_RETRY_DELAY", 5*time.Second)
+)
+
+// newRekeyJob records a new re-encryption job moving the entries of the tenant
+// to mode; the caller starts it once tx is committed. A job of the tenant that
+// is still running is superseded: its runner notices the new ID and stops.
+func newRekeyJob(tx *tenantTx, mode models.CryptoMode) (*models.RekeyJob, error) {
+	now := utils.Now()
+	job := models.RekeyJob{
+		ID:         uuid.NewString(),
+		TargetMode: mode,
+		Status:     models.RekeyRunning,
+		StartedAt:  now,
+		UpdatedAt:  now,
+	}
+
+	b := tx.Bucket([]byte(vaultBucket))
+	if b == nil {
+		return nil, errors.New("vault bucket not found")
+	}
+	old, err := loadRekeyJob(tx)
+	if err != nil {
+		return nil, err
+	}
+	if old != nil && old.Status == models.RekeyRunning {
+		utils.Warn("rekey", "job %s superseded by %s", old.ID, job.ID)
+	}
+	job.Total = b.Stats().KeyN
+	return &job, saveRekeyJob(tx, &job)
+}
+
+// GetRekeyJob returns the most recent re-encryption job of tenant, or nil if none was ever started
+func GetRekeyJob(tenant string) (*models.RekeyJob, error) {
+	var job *models.RekeyJob
+	err := view(tenant, func(tx *tenantTx) error {
+		var err error
+		job, err = loadRekeyJob(tx)
+		return err
+	})
+	return job, err
+}
+
+// cancelRekeyJob stops a running job, e.g. when switching to lazy migration.
+// Entries already migrated keep their new mode.
+func cancelRekeyJob(tx *tenantTx) error {
+	job, err := loadRekeyJob(tx)
+	if err != nil || job == nil || job.Status != models.RekeyRunning {
+		return err
+	}
+	now := utils.Now()
+	job.Status = models.RekeyCancelled
+	job.UpdatedAt = now
+	job.FinishedAt = &now
+	utils.Info("rekey", "job %s cancelled", job.ID)
+	return saveRekeyJob(tx, job)
+}
+
+// ResumeRekeyJob restarts the jobs that were still running when the server stopped
+func ResumeRekeyJob() error {
+	return forEachTenant(func(tenant string) error {
+		job, err := GetRekeyJob(tenant)
+		if err != nil || job == nil || job.Status != models.RekeyRunning {
+			return err
+		}
+		utils.Info("rekey", "resuming job %s of tenant %s to %s at cursor %q", job.ID, tenant, job.TargetMode, job.Cursor)
+		go runRekeyJob(tenant, job.ID)
+		return nil
+	})
+}
+
+func runRekeyJob(tenant, id string) {
+	for {
+		done, wait, err := rekeyBatch(tenant, id)
+		if err != nil {
+			utils.Error("rekey", "job %s batch failed: %v", id, err)
+			time.Sleep(rekeyRetryDelay)
+			continue
+		}
+		if done {
+			return
+		}
+		time.Sleep(wait)
+	}
+}
+
+// rekeyBatch handles up to rekeyBatchSize entries in a single transaction and
+// checkpoints the job in that same transaction.
+func rekeyBatch(tenant, id string) (done bool, wait time.Duration, err error) {
+	err = update(tenant, func(tx *tenantTx) error {
+		job, err := loadRekeyJob(tx)
+		if err != nil {
+			return err
+		}
+		if job == nil || job.ID != id || job.Status != models.RekeyRunning {
+			done = true
+			return nil
+		}
+		b := tx.Bucket([]byte(vaultBucket))
+		if b == nil {
+			return errors.New("vault bucket not found")
+		}
+		if job.Failures == nil {
+			job.Failures = map[string]models.RekeyFailure{}
+		}
+		now := utils.Now()
+
+		if !job.PassDone {
+			// Collect the batch first: bbolt cursors are invalidated by Put
+			var keys, values [][]byte
+			c := b.Cursor()
+			k, v := c.First()
+			if job.Cursor != "" {
+				k, v = c.Seek([]byte(job.Cursor))
+				if k != nil && string(k) == job.Cursor {
+					k, v = c.Next()
+				}
+			}
+			for ; k != nil && len(keys) < rekeyBatchSize; k, v = c.Next() {
+				keys = append(keys, append([]byte(nil), k...))
+				values = append(values, append([]byte(nil), v...))
+			}
+			job.PassDone = k == nil
+
+			for i, k := range keys {
+				job.Cursor = string(k)
+				job.Processed++
+				migrated, err := rekeyOne(tx, k, values[i], job.TargetMode)
+				if err != nil {
+					recordRekeyFailure(job, string(k), err, now)
+				} else if migrated {
+					job.Migrated++
+				}
+			}
+			wait = rekeyBatchPause
+		} else {
+			retried := 0
+			for entryID, f := range job.Failures {
+				if retried >= rekeyBatchSize {
+					break
+				}
+				if f.Attempts >= rekeyMaxAttempts || now.Before(f.NextAttempt) {
+					continue
+				}
+				retried++
+				v := b.Get([]byte(entryID))
+				if v == nil {
+					// Deleted since the failure, nothing left to migrate
+					delete(job.Failures, entryID)
+					continue
+				}
+				migrated, err := rekeyOne(tx, []byte(entryID), v, job.TargetMode)
+				if err != nil {
+					recordRekeyFailure(job, entryID, err, now)
+					continue
+				}
+				delete(job.Failures, entryID)
+				if migrated {
+					job.Migrated++
+				}
+			}
+
+			// Finish once no failure is eligible for another attempt
+			var next time.Time
+			for _, f := range job.Failures {
+				if f.Attempts < rekeyMaxAttempts && (next.IsZero() || f.NextAttempt.Before(next)) {
+					next = f.NextAttempt
+				}
+			}
+			if next.IsZero() {
+				job.Status = models.RekeyCompleted
+				if len(job.Failures) > 0 {
+					job.Status = models.RekeyCompletedWithErrors
+				}
+				job.FinishedAt = &now
+				done = true
+				utils.Info("rekey", "job %s finished: status=%s migrated=%d failed=%d", job.ID, job.Status, job.Migrated, len(job.Failures))
+			} else if wait = next.Sub(now); wait < rekeyBatchPause {
+				wait = rekeyBatchPause
+			}
+		}
+
+		job.UpdatedAt = now
+		return saveRekeyJob(tx, job)
+	})
+	return done, wait, err
+}
+
+// rekeyOne re-encrypts a single stored entry if it is not already in mode and
+// not pinned by a targeted re-encryption. It reports whether the entry was rewritten.
+func rekeyOne(tx *tenantTx, k, v []byte, mode models.CryptoMode) (bool, error) {
+	entry, err := decodeEntry(tx.tenant, v)
+	if err != nil {
+		return false, err
+	}
+	if entry.CryptoMode == string(mode) || entry.ModePinned || entry.IsTombstone() {
+		return false, nil
+	}
+	if err := reEncryptEntry(&entry, mode, ""); err != nil {
+		return false, err
+	}
+	return true, putEntry(tx, &entry)
+}
+
+func recordRekeyFailure(job *models.RekeyJob, id string, err error, now time.Time) {
+	f := job.Failures[id]
+	f.Attempts++
+	f.LastError = err.Error()
+	// Exponential backoff: delay, 2*delay, 4*delay...
+	f.NextAttempt = now.Add(rekeyRetryDelay << (f.Attempts - 1))
+	job.Failures[id] = f
+	utils.Warn("rekey", "job %s: entry %s failed (attempt %d/%d): %v", job.ID, id, f.Attempts, rekeyMaxAttempts, err)
+}
+
+func loadRekeyJob(tx *tenantTx) (*models.RekeyJob, error) {
+	v := tx.Bucket([]byte(settingsBucket)).Get([]byte(rekeyJobKey))
+	if v == nil {
+		return nil, nil
+	}
+	var job models.RekeyJob
+	if err := json.Unmarshal(v, &job); err != nil {
+		return nil, err
+	}
+	return &job, nil
+}
+
+func saveRekeyJob(tx *tenantTx, job *models.RekeyJob) error {
+	data, err := json.Marshal(job)
+	if err != nil {
+		return err
+	}
+	return tx.Bucket([]byte(settingsBucket)).Put([]byte(rekeyJobKey), data)
+}
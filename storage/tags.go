@@ -0,0 +1,134 @@
+package storage
+
+import (
+	"bytes"
+	"sort"
+
+	"secure-vault/models"
+)
+
+// The tag index holds one empty-valued key per tag of a live entry: the blinded
+// token of "<tag key>\x00<tag value>" followed by the entry ID. The owner index
+// does the same for the entry's user ID. Tag keys and values cannot contain NUL.
+const (
+	tagIndexBucket   = "tagindex"
+	ownerIndexBucket = "ownerindex"
+)
+
+func tagIndexPrefix(key, value string) []byte {
+	return blindToken("tag", key+"\x00"+value)
+}
+
+func ownerIndexPrefix(userID string) []byte {
+	return blindToken("user", userID)
+}
+
+// updateOwnerIndex moves entry's owner index key; old is nil for a new entry
+func updateOwnerIndex(tx *tenantTx, old, entry *models.VaultEntry) error {
+	b := tx.Bucket([]byte(ownerIndexBucket))
+	if old != nil && !old.IsTombstone() && (entry.IsTombstone() || old.UserID != entry.UserID) {
+		if err := b.Delete(append(ownerIndexPrefix(old.UserID), old.ID...)); err != nil {
+			return err
+		}
+	}
+	if entry.IsTombstone() {
+		return nil
+	}
+	return b.Put(append(ownerIndexPrefix(entry.UserID), entry.ID...), nil)
+}
+
+// updateTagIndex replaces old's index keys with entry's; old is nil for a new entry
+func updateTagIndex(tx *tenantTx, old, entry *models.VaultEntry) error {
+	b := tx.Bucket([]byte(tagIndexBucket))
+	if old != nil && !old.IsTombstone() {
+		for k, v := range old.Tags {
+			if entry.IsTombstone() || entry.Tags[k] != v {
+				if err := b.Delete(append(tagIndexPrefix(k, v), old.ID...)); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	if entry.IsTombstone() {
+		return nil
+	}
+	for k, v := range entry.Tags {
+		if err := b.Put(append(tagIndexPrefix(k, v), entry.ID...), nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// indexedIDs returns the entry IDs under prefix in an index bucket, in ID order,
+// starting after the given ID
+func indexedIDs(tx *tenantTx, bucket string, prefix []byte, after string) []string {
+	c := tx.Bucket([]byte(bucket)).Cursor()
+
+	var ids []string
+	for k, _ := c.Seek(append(append([]byte(nil), prefix...), after...)); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+		if id := string(k[len(prefix):]); id != after {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// ListEntries returns the metadata of live entries of tenant matching filter, in ID order,
+// starting after the given ID. next is the cursor for the following page, empty
+// on the last one. Tag and owner filters are resolved through the indexes.
+func ListEntries(tenant string, filter models.ReEncryptFilter, after string, limit int) (entries []models.EntryInfo, next string, err error) {
+	err = view(tenant, func(tx *tenantTx) error {
+		b := tx.Bucket([]byte(vaultBucket))
+
+		// collect reports whether another entry is wanted
+		collect := func(data []byte) bool {
+			entry, err := decodeEntry(tenant, data)
+			if err != nil || entry.IsTombstone() || !filter.Matches(&entry) {
+				return true
+			}
+			entries = append(entries, entry.Info())
+			return len(entries) <= limit
+		}
+
+		// Walk the index of one tag, or the owner's; Matches checks the rest
+		var ids []string
+		switch {
+		case len(filter.Tags) > 0:
+			keys := make([]string, 0, len(filter.Tags))
+			for k := range filter.Tags {
+				keys = append(keys, k)
+			}
+			sort.Strings(keys)
+			ids = indexedIDs(tx, tagIndexBucket, tagIndexPrefix(keys[0], filter.Tags[keys[0]]), after)
+		case filter.UserID != "":
+			ids = indexedIDs(tx, ownerIndexBucket, ownerIndexPrefix(filter.UserID), after)
+		}
+		if len(filter.Tags) > 0 || filter.UserID != "" {
+			for _, id := range ids {
+				if data := b.Get([]byte(id)); data != nil && !collect(data) {
+					break
+				}
+			}
+			return nil
+		}
+
+		c := b.Cursor()
+		k, v := c.First()
+		if after != "" {
+			if k, v = c.Seek([]byte(after)); k != nil && string(k) == after {
+				k, v = c.Next()
+			}
+		}
+		for ; k != nil && collect(v); k, v = c.Next() {
+		}
+		return nil
+	})
+
+	// One more than the page was collected when there is a following page
+	if len(entries) > limit {
+		entries = entries[:limit]
+		next = entries[limit-1].ID
+	}
+	return entries, next, err
+}
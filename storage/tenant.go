@@ -0,0 +1,259 @@
+package storage
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"secure-vault/crypto"
+	"secure-vault/models"
+	"secure-vault/utils"
+
+	"go.etcd.io/bbolt"
+)
+
+// The default tenant uses the root-level buckets. Every other tenant has the same
+// bucket tree under tenants/<name>/, and its own KEK: a random key wrapped by
+// the master key and stored in the tenant's settings. The default tenant's
+// entries stay wrapped by the master key directly.
+const (
+	tenantsBucket    = "tenants"
+	tenantKEKKey     = "kek"
+	tenantCreatedKey = "created"
+)
+
+var ErrUnknownTenant = errors.New("unknown tenant")
+
+// tenantBuckets make up one tenant's tree
+var tenantBuckets = []string{vaultBucket, settingsBucket, usageBucket, quotaBucket, tagIndexBucket, ownerIndexBucket, usersBucket, apiKeysBucket, refreshTokensBucket, policiesBucket}
+
+var (
+	tenantsMu  sync.RWMutex
+	tenantKEKs = map[string]crypto.KeyWrapper{}
+)
+
+// tenantTx is a transaction scoped to one tenant: Bucket resolves names inside
+// the tenant's tree
+type tenantTx struct {
+	*bbolt.Tx
+	tenant string
+}
+
+func (tx *tenantTx) Bucket(name []byte) *bbolt.Bucket {
+	if tx.tenant == models.DefaultTenant {
+		return tx.Tx.Bucket(name)
+	}
+	root := tx.Tx.Bucket([]byte(tenantsBucket)).Bucket([]byte(tx.tenant))
+	if root == nil {
+		return nil
+	}
+	return root.Bucket(name)
+}
+
+// resetBucket replaces a bucket of the tenant's tree with an empty one
+func (tx *tenantTx) resetBucket(name []byte) error {
+	var parent interface {
+		DeleteBucket(name []byte) error
+		CreateBucket(name []byte) (*bbolt.Bucket, error)
+	} = tx.Tx
+	if tx.tenant != models.DefaultTenant {
+		parent = tx.Tx.Bucket([]byte(tenantsBucket)).Bucket([]byte(tx.tenant))
+	}
+	if err := parent.DeleteBucket(name); err != nil && err != bbolt.ErrBucketNotFound {
+		return err
+	}
+	_, err := parent.CreateBucket(name)
+	return err
+}
+
+// kekFor returns the key-encryption key of a tenant
+func kekFor(tenant string) (crypto.KeyWrapper, error) {
+	tenantsMu.RLock()
+	defer tenantsMu.RUnlock()
+	kek, ok := tenantKEKs[tenant]
+	if !ok {
+		return nil, ErrUnknownTenant
+	}
+	return kek, nil
+}
+
+// TenantExists reports whether tenant was created
+func TenantExists(tenant string) bool {
+	_, err := kekFor(tenant)
+	return err == nil
+}
+
+// Tenants returns the names of all tenants, the default one included
+func Tenants() []string {
+	tenantsMu.RLock()
+	defer tenantsMu.RUnlock()
+	names := make([]string, 0, len(tenantKEKs))
+	for name := range tenantKEKs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// forEachTenant runs fn for every tenant and returns the first error
+func forEachTenant(fn func(tenant string) error) error {
+	for _, tenant := range Tenants() {
+		if err := fn(tenant); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type wrappedKEK struct {
+	Ciphertext []byte `json:"ciphertext"`
+	Nonce      []byte `json:"nonce"`
+}
+
+// loadTenantKeys unwraps the KEK of every tenant in the database
+func loadTenantKeys(tx *bbolt.Tx) error {
+	keks := map[string]crypto.KeyWrapper{models.DefaultTenant: utils.MasterKey()}
+
+	if tenants := tx.Bucket([]byte(tenantsBucket)); tenants != nil {
+		err := tenants.ForEach(func(name, _ []byte) error {
+			ttx := &tenantTx{Tx: tx, tenant: string(name)}
+			var wrapped wrappedKEK
+			if err := json.Unmarshal(ttx.Bucket([]byte(settingsBucket)).Get([]byte(tenantKEKKey)), &wrapped); err != nil {
+				return errors.New("tenant " + string(name) + ": unreadable KEK")
+			}
+			key, err := utils.DecryptWithMasterKey(wrapped.Ciphertext, wrapped.Nonce)
+			if err != nil {
+				return errors.New("tenant " + string(name) + ": cannot unwrap KEK: " + err.Error())
+			}
+			if keks[string(name)], err = utils.NewAESWrapper(key); err != nil {
+				return err
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	tenantsMu.Lock()
+	tenantKEKs = keks
+	tenantsMu.Unlock()
+	return nil
+}
+
+// CreateTenant provisions an empty namespace with a fresh KEK and its own
+// crypto mode, and its first admin account, from which the tenant's other
+// accounts are managed
+func CreateTenant(name string, mode models.CryptoMode, adminID, adminPassword, createdBy string) (models.Tenant, error) {
+	now := utils.Now()
+	tenant := models.Tenant{Name: name, CreatedAt: &now, CryptoMode: mode, KEK: "wrapped"}
+	if err := models.ValidateTenantName(name); err != nil {
+		return tenant, err
+	}
+	if name == models.DefaultTenant {
+		return tenant, errors.New("tenant already exists")
+	}
+	if err := models.ValidateUserID(adminID); err != nil {
+		return tenant, err
+	}
+	hash, err := hashNewPassword(adminPassword)
+	if err != nil {
+		return tenant, err
+	}
+	admin := storedUser{User: models.User{UserID: adminID, Tenant: name, Role: models.RoleAdmin, CreatedAt: now, CreatedBy: createdBy, PasswordChangedAt: &now}, PasswordHash: hash}
+
+	kek := make([]byte, 32)
+	if _, err := rand.Read(kek); err != nil {
+		return tenant, err
+	}
+	wrapper, err := utils.NewAESWrapper(kek)
+	if err != nil {
+		return tenant, err
+	}
+
+	err = updateRoot(func(tx *bbolt.Tx) error {
+		tenants := tx.Bucket([]byte(tenantsBucket))
+		if tenants.Bucket([]byte(name)) != nil {
+			return errors.New("tenant already exists")
+		}
+		root, err := tenants.CreateBucket([]byte(name))
+		if err != nil {
+			return err
+		}
+		for _, b := range tenantBuckets {
+			if _, err := root.CreateBucket([]byte(b)); err != nil {
+				return err
+			}
+		}
+
+		ct, nonce, err := utils.EncryptWithMasterKey(kek)
+		if err != nil {
+			return err
+		}
+		settings := root.Bucket([]byte(settingsBucket))
+		if err := putJSON(settings, []byte(tenantKEKKey), wrappedKEK{Ciphertext: ct, Nonce: nonce}); err != nil {
+			return err
+		}
+		if err := settings.Put([]byte(tenantCreatedKey), []byte(tenant.CreatedAt.Format(time.RFC3339Nano))); err != nil {
+			return err
+		}
+		if err := settings.Put([]byte(indexVersionKey), []byte(strconv.Itoa(indexVersion))); err != nil {
+			return err
+		}
+		if err := settings.Put([]byte(modeKey), []byte(mode)); err != nil {
+			return err
+		}
+
+		// Followers create the tenant from a copy of its settings
+		copied := map[string][]byte{}
+		settings.ForEach(func(k, v []byte) error {
+			copied[string(k)] = v
+			return nil
+		})
+		value, err := json.Marshal(copied)
+		if err != nil {
+			return err
+		}
+		if err := logChange(tx, models.ChangeTenant, name, nil, value); err != nil {
+			return err
+		}
+		return putUser(&tenantTx{Tx: tx, tenant: name}, &admin)
+	})
+	if err != nil {
+		return tenant, err
+	}
+
+	tenantsMu.Lock()
+	tenantKEKs[name] = wrapper
+	tenantsMu.Unlock()
+	utils.Info("tenant", "created tenant %s (mode %s)", name, mode)
+	utils.Info("audit", "user created: tenant=%s user=%s service_account=false by=%s", name, adminID, createdBy)
+	return tenant, nil
+}
+
+// ListTenants describes every tenant
+func ListTenants() ([]models.Tenant, error) {
+	var list []models.Tenant
+	err := forEachTenant(func(name string) error {
+		return view(name, func(tx *tenantTx) error {
+			t := models.Tenant{Name: name, CryptoMode: cryptoMode(tx), KEK: "wrapped"}
+			if name == models.DefaultTenant {
+				t.KEK = "master"
+			}
+			settings := tx.Bucket([]byte(settingsBucket))
+			if v := settings.Get([]byte(tenantCreatedKey)); v != nil {
+				if created, err := time.Parse(time.RFC3339Nano, string(v)); err == nil {
+					t.CreatedAt = &created
+				}
+			}
+			t.Entries = tx.Bucket([]byte(vaultBucket)).Stats().KeyN
+			list = append(list, t)
+			return nil
+		})
+	})
+	return list, err
+}
@@ -0,0 +1,347 @@
+package storage
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+
+	"secure-vault/models"
+	"secure-vault/utils"
+
+	"go.etcd.io/bbolt"
+)
+
+// Refresh tokens read rt_<tenant>_<id>_<secret> and are kept in each tenant's
+// refreshtokens bucket like API keys. Every refresh replaces the token with a
+// new one of the same session (family); presenting a replaced token again means
+// it leaked, and ends the session.
+//
+// The root revocations bucket holds what RequireAuth refuses: single access
+// tokens by jti and sessions by sid until they would have expired anyway, and
+// a per-user cutoff before which all of the user's tokens are void. It is
+// cached in memory.
+const (
+	refreshTokensBucket = "refreshtokens"
+	refreshTokenPrefix  = "rt_"
+	revocationsBucket   = "revocations"
+)
+
+var (
+	ErrInvalidRefreshToken = errors.New("invalid or expired refresh token")
+	ErrRefreshTokenReused  = errors.New("refresh token was already used")
+)
+
+var (
+	AccessTokenTTL  = utils.EnvDuration("ACCESS_TOKEN_TTL", 15*time.Minute)
+	refreshTokenTTL = utils.EnvDuration("REFRESH_TOKEN_TTL", 24*time.Hour)
+)
+
+type storedRefreshToken struct {
+	ID         string     `json:"id"`
+	Family     string     `json:"family"`
+	UserID     string     `json:"user_id"`
+	SecretHash string     `json:"secret_hash"`
+	CreatedAt  time.Time  `json:"created_at"`
+	ExpiresAt  time.Time  `json:"expires_at"`
+	UsedAt     *time.Time `json:"used_at,omitempty"`
+}
+
+// Session is what a refresh token stands for
+type Session struct {
+	Tenant       string
+	UserID       string
+	ID           string // the family, carried as sid in access tokens
+	RefreshToken string
+	ExpiresAt    time.Time
+}
+
+var (
+	revocationsMu     sync.RWMutex
+	revocations       = map[string]time.Time{}
+	revocationsPruned time.Time
+)
+
+func randomHex(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+func jtiRevocation(jti string) string { return "jti/" + jti }
+
+func sessionRevocation(tenant, sid string) string { return "sid/" + tenant + "/" + sid }
+
+func userRevocation(tenant, userID string) string {
+	return "user/" + tenant + "/" + hex.EncodeToString(userKey(userID))
+}
+
+// putRefreshToken stores a refresh token and records it in the change log
+func putRefreshToken(tx *tenantTx, t *storedRefreshToken) error {
+	b := tx.Bucket([]byte(refreshTokensBucket))
+	if err := putJSON(b, []byte(t.ID), t); err != nil {
+		return err
+	}
+	return logChange(tx.Tx, models.ChangeRefreshToken, tx.tenant, []byte(t.ID), b.Get([]byte(t.ID)))
+}
+
+// deleteRefreshTokens removes the tokens match selects, and expired ones
+func deleteRefreshTokens(tx *tenantTx, match func(t *storedRefreshToken) bool) error {
+	b := tx.Bucket([]byte(refreshTokensBucket))
+	now := utils.Now()
+	var ids [][]byte
+	err := b.ForEach(func(k, v []byte) error {
+		var t storedRefreshToken
+		if err := json.Unmarshal(v, &t); err != nil {
+			return err
+		}
+		if match(&t) || now.After(t.ExpiresAt) {
+			ids = append(ids, append([]byte(nil), k...))
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, id := range ids {
+		if err := b.Delete(id); err != nil {
+			return err
+		}
+		if err := logChange(tx.Tx, models.ChangeRefreshToken, tx.tenant, id, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// newRefreshToken adds a token to family, or to a new session when family is ""
+func newRefreshToken(tx *tenantTx, userID, family string) (Session, error) {
+	id, err := randomHex(8)
+	if err != nil {
+		return Session{}, err
+	}
+	secret, err := randomHex(32)
+	if err != nil {
+		return Session{}, err
+	}
+	if family == "" {
+		family = id
+	}
+	now := utils.Now()
+	t := storedRefreshToken{ID: id, Family: family, UserID: userID, SecretHash: hashSecret(secret), CreatedAt: now, ExpiresAt: now.Add(refreshTokenTTL)}
+	if err := putRefreshToken(tx, &t); err != nil {
+		return Session{}, err
+	}
+	return Session{
+		Tenant:       tx.tenant,
+		UserID:       userID,
+		ID:           family,
+		RefreshToken: refreshTokenPrefix + tx.tenant + "_" + id + "_" + secret,
+		ExpiresAt:    t.ExpiresAt,
+	}, nil
+}
+
+// StartSession issues the first refresh token of a login
+func StartSession(tenant, userID string) (Session, error) {
+	var s Session
+	err := update(tenant, func(tx *tenantTx) error {
+		// Expired tokens of the tenant go along the way
+		if err := deleteRefreshTokens(tx, func(*storedRefreshToken) bool { return false }); err != nil {
+			return err
+		}
+		var err error
+		s, err = newRefreshToken(tx, userID, "")
+		return err
+	})
+	return s, err
+}
+
+// RefreshSession trades a refresh token for the next one of its session. A
+// token presented twice ends the session: one of the two callers stole it.
+func RefreshSession(raw string) (Session, error) {
+	tenant, id, secret, ok := parseSecretToken(refreshTokenPrefix, raw)
+	if !ok || !TenantExists(tenant) {
+		return Session{}, ErrInvalidRefreshToken
+	}
+
+	var s Session
+	var reused *storedRefreshToken
+	err := update(tenant, func(tx *tenantTx) error {
+		var t storedRefreshToken
+		data := tx.Bucket([]byte(refreshTokensBucket)).Get([]byte(id))
+		if data == nil || json.Unmarshal(data, &t) != nil {
+			return ErrInvalidRefreshToken
+		}
+		if subtle.ConstantTimeCompare([]byte(hashSecret(secret)), []byte(t.SecretHash)) != 1 {
+			return ErrInvalidRefreshToken
+		}
+		now := utils.Now()
+		if now.After(t.ExpiresAt) {
+			return ErrInvalidRefreshToken
+		}
+		if t.UsedAt != nil {
+			reused = &t
+			return nil
+		}
+		if u := getUser(tx, t.UserID); u != nil && u.Disabled {
+			return ErrUserDisabled
+		}
+
+		t.UsedAt = &now
+		if err := putRefreshToken(tx, &t); err != nil {
+			return err
+		}
+		var err error
+		s, err = newRefreshToken(tx, t.UserID, t.Family)
+		return err
+	})
+	if err != nil {
+		return Session{}, err
+	}
+	if reused != nil {
+		utils.Warn("audit", "refresh token reused, ending session: tenant=%s user=%s session=%s", tenant, reused.UserID, reused.Family)
+		if err := EndSession(tenant, reused.Family); err != nil {
+			return Session{}, err
+		}
+		return Session{}, ErrRefreshTokenReused
+	}
+	return s, nil
+}
+
+// EndSession deletes the refresh tokens of a session and voids its access tokens
+func EndSession(tenant, sid string) error {
+	err := update(tenant, func(tx *tenantTx) error {
+		if err := deleteRefreshTokens(tx, func(t *storedRefreshToken) bool { return t.Family == sid }); err != nil {
+			return err
+		}
+		return putRevocation(tx.Tx, sessionRevocation(tenant, sid), utils.Now().Add(AccessTokenTTL))
+	})
+	if err == nil {
+		utils.Info("audit", "session ended: tenant=%s session=%s", tenant, sid)
+	}
+	return err
+}
+
+// RevokeToken voids one access token until it expires
+func RevokeToken(jti string, expiresAt time.Time) error {
+	return updateRoot(func(tx *bbolt.Tx) error {
+		return putRevocation(tx, jtiRevocation(jti), expiresAt)
+	})
+}
+
+// RevokeUserTokens voids every token issued to a user so far and deletes the
+// user's refresh tokens
+func RevokeUserTokens(tenant, userID string) error {
+	err := update(tenant, func(tx *tenantTx) error {
+		if err := deleteRefreshTokens(tx, func(t *storedRefreshToken) bool { return t.UserID == userID }); err != nil {
+			return err
+		}
+		return putRevocation(tx.Tx, userRevocation(tenant, userID), utils.Now())
+	})
+	if err == nil {
+		utils.Info("audit", "all tokens revoked: tenant=%s user=%s", tenant, userID)
+	}
+	return err
+}
+
+// putRevocation records a revocation, and at most once a minute drops those
+// that ran out. The cache follows once the transaction commits.
+func putRevocation(tx *bbolt.Tx, key string, at time.Time) error {
+	b := tx.Bucket([]byte(revocationsBucket))
+	expired := expiredRevocations()
+	for _, k := range expired {
+		if err := b.Delete([]byte(k)); err != nil {
+			return err
+		}
+		if err := logChange(tx, models.ChangeRevocation, "", []byte(k), nil); err != nil {
+			return err
+		}
+	}
+
+	value, err := at.UTC().MarshalText()
+	if err != nil {
+		return err
+	}
+	if err := b.Put([]byte(key), value); err != nil {
+		return err
+	}
+	if err := logChange(tx, models.ChangeRevocation, "", []byte(key), value); err != nil {
+		return err
+	}
+	tx.OnCommit(func() {
+		revocationsMu.Lock()
+		defer revocationsMu.Unlock()
+		for _, k := range expired {
+			delete(revocations, k)
+		}
+		revocations[key] = at
+	})
+	return nil
+}
+
+// expiredRevocations returns the cached token and session revocations past
+// their tokens' expiry, unless they were looked for within the last minute.
+// User cutoffs never expire.
+func expiredRevocations() []string {
+	now := utils.Now()
+	revocationsMu.Lock()
+	defer revocationsMu.Unlock()
+	if now.Sub(revocationsPruned) < time.Minute {
+		return nil
+	}
+	revocationsPruned = now
+	var expired []string
+	for k, until := range revocations {
+		if !strings.HasPrefix(k, "user/") && now.After(until) {
+			expired = append(expired, k)
+		}
+	}
+	return expired
+}
+
+// loadRevocations fills the cache from the revocations bucket
+func loadRevocations(tx *bbolt.Tx) error {
+	m := map[string]time.Time{}
+	err := tx.Bucket([]byte(revocationsBucket)).ForEach(func(k, v []byte) error {
+		var at time.Time
+		if err := at.UnmarshalText(v); err != nil {
+			return err
+		}
+		m[string(k)] = at
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	revocationsMu.Lock()
+	revocations = m
+	revocationsMu.Unlock()
+	return nil
+}
+
+// TokenRevoked reports whether a token was revoked by its jti, its session
+// (sid) or a cutoff for its user. Issue times are compared to the millisecond,
+// the precision of the iat the vault signs; a token issued in the cutoff's
+// millisecond counts as before it.
+func TokenRevoked(tenant, userID, jti, sid string, issuedAt time.Time) bool {
+	revocationsMu.RLock()
+	defer revocationsMu.RUnlock()
+	if jti != "" {
+		if _, ok := revocations[jtiRevocation(jti)]; ok {
+			return true
+		}
+	}
+	if sid != "" {
+		if _, ok := revocations[sessionRevocation(tenant, sid)]; ok {
+			return true
+		}
+	}
+	cutoff, ok := revocations[userRevocation(tenant, userID)]
+	return ok && !issuedAt.After(cutoff.Truncate(time.Millisecond))
+}
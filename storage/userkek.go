@@ -0,0 +1,365 @@
+package storage
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"os"
+	"sync"
+	"time"
+
+	"secure-vault/crypto"
+	"secure-vault/models"
+	"secure-vault/utils"
+
+	"go.etcd.io/bbolt"
+)
+
+// Every user has a KEK of their own between the tenant KEK and their entries:
+// envelopes record its ID and their ephemeral private keys are wrapped with it.
+// User KEKs live in a separate keystore file that snapshots never include, so
+// destroying one (ShredUser) leaves the user's ciphertexts, retained versions
+// and backups without a key. The keystore has to be backed up on its own.
+const (
+	kekBucket     = "keks"     // KEK ID -> storedUserKEK
+	userKEKBucket = "userkeks" // tenant NUL blinded user token -> current KEK ID
+)
+
+var ErrKEKShredded = errors.New("key-encryption key was destroyed")
+
+var (
+	keystore   *bbolt.DB
+	keystoreMu sync.RWMutex // access: RLock; wipe after a shred: Lock
+	userKEKMu  sync.Mutex   // serialises KEK creation
+)
+
+type storedUserKEK struct {
+	Tenant     string    `json:"tenant"`
+	CreatedAt  time.Time `json:"created_at"`
+	wrappedKEK           // wrapped by the tenant KEK
+}
+
+// KeystorePath returns the keystore file location (VAULT_KEYSTORE, default <db>.keys)
+func KeystorePath() string {
+	if p := os.Getenv("VAULT_KEYSTORE"); p != "" {
+		return p
+	}
+	return DBPath() + ".keys"
+}
+
+// openKeystore opens the keystore next to the database. Read-only opens of a
+// missing keystore succeed; every user KEK lookup then fails.
+func openKeystore(readOnly bool) error {
+	if readOnly {
+		if _, err := os.Stat(KeystorePath()); os.IsNotExist(err) {
+			return nil
+		}
+	}
+	ks, err := bbolt.Open(KeystorePath(), 0600, &bbolt.Options{ReadOnly: readOnly, Timeout: time.Second})
+	if err != nil {
+		return errors.New("cannot open keystore " + KeystorePath() + ": " + err.Error())
+	}
+	if !readOnly {
+		err = ks.Update(func(tx *bbolt.Tx) error {
+			for _, b := range []string{kekBucket, userKEKBucket, changelogBucket} {
+				if _, err := tx.CreateBucketIfNotExists([]byte(b)); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			ks.Close()
+			return err
+		}
+	}
+	keystore = ks
+	return nil
+}
+
+func closeKeystore() error {
+	if keystore == nil {
+		return nil
+	}
+	err := keystore.Close()
+	keystore = nil
+	return err
+}
+
+func userKEKKey(tenant, userID string) []byte {
+	return append([]byte(tenant+"\x00"), blindToken("user", userID)...)
+}
+
+// userKEK returns the ID and wrapper of the user's current KEK, creating it on
+// the user's first write. Read-only tools, which never persist what they seal,
+// get the tenant KEK and an empty ID.
+func userKEK(tenant, userID string) (string, crypto.KeyWrapper, error) {
+	keystoreMu.RLock()
+	defer keystoreMu.RUnlock()
+	if keystore == nil || keystore.IsReadOnly() {
+		kek, err := kekFor(tenant)
+		return "", kek, err
+	}
+
+	var id string
+	lookup := func(tx *bbolt.Tx) error {
+		id = string(tx.Bucket([]byte(userKEKBucket)).Get(userKEKKey(tenant, userID)))
+		return nil
+	}
+	if err := keystore.View(lookup); err != nil {
+		return "", nil, err
+	}
+	if id == "" {
+		userKEKMu.Lock()
+		defer userKEKMu.Unlock()
+		if err := keystore.View(lookup); err != nil {
+			return "", nil, err
+		}
+		if id == "" {
+			return createUserKEK(tenant, userID)
+		}
+	}
+	kek, err := loadUserKEK(tenant, id)
+	return id, kek, err
+}
+
+// createUserKEK stores a fresh KEK for the user, wrapped by the tenant KEK
+func createUserKEK(tenant, userID string) (string, crypto.KeyWrapper, error) {
+	if IsFollower() {
+		return "", nil, ErrReadOnlyReplica
+	}
+	tenantKEK, err := kekFor(tenant)
+	if err != nil {
+		return "", nil, err
+	}
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return "", nil, err
+	}
+	defer wipe(key)
+	idBytes := make([]byte, 16)
+	if _, err := rand.Read(idBytes); err != nil {
+		return "", nil, err
+	}
+	id := hex.EncodeToString(idBytes)
+
+	stored := storedUserKEK{Tenant: tenant, CreatedAt: utils.Now()}
+	if stored.Ciphertext, stored.Nonce, err = tenantKEK.Wrap(key); err != nil {
+		return "", nil, err
+	}
+	err = keystore.Update(func(tx *bbolt.Tx) error {
+		if err := putJSON(tx.Bucket([]byte(kekBucket)), []byte(id), stored); err != nil {
+			return err
+		}
+		if err := tx.Bucket([]byte(userKEKBucket)).Put(userKEKKey(tenant, userID), []byte(id)); err != nil {
+			return err
+		}
+		return logKeystoreChange(tx, models.KeystorePut, id, userKEKKey(tenant, userID))
+	})
+	if err != nil {
+		return "", nil, err
+	}
+	kek, err := utils.NewAESWrapper(key)
+	return id, kek, err
+}
+
+// loadUserKEK unwraps the KEK with the given ID. The caller holds keystoreMu.
+func loadUserKEK(tenant, id string) (crypto.KeyWrapper, error) {
+	if keystore == nil {
+		return nil, errors.New("keystore is not open")
+	}
+	var stored storedUserKEK
+	err := keystore.View(func(tx *bbolt.Tx) error {
+		data := tx.Bucket([]byte(kekBucket)).Get([]byte(id))
+		if data == nil {
+			return ErrKEKShredded
+		}
+		return json.Unmarshal(data, &stored)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if stored.Tenant != tenant {
+		return nil, errors.New("key-encryption key belongs to another tenant")
+	}
+
+	tenantKEK, err := kekFor(tenant)
+	if err != nil {
+		return nil, err
+	}
+	key, err := tenantKEK.Unwrap(stored.Ciphertext, stored.Nonce)
+	if err != nil {
+		return nil, errors.New("cannot unwrap user KEK: " + err.Error())
+	}
+	defer wipe(key)
+	return utils.NewAESWrapper(key)
+}
+
+// envelopeKEK returns the KEK that wrapped env's ephemeral private key: the
+// user KEK it names, or the tenant KEK for envelopes sealed before user KEKs
+func envelopeKEK(tenant string, env *models.Envelope) (crypto.KeyWrapper, error) {
+	if env.KEKID == "" {
+		return kekFor(tenant)
+	}
+	keystoreMu.RLock()
+	defer keystoreMu.RUnlock()
+	return loadUserKEK(tenant, env.KEKID)
+}
+
+// applyUserKEKs re-wraps envelopes still wrapped by the tenant KEK under their
+// owner's KEK. Records that fail are logged and retried on the next start.
+func applyUserKEKs() error {
+	rewrapped, failed, err := rewriteEntries("kek", hasTenantWrappedEnvelope, func(entry *models.VaultEntry) error {
+		if entry.IsTombstone() {
+			return nil
+		}
+		plainKey, versions, err := openEntry(entry)
+		if err != nil {
+			return err
+		}
+		return resealEntry(entry, plainKey, versions)
+	})
+	if rewrapped > 0 || failed > 0 {
+		utils.Info("kek", "moved %d entries to per-user KEKs (%d failed)", rewrapped, failed)
+	}
+	return err
+}
+
+// hasTenantWrappedEnvelope reports whether a record's current envelope holds a
+// key but names no user KEK, without decrypting it. Versions are sealed along
+// with the current envelope, so checking that one is enough.
+func hasTenantWrappedEnvelope(raw []byte) bool {
+	var probe struct {
+		Envelope models.Envelope `cbor:"11,keyasint"`
+	}
+	if version, err := recordVersion(raw); err != nil || version == 0 {
+		return true
+	}
+	if cborDec.Unmarshal(raw[len(recordMagic)+1:], &probe) != nil {
+		return false
+	}
+	return len(probe.Envelope.WrappedPrivKey) > 0 && probe.Envelope.KEKID == ""
+}
+
+// ShredUser destroys the user's KEK in tenant, then tombstones whatever entries
+// of theirs remain and drops their earlier copies from the change log. Their
+// ciphertexts, retained versions and any backup holding them can no longer be
+// decrypted. The keystore is rewritten afterwards so the destroyed key does not
+// linger in its free pages.
+func ShredUser(tenant, userID string) (models.ShredReport, error) {
+	report := models.ShredReport{Tenant: tenant, UserID: userID, ShreddedAt: utils.Now()}
+	if _, err := kekFor(tenant); err != nil {
+		return report, err
+	}
+
+	// 1. Destroy the key, so nothing sealed under it can be opened again
+	var err error
+	if report.KEKDestroyed, report.KeystoreWiped, err = destroyUserKEK(tenant, userID); err != nil {
+		return report, err
+	}
+
+	// 2. Tombstone the entries, dropping the wrapped material and labels
+	var ids []string
+	var logged uint64
+	err = view(tenant, func(tx *tenantTx) error {
+		ids = indexedIDs(tx, ownerIndexBucket, ownerIndexPrefix(userID), "")
+		logged = tx.Tx.Bucket([]byte(changelogBucket)).Sequence()
+		return nil
+	})
+	if err != nil {
+		return report, err
+	}
+	now := utils.Now()
+	for start := 0; start < len(ids); start += rekeyBatchSize {
+		batch := ids[start:min(start+rekeyBatchSize, len(ids))]
+		err := update(tenant, func(tx *tenantTx) error {
+			for _, id := range batch {
+				entry := storedEntry(tx, id)
+				if entry == nil || entry.IsTombstone() || entry.UserID != userID {
+					continue
+				}
+				entry.Envelope = models.Envelope{}
+				entry.Versions = nil
+				entry.Label = ""
+				entry.Tags = nil
+				entry.DeletedAt = &now
+				entry.Revision++
+				if err := putEntry(tx, entry); err != nil {
+					return err
+				}
+				report.Entries++
+			}
+			return nil
+		})
+		if err != nil {
+			return report, err
+		}
+	}
+
+	// 3. Keep only the tombstones in the change log
+	if report.Changes, err = purgeEntryEvents(tenant, ids, logged); err != nil {
+		return report, err
+	}
+
+	utils.Info("audit", "user shredded: tenant=%s user=%s kek_destroyed=%t entries=%d changes=%d", tenant, userID, report.KEKDestroyed, report.Entries, report.Changes)
+	return report, nil
+}
+
+// destroyUserKEK deletes the user's KEK from the keystore and wipes the file.
+// It reports whether there was a KEK to destroy.
+func destroyUserKEK(tenant, userID string) (destroyed, wiped bool, err error) {
+	keystoreMu.Lock()
+	defer keystoreMu.Unlock()
+	if keystore == nil || keystore.IsReadOnly() {
+		return false, false, errors.New("keystore is not open for writing")
+	}
+	if IsFollower() {
+		return false, false, ErrReadOnlyReplica
+	}
+
+	err = keystore.Update(func(tx *bbolt.Tx) error {
+		users := tx.Bucket([]byte(userKEKBucket))
+		id := users.Get(userKEKKey(tenant, userID))
+		if id == nil {
+			return nil
+		}
+		if err := tx.Bucket([]byte(kekBucket)).Delete(id); err != nil {
+			return err
+		}
+		destroyed = true
+		if err := users.Delete(userKEKKey(tenant, userID)); err != nil {
+			return err
+		}
+		return logKeystoreChange(tx, models.KeystoreDelete, string(id), userKEKKey(tenant, userID))
+	})
+	if err != nil || !destroyed {
+		return destroyed, false, err
+	}
+	wiped, err = wipeKeystore()
+	return destroyed, wiped, err
+}
+
+// wipeKeystore rewrites the keystore into a fresh file and zeroes the old one,
+// as with database compaction. The caller holds keystoreMu exclusively.
+func wipeKeystore() (bool, error) {
+	path := KeystorePath()
+	tmp, err := compactInto(keystore, path)
+	if err != nil {
+		return false, err
+	}
+	if err := keystore.Close(); err != nil {
+		os.Remove(tmp)
+		return false, err
+	}
+	var scratch models.CompactReport
+	wiped, err := swapCompacted(path, tmp, &scratch)
+	reopened, openErr := bbolt.Open(path, 0600, nil)
+	if openErr != nil {
+		keystore = nil
+		utils.Error("kek", "cannot reopen keystore %s: %v", path, openErr)
+		return wiped, openErr
+	}
+	keystore = reopened
+	return wiped, err
+}
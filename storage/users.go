@@ -0,0 +1,329 @@
+package storage
+
+import (
+	"encoding/json"
+	"errors"
+	"sort"
+	"sync"
+	"time"
+
+	"secure-vault/crypto"
+	"secure-vault/models"
+	"secure-vault/utils"
+)
+
+// Accounts live in each tenant's users bucket, keyed by the blinded user ID
+// like quota overrides. Records hold an Argon2id hash of the password and the
+// failed-login count; too many failures lock the account for a while.
+const usersBucket = "users"
+
+var (
+	ErrInvalidCredentials = errors.New("invalid credentials")
+	ErrUserExists         = errors.New("user already exists")
+	ErrUserNotFound       = errors.New("user not found")
+	ErrUserDisabled       = errors.New("user is disabled")
+	ErrUserLocked         = errors.New("user is locked after failed logins")
+	ErrWeakPassword       = errors.New("password is too short")
+	ErrServiceAccount     = errors.New("service accounts have no password")
+)
+
+var (
+	minPasswordLength = utils.EnvInt("AUTH_MIN_PASSWORD_LENGTH", 12)
+	maxFailedLogins   = utils.EnvInt("AUTH_MAX_FAILED_LOGINS", 5)
+	loginLockout      = utils.EnvDuration("AUTH_LOCKOUT", 15*time.Minute)
+
+	// Accounts created without a role, or before roles existed, have this one
+	defaultRole = utils.EnvString("AUTH_DEFAULT_ROLE", models.RoleWriter)
+)
+
+var (
+	dummyHashOnce sync.Once
+	dummyHash     string
+)
+
+type storedUser struct {
+	models.User
+	PasswordHash string `json:"password_hash"`
+}
+
+func userKey(userID string) []byte { return blindToken("user", userID) }
+
+// getUser returns the account of userID, or nil
+func getUser(tx *tenantTx, userID string) *storedUser {
+	data := tx.Bucket([]byte(usersBucket)).Get(userKey(userID))
+	if data == nil {
+		return nil
+	}
+	var u storedUser
+	if err := json.Unmarshal(data, &u); err != nil {
+		return nil
+	}
+	if u.Role == "" {
+		u.Role = defaultRole
+	}
+	return &u
+}
+
+// putUser stores an account and records it in the change log
+func putUser(tx *tenantTx, u *storedUser) error {
+	b := tx.Bucket([]byte(usersBucket))
+	if err := putJSON(b, userKey(u.UserID), u); err != nil {
+		return err
+	}
+	return logChange(tx.Tx, models.ChangeUser, tx.tenant, userKey(u.UserID), b.Get(userKey(u.UserID)))
+}
+
+func hashNewPassword(password string) (string, error) {
+	if len(password) < minPasswordLength {
+		return "", ErrWeakPassword
+	}
+	return crypto.HashPassword(password)
+}
+
+// CreateUser adds an account to tenant; an empty role means AUTH_DEFAULT_ROLE
+func CreateUser(tenant, userID, password, role, createdBy string) (models.User, error) {
+	now := utils.Now()
+	u := storedUser{User: models.User{UserID: userID, Tenant: tenant, Role: role, CreatedAt: now, CreatedBy: createdBy, PasswordChangedAt: &now}}
+	hash, err := hashNewPassword(password)
+	if err != nil {
+		return u.User, err
+	}
+	u.PasswordHash = hash
+	return addUser(&u)
+}
+
+// CreateServiceAccount adds an account to tenant that authenticates with API keys only
+func CreateServiceAccount(tenant, userID, role, createdBy string) (models.User, error) {
+	u := storedUser{User: models.User{UserID: userID, Tenant: tenant, ServiceAccount: true, Role: role, CreatedAt: utils.Now(), CreatedBy: createdBy}}
+	return addUser(&u)
+}
+
+func addUser(u *storedUser) (models.User, error) {
+	if err := models.ValidateUserID(u.UserID); err != nil {
+		return u.User, err
+	}
+	if u.Role == "" {
+		u.Role = defaultRole
+	}
+	if err := models.ValidateRole(u.Role); err != nil {
+		return u.User, err
+	}
+	err := update(u.Tenant, func(tx *tenantTx) error {
+		if getUser(tx, u.UserID) != nil {
+			return ErrUserExists
+		}
+		return putUser(tx, u)
+	})
+	if err == nil {
+		utils.Info("audit", "user created: tenant=%s user=%s service_account=%t by=%s", u.Tenant, u.UserID, u.ServiceAccount, u.CreatedBy)
+	}
+	return u.User, err
+}
+
+// EnsureUser creates the account as an admin unless it exists, for
+// bootstrapping the first one. An account from before roles existed is made
+// an admin, so it keeps its access.
+func EnsureUser(tenant, userID, password string) error {
+	_, err := CreateUser(tenant, userID, password, models.RoleAdmin, "bootstrap")
+	if !errors.Is(err, ErrUserExists) {
+		return err
+	}
+	return update(tenant, func(tx *tenantTx) error {
+		data := tx.Bucket([]byte(usersBucket)).Get(userKey(userID))
+		var u storedUser
+		if data == nil || json.Unmarshal(data, &u) != nil || u.Role != "" {
+			return nil
+		}
+		u.Role = models.RoleAdmin
+		return putUser(tx, &u)
+	})
+}
+
+// updateUser applies mutate to an existing account
+func updateUser(tenant, userID string, mutate func(u *storedUser) error) (models.User, error) {
+	var u *storedUser
+	err := update(tenant, func(tx *tenantTx) error {
+		if u = getUser(tx, userID); u == nil {
+			return ErrUserNotFound
+		}
+		if err := mutate(u); err != nil {
+			return err
+		}
+		return putUser(tx, u)
+	})
+	if err != nil {
+		return models.User{}, err
+	}
+	return u.User, nil
+}
+
+// SetUserDisabled disables or re-enables an account. Tokens of a disabled user
+// are refused as well.
+func SetUserDisabled(tenant, userID string, disabled bool) (models.User, error) {
+	u, err := updateUser(tenant, userID, func(u *storedUser) error {
+		u.Disabled = disabled
+		return nil
+	})
+	if err == nil {
+		utils.Info("audit", "user disabled=%t: tenant=%s user=%s", disabled, tenant, userID)
+	}
+	return u, err
+}
+
+// SetUserRole changes the role of an account
+func SetUserRole(tenant, userID, role string) (models.User, error) {
+	if err := models.ValidateRole(role); err != nil {
+		return models.User{}, err
+	}
+	u, err := updateUser(tenant, userID, func(u *storedUser) error {
+		u.Role = role
+		return nil
+	})
+	if err == nil {
+		utils.Info("audit", "user role changed: tenant=%s user=%s role=%s", tenant, userID, role)
+	}
+	return u, err
+}
+
+// SetUserGroups replaces the groups of an account, which grants can name
+func SetUserGroups(tenant, userID string, groups []string) (models.User, error) {
+	for _, g := range groups {
+		if err := models.ValidateGroup(g); err != nil {
+			return models.User{}, err
+		}
+	}
+	u, err := updateUser(tenant, userID, func(u *storedUser) error {
+		u.Groups = groups
+		return nil
+	})
+	if err == nil {
+		utils.Info("audit", "user groups changed: tenant=%s user=%s groups=%v", tenant, userID, groups)
+	}
+	return u, err
+}
+
+// ResetPassword sets a new password and lifts a lockout
+func ResetPassword(tenant, userID, password string) (models.User, error) {
+	hash, err := hashNewPassword(password)
+	if err != nil {
+		return models.User{}, err
+	}
+	u, err := updateUser(tenant, userID, func(u *storedUser) error {
+		if u.ServiceAccount {
+			return ErrServiceAccount
+		}
+		now := utils.Now()
+		u.PasswordHash = hash
+		u.PasswordChangedAt = &now
+		u.FailedLogins = 0
+		u.LockedUntil = nil
+		return nil
+	})
+	if err == nil {
+		utils.Info("audit", "password reset: tenant=%s user=%s", tenant, userID)
+	}
+	return u, err
+}
+
+// ListUsers returns the accounts of tenant ordered by user ID
+func ListUsers(tenant string) ([]models.User, error) {
+	users := []models.User{}
+	err := view(tenant, func(tx *tenantTx) error {
+		return tx.Bucket([]byte(usersBucket)).ForEach(func(_, v []byte) error {
+			var u storedUser
+			if err := json.Unmarshal(v, &u); err != nil {
+				return err
+			}
+			if u.Role == "" {
+				u.Role = defaultRole
+			}
+			users = append(users, u.User)
+			return nil
+		})
+	})
+	sort.Slice(users, func(i, j int) bool { return users[i].UserID < users[j].UserID })
+	return users, err
+}
+
+// CheckUser returns the account of userID, failing unless it is an enabled
+// account of tenant
+func CheckUser(tenant, userID string) (models.User, error) {
+	var user models.User
+	err := view(tenant, func(tx *tenantTx) error {
+		u := getUser(tx, userID)
+		switch {
+		case u == nil:
+			return ErrUserNotFound
+		case u.Disabled:
+			return ErrUserDisabled
+		}
+		user = u.User
+		return nil
+	})
+	return user, err
+}
+
+// Authenticate verifies a password and records the attempt. Unknown users cost
+// as much as known ones. A follower verifies but cannot record; the leader
+// keeps the count.
+func Authenticate(tenant, userID, password string) (models.User, error) {
+	var u *storedUser
+	if TenantExists(tenant) {
+		view(tenant, func(tx *tenantTx) error {
+			u = getUser(tx, userID)
+			return nil
+		})
+	}
+	if u == nil || u.ServiceAccount {
+		dummyHashOnce.Do(func() { dummyHash, _ = crypto.HashPassword("") })
+		crypto.VerifyPassword(dummyHash, password)
+		return models.User{}, ErrInvalidCredentials
+	}
+
+	ok, rehash, err := crypto.VerifyPassword(u.PasswordHash, password)
+	if err != nil {
+		return u.User, err
+	}
+	now := utils.Now()
+	switch {
+	case u.Disabled:
+		return u.User, ErrUserDisabled
+	case u.LockedUntil != nil && now.Before(*u.LockedUntil):
+		return u.User, ErrUserLocked
+	}
+
+	var newHash string
+	if ok && rehash {
+		newHash, _ = crypto.HashPassword(password)
+	}
+	user, err := updateUser(tenant, userID, func(u *storedUser) error {
+		if !ok {
+			u.FailedLogins++
+			u.LastFailedLogin = &now
+			if u.FailedLogins >= maxFailedLogins {
+				until := now.Add(loginLockout)
+				u.LockedUntil = &until
+				utils.Warn("audit", "user locked: tenant=%s user=%s until=%s", tenant, userID, until.Format(time.RFC3339))
+			}
+			return nil
+		}
+		u.FailedLogins = 0
+		u.LockedUntil = nil
+		u.LastLogin = &now
+		if newHash != "" {
+			u.PasswordHash = newHash
+		}
+		return nil
+	})
+	if err != nil && !errors.Is(err, ErrReadOnlyReplica) {
+		utils.Warn("auth", "cannot record login of %s: %v", userID, err)
+	}
+	if err != nil {
+		user = u.User
+	}
+
+	if !ok {
+		return user, ErrInvalidCredentials
+	}
+	return user, nil
+}
@@ -1,39 +1,78 @@
 package storage
 
 import (
-	"encoding/json"
 	"errors"
 	"os"
 	"time"
 
 	"secure-vault/models"
+	"secure-vault/utils"
 
 	"go.etcd.io/bbolt"
 )
 
 const vaultBucket = "vault"
 
+var (
+	ErrNotFound         = errors.New("key not found")
+	ErrRevisionMismatch = errors.New("revision mismatch")
+)
+
 var db *bbolt.DB
 
+// DBPath returns the bbolt file location (VAULT_DB, default vault.db)
+func DBPath() string {
+	if p := os.Getenv("VAULT_DB"); p != "" {
+		return p
+	}
+	return "vault.db"
+}
+
 func Init() error {
 	var err error
-	dbPath := os.Getenv("VAULT_DB")
-	if dbPath == "" {
-		dbPath = "vault.db"
-	}
-	db, err = bbolt.Open(dbPath, 0600, nil)
+	db, err = bbolt.Open(DBPath(), 0600, nil)
 	if err != nil {
 		return err
 	}
 
-	return db.Update(func(tx *bbolt.Tx) error {
-		// Ensure buckets exist
-		buckets := []string{"vault", "settings"}
-		for _, b := range buckets {
+	// Nothing in here writes to a database seeded from the leader
+	err = writeRoot(func(tx *bbolt.Tx) error {
+		// Ensure buckets exist: the default tenant's tree at the root, and the tenants
+		for _, b := range append(tenantBuckets, tenantsBucket, changelogBucket, followerAcksBucket, jwtKeysBucket, revocationsBucket) {
 			if _, err := tx.CreateBucketIfNotExists([]byte(b)); err != nil {
 				return errors.New("init failed: cannot create bucket " + b)
 			}
 		}
+		// Tenants created by older builds lack the buckets added since
+		err := tx.Bucket([]byte(tenantsBucket)).ForEach(func(name, _ []byte) error {
+			root := tx.Bucket([]byte(tenantsBucket)).Bucket(name)
+			for _, b := range tenantBuckets {
+				if _, err := root.CreateBucketIfNotExists([]byte(b)); err != nil {
+					return errors.New("init failed: cannot create bucket " + b + " of tenant " + string(name))
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		// Refuse to start with a master key the stored entries were not wrapped with
+		if err := ensureKeyCheck(tx); err != nil {
+			return err
+		}
+		if err := ensureMetadataKey(tx); err != nil {
+			return err
+		}
+		if err := loadTenantKeys(tx); err != nil {
+			return err
+		}
+		if err := loadJWTKeys(tx); err != nil {
+			return err
+		}
+		if err := loadRevocations(tx); err != nil {
+			return err
+		}
 
 		// Initialize default crypto mode if not set
 		settings := tx.Bucket([]byte("settings"))
@@ -46,49 +85,168 @@ func Init() error {
 
 		return nil
 	})
+	if err != nil {
+		return err
+	}
+	if err := openKeystore(false); err != nil {
+		return err
+	}
+
+	// A follower takes every change below from the leader's log
+	if IsFollower() {
+		return nil
+	}
+
+	// Create the first token signing key, or one for a new JWT_SIGNING_ALG
+	if err := ensureSigningKey(); err != nil {
+		return err
+	}
+
+	// Upgrade records written by older builds
+	if utils.EnvBool("SCHEMA_MIGRATE_ON_START", true) {
+		if err := MigrateSchema(); err != nil {
+			return err
+		}
+	}
+
+	// Seal or unseal metadata after METADATA_ENCRYPTION was switched
+	if err := applyMetadataEncryption(); err != nil {
+		return err
+	}
+
+	// Wrap entries sealed before per-user KEKs under their owner's KEK
+	if err := applyUserKEKs(); err != nil {
+		return err
+	}
+
+	// Build derived data (usage counters, indexes) for databases written before it existed
+	return forEachTenant(ensureIndexes)
+}
+
+// InitReadOnly opens the database without taking the write lock, for offline
+// tools. It fails after a second if a running server holds the file.
+func InitReadOnly() error {
+	var err error
+	db, err = bbolt.Open(DBPath(), 0600, &bbolt.Options{ReadOnly: true, Timeout: time.Second})
+	if err != nil {
+		return errors.New("cannot open " + DBPath() + ": " + err.Error())
+	}
+	err = viewRoot(func(tx *bbolt.Tx) error {
+		if err := loadMetadataKey(tx); err != nil {
+			return err
+		}
+		return loadTenantKeys(tx)
+	})
+	if err != nil {
+		return err
+	}
+	return openKeystore(true)
 }
 
+// Close releases the database and keystore files
+func Close() error {
+	err := db.Close()
+	if kerr := closeKeystore(); err == nil {
+		err = kerr
+	}
+	return err
+}
 
-// SaveKey stores a VaultEntry (new or updated)
+// SaveKey stores a new VaultEntry in entry.Tenant
 func SaveKey(entry models.VaultEntry) error {
-	entry.CreatedAt = time.Now()
+	if entry.CreatedAt.IsZero() {
+		entry.CreatedAt = time.Now() // normally set by the caller, as it is bound into the envelope
+	}
+	entry.Revision = 1
 
-	return db.Update(func(tx *bbolt.Tx) error {
-		b := tx.Bucket([]byte(vaultBucket))
-		data, err := json.Marshal(entry)
-		if err != nil {
+	return update(entry.Tenant, func(tx *tenantTx) error {
+		if err := checkQuota(tx, &entry); err != nil {
 			return err
 		}
-		return b.Put([]byte(entry.ID), data)
+		return putEntry(tx, &entry)
 	})
 }
 
-// GetKey retrieves a VaultEntry by ID
-func GetKey(id string) (models.VaultEntry, error) {
+// GetKey retrieves a VaultEntry of tenant by ID
+func GetKey(tenant, id string) (models.VaultEntry, error) {
 	var entry models.VaultEntry
 
-	err := db.View(func(tx *bbolt.Tx) error {
+	err := view(tenant, func(tx *tenantTx) error {
 		b := tx.Bucket([]byte(vaultBucket))
 		data := b.Get([]byte(id))
 		if data == nil {
-			return errors.New("key not found")
+			return ErrNotFound
 		}
-		return json.Unmarshal(data, &entry)
+		var err error
+		entry, err = decodeEntry(tenant, data)
+		return err
 	})
 
 	return entry, err
 }
 
-func UpdateVaultEntry(id string, entry *models.VaultEntry) error {
-	return db.Update(func(tx *bbolt.Tx) error {
+// UpdateEntry applies mutate to the stored entry and bumps its revision, all in
+// one write transaction. When ifMatch is set, the update only happens if the
+// stored revision still equals *ifMatch (compare-and-swap). Entries on which
+// the caller may not do op are reported as not found, before the revision is
+// compared, so they stay indistinguishable from missing ones.
+func UpdateEntry(tenant, id string, caller models.Caller, op string, ifMatch *uint64, mutate func(entry *models.VaultEntry) error) (models.VaultEntry, error) {
+	var entry models.VaultEntry
+
+	err := update(tenant, func(tx *tenantTx) error {
 		b := tx.Bucket([]byte(vaultBucket))
 		if b == nil {
 			return errors.New("vault bucket not found")
 		}
-		data, err := json.Marshal(entry)
+		data := b.Get([]byte(id))
+		if data == nil {
+			return ErrNotFound
+		}
+		var err error
+		if entry, err = decodeEntry(tenant, data); err != nil {
+			return err
+		}
+		d, err := authorize(tx, caller, op, &entry)
 		if err != nil {
 			return err
 		}
-		return b.Put([]byte(id), data)
+		if !d.Allowed {
+			return ErrNotFound
+		}
+		if ifMatch != nil && entry.Revision != *ifMatch {
+			return ErrRevisionMismatch
+		}
+
+		if err := mutate(&entry); err != nil {
+			return err
+		}
+		pruneVersions(tx, &entry)
+		entry.Revision++
+
+		if err := checkQuota(tx, &entry); err != nil {
+			return err
+		}
+		return putEntry(tx, &entry)
+	})
+
+	return entry, err
+}
+
+// UpdateMetadata applies a metadata-only change such as new tags or a new label.
+// The key itself is unchanged, but its envelopes are re-sealed because they bind
+// the metadata as additional data.
+func UpdateMetadata(tenant, id string, caller models.Caller, op string, ifMatch *uint64, mutate func(entry *models.VaultEntry) error) (models.VaultEntry, error) {
+	return UpdateEntry(tenant, id, caller, op, ifMatch, func(entry *models.VaultEntry) error {
+		if entry.IsTombstone() {
+			return ErrExpired
+		}
+		plainKey, versions, err := openEntry(entry)
+		if err != nil {
+			return err
+		}
+		if err := mutate(entry); err != nil {
+			return err
+		}
+		return resealEntry(entry, plainKey, versions)
 	})
 }
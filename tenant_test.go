@@ -0,0 +1,78 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+// TestTenantIsolation checks that a tenant's accounts see neither the entries
+// nor the settings of another tenant, even under the same user ID
+func TestTenantIsolation(t *testing.T) {
+	v := startVault(t, t.TempDir(), "vault")
+	root := v.token(t)
+	tenant := map[string]string{"name": "payments", "mode": "quantum-safe", "admin_user": "alice", "admin_password": testPassword}
+	if status := v.call(t, "POST", "/admin/tenants", root, tenant, nil); status != http.StatusCreated {
+		t.Fatalf("create tenant: status %d", status)
+	}
+	var signedIn struct {
+		Token string `json:"token"`
+	}
+	creds := map[string]string{"user_id": "alice", "password": testPassword, "tenant": "payments"}
+	if status := v.call(t, "POST", "/auth/token", "", creds, &signedIn); status != http.StatusOK {
+		t.Fatalf("sign-in to the tenant: status %d", status)
+	}
+	payments := signedIn.Token
+	alice := v.user(t, root, "alice", "admin") // the default tenant's alice
+
+	paymentsKey := storeKeys(t, v, payments, 1)[0]
+	defaultKey := storeKeys(t, v, alice, 1)[0]
+
+	// 1. Entries are only found in their own tenant
+	if status := v.call(t, "GET", "/vault/retrive/"+paymentsKey, payments, nil, nil); status != http.StatusOK {
+		t.Fatalf("read in the own tenant: status %d", status)
+	}
+	for name, token := range map[string]string{"alice": alice, "root": root} {
+		if status := v.call(t, "GET", "/vault/retrive/"+paymentsKey, token, nil, nil); status != http.StatusNotFound {
+			t.Fatalf("read of another tenant's entry as the default tenant's %s: status %d, want 404", name, status)
+		}
+	}
+	if status := v.call(t, "GET", "/vault/retrive/"+defaultKey, payments, nil, nil); status != http.StatusNotFound {
+		t.Fatalf("read of the default tenant's entry from payments: status %d, want 404", status)
+	}
+	var list struct {
+		Entries []struct {
+			ID string `json:"id"`
+		} `json:"entries"`
+	}
+	if status := v.call(t, "GET", "/vault/entries", payments, nil, &list); status != http.StatusOK {
+		t.Fatalf("list: status %d", status)
+	}
+	if len(list.Entries) != 1 || list.Entries[0].ID != paymentsKey {
+		t.Fatalf("payments lists %+v, want only %s", list.Entries, paymentsKey)
+	}
+
+	// 2. Each tenant has its own crypto mode
+	for token, want := range map[string]string{payments: "quantum-safe", alice: "classical"} {
+		var mode struct {
+			Tenant string `json:"tenant"`
+			Mode   string `json:"mode"`
+		}
+		if status := v.call(t, "GET", "/vault/get-mode", token, nil, &mode); status != http.StatusOK || mode.Mode != want {
+			t.Fatalf("mode of tenant %s: status %d, mode %q, want %q", mode.Tenant, status, mode.Mode, want)
+		}
+	}
+
+	// 3. A tenant's admin manages only its own tenant
+	if status := v.call(t, "GET", "/admin/tenants", payments, nil, nil); status != http.StatusForbidden {
+		t.Fatalf("list tenants as a tenant's admin: status %d, want 403", status)
+	}
+	if status := v.call(t, "POST", "/admin/users/alice/revoke-tokens", payments, nil, nil); status != http.StatusNoContent {
+		t.Fatalf("revoke tokens of the tenant's alice: status %d", status)
+	}
+	if status := v.call(t, "GET", "/vault/retrive/"+paymentsKey, payments, nil, nil); status != http.StatusUnauthorized {
+		t.Fatalf("the tenant's alice after revoking her tokens: status %d, want 401", status)
+	}
+	if status := v.call(t, "GET", "/vault/retrive/"+defaultKey, alice, nil, nil); status != http.StatusOK {
+		t.Fatalf("the default tenant's alice after a revocation in payments: status %d", status)
+	}
+}
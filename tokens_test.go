@@ -0,0 +1,66 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+type tokenPair struct {
+	Token        string `json:"token"`
+	RefreshToken string `json:"refresh_token"`
+}
+
+// refresh trades a refresh token and returns the status and the new pair
+func refresh(t *testing.T, v *vaultProcess, refreshToken string) (int, tokenPair) {
+	t.Helper()
+	var pair tokenPair
+	status := v.call(t, "POST", "/auth/refresh", "", map[string]string{"refresh_token": refreshToken}, &pair)
+	return status, pair
+}
+
+// TestRefreshTokenReuse presents a refresh token twice: the second use ends
+// the session, voiding its newer refresh and access tokens too
+func TestRefreshTokenReuse(t *testing.T) {
+	vault := startVault(t, t.TempDir(), "vault")
+
+	var first tokenPair
+	login := map[string]string{"user_id": testAdmin, "password": testPassword}
+	if status := vault.call(t, "POST", "/auth/token", "", login, &first); status != http.StatusOK {
+		t.Fatalf("sign-in: status %d", status)
+	}
+	status, second := refresh(t, vault, first.RefreshToken)
+	if status != http.StatusOK {
+		t.Fatalf("first refresh: status %d", status)
+	}
+	if status := vault.call(t, "GET", "/vault/stats", second.Token, nil, nil); status != http.StatusOK {
+		t.Fatalf("refreshed token: status %d", status)
+	}
+
+	if status, _ := refresh(t, vault, first.RefreshToken); status != http.StatusUnauthorized {
+		t.Fatalf("reused refresh token: status %d, want 401", status)
+	}
+	if status, _ := refresh(t, vault, second.RefreshToken); status != http.StatusUnauthorized {
+		t.Fatalf("refresh token of the ended session: status %d, want 401", status)
+	}
+	if status := vault.call(t, "GET", "/vault/stats", second.Token, nil, nil); status != http.StatusUnauthorized {
+		t.Fatalf("access token of the ended session: status %d, want 401", status)
+	}
+}
+
+// TestRevokeUserTokens voids a user's tokens, while one issued right after
+// the cutoff, within the same second, keeps working
+func TestRevokeUserTokens(t *testing.T) {
+	vault := startVault(t, t.TempDir(), "vault")
+	before := vault.token(t)
+
+	if status := vault.call(t, "POST", "/admin/users/"+testAdmin+"/revoke-tokens", before, nil, nil); status != http.StatusNoContent {
+		t.Fatalf("revoke: status %d", status)
+	}
+	after := vault.token(t)
+	if status := vault.call(t, "GET", "/vault/stats", before, nil, nil); status != http.StatusUnauthorized {
+		t.Fatalf("token issued before the cutoff: status %d, want 401", status)
+	}
+	if status := vault.call(t, "GET", "/vault/stats", after, nil, nil); status != http.StatusOK {
+		t.Fatalf("token issued after the cutoff: status %d", status)
+	}
+}
@@ -0,0 +1,42 @@
+package utils
+
+import (
+	"os"
+	"strconv"
+	"time"
+)
+
+// EnvInt reads a positive integer from the environment, falling back to def
+func EnvInt(name string, def int) int {
+	v, err := strconv.Atoi(os.Getenv(name))
+	if err != nil || v <= 0 {
+		return def
+	}
+	return v
+}
+
+// EnvDuration reads a Go duration (e.g. "500ms", "1h") from the environment, falling back to def
+func EnvDuration(name string, def time.Duration) time.Duration {
+	v, err := time.ParseDuration(os.Getenv(name))
+	if err != nil || v <= 0 {
+		return def
+	}
+	return v
+}
+
+// EnvBool reads a boolean ("true", "0", ...) from the environment, falling back to def
+func EnvBool(name string, def bool) bool {
+	v, err := strconv.ParseBool(os.Getenv(name))
+	if err != nil {
+		return def
+	}
+	return v
+}
+
+// EnvString reads a string from the environment, falling back to def when unset or empty
+func EnvString(name, def string) string {
+	if v := os.Getenv(name); v != "" {
+		return v
+	}
+	return def
+}
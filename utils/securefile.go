@@ -4,6 +4,7 @@ import (
 	"crypto/aes"
 	"crypto/cipher"
 	"crypto/rand"
+	"crypto/sha256"
 	"encoding/hex"
 	"errors"
 	"io"
@@ -34,7 +35,43 @@ func LoadAESKey() error {
 
 // EncryptWithMasterKey encrypts the data using AES-GCM with the loaded AES key
 func EncryptWithMasterKey(plaintext []byte) ([]byte, []byte, error) {
-	block, err := aes.NewCipher(masterAESKey)
+	return sealAES(masterAESKey, plaintext)
+}
+
+// DecryptWithMasterKey decrypts AES-GCM data using the loaded AES key
+func DecryptWithMasterKey(ciphertext, nonce []byte) ([]byte, error) {
+	return openAES(masterAESKey, ciphertext, nonce)
+}
+
+// AESWrapper seals small secrets (ephemeral private keys, lower-level KEKs)
+// under a 32-byte key with AES-GCM
+type AESWrapper struct {
+	key []byte
+}
+
+// NewAESWrapper returns a wrapper for a 32-byte key
+func NewAESWrapper(key []byte) (*AESWrapper, error) {
+	if len(key) != 32 {
+		return nil, errors.New("wrapping key must be 32 bytes")
+	}
+	return &AESWrapper{key: key}, nil
+}
+
+// MasterKey returns the loaded master key as a wrapper
+func MasterKey() *AESWrapper {
+	return &AESWrapper{key: masterAESKey}
+}
+
+func (w *AESWrapper) Wrap(plaintext []byte) ([]byte, []byte, error) {
+	return sealAES(w.key, plaintext)
+}
+
+func (w *AESWrapper) Unwrap(ciphertext, nonce []byte) ([]byte, error) {
+	return openAES(w.key, ciphertext, nonce)
+}
+
+func sealAES(key, plaintext []byte) ([]byte, []byte, error) {
+	block, err := aes.NewCipher(key)
 	if err != nil {
 		return nil, nil, err
 	}
@@ -53,9 +90,8 @@ func EncryptWithMasterKey(plaintext []byte) ([]byte, []byte, error) {
 	return ciphertext, nonce, nil
 }
 
-// DecryptWithMasterKey decrypts AES-GCM data using the loaded AES key
-func DecryptWithMasterKey(ciphertext, nonce []byte) ([]byte, error) {
-	block, err := aes.NewCipher(masterAESKey)
+func openAES(key, ciphertext, nonce []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
 	if err != nil {
 		return nil, err
 	}
@@ -67,3 +103,9 @@ func DecryptWithMasterKey(ciphertext, nonce []byte) ([]byte, error) {
 
 	return aesgcm.Open(nil, nonce, ciphertext, nil)
 }
+
+// MasterKeyFingerprint identifies the loaded master key without revealing it
+func MasterKeyFingerprint() string {
+	sum := sha256.Sum256(append([]byte("secure-vault master key fingerprint:"), masterAESKey...))
+	return hex.EncodeToString(sum[:8])
+}
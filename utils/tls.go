@@ -0,0 +1,125 @@
+package utils
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Client certificate policies for TLS_CLIENT_AUTH
+const (
+	ClientAuthNone    = "none"    // client certificates are not asked for
+	ClientAuthRequest = "request" // verified when sent; callers may still use tokens
+	ClientAuthRequire = "require" // every connection must present a valid certificate
+)
+
+// ServerTLSConfig builds the TLS configuration from TLS_CERT_FILE and
+// TLS_KEY_FILE, and returns nil when neither is set. Client certificates are
+// verified against the PEM bundles in TLS_CLIENT_CA_FILES (comma-separated),
+// as TLS_CLIENT_AUTH says: "request" by default when bundles are given.
+func ServerTLSConfig() (*tls.Config, error) {
+	certFile, keyFile := os.Getenv("TLS_CERT_FILE"), os.Getenv("TLS_KEY_FILE")
+	if certFile == "" && keyFile == "" {
+		return nil, nil
+	}
+	if certFile == "" || keyFile == "" {
+		return nil, errors.New("TLS_CERT_FILE and TLS_KEY_FILE go together")
+	}
+	cert := &reloadingCert{certFile: certFile, keyFile: keyFile}
+	if _, err := cert.get(nil); err != nil {
+		return nil, err
+	}
+	cfg := &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: cert.get,
+	}
+
+	var caFiles []string
+	for _, f := range strings.Split(os.Getenv("TLS_CLIENT_CA_FILES"), ",") {
+		if f = strings.TrimSpace(f); f != "" {
+			caFiles = append(caFiles, f)
+		}
+	}
+	mode := EnvString("TLS_CLIENT_AUTH", ClientAuthRequest)
+	if len(caFiles) == 0 {
+		if mode == ClientAuthRequire {
+			return nil, errors.New("TLS_CLIENT_AUTH=require needs TLS_CLIENT_CA_FILES")
+		}
+		return cfg, nil
+	}
+
+	pool := x509.NewCertPool()
+	for _, f := range caFiles {
+		pem, err := os.ReadFile(f)
+		if err != nil {
+			return nil, err
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates in client CA bundle %s", f)
+		}
+	}
+	cfg.ClientCAs = pool
+	switch mode {
+	case ClientAuthNone:
+		cfg.ClientAuth = tls.NoClientCert
+	case ClientAuthRequest:
+		cfg.ClientAuth = tls.VerifyClientCertIfGiven
+	case ClientAuthRequire:
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	default:
+		return nil, fmt.Errorf("TLS_CLIENT_AUTH must be %s, %s or %s", ClientAuthNone, ClientAuthRequest, ClientAuthRequire)
+	}
+	return cfg, nil
+}
+
+// reloadingCert serves the server certificate, loading it again when the
+// files change, since meshes rotate certificates often
+type reloadingCert struct {
+	certFile, keyFile string
+
+	mu       sync.Mutex
+	cert     *tls.Certificate
+	modified time.Time
+}
+
+func (c *reloadingCert) get(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var modified time.Time
+	for _, f := range []string{c.certFile, c.keyFile} {
+		info, err := os.Stat(f)
+		if err != nil {
+			if c.cert != nil {
+				return c.cert, nil
+			}
+			return nil, err
+		}
+		if info.ModTime().After(modified) {
+			modified = info.ModTime()
+		}
+	}
+	if c.cert != nil && !modified.After(c.modified) {
+		return c.cert, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		// A half-written pair keeps the previous certificate in service
+		if c.cert != nil {
+			Warn("tls", "Cannot reload certificate, keeping the previous one: %v", err)
+			return c.cert, nil
+		}
+		return nil, err
+	}
+	if c.cert != nil {
+		Info("tls", "Reloaded certificate %s", c.certFile)
+	}
+	c.cert, c.modified = &cert, modified
+	return c.cert, nil
+}